@@ -0,0 +1,131 @@
+package certs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// httpChallengeSuffix is the suffix autocert appends to cache keys holding HTTP-01 key authorizations
+const httpChallengeSuffix = "+http-01"
+
+// DBCache is an autocert.Cache backed by PostgreSQL so every server instance shares
+// certificates and pending challenges. HTTP-01 challenges go to acme_challenges, everything
+// else (certificates, the ACME account key) goes to certificates.
+type DBCache struct {
+	db *sql.DB
+}
+
+func NewDBCache(db *sql.DB) *DBCache {
+	return &DBCache{db: db}
+}
+
+// Get implements autocert.Cache
+func (c *DBCache) Get(ctx context.Context, key string) ([]byte, error) {
+	var data []byte
+	var err error
+	if token, ok := challengeToken(key); ok {
+		var keyAuth string
+		err = c.db.QueryRowContext(ctx, "SELECT key_authorization FROM acme_challenges WHERE token = $1", token).Scan(&keyAuth)
+		data = []byte(keyAuth)
+	} else {
+		err = c.db.QueryRowContext(ctx, "SELECT data FROM certificates WHERE key = $1", key).Scan(&data)
+	}
+
+	if err == sql.ErrNoRows {
+		return nil, autocert.ErrCacheMiss
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from cache: %w", key, err)
+	}
+	return data, nil
+}
+
+// Put implements autocert.Cache
+func (c *DBCache) Put(ctx context.Context, key string, data []byte) error {
+	var err error
+	if token, ok := challengeToken(key); ok {
+		_, err = c.db.ExecContext(ctx, `
+			INSERT INTO acme_challenges (token, key_authorization) VALUES ($1, $2)
+			ON CONFLICT (token) DO UPDATE SET key_authorization = EXCLUDED.key_authorization
+		`, token, string(data))
+	} else {
+		_, err = c.db.ExecContext(ctx, `
+			INSERT INTO certificates (key, data, updated_at) VALUES ($1, $2, NOW())
+			ON CONFLICT (key) DO UPDATE SET data = EXCLUDED.data, updated_at = NOW()
+		`, key, data)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to write %s to cache: %w", key, err)
+	}
+	return nil
+}
+
+// Delete implements autocert.Cache
+func (c *DBCache) Delete(ctx context.Context, key string) error {
+	var err error
+	if token, ok := challengeToken(key); ok {
+		_, err = c.db.ExecContext(ctx, "DELETE FROM acme_challenges WHERE token = $1", token)
+	} else {
+		_, err = c.db.ExecContext(ctx, "DELETE FROM certificates WHERE key = $1", key)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to delete %s from cache: %w", key, err)
+	}
+	return nil
+}
+
+// LookupChallenge returns the key authorization for a pending HTTP-01 challenge token
+func (c *DBCache) LookupChallenge(ctx context.Context, token string) (string, bool, error) {
+	data, err := c.Get(ctx, token+httpChallengeSuffix)
+	if err == autocert.ErrCacheMiss {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return string(data), true, nil
+}
+
+// NewManager creates an autocert manager that issues certificates for verified custom domains.
+// Certificates are obtained on the first TLS handshake for a domain and renewed automatically
+// before they expire.
+func NewManager(db *sql.DB, cache *DBCache, email string) *autocert.Manager {
+	manager := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  cache,
+		Email:  email,
+		HostPolicy: func(ctx context.Context, host string) error {
+			var verified bool
+			err := db.QueryRowContext(ctx, `
+				SELECT EXISTS(SELECT 1 FROM custom_domains WHERE domain = $1 AND verified_at IS NOT NULL)
+			`, strings.ToLower(host)).Scan(&verified)
+			if err != nil {
+				return fmt.Errorf("failed to check custom domain %s: %w", host, err)
+			}
+			if !verified {
+				return fmt.Errorf("custom domain %s is not verified", host)
+			}
+			return nil
+		},
+	}
+
+	// Enables HTTP-01 challenges. The challenge itself is answered by ProxyHandler from the
+	// shared cache, so the returned handler isn't needed.
+	manager.HTTPHandler(nil)
+
+	return manager
+}
+
+// challengeToken extracts the token from an HTTP-01 cache key
+func challengeToken(key string) (string, bool) {
+	if !strings.HasSuffix(key, httpChallengeSuffix) {
+		return "", false
+	}
+	return strings.TrimSuffix(key, httpChallengeSuffix), true
+}
@@ -0,0 +1,23 @@
+package config
+
+import (
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ValidateBasicAuthHash validates basic auth credentials carried over from an export or clone
+// and returns an error message if invalid. The password is only ever stored as a bcrypt hash.
+func ValidateBasicAuthHash(username, passwordHash string) (bool, string) {
+	if username == "" || passwordHash == "" {
+		return false, "basic_auth_user and basic_auth_password_hash must be set together"
+	}
+	// The header joins the two with a colon, so it can't be part of the username
+	if strings.Contains(username, ":") {
+		return false, "basic_auth_user must not contain a colon"
+	}
+	if _, err := bcrypt.Cost([]byte(passwordHash)); err != nil {
+		return false, "basic_auth_password_hash must be a bcrypt hash"
+	}
+	return true, ""
+}
@@ -0,0 +1,19 @@
+package config
+
+import "fmt"
+
+// ValidateCountryCodes checks that every entry is an uppercase ISO 3166-1 alpha-2 code
+// and returns an error message if not
+func ValidateCountryCodes(codes []string) (bool, string) {
+	seen := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+			return false, fmt.Sprintf("Country %q must be an uppercase two-letter ISO 3166-1 code", code)
+		}
+		if seen[code] {
+			return false, fmt.Sprintf("Duplicate country %q", code)
+		}
+		seen[code] = true
+	}
+	return true, ""
+}
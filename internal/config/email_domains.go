@@ -0,0 +1,45 @@
+package config
+
+import (
+	"strings"
+)
+
+// parseEmailDomains splits SKYPORT_ALLOWED_EMAIL_DOMAINS into lowercase domain patterns
+func parseEmailDomains(value string) []string {
+	domains := splitList(value)
+	for i, domain := range domains {
+		domains[i] = strings.ToLower(domain)
+	}
+	return domains
+}
+
+// IsEmailDomainAllowed reports whether an email address belongs to one of the allowed
+// domains. A pattern like *.company.com matches subdomains but not company.com itself.
+// An empty allowlist allows every domain.
+func IsEmailDomainAllowed(email string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+
+	for _, pattern := range allowed {
+		if suffix, isWildcard := strings.CutPrefix(pattern, "*"); isWildcard {
+			if strings.HasSuffix(domain, suffix) && len(domain) > len(suffix) {
+				return true
+			}
+		} else if domain == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// EmailDomainRestrictionMessage is the error returned for signups outside the allowlist
+func EmailDomainRestrictionMessage(allowed []string) string {
+	return "Signups are restricted to " + strings.Join(allowed, ", ") + " email addresses"
+}
@@ -0,0 +1,33 @@
+package config
+
+import "testing"
+
+func TestIsEmailDomainAllowed(t *testing.T) {
+	allowed := parseEmailDomains("Company.com, partner.io, *.corp.example.com")
+
+	tests := []struct {
+		email string
+		want  bool
+	}{
+		{"alice@company.com", true},
+		{"Bob@COMPANY.COM", true},
+		{"carol@partner.io", true},
+		{"dave@eu.corp.example.com", true},
+		{"erin@corp.example.com", false},
+		{"frank@gmail.com", false},
+		{"grace@notcompany.com", false},
+		{"heidi@company.com.evil.io", false},
+		{"no-at-sign", false},
+	}
+	for _, tt := range tests {
+		if got := IsEmailDomainAllowed(tt.email, allowed); got != tt.want {
+			t.Errorf("IsEmailDomainAllowed(%q) = %v, want %v", tt.email, got, tt.want)
+		}
+	}
+}
+
+func TestIsEmailDomainAllowedEmptyList(t *testing.T) {
+	if !IsEmailDomainAllowed("anyone@anywhere.dev", nil) {
+		t.Error("an empty allowlist must allow every domain")
+	}
+}
@@ -0,0 +1,24 @@
+package config
+
+import (
+	"net/http"
+	"skyport-server/internal/models"
+	"strings"
+)
+
+// MaxTunnelHeaderRules is the maximum number of header rules a tunnel can have
+const MaxTunnelHeaderRules = 50
+
+// ValidateHeaderRule validates a header rule and returns an error message if invalid
+func ValidateHeaderRule(rule models.CreateHeaderRuleRequest) (bool, string) {
+	if strings.ContainsAny(rule.HeaderName, " \t\r\n:") {
+		return false, "Invalid header name"
+	}
+	if http.CanonicalHeaderKey(rule.HeaderName) == "Host" {
+		return false, "The Host header cannot be changed"
+	}
+	if rule.Action == "set" && strings.ContainsAny(rule.HeaderValue, "\r\n") {
+		return false, "Header value cannot contain line breaks"
+	}
+	return true, ""
+}
@@ -0,0 +1,18 @@
+package config
+
+import "net/url"
+
+// ValidateProxyTargetURL validates a reverse proxy target and returns an error message if invalid
+func ValidateProxyTargetURL(target string) (bool, string) {
+	parsed, err := url.Parse(target)
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return false, "proxy_target_url must be an absolute http(s) URL"
+	}
+	if parsed.User != nil {
+		return false, "proxy_target_url cannot contain credentials"
+	}
+	if parsed.RawQuery != "" || parsed.Fragment != "" {
+		return false, "proxy_target_url cannot contain a query or fragment"
+	}
+	return true, ""
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"net"
 	"regexp"
 	"strings"
 )
@@ -130,6 +131,32 @@ func IsReservedSubdomain(subdomain string) bool {
 	return false
 }
 
+// IsTunnelHost reports whether a request host is a user tunnel subdomain of the skyport domain
+func IsTunnelHost(host, domain string) bool {
+	if !strings.HasSuffix(host, "."+domain) {
+		return false
+	}
+	subdomain := strings.TrimSuffix(host, "."+domain)
+	return !strings.Contains(subdomain, ".") && !IsReservedSubdomain(subdomain)
+}
+
+// IsCustomDomainHost reports whether a request host may be a tunnel's custom domain: a domain
+// name outside the skyport domain. IP addresses and localhost reach the server itself.
+func IsCustomDomainHost(host, domain string) bool {
+	if host == domain || strings.HasSuffix(host, "."+domain) {
+		return false
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return host != "localhost" && strings.Contains(host, ".") && net.ParseIP(host) == nil
+}
+
+// IsProxiedHost reports whether requests to host are tunnel traffic rather than API calls
+func IsProxiedHost(host, domain string) bool {
+	return IsTunnelHost(host, domain) || IsCustomDomainHost(host, domain)
+}
+
 // ValidateSubdomain performs comprehensive validation on a subdomain
 func ValidateSubdomain(subdomain string) (bool, string) {
 	subdomainLower := strings.ToLower(subdomain)
@@ -0,0 +1,28 @@
+package config
+
+import (
+	"fmt"
+	"skyport-server/internal/models"
+	"strings"
+)
+
+// MaxTunnelRoutingRules is the maximum number of routing rules a tunnel can carry
+const MaxTunnelRoutingRules = 20
+
+// ValidateRoutingRules validates tunnel routing rules and returns an error message if invalid
+func ValidateRoutingRules(rules []models.RoutingRule) (bool, string) {
+	if len(rules) > MaxTunnelRoutingRules {
+		return false, fmt.Sprintf("A tunnel can have at most %d routing rules", MaxTunnelRoutingRules)
+	}
+
+	for i, rule := range rules {
+		if !strings.HasPrefix(rule.PathPrefix, "/") {
+			return false, fmt.Sprintf("Routing rule %d: path_prefix must start with /", i)
+		}
+		if rule.TargetPort < 1 || rule.TargetPort > 65535 {
+			return false, fmt.Sprintf("Routing rule %d: target_port must be between 1 and 65535", i)
+		}
+	}
+
+	return true, ""
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	// MaxTunnelTags is the maximum number of tags a tunnel can carry
+	MaxTunnelTags = 5
+	// MaxTunnelTagLength is the maximum length of a single tag
+	MaxTunnelTagLength = 30
+)
+
+// ValidateTags validates tunnel tags and returns an error message if invalid
+func ValidateTags(tags []string) (bool, string) {
+	if len(tags) > MaxTunnelTags {
+		return false, fmt.Sprintf("A tunnel can have at most %d tags", MaxTunnelTags)
+	}
+
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		if tag == "" {
+			return false, "Tags cannot be empty"
+		}
+		if len(tag) > MaxTunnelTagLength {
+			return false, fmt.Sprintf("Tag %q cannot exceed %d characters", tag, MaxTunnelTagLength)
+		}
+		if strings.IndexFunc(tag, unicode.IsSpace) >= 0 {
+			return false, fmt.Sprintf("Tag %q cannot contain spaces", tag)
+		}
+		if tag != strings.ToLower(tag) {
+			return false, fmt.Sprintf("Tag %q must be lowercase", tag)
+		}
+		if seen[tag] {
+			return false, fmt.Sprintf("Duplicate tag %q", tag)
+		}
+		seen[tag] = true
+	}
+
+	return true, ""
+}
@@ -0,0 +1,20 @@
+package config
+
+import "fmt"
+
+const (
+	// MinTunnelTimeoutSeconds is the shortest response timeout a tunnel can set
+	MinTunnelTimeoutSeconds = 5
+	// MaxTunnelTimeoutSeconds is the longest response timeout a tunnel can set
+	MaxTunnelTimeoutSeconds = 300
+)
+
+// ValidateTimeoutSeconds validates a tunnel's timeout_seconds and returns an error message
+// if invalid. 0 keeps the default timeout.
+func ValidateTimeoutSeconds(seconds int) (bool, string) {
+	if seconds != 0 && (seconds < MinTunnelTimeoutSeconds || seconds > MaxTunnelTimeoutSeconds) {
+		return false, fmt.Sprintf("timeout_seconds must be between %d and %d seconds, or 0 for the default",
+			MinTunnelTimeoutSeconds, MaxTunnelTimeoutSeconds)
+	}
+	return true, ""
+}
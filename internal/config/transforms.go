@@ -0,0 +1,48 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"skyport-server/internal/models"
+	"strings"
+)
+
+// MaxTunnelTransforms is the maximum number of transform rules a tunnel can carry
+const MaxTunnelTransforms = 20
+
+// ValidateTransforms validates tunnel transform rules and returns an error message if invalid
+func ValidateTransforms(rules []models.TransformRule) (bool, string) {
+	if len(rules) > MaxTunnelTransforms {
+		return false, fmt.Sprintf("A tunnel can have at most %d transforms", MaxTunnelTransforms)
+	}
+
+	for i, rule := range rules {
+		if rule.Direction != "" && rule.Direction != "request" && rule.Direction != "response" {
+			return false, fmt.Sprintf("Transform %d: direction must be \"request\" or \"response\"", i)
+		}
+
+		switch rule.Type {
+		case "header_add", "header_remove":
+			if rule.Name == "" || strings.ContainsAny(rule.Name, " \t\r\n:") {
+				return false, fmt.Sprintf("Transform %d: invalid header name %q", i, rule.Name)
+			}
+			if rule.Type == "header_add" && strings.ContainsAny(rule.Value, "\r\n") {
+				return false, fmt.Sprintf("Transform %d: header value cannot contain line breaks", i)
+			}
+			if http.CanonicalHeaderKey(rule.Name) == "Host" {
+				return false, fmt.Sprintf("Transform %d: the Host header cannot be transformed", i)
+			}
+		case "path_rewrite":
+			if rule.Direction == "response" {
+				return false, fmt.Sprintf("Transform %d: path_rewrite only applies to requests", i)
+			}
+			if !strings.HasPrefix(rule.From, "/") || !strings.HasPrefix(rule.To, "/") {
+				return false, fmt.Sprintf("Transform %d: path_rewrite from and to must start with /", i)
+			}
+		default:
+			return false, fmt.Sprintf("Transform %d: unknown type %q", i, rule.Type)
+		}
+	}
+
+	return true, ""
+}
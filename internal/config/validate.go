@@ -0,0 +1,77 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	defaultJWTSecret = "your-super-secret-jwt-key-change-this-in-production"
+	// minJWTSecretLength keeps HS256 secrets at 256 bits or more
+	minJWTSecretLength = 32
+	// minInstanceSecretLength matches the JWT secret, it guards the same kind of trust
+	minInstanceSecretLength = 32
+	// minDatabasePasswordLength is the shortest database password accepted outside of tests
+	minDatabasePasswordLength = 8
+)
+
+// weakDatabasePasswords are common defaults that should never reach production
+var weakDatabasePasswords = []string{"password", "postgres", "admin", "root", "secret", "changeme", "12345678"}
+
+// Validate checks that security-sensitive settings were configured for production.
+// Set SKYPORT_SKIP_CONFIG_VALIDATION=true to skip it (tests, local development).
+func Validate(cfg *Config) error {
+	if os.Getenv("SKYPORT_SKIP_CONFIG_VALIDATION") == "true" {
+		return nil
+	}
+
+	var problems []error
+
+	if cfg.JWTSecret == defaultJWTSecret {
+		problems = append(problems, errors.New("JWT_SECRET must be changed from the default value"))
+	} else if len(cfg.JWTSecret) < minJWTSecretLength {
+		problems = append(problems, fmt.Errorf("JWT_SECRET must be at least %d characters", minJWTSecretLength))
+	}
+
+	if dbURL, err := url.Parse(cfg.DatabaseURL); err != nil {
+		problems = append(problems, errors.New("DATABASE_URL is not a valid URL"))
+	} else if password, hasPassword := dbURL.User.Password(); hasPassword && isWeakDatabasePassword(password) {
+		problems = append(problems, errors.New("DATABASE_URL contains a weak password"))
+	}
+
+	if webAppURL, err := url.Parse(cfg.WebAppURL); err != nil || webAppURL.Host == "" ||
+		(webAppURL.Scheme != "http" && webAppURL.Scheme != "https") {
+		problems = append(problems, fmt.Errorf("WEB_APP_URL %q is not a valid http(s) URL", cfg.WebAppURL))
+	}
+
+	if cfg.MTLSEnabled && cfg.CAKeyFile == "" {
+		problems = append(problems, errors.New("SKYPORT_CA_KEY_FILE is required when SKYPORT_MTLS_ENABLED is true"))
+	}
+	// Client certificates are only checked on the TLS listener, which ACME provides
+	if cfg.MTLSEnabled && !cfg.ACMEEnabled {
+		problems = append(problems, errors.New("SKYPORT_ACME_ENABLED must be true when SKYPORT_MTLS_ENABLED is true"))
+	}
+
+	// Forwarded requests skip IP rules, basic auth and geofencing on the receiving instance
+	if len(cfg.InstancePeers) > 0 && len(cfg.InstanceSecret) < minInstanceSecretLength {
+		problems = append(problems, fmt.Errorf("SKYPORT_INSTANCE_SECRET must be at least %d characters when SKYPORT_INSTANCE_PEERS is set", minInstanceSecretLength))
+	}
+
+	return errors.Join(problems...)
+}
+
+// isWeakDatabasePassword reports whether a password is too short or a well-known default
+func isWeakDatabasePassword(password string) bool {
+	if len(password) < minDatabasePasswordLength {
+		return true
+	}
+	for _, weak := range weakDatabasePasswords {
+		if strings.EqualFold(password, weak) {
+			return true
+		}
+	}
+	return false
+}
@@ -3,13 +3,19 @@ package database
 import (
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 )
 
+// Initialize connects to a single database
 func Initialize(databaseURL string) (*sql.DB, error) {
+	return ConnectWithFailover([]string{databaseURL})
+}
+
+// prepareDatabaseURL adds the statement cache settings the detected pooler type needs
+func prepareDatabaseURL(databaseURL string) string {
 	// Detect pooler type and configure accordingly
 	// Transaction poolers (port 6543) don't support prepared statements at all
 	// Session poolers (port 5432) can use statement caching
@@ -30,10 +36,10 @@ func Initialize(databaseURL string) (*sql.DB, error) {
 		if isTransactionPooler {
 			// Transaction poolers (port 6543) are NOT RECOMMENDED for this application
 			// They don't support prepared statements and cause connection issues
-			log.Println("⚠️  WARNING: Transaction pooler detected (port 6543)")
-			log.Println("⚠️  Transaction poolers are NOT recommended for applications with WebSockets")
-			log.Println("⚠️  Please switch to Session Pooler (port 5432) for better stability")
-			log.Println("⚠️  Attempting to disable prepared statements, but issues may still occur...")
+			slog.Warn("⚠️  WARNING: Transaction pooler detected (port 6543)")
+			slog.Warn("⚠️  Transaction poolers are NOT recommended for applications with WebSockets")
+			slog.Warn("⚠️  Please switch to Session Pooler (port 5432) for better stability")
+			slog.Warn("⚠️  Attempting to disable prepared statements, but issues may still occur...")
 
 			// Must use prefer_simple_protocol=yes to disable them completely
 			databaseURL += separator + "prefer_simple_protocol=yes"
@@ -46,27 +52,21 @@ func Initialize(databaseURL string) (*sql.DB, error) {
 		} else if needsStatementCacheMode(databaseURL) {
 			// Session poolers (port 5432) can use statement caching safely
 			databaseURL += separator + "statement_cache_mode=describe"
-			log.Println("✓ Session pooler detected - configured with statement_cache_mode=describe")
+			slog.Info("✓ Session pooler detected - configured with statement_cache_mode=describe")
 		}
 	}
 
-	db, err := sql.Open("pgx", databaseURL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
-	}
+	return databaseURL
+}
 
+// configurePool applies the connection pool settings
+func configurePool(db *sql.DB) {
 	// Set connection pool settings optimized for session pooler
 	// These settings work well with Supabase session pooler (port 5432)
 	db.SetMaxOpenConns(20)   // Reasonable for session pooler
 	db.SetMaxIdleConns(5)    // Keep some idle connections ready
 	db.SetConnMaxLifetime(0) // Reuse connections indefinitely
 	db.SetConnMaxIdleTime(0) // Don't close idle connections
-
-	if err := db.Ping(); err != nil {
-		return nil, fmt.Errorf("failed to ping database: %w", err)
-	}
-
-	return db, nil
 }
 
 // containsQueryParams checks if a database URL already has query parameters
@@ -87,7 +87,7 @@ func needsStatementCacheMode(url string) bool {
 	localIndicators := []string{"localhost", "127.0.0.1", "host=localhost", "host=127.0.0.1"}
 	for _, indicator := range localIndicators {
 		if contains(url, indicator) {
-			log.Println("✓ Local PostgreSQL detected - using standard configuration")
+			slog.Info("✓ Local PostgreSQL detected - using standard configuration")
 			return false
 		}
 	}
@@ -161,6 +161,10 @@ func RunMigrations(db *sql.DB) error {
 		`CREATE INDEX IF NOT EXISTS idx_tunnels_subdomain ON tunnels(subdomain);`,
 		`CREATE INDEX IF NOT EXISTS idx_tunnels_auth_token ON tunnels(auth_token);`,
 
+		// Partial index for the proxy lookup, rebuilt with the lookup's current predicate
+		// further down once is_paused and proxy_target_url exist
+		`CREATE INDEX IF NOT EXISTS idx_tunnels_active_subdomain ON tunnels(subdomain) WHERE is_active = true;`,
+
 		`CREATE TABLE IF NOT EXISTS refresh_tokens (
 			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
 			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
@@ -171,6 +175,260 @@ func RunMigrations(db *sql.DB) error {
 
 		`CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens(user_id);`,
 		`CREATE INDEX IF NOT EXISTS idx_refresh_tokens_token ON refresh_tokens(token);`,
+
+		`CREATE TABLE IF NOT EXISTS login_sessions (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			fingerprint VARCHAR(64) NOT NULL,
+			ip VARCHAR(45) NOT NULL,
+			first_seen TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			last_seen TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			count INTEGER NOT NULL DEFAULT 1,
+			is_new_device BOOLEAN DEFAULT FALSE,
+			is_trusted BOOLEAN DEFAULT FALSE,
+			UNIQUE (user_id, fingerprint, ip)
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_login_sessions_user_id ON login_sessions(user_id);`,
+
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN DEFAULT FALSE;`,
+
+		`CREATE TABLE IF NOT EXISTS server_settings (
+			id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+			maintenance_mode_until TIMESTAMP WITH TIME ZONE,
+			updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);`,
+
+		`INSERT INTO server_settings (id) VALUES (TRUE) ON CONFLICT (id) DO NOTHING;`,
+
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS coalesce_get_requests BOOLEAN DEFAULT FALSE;`,
+
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+			target_user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+			action VARCHAR(100) NOT NULL,
+			ip_address VARCHAR(45),
+			details JSONB,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_actor_id ON audit_log(actor_id);`,
+
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';`,
+
+		`CREATE INDEX IF NOT EXISTS idx_tunnels_tags ON tunnels USING GIN (tags);`,
+
+		`CREATE TABLE IF NOT EXISTS custom_domains (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			tunnel_id UUID NOT NULL REFERENCES tunnels(id) ON DELETE CASCADE,
+			domain VARCHAR(253) UNIQUE NOT NULL,
+			verified_at TIMESTAMP WITH TIME ZONE,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);`,
+
+		`CREATE TABLE IF NOT EXISTS acme_challenges (
+			token VARCHAR(255) PRIMARY KEY,
+			key_authorization TEXT NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);`,
+
+		`CREATE TABLE IF NOT EXISTS certificates (
+			key VARCHAR(255) PRIMARY KEY,
+			data BYTEA NOT NULL,
+			updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);`,
+
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS allow_indexing BOOLEAN DEFAULT FALSE;`,
+
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS proxy_protocol_enabled BOOLEAN DEFAULT FALSE;`,
+
+		`CREATE TABLE IF NOT EXISTS invitations (
+			code VARCHAR(64) PRIMARY KEY,
+			email VARCHAR(255) NOT NULL,
+			invited_by UUID REFERENCES users(id) ON DELETE SET NULL,
+			used_at TIMESTAMP WITH TIME ZONE,
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);`,
+
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS is_email_verified BOOLEAN DEFAULT FALSE;`,
+
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS password_changed_at TIMESTAMP WITH TIME ZONE;`,
+
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS auto_restart BOOLEAN DEFAULT FALSE;`,
+
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS agent_callback_url TEXT;`,
+
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS last_agent_addr VARCHAR(64);`,
+
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS client_cert BYTEA;`,
+
+		`CREATE TABLE IF NOT EXISTS magic_link_tokens (
+			token_hash VARCHAR(64) PRIMARY KEY,
+			email VARCHAR(255) NOT NULL,
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			used BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_magic_link_tokens_email ON magic_link_tokens(email, created_at);`,
+
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS transforms JSONB NOT NULL DEFAULT '[]';`,
+
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS write_buffer_kb INT NOT NULL DEFAULT 64;`,
+
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS blocked_countries TEXT[] NOT NULL DEFAULT '{}';`,
+
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS proxy_target_url TEXT;`,
+
+		`CREATE TABLE IF NOT EXISTS auth_audit_log (
+			id BIGSERIAL PRIMARY KEY,
+			user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+			event_type VARCHAR(50) NOT NULL,
+			ip_address VARCHAR(64),
+			user_agent TEXT,
+			success BOOLEAN NOT NULL,
+			details JSONB NOT NULL DEFAULT '{}',
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_auth_audit_log_user_id ON auth_audit_log(user_id, id DESC);`,
+
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS routing_rules JSONB NOT NULL DEFAULT '[]';`,
+
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS cors_bypass BOOLEAN NOT NULL DEFAULT FALSE;`,
+
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS sticky_session_cookie BOOLEAN NOT NULL DEFAULT FALSE;`,
+
+		// Which server instance holds the agent connection, for forwarding between instances
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS connected_instance VARCHAR(255);`,
+
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS timeout_seconds INT NOT NULL DEFAULT 0;`,
+
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS is_paused BOOLEAN NOT NULL DEFAULT FALSE;`,
+
+		// Traffic per tunnel and hour, the source of the tunnel statistics
+		`CREATE TABLE IF NOT EXISTS tunnel_stats (
+			tunnel_id UUID NOT NULL REFERENCES tunnels(id) ON DELETE CASCADE,
+			hour TIMESTAMP WITH TIME ZONE NOT NULL,
+			requests BIGINT NOT NULL DEFAULT 0,
+			bytes BIGINT NOT NULL DEFAULT 0,
+			latency_ms_total BIGINT NOT NULL DEFAULT 0,
+			errors BIGINT NOT NULL DEFAULT 0,
+			connected_seconds BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (tunnel_id, hour)
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_tunnel_stats_hour ON tunnel_stats(hour);`,
+
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS max_body_bytes BIGINT NOT NULL DEFAULT 10485760;`,
+
+		`CREATE TABLE IF NOT EXISTS tunnel_ip_rules (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			tunnel_id UUID NOT NULL REFERENCES tunnels(id) ON DELETE CASCADE,
+			cidr VARCHAR(64) NOT NULL,
+			action VARCHAR(5) NOT NULL CHECK (action IN ('allow', 'deny')),
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_tunnel_ip_rules_tunnel_id ON tunnel_ip_rules(tunnel_id);`,
+
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS basic_auth_user VARCHAR(255);`,
+
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS basic_auth_password_hash VARCHAR(255);`,
+
+		`CREATE TABLE IF NOT EXISTS tunnel_header_rules (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			tunnel_id UUID NOT NULL REFERENCES tunnels(id) ON DELETE CASCADE,
+			direction VARCHAR(8) NOT NULL CHECK (direction IN ('request', 'response')),
+			action VARCHAR(6) NOT NULL CHECK (action IN ('set', 'remove')),
+			header_name VARCHAR(255) NOT NULL,
+			header_value TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_tunnel_header_rules_tunnel_id ON tunnel_header_rules(tunnel_id);`,
+
+		`CREATE TABLE IF NOT EXISTS tunnel_webhooks (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			tunnel_id UUID NOT NULL REFERENCES tunnels(id) ON DELETE CASCADE,
+			url TEXT NOT NULL,
+			secret VARCHAR(255) NOT NULL,
+			events TEXT[] NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_tunnel_webhooks_tunnel_id ON tunnel_webhooks(tunnel_id);`,
+
+		// TOTP secrets are AES-GCM encrypted, the pending one waits for the first code during setup
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret TEXT;`,
+
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_pending_secret TEXT;`,
+
+		`CREATE TABLE IF NOT EXISTS password_resets (
+			token_hash VARCHAR(64) PRIMARY KEY,
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_password_resets_user_id ON password_resets(user_id, created_at);`,
+
+		// Verification became required for creating tunnels together with this table, accounts
+		// that existed before are trusted. The check on the table makes it run only once.
+		`DO $$
+		BEGIN
+			IF to_regclass('email_verifications') IS NULL THEN
+				UPDATE users SET is_email_verified = true;
+			END IF;
+		END $$;`,
+
+		`CREATE TABLE IF NOT EXISTS email_verifications (
+			token_hash VARCHAR(64) PRIMARY KEY,
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_email_verifications_user_id ON email_verifications(user_id, created_at);`,
+
+		// Failed code count and lockout for brute force protection, the last accepted time
+		// step keeps a code from being used twice
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_failed_attempts INT NOT NULL DEFAULT 0;`,
+
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_locked_until TIMESTAMP WITH TIME ZONE;`,
+
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT;`,
+
+		// Custom domains are verified with a TXT record holding this token
+		`ALTER TABLE custom_domains ADD COLUMN IF NOT EXISTS verification_token VARCHAR(64) NOT NULL DEFAULT '';`,
+
+		`CREATE INDEX IF NOT EXISTS idx_custom_domains_tunnel_id ON custom_domains(tunnel_id);`,
+
+		// idx_tunnels_active_subdomain serves the proxy lookup in ProxyHandler.HandleSubdomain,
+		// so its predicate must stay the same as the query's. It only holds tunnels that can
+		// serve traffic and stays small however many inactive tunnels the table has; how much
+		// that speeds up the lookup depends on the ratio. TestActiveSubdomainIndexPlan checks
+		// that EXPLAIN uses it. The first version covered only is_active, which the lookup's
+		// predicate doesn't imply, so it is rebuilt once.
+		`DO $$
+		BEGIN
+			IF EXISTS (
+				SELECT 1 FROM pg_indexes
+				WHERE indexname = 'idx_tunnels_active_subdomain' AND indexdef NOT LIKE '%is_paused%'
+			) THEN
+				DROP INDEX idx_tunnels_active_subdomain;
+			END IF;
+		END $$;`,
+
+		`CREATE INDEX IF NOT EXISTS idx_tunnels_active_subdomain ON tunnels(subdomain)
+			WHERE is_active = true OR is_paused = true OR proxy_target_url IS NOT NULL;`,
+
+		// timeout_seconds was unbounded before the 5 to 300 second limit, older values are
+		// clamped so they can't hold requests open longer than the server allows
+		`UPDATE tunnels SET timeout_seconds = LEAST(GREATEST(timeout_seconds, 5), 300)
+			WHERE timeout_seconds <> 0 AND (timeout_seconds < 5 OR timeout_seconds > 300);`,
 	}
 
 	for _, migration := range migrations {
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// testDatabaseURL returns the database the tests may migrate and write to, they are skipped
+// without one
+func testDatabaseURL(t *testing.T) string {
+	t.Helper()
+	databaseURL := os.Getenv("SKYPORT_TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("SKYPORT_TEST_DATABASE_URL is not set")
+	}
+	return databaseURL
+}
+
+func TestActiveSubdomainIndexPlan(t *testing.T) {
+	db, err := Initialize(testDatabaseURL(t))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer db.Close()
+	if err := RunMigrations(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	// Everything happens in a transaction that is rolled back, ANALYZE included
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRow(`
+		INSERT INTO users (email, password_hash, name)
+		VALUES ('index-plan-test@example.com', 'x', 'Index plan test')
+		RETURNING id
+	`).Scan(&userID)
+	if err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+
+	// Mostly inactive tunnels, the case the partial index is for
+	_, err = tx.Exec(`
+		INSERT INTO tunnels (user_id, name, subdomain, local_port, auth_token, is_active)
+		SELECT $1, 'tunnel-' || n, 'index-plan-test-' || n, 3000, 'index-plan-test-token-' || n, n % 100 = 0
+		FROM generate_series(1, 5000) AS n
+	`, userID)
+	if err != nil {
+		t.Fatalf("insert tunnels: %v", err)
+	}
+	if _, err := tx.Exec("ANALYZE tunnels"); err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+
+	// The predicate of ProxyHandler.HandleSubdomain
+	rows, err := tx.Query(`
+		EXPLAIN SELECT id FROM tunnels
+		WHERE subdomain = $1 AND (is_active = true OR is_paused = true OR proxy_target_url IS NOT NULL)
+	`, "index-plan-test-100")
+	if err != nil {
+		t.Fatalf("explain: %v", err)
+	}
+	defer rows.Close()
+
+	var plan []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			t.Fatalf("scan plan: %v", err)
+		}
+		plan = append(plan, line)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("read plan: %v", err)
+	}
+
+	if !strings.Contains(strings.Join(plan, "\n"), "idx_tunnels_active_subdomain") {
+		t.Errorf("proxy lookup doesn't use idx_tunnels_active_subdomain, plan:\n%s", strings.Join(plan, "\n"))
+	}
+}
@@ -0,0 +1,78 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// failoverConnector opens each new pool connection on the first reachable database,
+// starting with the one that worked last. When the current database goes down, its
+// connections fail, the pool discards them and replacements land on the next URL, so
+// handlers keep using the same *sql.DB throughout.
+type failoverConnector struct {
+	connectors []driver.Connector
+	urls       []string // sanitized, for logging
+	current    atomic.Int32
+}
+
+func (fc *failoverConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	start := int(fc.current.Load())
+	var lastErr error
+	for i := range fc.connectors {
+		index := (start + i) % len(fc.connectors)
+		conn, err := fc.connectors[index].Connect(ctx)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if index != start && fc.current.CompareAndSwap(int32(start), int32(index)) {
+			slog.Warn("Database unreachable, failed over", "from", fc.urls[start], "to", fc.urls[index])
+		}
+		return conn, nil
+	}
+	return nil, lastErr
+}
+
+func (fc *failoverConnector) Driver() driver.Driver {
+	return stdlib.GetDefaultDriver()
+}
+
+// ConnectWithFailover opens a database that connects to the first reachable URL in order
+// and moves on to the next one whenever the current database stops accepting connections
+func ConnectWithFailover(urls []string) (*sql.DB, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("no database URL configured")
+	}
+
+	drv, ok := stdlib.GetDefaultDriver().(driver.DriverContext)
+	if !ok {
+		return nil, errors.New("pgx driver does not support connectors")
+	}
+
+	fc := &failoverConnector{}
+	for _, databaseURL := range urls {
+		connector, err := drv.OpenConnector(prepareDatabaseURL(databaseURL))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse database URL %s: %w", sanitizeDatabaseURL(databaseURL), err)
+		}
+		fc.connectors = append(fc.connectors, connector)
+		fc.urls = append(fc.urls, sanitizeDatabaseURL(databaseURL))
+	}
+
+	db := openTraced(fc, urls[0])
+	configurePool(db)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	return db, nil
+}
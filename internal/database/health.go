@@ -0,0 +1,126 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// healthCheckInterval is how often the database is pinged while the circuit is closed
+	healthCheckInterval = 10 * time.Second
+	// healthCheckTimeout bounds a single ping
+	healthCheckTimeout = 5 * time.Second
+	// circuitFailureThreshold consecutive failed pings open the circuit
+	circuitFailureThreshold = 3
+	// circuitCooldown is how long an open circuit waits before probing the database again
+	circuitCooldown = 30 * time.Second
+)
+
+// HealthChecker pings the database in the background and acts as a circuit breaker, so
+// request paths can fail fast while the database is down instead of piling up queries.
+// After circuitFailureThreshold consecutive failures the circuit opens (unhealthy); after
+// circuitCooldown a single probe decides whether it closes again.
+type HealthChecker struct {
+	db      *sql.DB
+	healthy atomic.Bool
+
+	mutex     sync.Mutex
+	failures  int
+	openedAt  time.Time
+	lastError string
+	checkedAt time.Time
+}
+
+// HealthStatus is the checker state reported by GET /health, LastError only to admins
+// (GET /api/v1/admin/health)
+type HealthStatus struct {
+	Healthy   bool      `json:"healthy"`
+	Failures  int       `json:"consecutive_failures"`
+	LastError string    `json:"last_error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// NewHealthChecker creates a checker that starts out healthy
+func NewHealthChecker(db *sql.DB) *HealthChecker {
+	hc := &HealthChecker{db: db}
+	hc.healthy.Store(true)
+	return hc
+}
+
+// Run pings the database until ctx is cancelled
+func (hc *HealthChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			hc.check(ctx)
+		}
+	}
+}
+
+// IsHealthy reports whether the circuit is closed
+func (hc *HealthChecker) IsHealthy() bool {
+	return hc.healthy.Load()
+}
+
+// Status returns a snapshot of the checker state
+func (hc *HealthChecker) Status() HealthStatus {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	return HealthStatus{
+		Healthy:   hc.healthy.Load(),
+		Failures:  hc.failures,
+		LastError: hc.lastError,
+		CheckedAt: hc.checkedAt,
+	}
+}
+
+func (hc *HealthChecker) check(ctx context.Context) {
+	// An open circuit leaves the database alone until the cooldown has passed
+	hc.mutex.Lock()
+	open := !hc.healthy.Load()
+	if open && time.Since(hc.openedAt) < circuitCooldown {
+		hc.mutex.Unlock()
+		return
+	}
+	hc.mutex.Unlock()
+
+	pingCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	err := hc.db.PingContext(pingCtx)
+	cancel()
+
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	hc.checkedAt = time.Now()
+
+	if err == nil {
+		if open {
+			slog.Info("Database is reachable again, closing circuit")
+		}
+		hc.failures = 0
+		hc.lastError = ""
+		hc.healthy.Store(true)
+		return
+	}
+
+	hc.failures++
+	hc.lastError = err.Error()
+	if open {
+		// The probe failed, wait another cooldown
+		hc.openedAt = time.Now()
+		return
+	}
+	if hc.failures >= circuitFailureThreshold {
+		slog.Error("Database ping failed repeatedly, opening circuit", "failures", hc.failures, "error", err)
+		hc.openedAt = time.Now()
+		hc.healthy.Store(false)
+	}
+}
@@ -0,0 +1,100 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/XSAM/otelsql"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// InitTracing exports spans to the OTLP endpoint in OTEL_EXPORTER_OTLP_ENDPOINT. Without an
+// endpoint tracing stays disabled and the returned shutdown function does nothing.
+func InitTracing(serviceName string) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" {
+		slog.Info("OTEL_EXPORTER_OTLP_ENDPOINT not set, tracing disabled")
+		return noop, nil
+	}
+
+	// The exporter reads the endpoint and headers from the standard OTEL_* variables
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		return noop, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+	))
+	if err != nil {
+		return noop, fmt.Errorf("failed to build tracing resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// openTraced opens the database through otelsql so every query produces a span
+func openTraced(connector driver.Connector, databaseURL string) *sql.DB {
+	return otelsql.OpenDB(connector,
+		otelsql.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			attribute.String("db.url", sanitizeDatabaseURL(databaseURL)),
+		),
+		otelsql.WithAttributesGetter(func(ctx context.Context, method otelsql.Method, query string, args []driver.NamedValue) []attribute.KeyValue {
+			if query == "" {
+				return nil
+			}
+			return []attribute.KeyValue{
+				attribute.String("db.statement", query),
+				attribute.String("db.operation", queryOperation(query)),
+			}
+		}),
+	)
+}
+
+// sanitizeDatabaseURL removes the password and query parameters from a connection string
+func sanitizeDatabaseURL(databaseURL string) string {
+	parsed, err := url.Parse(databaseURL)
+	if err != nil || parsed.Host == "" {
+		// DSN format (host=... password=...), keep only the host
+		for _, field := range strings.Fields(databaseURL) {
+			if strings.HasPrefix(field, "host=") {
+				return strings.TrimPrefix(field, "host=")
+			}
+		}
+		return ""
+	}
+	if parsed.User != nil {
+		parsed.User = url.User(parsed.User.Username())
+	}
+	parsed.RawQuery = ""
+	return parsed.String()
+}
+
+// queryOperation returns the leading SQL keyword of a query (SELECT, INSERT, ...)
+func queryOperation(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(fields[0])
+}
@@ -0,0 +1,54 @@
+package database
+
+import (
+	"database/sql"
+	"skyport-server/internal/models"
+)
+
+// TunnelColumns is the tunnels column list matching TunnelScanArgs
+const TunnelColumns = `id, user_id, name, subdomain, local_port, auth_token, is_active, last_seen, connected_ip,
+			coalesce_get_requests, tags, allow_indexing, proxy_protocol_enabled, auto_restart, agent_callback_url,
+			last_agent_addr, transforms, write_buffer_kb, blocked_countries,
+			proxy_target_url, routing_rules, cors_bypass, sticky_session_cookie, timeout_seconds, is_paused, max_body_bytes,
+			basic_auth_user, basic_auth_password_hash, created_at, updated_at`
+
+// TunnelScanArgs returns the scan destinations for a row selected with TunnelColumns
+func TunnelScanArgs(tunnel *models.Tunnel) []interface{} {
+	return []interface{}{
+		&tunnel.ID, &tunnel.UserID, &tunnel.Name, &tunnel.Subdomain,
+		&tunnel.LocalPort, &tunnel.AuthToken, &tunnel.IsActive,
+		&tunnel.LastSeen, &tunnel.ConnectedIP, &tunnel.CoalesceGetRequests,
+		(*StringArray)(&tunnel.Tags), &tunnel.AllowIndexing, &tunnel.ProxyProtocolEnabled,
+		&tunnel.AutoRestart, &tunnel.AgentCallbackURL, &tunnel.LastAgentAddr,
+		JSON(&tunnel.Transforms), &tunnel.WriteBufferKB, (*StringArray)(&tunnel.BlockedCountries),
+		&tunnel.ProxyTargetURL, JSON(&tunnel.RoutingRules), &tunnel.CORSBypass,
+		&tunnel.StickySessionCookie, &tunnel.TimeoutSeconds, &tunnel.IsPaused, &tunnel.MaxBodyBytes,
+		&tunnel.BasicAuthUser, &tunnel.BasicAuthPasswordHash,
+		&tunnel.CreatedAt, &tunnel.UpdatedAt,
+	}
+}
+
+// GetTunnel fetches a tunnel by ID in a single query. Returns sql.ErrNoRows if it doesn't exist.
+func GetTunnel(db *sql.DB, tunnelID string) (*models.Tunnel, error) {
+	var tunnel models.Tunnel
+	err := db.QueryRow("SELECT "+TunnelColumns+" FROM tunnels WHERE id = $1", tunnelID).Scan(TunnelScanArgs(&tunnel)...)
+	if err != nil {
+		return nil, err
+	}
+	return &tunnel, nil
+}
+
+// EachTunnel scans rows selected with TunnelColumns one at a time and calls fn for each,
+// so large result sets never have to be held in memory. It stops at the first error.
+func EachTunnel(rows *sql.Rows, fn func(tunnel *models.Tunnel) error) error {
+	for rows.Next() {
+		var tunnel models.Tunnel
+		if err := rows.Scan(TunnelScanArgs(&tunnel)...); err != nil {
+			return err
+		}
+		if err := fn(&tunnel); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
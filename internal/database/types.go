@@ -0,0 +1,102 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// StringArray scans a PostgreSQL TEXT[] column into a []string.
+// pgx's database/sql driver returns arrays in their text form ("{a,b}"), which database/sql
+// cannot convert to a slice on its own. Writes don't need it, pgx encodes []string directly.
+//
+//	rows.Scan((*database.StringArray)(&tunnel.Tags))
+type StringArray []string
+
+// Scan implements sql.Scanner
+func (a *StringArray) Scan(src interface{}) error {
+	var text string
+	switch value := src.(type) {
+	case nil:
+		*a = []string{}
+		return nil
+	case string:
+		text = value
+	case []byte:
+		text = string(value)
+	default:
+		return fmt.Errorf("cannot scan %T into StringArray", src)
+	}
+
+	if len(text) < 2 || text[0] != '{' || text[len(text)-1] != '}' {
+		return fmt.Errorf("invalid array literal %q", text)
+	}
+	text = text[1 : len(text)-1]
+
+	result := []string{}
+	if text == "" {
+		*a = result
+		return nil
+	}
+
+	var current strings.Builder
+	quoted, inQuotes, escaped := false, false, false
+	for i := 0; i < len(text); i++ {
+		ch := text[i]
+		switch {
+		case escaped:
+			current.WriteByte(ch)
+			escaped = false
+		case ch == '\\':
+			escaped = true
+		case ch == '"':
+			inQuotes = !inQuotes
+			quoted = true
+		case ch == ',' && !inQuotes:
+			result = append(result, arrayElement(current.String(), quoted))
+			current.Reset()
+			quoted = false
+		default:
+			current.WriteByte(ch)
+		}
+	}
+	result = append(result, arrayElement(current.String(), quoted))
+
+	*a = result
+	return nil
+}
+
+// arrayElement converts an unquoted NULL element to an empty string
+func arrayElement(value string, quoted bool) string {
+	if !quoted && value == "NULL" {
+		return ""
+	}
+	return value
+}
+
+// JSON scans a JSON or JSONB column into any value encoding/json can decode into.
+// NULL leaves the destination untouched.
+//
+//	rows.Scan(database.JSON(&tunnel.Transforms))
+func JSON(dest interface{}) sql.Scanner {
+	return jsonScanner{dest: dest}
+}
+
+type jsonScanner struct {
+	dest interface{}
+}
+
+// Scan implements sql.Scanner
+func (s jsonScanner) Scan(src interface{}) error {
+	switch value := src.(type) {
+	case nil:
+		return nil
+	case string:
+		return json.Unmarshal([]byte(value), s.dest)
+	case []byte:
+		return json.Unmarshal(value, s.dest)
+	default:
+		return fmt.Errorf("cannot scan %T into JSON", src)
+	}
+}
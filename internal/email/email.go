@@ -0,0 +1,67 @@
+package email
+
+import (
+	"fmt"
+	"log/slog"
+	"net/smtp"
+	"skyport-server/internal/config"
+	"strings"
+)
+
+// Sender delivers plain-text emails over SMTP
+type Sender struct {
+	host     string
+	port     string
+	username string
+	password string
+	from     string
+}
+
+func NewSender(cfg *config.Config) *Sender {
+	return &Sender{
+		host:     cfg.SMTPHost,
+		port:     cfg.SMTPPort,
+		username: cfg.SMTPUsername,
+		password: cfg.SMTPPassword,
+		from:     cfg.SMTPFrom,
+	}
+}
+
+// Send delivers an email to a single recipient
+// When SMTP is not configured the email is logged instead so local development keeps working
+func (s *Sender) Send(to, subject, body string) error {
+	if s.host == "" {
+		slog.Info("SMTP not configured, skipping email", "email", to, "subject", subject)
+		return nil
+	}
+
+	var auth smtp.Auth
+	if s.username != "" {
+		auth = smtp.PlainAuth("", s.username, s.password, s.host)
+	}
+
+	message := strings.Join([]string{
+		"From: " + s.from,
+		"To: " + to,
+		"Subject: " + subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		body,
+	}, "\r\n")
+
+	if err := smtp.SendMail(s.host+":"+s.port, auth, senderAddress(s.from), []string{to}, []byte(message)); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return nil
+}
+
+// senderAddress extracts the bare address from a "Name <address>" sender
+func senderAddress(from string) string {
+	if start := strings.Index(from, "<"); start != -1 {
+		if end := strings.Index(from[start:], ">"); end != -1 {
+			return from[start+1 : start+end]
+		}
+	}
+	return from
+}
@@ -0,0 +1,131 @@
+package geoip
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// Location is the result of an IP geolocation lookup
+type Location struct {
+	Country string // ISO 3166-1 alpha-2 code, e.g. "US"
+	Region  string // English subdivision name, e.g. "California" (City databases only)
+}
+
+// Locator looks up client IPs in a local MaxMind GeoLite2/GeoIP2 database.
+// A nil or unloaded Locator returns empty locations so callers don't need to special case it.
+type Locator struct {
+	reader *geoip2.Reader
+	isCity bool
+
+	cacheMutex sync.Mutex
+	cache      map[string]cachedLocation
+}
+
+const (
+	// lookupCacheTTL is how long a lookup result is reused for the same IP
+	lookupCacheTTL = 5 * time.Minute
+	// maxCachedLookups bounds the cache, expired entries are swept when it fills up
+	maxCachedLookups = 10000
+)
+
+type cachedLocation struct {
+	location  Location
+	expiresAt time.Time
+}
+
+// Open loads the .mmdb file at path. A missing path or unreadable file is logged and
+// results in a Locator that never finds anything.
+func Open(path string) *Locator {
+	if path == "" {
+		slog.Info("GeoIP database not configured, client country headers disabled")
+		return &Locator{}
+	}
+
+	reader, err := geoip2.Open(path)
+	if err != nil {
+		slog.Warn("Failed to open GeoIP database, client country headers disabled", "path", path, "error", err)
+		return &Locator{}
+	}
+
+	slog.Info("✓ GeoIP database loaded", "path", path)
+	return &Locator{
+		reader: reader,
+		isCity: strings.Contains(reader.Metadata().DatabaseType, "City"),
+	}
+}
+
+// Lookup returns the location of an IP address, or an empty Location if it is unknown.
+// Results are cached per IP for lookupCacheTTL.
+func (l *Locator) Lookup(ipStr string) Location {
+	if l == nil || l.reader == nil {
+		return Location{}
+	}
+
+	l.cacheMutex.Lock()
+	if cached, found := l.cache[ipStr]; found && time.Now().Before(cached.expiresAt) {
+		l.cacheMutex.Unlock()
+		return cached.location
+	}
+	l.cacheMutex.Unlock()
+
+	location := l.lookup(ipStr)
+
+	l.cacheMutex.Lock()
+	defer l.cacheMutex.Unlock()
+	if l.cache == nil {
+		l.cache = make(map[string]cachedLocation)
+	}
+	if len(l.cache) >= maxCachedLookups {
+		now := time.Now()
+		for ip, cached := range l.cache {
+			if now.After(cached.expiresAt) {
+				delete(l.cache, ip)
+			}
+		}
+		// Everything is still fresh, start over rather than grow without bound
+		if len(l.cache) >= maxCachedLookups {
+			l.cache = make(map[string]cachedLocation)
+		}
+	}
+	l.cache[ipStr] = cachedLocation{location: location, expiresAt: time.Now().Add(lookupCacheTTL)}
+	return location
+}
+
+// lookup reads the location of an IP address from the database
+func (l *Locator) lookup(ipStr string) Location {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return Location{}
+	}
+
+	if l.isCity {
+		record, err := l.reader.City(ip)
+		if err != nil {
+			return Location{}
+		}
+		location := Location{Country: record.Country.IsoCode}
+		if len(record.Subdivisions) > 0 {
+			location.Region = record.Subdivisions[0].Names["en"]
+		}
+		return location
+	}
+
+	record, err := l.reader.Country(ip)
+	if err != nil {
+		return Location{}
+	}
+	return Location{Country: record.Country.IsoCode}
+}
+
+// Close releases the database file
+func (l *Locator) Close() error {
+	if l == nil || l.reader == nil {
+		return nil
+	}
+	return l.reader.Close()
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"skyport-server/internal/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// defaultInviteTTL is how long an invite code stays valid when no expiry is requested
+const defaultInviteTTL = 7 * 24 * time.Hour
+
+type AdminHandler struct {
+	db     *sql.DB
+	logger *slog.Logger
+}
+
+func NewAdminHandler(db *sql.DB, logger *slog.Logger) *AdminHandler {
+	return &AdminHandler{
+		db:     db,
+		logger: logger,
+	}
+}
+
+// GetMaintenanceStatus reports whether the server is in maintenance mode
+func (h *AdminHandler) GetMaintenanceStatus(c *gin.Context) {
+	var until sql.NullTime
+	err := h.db.QueryRow("SELECT maintenance_mode_until FROM server_settings").Scan(&until)
+	if err != nil && err != sql.ErrNoRows {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to read maintenance mode", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if !until.Valid || !time.Now().Before(until.Time) {
+		c.JSON(http.StatusOK, gin.H{"maintenance": false})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"maintenance":       true,
+		"maintenance_until": until.Time,
+	})
+}
+
+// SetMaintenance enables maintenance mode for the given number of minutes, or clears it
+func (h *AdminHandler) SetMaintenance(c *gin.Context) {
+	var req models.SetMaintenanceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var until *time.Time
+	if req.Enabled {
+		if req.Minutes < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "minutes must be at least 1 when enabling maintenance"})
+			return
+		}
+		end := time.Now().Add(time.Duration(req.Minutes) * time.Minute)
+		until = &end
+	}
+
+	_, err := h.db.Exec(
+		"UPDATE server_settings SET maintenance_mode_until = $1, updated_at = NOW()",
+		until,
+	)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to update maintenance mode", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update maintenance mode"})
+		return
+	}
+
+	adminID, _ := c.Get("user_id")
+	if until != nil {
+		h.logger.InfoContext(c.Request.Context(), "Maintenance mode enabled", "until", until.Format(time.RFC3339), "admin_id", adminID)
+		c.JSON(http.StatusOK, gin.H{"maintenance": true, "maintenance_until": until})
+		return
+	}
+
+	h.logger.InfoContext(c.Request.Context(), "Maintenance mode cleared", "admin_id", adminID)
+	c.JSON(http.StatusOK, gin.H{"maintenance": false})
+}
+
+// CreateInvite creates a single-use invite code for the given email
+func (h *AdminHandler) CreateInvite(c *gin.Context) {
+	var req models.CreateInviteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	adminIDStr, _ := c.Get("user_id")
+	adminID, err := uuid.Parse(adminIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	codeBytes := make([]byte, 16)
+	if _, err := rand.Read(codeBytes); err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to generate invite code", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate invite code"})
+		return
+	}
+
+	ttl := defaultInviteTTL
+	if req.ExpiresInHours > 0 {
+		ttl = time.Duration(req.ExpiresInHours) * time.Hour
+	}
+
+	invite := models.Invitation{
+		Code:      hex.EncodeToString(codeBytes),
+		Email:     req.Email,
+		InvitedBy: adminID,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+
+	_, err = h.db.Exec(
+		"INSERT INTO invitations (code, email, invited_by, expires_at) VALUES ($1, $2, $3, $4)",
+		invite.Code, invite.Email, invite.InvitedBy, invite.ExpiresAt,
+	)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to create invite", "email", req.Email, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invite"})
+		return
+	}
+
+	h.logger.InfoContext(c.Request.Context(), "Invite created", "email", invite.Email, "admin_id", adminID)
+	c.JSON(http.StatusCreated, invite)
+}
@@ -2,8 +2,11 @@ package handlers
 
 import (
 	"database/sql"
-	"log"
+	"log/slog"
 	"net/http"
+	"skyport-server/internal/config"
+	"skyport-server/internal/email"
+	"skyport-server/internal/middleware"
 	"skyport-server/internal/models"
 	"time"
 
@@ -13,15 +16,34 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// impersonationTokenTTL is how long an admin impersonation session lasts
+const impersonationTokenTTL = 15 * time.Minute
+
 type AuthHandler struct {
-	db        *sql.DB
-	jwtSecret string
+	db         *sql.DB
+	jwtSecret  string
+	mailer     *email.Sender
+	inviteOnly bool
+	webAppURL  string
+	logger     *slog.Logger
+
+	// allowedEmailDomains limits new accounts to these domains, empty allows all
+	allowedEmailDomains []string
+
+	// maxTunnelsPerUser is reported on the profile, 0 for no limit
+	maxTunnelsPerUser int
 }
 
-func NewAuthHandler(db *sql.DB, jwtSecret string) *AuthHandler {
+func NewAuthHandler(db *sql.DB, jwtSecret string, mailer *email.Sender, inviteOnly bool, allowedEmailDomains []string, webAppURL string, maxTunnelsPerUser int, logger *slog.Logger) *AuthHandler {
 	return &AuthHandler{
-		db:        db,
-		jwtSecret: jwtSecret,
+		db:                  db,
+		jwtSecret:           jwtSecret,
+		mailer:              mailer,
+		inviteOnly:          inviteOnly,
+		allowedEmailDomains: allowedEmailDomains,
+		webAppURL:           webAppURL,
+		maxTunnelsPerUser:   maxTunnelsPerUser,
+		logger:              logger,
 	}
 }
 
@@ -32,11 +54,21 @@ func (h *AuthHandler) SignUp(c *gin.Context) {
 		return
 	}
 
+	if h.inviteOnly && req.InviteCode == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Signup requires an invite code"})
+		return
+	}
+
+	if !config.IsEmailDomainAllowed(req.Email, h.allowedEmailDomains) {
+		c.JSON(http.StatusForbidden, gin.H{"error": config.EmailDomainRestrictionMessage(h.allowedEmailDomains)})
+		return
+	}
+
 	// Check if user already exists
 	var userExists bool
 	err := h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = $1)", req.Email).Scan(&userExists)
 	if err != nil {
-		log.Printf("Failed to check user existence for email %s: %v", req.Email, err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to check user existence", "email", req.Email, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
@@ -49,27 +81,75 @@ func (h *AuthHandler) SignUp(c *gin.Context) {
 	// Hash password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
-		log.Printf("Failed to hash password for email %s: %v", req.Email, err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to hash password", "email", req.Email, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
 		return
 	}
 
+	tx, err := h.db.Begin()
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to begin signup transaction", "email", req.Email, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// In invite-only mode the invite is claimed in the same transaction as the user is created
+	if h.inviteOnly {
+		result, err := tx.Exec(`
+			UPDATE invitations SET used_at = NOW()
+			WHERE code = $1 AND LOWER(email) = LOWER($2) AND used_at IS NULL AND expires_at > NOW()
+		`, req.InviteCode, req.Email)
+		if err != nil {
+			h.logger.ErrorContext(c.Request.Context(), "Failed to claim invite", "email", req.Email, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			h.logger.ErrorContext(c.Request.Context(), "Failed to check invite claim", "email", req.Email, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		if rowsAffected == 0 {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired invite code"})
+			return
+		}
+	}
+
 	// Create user
 	userID := uuid.New()
-	_, err = h.db.Exec(
+	_, err = tx.Exec(
 		"INSERT INTO users (id, email, password_hash, name) VALUES ($1, $2, $3, $4)",
 		userID, req.Email, string(hashedPassword), req.Name,
 	)
 	if err != nil {
-		log.Printf("Failed to create user with email %s: %v", req.Email, err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to create user", "email", req.Email, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 		return
 	}
 
+	verificationToken, err := createEmailVerification(tx, userID.String())
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to create email verification", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to commit signup", "email", req.Email, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+
+	go h.sendVerificationEmail(req.Email, verificationToken)
+
 	// Generate tokens
 	token, refreshToken, err := h.generateTokens(userID.String())
 	if err != nil {
-		log.Printf("Failed to generate tokens for user %s: %v", userID, err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to generate tokens", "user_id", userID, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tokens"})
 		return
 	}
@@ -77,11 +157,13 @@ func (h *AuthHandler) SignUp(c *gin.Context) {
 	// Save refresh token
 	err = h.saveRefreshToken(userID, refreshToken)
 	if err != nil {
-		log.Printf("Failed to save refresh token for user %s: %v", userID, err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to save refresh token", "user_id", userID, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save refresh token"})
 		return
 	}
 
+	recordAuthEvent(h.db, c, userID.String(), auditEventSignup, true, nil)
+
 	// Return user and tokens
 	user := models.User{
 		ID:    userID,
@@ -106,17 +188,19 @@ func (h *AuthHandler) Login(c *gin.Context) {
 	// Get user from database
 	var user models.User
 	var passwordHash string
+	var totpEnabled bool
 	err := h.db.QueryRow(
-		"SELECT id, email, password_hash, name, created_at, updated_at FROM users WHERE email = $1",
+		"SELECT id, email, password_hash, name, created_at, updated_at, totp_secret IS NOT NULL FROM users WHERE email = $1",
 		req.Email,
-	).Scan(&user.ID, &user.Email, &passwordHash, &user.Name, &user.CreatedAt, &user.UpdatedAt)
+	).Scan(&user.ID, &user.Email, &passwordHash, &user.Name, &user.CreatedAt, &user.UpdatedAt, &totpEnabled)
 
 	if err == sql.ErrNoRows {
+		recordAuthEvent(h.db, c, "", auditEventLogin, false, gin.H{"email": req.Email, "reason": "unknown_email"})
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
 		return
 	}
 	if err != nil {
-		log.Printf("Failed to fetch user for login with email %s: %v", req.Email, err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch user for login", "email", req.Email, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
@@ -124,14 +208,24 @@ func (h *AuthHandler) Login(c *gin.Context) {
 	// Check password
 	err = bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.Password))
 	if err != nil {
+		recordAuthEvent(h.db, c, user.ID.String(), auditEventLogin, false, gin.H{"reason": "invalid_password"})
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
 		return
 	}
 
+	// The login completes in AuthenticateTOTP
+	if totpEnabled {
+		h.respondRequires2FA(c, user.ID.String())
+		return
+	}
+
+	// Track the device and flag logins from unrecognised devices
+	h.recordLoginSession(user, c)
+
 	// Generate tokens
 	token, refreshToken, err := h.generateTokens(user.ID.String())
 	if err != nil {
-		log.Printf("Failed to generate tokens for user %s: %v", user.ID, err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to generate tokens", "user_id", user.ID, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tokens"})
 		return
 	}
@@ -139,11 +233,13 @@ func (h *AuthHandler) Login(c *gin.Context) {
 	// Save refresh token
 	err = h.saveRefreshToken(user.ID, refreshToken)
 	if err != nil {
-		log.Printf("Failed to save refresh token for user %s: %v", user.ID, err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to save refresh token", "user_id", user.ID, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save refresh token"})
 		return
 	}
 
+	recordAuthEvent(h.db, c, user.ID.String(), auditEventLogin, true, nil)
+
 	c.JSON(http.StatusOK, models.AuthResponse{
 		Token:        token,
 		RefreshToken: refreshToken,
@@ -173,12 +269,13 @@ func (h *AuthHandler) RefreshToken(c *gin.Context) {
 		return
 	}
 	if err != nil {
-		log.Printf("Failed to validate refresh token: %v", err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to validate refresh token", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
 	if time.Now().After(expiresAt) {
+		recordAuthEvent(h.db, c, userID.String(), auditEventTokenRefresh, false, gin.H{"reason": "expired"})
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token expired"})
 		return
 	}
@@ -186,7 +283,7 @@ func (h *AuthHandler) RefreshToken(c *gin.Context) {
 	// Generate new tokens
 	token, newRefreshToken, err := h.generateTokens(userID.String())
 	if err != nil {
-		log.Printf("Failed to generate new tokens for user %s: %v", userID, err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to generate new tokens", "user_id", userID, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tokens"})
 		return
 	}
@@ -194,18 +291,20 @@ func (h *AuthHandler) RefreshToken(c *gin.Context) {
 	// Delete old refresh token and save new one
 	_, err = h.db.Exec("DELETE FROM refresh_tokens WHERE token = $1", req.RefreshToken)
 	if err != nil {
-		log.Printf("Failed to delete old refresh token for user %s: %v", userID, err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to delete old refresh token", "user_id", userID, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete old refresh token"})
 		return
 	}
 
 	err = h.saveRefreshToken(userID, newRefreshToken)
 	if err != nil {
-		log.Printf("Failed to save new refresh token for user %s: %v", userID, err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to save new refresh token", "user_id", userID, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save refresh token"})
 		return
 	}
 
+	recordAuthEvent(h.db, c, userID.String(), auditEventTokenRefresh, true, nil)
+
 	c.JSON(http.StatusOK, gin.H{
 		"token":         token,
 		"refresh_token": newRefreshToken,
@@ -228,6 +327,7 @@ func (h *AuthHandler) AgentAuth(c *gin.Context) {
 	})
 
 	if err != nil || !token.Valid {
+		recordAuthEvent(h.db, c, "", auditEventAgentAuth, false, gin.H{"reason": "invalid_token"})
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 		return
 	}
@@ -244,6 +344,44 @@ func (h *AuthHandler) AgentAuth(c *gin.Context) {
 		return
 	}
 
+	// A password alone doesn't authenticate users with 2FA
+	if tokenType, _ := claims["type"].(string); tokenType == middleware.PartialTokenType {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Two-factor authentication required"})
+		return
+	}
+
+	// Impersonation sessions are short-lived and must not be turned into permanent agent tokens
+	if _, impersonated := claims["impersonated_by"]; impersonated {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Impersonation tokens cannot be used for agent authentication"})
+		return
+	}
+
+	// Browser tokens must be unexpired and belong to a user who is still logged in,
+	// otherwise a leaked token could be exchanged for a permanent agent token after logout
+	if tokenType, _ := claims["type"].(string); tokenType == "access" {
+		expiresAt, err := claims.GetExpirationTime()
+		if err != nil || expiresAt == nil || time.Now().After(expiresAt.Time) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Token expired"})
+			return
+		}
+
+		var hasActiveSession bool
+		err = h.db.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM refresh_tokens WHERE user_id = $1 AND expires_at > NOW())",
+			userIDStr,
+		).Scan(&hasActiveSession)
+		if err != nil {
+			h.logger.ErrorContext(c.Request.Context(), "Failed to check active sessions", "user_id", userIDStr, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		if !hasActiveSession {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has been logged out"})
+			return
+		}
+	}
+
 	// Get user info
 	var user models.User
 	err = h.db.QueryRow(
@@ -256,7 +394,7 @@ func (h *AuthHandler) AgentAuth(c *gin.Context) {
 		return
 	}
 	if err != nil {
-		log.Printf("Failed to fetch user %s for agent auth: %v", userIDStr, err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch user for agent auth", "user_id", userIDStr, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
@@ -264,11 +402,13 @@ func (h *AuthHandler) AgentAuth(c *gin.Context) {
 	// Generate permanent agent service token (no expiry)
 	agentToken, err := h.generateAgentToken(userIDStr)
 	if err != nil {
-		log.Printf("Failed to generate agent token for user %s: %v", userIDStr, err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to generate agent token", "user_id", userIDStr, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate agent token"})
 		return
 	}
 
+	recordAuthEvent(h.db, c, userIDStr, auditEventAgentAuth, true, nil)
+
 	c.JSON(http.StatusOK, gin.H{
 		"valid":       true,
 		"user":        user,
@@ -285,22 +425,102 @@ func (h *AuthHandler) GetProfile(c *gin.Context) {
 
 	// Get user info
 	var user models.User
+	var isAdmin, emailVerified bool
 	err := h.db.QueryRow(
-		"SELECT id, email, name, created_at, updated_at FROM users WHERE id = $1",
+		"SELECT id, email, name, created_at, updated_at, COALESCE(is_admin, false), COALESCE(is_email_verified, false) FROM users WHERE id = $1",
 		userIDStr,
-	).Scan(&user.ID, &user.Email, &user.Name, &user.CreatedAt, &user.UpdatedAt)
+	).Scan(&user.ID, &user.Email, &user.Name, &user.CreatedAt, &user.UpdatedAt, &isAdmin, &emailVerified)
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch profile", "user_id", userIDStr, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	profile := models.ProfileResponse{User: user, MaxTunnels: h.maxTunnelsPerUser, EmailVerified: emailVerified}
+	if isAdmin {
+		profile.MaxTunnels = 0
+	}
+	c.JSON(http.StatusOK, profile)
+}
+
+// Impersonate issues a short-lived access token that lets an admin act as another, non-admin user
+func (h *AuthHandler) Impersonate(c *gin.Context) {
+	adminID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req models.ImpersonateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Get target user info
+	var user models.User
+	var targetIsAdmin bool
+	err := h.db.QueryRow(
+		"SELECT id, email, name, created_at, updated_at, COALESCE(is_admin, false) FROM users WHERE id = $1",
+		req.UserID,
+	).Scan(&user.ID, &user.Email, &user.Name, &user.CreatedAt, &user.UpdatedAt, &targetIsAdmin)
 
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
 	if err != nil {
-		log.Printf("Failed to fetch profile for user %s: %v", userIDStr, err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch user for impersonation", "user_id", req.UserID, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
-	c.JSON(http.StatusOK, user)
+	// An impersonated admin would pass AdminMiddleware and could impersonate again
+	if targetIsAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Admins can't be impersonated"})
+		return
+	}
+
+	// No refresh token is issued, so the session ends when the access token expires
+	expiresAt := time.Now().Add(impersonationTokenTTL)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id":         user.ID.String(),
+		"exp":             expiresAt.Unix(),
+		"iat":             time.Now().Unix(),
+		"type":            "access",
+		"impersonated_by": adminID,
+	})
+
+	tokenString, err := token.SignedString([]byte(h.jwtSecret))
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to generate impersonation token", "user_id", user.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	// Record the impersonation in the audit log
+	_, err = h.db.Exec(
+		"INSERT INTO audit_log (actor_id, target_user_id, action, ip_address, details) VALUES ($1, $2, $3, $4, $5)",
+		adminID, user.ID, "impersonate", c.ClientIP(), `{"expires_at":"`+expiresAt.UTC().Format(time.RFC3339)+`"}`,
+	)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to write impersonation audit log", "admin_id", adminID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record impersonation"})
+		return
+	}
+
+	h.logger.InfoContext(c.Request.Context(), "IMPERSONATION: admin started impersonating user", "admin_id", adminID, "user_id", user.ID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":      tokenString,
+		"expires_at": expiresAt,
+		"user":       user,
+	})
 }
 
 // generateTokens creates browser tokens with industry-standard expiry times
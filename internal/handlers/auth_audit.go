@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"skyport-server/internal/models"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Auth audit event types. Password changes and account deletion record their own events
+// once those flows exist.
+const (
+	auditEventSignup         = "signup"
+	auditEventLogin          = "login"
+	auditEventMagicLinkLogin = "magic_link_login"
+	auditEventTokenRefresh   = "token_refresh"
+	auditEventAgentAuth      = "agent_auth"
+	auditEventTokenExchange  = "token_exchange"
+	auditEventTOTPEnabled    = "totp_enabled"
+	auditEventTOTPDisabled   = "totp_disabled"
+	auditEventPasswordReset  = "password_reset"
+	auditEventEmailVerified  = "email_verified"
+)
+
+const (
+	// defaultAuditLogLimit and maxAuditLogLimit bound a page of audit log entries
+	defaultAuditLogLimit = 50
+	maxAuditLogLimit     = 200
+)
+
+// recordAuthEvent writes an auth_audit_log row. userID may be empty when the user is
+// unknown (e.g. a login with an unregistered email). Failures are logged, never returned,
+// so auditing can't break authentication.
+func recordAuthEvent(db *sql.DB, c *gin.Context, userID, eventType string, success bool, details gin.H) {
+	if details == nil {
+		details = gin.H{}
+	}
+	detailsJSON, err := json.Marshal(details)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to encode audit details", "event_type", eventType, "error", err)
+		detailsJSON = []byte("{}")
+	}
+
+	var user interface{}
+	if userID != "" {
+		user = userID
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO auth_audit_log (user_id, event_type, ip_address, user_agent, success, details)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, user, eventType, c.ClientIP(), c.Request.UserAgent(), success, string(detailsJSON))
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to record audit event", "event_type", eventType, "user_id", userID, "error", err)
+	}
+}
+
+// respondWithAuditLog writes a page of audit log entries, newest first. An empty userID
+// lists every user's events. Pages are walked with ?before=<next_cursor>.
+func respondWithAuditLog(db *sql.DB, c *gin.Context, userID string) {
+	limit := defaultAuditLogLimit
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+			return
+		}
+		limit = min(parsed, maxAuditLogLimit)
+	}
+
+	var before int64
+	if value := c.Query("before"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		before = parsed
+	}
+
+	rows, err := db.Query(`
+		SELECT id, user_id, event_type, ip_address, user_agent, success, details, created_at
+		FROM auth_audit_log
+		WHERE ($1 = '' OR user_id::text = $1) AND ($2 = 0 OR id < $2)
+		ORDER BY id DESC
+		LIMIT $3
+	`, userID, before, limit)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to fetch audit log", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	entries := []models.AuthAuditEntry{}
+	for rows.Next() {
+		var entry models.AuthAuditEntry
+		var details []byte
+		if err := rows.Scan(&entry.ID, &entry.UserID, &entry.EventType, &entry.IPAddress, &entry.UserAgent,
+			&entry.Success, &details, &entry.CreatedAt); err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to scan audit log entry", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		entry.Details = json.RawMessage(details)
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to read audit log", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	response := gin.H{"entries": entries}
+	if len(entries) == limit {
+		response["next_cursor"] = entries[len(entries)-1].ID
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// GetAuditLog lists the authenticated user's own auth events
+func (h *AuthHandler) GetAuditLog(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	respondWithAuditLog(h.db, c, userIDStr.(string))
+}
+
+// GetAuditLog lists auth events for all users
+func (h *AdminHandler) GetAuditLog(c *gin.Context) {
+	respondWithAuditLog(h.db, c, "")
+}
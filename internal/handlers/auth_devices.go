@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"skyport-server/internal/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// deviceFingerprint hashes the browser-identifying headers of a request
+func deviceFingerprint(r *http.Request) string {
+	sum := sha256.Sum256([]byte(
+		r.Header.Get("User-Agent") + "|" +
+			r.Header.Get("Accept-Language") + "|" +
+			r.Header.Get("Accept-Encoding"),
+	))
+	return hex.EncodeToString(sum[:])
+}
+
+// recordLoginSession stores the device used for a login and notifies the user about new devices.
+// A login counts as a new device when the user has logged in before but neither the
+// fingerprint nor the IP matches any earlier session.
+func (h *AuthHandler) recordLoginSession(user models.User, c *gin.Context) {
+	fingerprint := deviceFingerprint(c.Request)
+	ip := c.ClientIP()
+
+	var totalSessions, matchingSessions int
+	err := h.db.QueryRow(`
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE fingerprint = $2 OR ip = $3)
+		FROM login_sessions
+		WHERE user_id = $1
+	`, user.ID, fingerprint, ip).Scan(&totalSessions, &matchingSessions)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to check login history", "user_id", user.ID, "error", err)
+		return
+	}
+
+	isNewDevice := totalSessions > 0 && matchingSessions == 0
+
+	_, err = h.db.Exec(`
+		INSERT INTO login_sessions (user_id, fingerprint, ip, is_new_device)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, fingerprint, ip)
+		DO UPDATE SET last_seen = NOW(), count = login_sessions.count + 1
+	`, user.ID, fingerprint, ip, isNewDevice)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to record login session", "user_id", user.ID, "error", err)
+		return
+	}
+
+	if isNewDevice {
+		h.logger.InfoContext(c.Request.Context(), "New device login detected", "user_id", user.ID, "ip", ip)
+		go h.sendNewDeviceEmail(user, ip, c.Request.UserAgent())
+	}
+}
+
+func (h *AuthHandler) sendNewDeviceEmail(user models.User, ip, userAgent string) {
+	body := fmt.Sprintf(
+		"Hi %s,\n\nYour SkyPort account was just signed in to from a new device.\n\n"+
+			"Time: %s\nIP address: %s\nBrowser: %s\n\n"+
+			"If this was you, you can mark the device as trusted from your account settings.\n"+
+			"If not, change your password immediately.\n",
+		user.Name, time.Now().UTC().Format(time.RFC1123), ip, userAgent,
+	)
+	if err := h.mailer.Send(user.Email, "New sign-in to your SkyPort account", body); err != nil {
+		h.logger.Error("Failed to send new device email", "user_id", user.ID, "error", err)
+	}
+}
+
+// GetSessions lists the devices the user has logged in from
+func (h *AuthHandler) GetSessions(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT id, user_id, fingerprint, ip, first_seen, last_seen, count, is_new_device, is_trusted
+		FROM login_sessions
+		WHERE user_id = $1
+		ORDER BY last_seen DESC
+	`, userIDStr)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch login sessions", "user_id", userIDStr, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
+		return
+	}
+	defer rows.Close()
+
+	sessions := []models.LoginSession{}
+	for rows.Next() {
+		var session models.LoginSession
+		err := rows.Scan(
+			&session.ID, &session.UserID, &session.Fingerprint, &session.IP,
+			&session.FirstSeen, &session.LastSeen, &session.Count,
+			&session.IsNewDevice, &session.IsTrusted,
+		)
+		if err != nil {
+			h.logger.ErrorContext(c.Request.Context(), "Failed to scan login session", "user_id", userIDStr, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan session"})
+			return
+		}
+		sessions = append(sessions, session)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+// GetTrustedDevices lists the device fingerprints the user has marked as trusted
+func (h *AuthHandler) GetTrustedDevices(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT DISTINCT ON (fingerprint) fingerprint, ip, last_seen
+		FROM login_sessions
+		WHERE user_id = $1 AND is_trusted = true
+		ORDER BY fingerprint, last_seen DESC
+	`, userIDStr)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch trusted devices", "user_id", userIDStr, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch trusted devices"})
+		return
+	}
+	defer rows.Close()
+
+	devices := []models.TrustedDevice{}
+	for rows.Next() {
+		var device models.TrustedDevice
+		if err := rows.Scan(&device.Fingerprint, &device.LastIP, &device.LastSeen); err != nil {
+			h.logger.ErrorContext(c.Request.Context(), "Failed to scan trusted device", "user_id", userIDStr, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan trusted device"})
+			return
+		}
+		devices = append(devices, device)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"trusted_devices": devices})
+}
+
+// TrustDevice marks a fingerprint as trusted and clears its new-device flags
+func (h *AuthHandler) TrustDevice(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req models.TrustDeviceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := h.db.Exec(
+		"UPDATE login_sessions SET is_trusted = true, is_new_device = false WHERE user_id = $1 AND fingerprint = $2",
+		userIDStr, req.Fingerprint,
+	)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to trust device", "user_id", userIDStr, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to trust device"})
+		return
+	}
+
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Device trusted"})
+}
+
+// UntrustDevice removes a fingerprint from the trusted devices
+func (h *AuthHandler) UntrustDevice(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	fingerprint := c.Param("fingerprint")
+
+	result, err := h.db.Exec(
+		"UPDATE login_sessions SET is_trusted = false WHERE user_id = $1 AND fingerprint = $2 AND is_trusted = true",
+		userIDStr, fingerprint,
+	)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to untrust device", "user_id", userIDStr, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to untrust device"})
+		return
+	}
+
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Trusted device not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Device removed from trusted devices"})
+}
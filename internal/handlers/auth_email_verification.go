@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"skyport-server/internal/middleware"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// emailVerificationTTL is how long a verification link stays valid
+	emailVerificationTTL = 24 * time.Hour
+	// maxVerificationEmailsPerHour limits how often a user can have the link resent
+	maxVerificationEmailsPerHour = 3
+)
+
+// createEmailVerification stores a new verification token for the user and returns it.
+// It takes a querier so signup can create the token in the same transaction as the user.
+func createEmailVerification(db dbQuerier, userID string) (string, error) {
+	token, err := generateMagicLinkToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec(
+		"INSERT INTO email_verifications (token_hash, user_id, expires_at) VALUES ($1, $2, $3)",
+		hashMagicLinkToken(token), userID, time.Now().Add(emailVerificationTTL),
+	)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// VerifyEmail consumes a verification link and marks the user's email address as verified
+func (h *AuthHandler) VerifyEmail(c *gin.Context) {
+	token := c.Query("token")
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing token"})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to begin email verification transaction", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRow(
+		"DELETE FROM email_verifications WHERE token_hash = $1 AND expires_at > NOW() RETURNING user_id",
+		hashMagicLinkToken(token),
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification link"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to consume email verification", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE users SET is_email_verified = true, updated_at = NOW() WHERE id = $1", userID); err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to mark email verified", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+
+	// Links resent earlier are useless now
+	if _, err := tx.Exec("DELETE FROM email_verifications WHERE user_id = $1", userID); err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to delete email verifications", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to commit email verification", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+	middleware.InvalidateUserCache(userID)
+
+	recordAuthEvent(h.db, c, userID, auditEventEmailVerified, true, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified"})
+}
+
+// ResendVerification emails a new verification link to the signed-in user
+func (h *AuthHandler) ResendVerification(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	userID := userIDStr.(string)
+
+	var email string
+	var verified bool
+	var recentVerifications int
+	err := h.db.QueryRow(`
+		SELECT u.email, COALESCE(u.is_email_verified, false),
+			(SELECT COUNT(*) FROM email_verifications v WHERE v.user_id = u.id AND v.created_at > NOW() - INTERVAL '1 hour')
+		FROM users u
+		WHERE u.id = $1
+	`, userID).Scan(&email, &verified, &recentVerifications)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch user for email verification", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if verified {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email is already verified"})
+		return
+	}
+	if recentVerifications >= maxVerificationEmailsPerHour {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many verification emails requested, try again later"})
+		return
+	}
+
+	token, err := createEmailVerification(h.db, userID)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to create email verification", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification email"})
+		return
+	}
+
+	go h.sendVerificationEmail(email, token)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+}
+
+func (h *AuthHandler) sendVerificationEmail(email, token string) {
+	link := h.webAppURL + "/auth/verify-email?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf(
+		"Hi,\n\nConfirm your email address for SkyPort with the link below:\n\n%s\n\n"+
+			"You need a verified address to create tunnels. The link expires in %d hours.\n"+
+			"If you didn't create an account, you can ignore this email.\n",
+		link, int(emailVerificationTTL.Hours()),
+	)
+	if err := h.mailer.Send(email, "Verify your SkyPort email address", body); err != nil {
+		h.logger.Error("Failed to send verification email", "email", email, "error", err)
+	}
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// InspectToken decodes the bearer token and reports whether it is valid. The claims are
+// returned even for invalid tokens to help debug integrations; they are not secret.
+func (h *AuthHandler) InspectToken(c *gin.Context) {
+	authHeader := c.GetHeader("Authorization")
+	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+	if authHeader == "" || tokenString == authHeader {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Authorization: Bearer <token> header required"})
+		return
+	}
+
+	// Decode the claims first so they can be shown even if validation fails
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenString, claims); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"valid": false, "error": "Malformed token"})
+		return
+	}
+
+	response := gin.H{
+		"valid":  true,
+		"claims": claims,
+		"type":   claims["type"],
+	}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		response["expires_at"] = exp.Time.UTC().Format(time.RFC3339)
+	}
+
+	// Then check the signature and expiry the same way AuthMiddleware does
+	_, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return []byte(h.jwtSecret), nil
+	})
+	if err != nil {
+		response["valid"] = false
+		response["error"] = inspectError(err)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// inspectError turns a jwt validation error into a short explanation
+func inspectError(err error) string {
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return "Token is expired"
+	case errors.Is(err, jwt.ErrTokenNotValidYet):
+		return "Token is not valid yet"
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrSignatureInvalid):
+		return "Token signature is invalid"
+	default:
+		return "Token is invalid"
+	}
+}
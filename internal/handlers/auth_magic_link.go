@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"skyport-server/internal/config"
+	"skyport-server/internal/middleware"
+	"skyport-server/internal/models"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// magicLinkTTL is how long a sign-in link stays valid
+	magicLinkTTL = 15 * time.Minute
+	// maxMagicLinksPerHour limits how many links can be sent to one address
+	maxMagicLinksPerHour = 3
+)
+
+// RequestMagicLink emails a single-use sign-in link. The response is the same whether or
+// not an account exists so the endpoint can't be used to discover registered addresses.
+func (h *AuthHandler) RequestMagicLink(c *gin.Context) {
+	var req models.MagicLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+
+	var recentLinks int
+	err := h.db.QueryRow(
+		"SELECT COUNT(*) FROM magic_link_tokens WHERE email = $1 AND created_at > NOW() - INTERVAL '1 hour'",
+		email,
+	).Scan(&recentLinks)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to count magic links", "email", email, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if recentLinks >= maxMagicLinksPerHour {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many sign-in links requested, try again later"})
+		return
+	}
+
+	// Invite-only servers don't create accounts through magic links
+	if h.inviteOnly {
+		var userExists bool
+		err := h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(email) = $1)", email).Scan(&userExists)
+		if err != nil {
+			h.logger.ErrorContext(c.Request.Context(), "Failed to check user existence", "email", email, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if !userExists {
+			c.JSON(http.StatusOK, gin.H{"message": "Check your email for a sign-in link"})
+			return
+		}
+	}
+
+	token, err := generateMagicLinkToken()
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to generate magic link token", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate sign-in link"})
+		return
+	}
+
+	// Only the hash is stored, a database leak doesn't expose usable links
+	_, err = h.db.Exec(
+		"INSERT INTO magic_link_tokens (token_hash, email, expires_at) VALUES ($1, $2, $3)",
+		hashMagicLinkToken(token), email, time.Now().Add(magicLinkTTL),
+	)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to store magic link", "email", email, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	go h.sendMagicLinkEmail(email, token)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Check your email for a sign-in link"})
+}
+
+// VerifyMagicLink consumes a sign-in link and returns tokens, creating the account if the
+// address is new. Following the link proves ownership of the address, so it is marked verified.
+func (h *AuthHandler) VerifyMagicLink(c *gin.Context) {
+	token := c.Query("token")
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing token"})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to begin magic link transaction", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var email string
+	err = tx.QueryRow(`
+		UPDATE magic_link_tokens SET used = true
+		WHERE token_hash = $1 AND used = false AND expires_at > NOW()
+		RETURNING email
+	`, hashMagicLinkToken(token)).Scan(&email)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired sign-in link"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to consume magic link", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var user models.User
+	var totpEnabled bool
+	err = tx.QueryRow(`
+		UPDATE users SET is_email_verified = true, updated_at = NOW()
+		WHERE LOWER(email) = $1
+		RETURNING id, email, name, created_at, updated_at, totp_secret IS NOT NULL
+	`, email).Scan(&user.ID, &user.Email, &user.Name, &user.CreatedAt, &user.UpdatedAt, &totpEnabled)
+	if err == sql.ErrNoRows {
+		if h.inviteOnly {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Signup requires an invite code"})
+			return
+		}
+		if !config.IsEmailDomainAllowed(email, h.allowedEmailDomains) {
+			c.JSON(http.StatusForbidden, gin.H{"error": config.EmailDomainRestrictionMessage(h.allowedEmailDomains)})
+			return
+		}
+
+		// Passwordless accounts get an empty hash, which never matches in Login
+		err = tx.QueryRow(`
+			INSERT INTO users (id, email, password_hash, name, is_email_verified)
+			VALUES ($1, $2, '', $3, true)
+			RETURNING id, email, name, created_at, updated_at
+		`, uuid.New(), email, nameFromEmail(email)).Scan(&user.ID, &user.Email, &user.Name, &user.CreatedAt, &user.UpdatedAt)
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to upsert user for magic link", "email", email, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to commit magic link sign-in", "email", email, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	middleware.InvalidateUserCache(user.ID.String())
+
+	// The link replaces the password, not the second factor
+	if totpEnabled {
+		h.respondRequires2FA(c, user.ID.String())
+		return
+	}
+
+	h.recordLoginSession(user, c)
+	recordAuthEvent(h.db, c, user.ID.String(), auditEventMagicLinkLogin, true, nil)
+
+	// Generate tokens
+	accessToken, refreshToken, err := h.generateTokens(user.ID.String())
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to generate tokens", "user_id", user.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tokens"})
+		return
+	}
+
+	// Save refresh token
+	err = h.saveRefreshToken(user.ID, refreshToken)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to save refresh token", "user_id", user.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save refresh token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.AuthResponse{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		User:         user,
+	})
+}
+
+func (h *AuthHandler) sendMagicLinkEmail(email, token string) {
+	link := h.webAppURL + "/auth/magic-link?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf(
+		"Hi,\n\nUse the link below to sign in to SkyPort:\n\n%s\n\n"+
+			"The link expires in %d minutes and can only be used once.\n"+
+			"If you didn't request it, you can ignore this email.\n",
+		link, int(magicLinkTTL.Minutes()),
+	)
+	if err := h.mailer.Send(email, "Your SkyPort sign-in link", body); err != nil {
+		h.logger.Error("Failed to send magic link email", "email", email, "error", err)
+	}
+}
+
+// generateMagicLinkToken returns 32 random bytes, hex encoded
+func generateMagicLinkToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// hashMagicLinkToken is the value stored in magic_link_tokens.token_hash
+func hashMagicLinkToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// nameFromEmail derives a display name for accounts created without a signup form
+func nameFromEmail(email string) string {
+	if at := strings.Index(email, "@"); at > 0 {
+		return email[:at]
+	}
+	return email
+}
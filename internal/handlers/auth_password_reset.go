@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"skyport-server/internal/middleware"
+	"skyport-server/internal/models"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// passwordResetTTL is how long a reset link stays valid
+	passwordResetTTL = time.Hour
+	// maxPasswordResetsPerHour limits how many reset emails one account receives
+	maxPasswordResetsPerHour = 3
+)
+
+// ForgotPassword emails a single-use password reset link. Like RequestMagicLink the response
+// doesn't depend on whether the account exists, so it can't reveal registered addresses.
+func (h *AuthHandler) ForgotPassword(c *gin.Context) {
+	var req models.ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	response := gin.H{"message": "If an account exists for this email, a password reset link has been sent"}
+
+	var userID string
+	var recentResets int
+	err := h.db.QueryRow(`
+		SELECT u.id, (SELECT COUNT(*) FROM password_resets r WHERE r.user_id = u.id AND r.created_at > NOW() - INTERVAL '1 hour')
+		FROM users u
+		WHERE LOWER(u.email) = $1
+	`, email).Scan(&userID, &recentResets)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch user for password reset", "email", email, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// A rate limit error would only ever be returned for registered addresses, so further
+	// requests are dropped silently instead
+	if recentResets >= maxPasswordResetsPerHour {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	token, err := generateMagicLinkToken()
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to generate password reset token", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate reset link"})
+		return
+	}
+
+	// Only the hash is stored, a database leak doesn't expose usable links
+	_, err = h.db.Exec(
+		"INSERT INTO password_resets (token_hash, user_id, expires_at) VALUES ($1, $2, $3)",
+		hashMagicLinkToken(token), userID, time.Now().Add(passwordResetTTL),
+	)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to store password reset", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	go h.sendPasswordResetEmail(email, token)
+
+	c.JSON(http.StatusOK, response)
+}
+
+// ResetPassword consumes a reset link and sets a new password. Every refresh token of the
+// user is revoked and password_changed_at makes AuthMiddleware reject older access tokens.
+func (h *AuthHandler) ResetPassword(c *gin.Context) {
+	var req models.ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to begin password reset transaction", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRow(
+		"DELETE FROM password_resets WHERE token_hash = $1 AND expires_at > NOW() RETURNING user_id",
+		hashMagicLinkToken(req.Token),
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset link"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to consume password reset", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// Hashing is slow on purpose, only a valid token gets that far
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to hash password", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	_, err = tx.Exec(
+		"UPDATE users SET password_hash = $1, password_changed_at = NOW(), updated_at = NOW() WHERE id = $2",
+		string(hashedPassword), userID,
+	)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to update password", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	if _, err := tx.Exec("DELETE FROM refresh_tokens WHERE user_id = $1", userID); err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to revoke refresh tokens", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	// Other links sent before this one shouldn't be able to change the password again
+	if _, err := tx.Exec("DELETE FROM password_resets WHERE user_id = $1", userID); err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to delete password resets", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to commit password reset", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+	middleware.InvalidateUserCache(userID)
+
+	recordAuthEvent(h.db, c, userID, auditEventPasswordReset, true, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password has been reset, sign in with the new password"})
+}
+
+func (h *AuthHandler) sendPasswordResetEmail(email, token string) {
+	link := h.webAppURL + "/auth/reset-password?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf(
+		"Hi,\n\nUse the link below to choose a new SkyPort password:\n\n%s\n\n"+
+			"The link expires in %d minutes and can only be used once.\n"+
+			"If you didn't request it, you can ignore this email and your password stays the same.\n",
+		link, int(passwordResetTTL.Minutes()),
+	)
+	if err := h.mailer.Send(email, "Reset your SkyPort password", body); err != nil {
+		h.logger.Error("Failed to send password reset email", "email", email, "error", err)
+	}
+}
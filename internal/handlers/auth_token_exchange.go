@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"skyport-server/internal/middleware"
+	"skyport-server/internal/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// tunnelAccessTokenTTL is how long an exchanged tunnel access token stays valid
+const tunnelAccessTokenTTL = 15 * time.Minute
+
+// ExchangeToken trades an agent token for a short-lived bearer token that only grants access
+// to one tunnel, so services behind tunnels can call each other without a human login.
+// The caller must own the target tunnel.
+func (h *AuthHandler) ExchangeToken(c *gin.Context) {
+	var req models.TokenExchangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, err := jwt.Parse(req.AgentToken, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return []byte(h.jwtSecret), nil
+	})
+	if err != nil || !token.Valid {
+		recordAuthEvent(h.db, c, "", auditEventTokenExchange, false, gin.H{"reason": "invalid_token"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		return
+	}
+
+	// Only agent service tokens can be exchanged, browser sessions have their own flow
+	if tokenType, _ := claims["type"].(string); tokenType != "agent" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Agent token required"})
+		return
+	}
+
+	userIDStr, ok := claims["user_id"].(string)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in token"})
+		return
+	}
+
+	// The same checks as AuthMiddleware: deleted users and tokens from before a password
+	// change or reset can't mint new tokens
+	_, err = middleware.LoadTokenUser(h.db, userIDStr, claims)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User no longer exists"})
+		return
+	}
+	if errors.Is(err, middleware.ErrTokenRevoked) {
+		recordAuthEvent(h.db, c, userIDStr, auditEventTokenExchange, false, gin.H{"reason": "token_revoked"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Token was revoked by a password change, log in again"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to load user for token exchange", "user_id", userIDStr, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var ownerID string
+	err = h.db.QueryRow("SELECT user_id FROM tunnels WHERE id = $1", req.TunnelID).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch tunnel for token exchange", "tunnel_id", req.TunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if ownerID != userIDStr {
+		recordAuthEvent(h.db, c, userIDStr, auditEventTokenExchange, false, gin.H{"reason": "not_owner", "tunnel_id": req.TunnelID})
+		c.JSON(http.StatusForbidden, gin.H{"error": "Tunnel does not belong to user"})
+		return
+	}
+
+	// The token deliberately has no user_id claim, so AuthMiddleware rejects it everywhere
+	// except endpoints guarded by TunnelAccessMiddleware
+	expiresAt := time.Now().Add(tunnelAccessTokenTTL)
+	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":       userIDStr,
+		"tunnel_id": req.TunnelID,
+		"exp":       expiresAt.Unix(),
+		"iat":       time.Now().Unix(),
+		"type":      "tunnel_access",
+	})
+
+	tokenString, err := accessToken.SignedString([]byte(h.jwtSecret))
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to generate tunnel access token", "user_id", userIDStr, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	recordAuthEvent(h.db, c, userIDStr, auditEventTokenExchange, true, gin.H{"tunnel_id": req.TunnelID})
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":      tokenString,
+		"token_type": "Bearer",
+		"expires_at": expiresAt,
+		"tunnel_id":  req.TunnelID,
+	})
+}
@@ -0,0 +1,427 @@
+package handlers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"skyport-server/internal/middleware"
+	"skyport-server/internal/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	// partialTokenTTL is how long a user has to enter their TOTP code after the password
+	partialTokenTTL = 5 * time.Minute
+	// totpIssuer is the account label shown in authenticator apps
+	totpIssuer = "SkyPort"
+	// totpPeriod is the length of a TOTP time step in seconds
+	totpPeriod = 30
+	// maxTOTPFailures wrong codes in a row lock code checks for totpLockout. The count is per
+	// user, a fresh partial token from Login doesn't reset it.
+	maxTOTPFailures = 5
+	totpLockout     = 15 * time.Minute
+)
+
+// errTOTPLocked is returned by checkTOTPCode while a user is locked out
+var errTOTPLocked = errors.New("too many invalid two-factor codes")
+
+// totpKey derives the key TOTP secrets are encrypted with. TOTP needs the secret itself to
+// check codes, so it is encrypted rather than hashed; changing JWT_SECRET means users have
+// to set up 2FA again.
+func (h *AuthHandler) totpKey() []byte {
+	key := sha256.Sum256([]byte("skyport-totp:" + h.jwtSecret))
+	return key[:]
+}
+
+// encryptTOTPSecret seals a TOTP secret with AES-GCM for storage
+func (h *AuthHandler) encryptTOTPSecret(secret string) (string, error) {
+	block, err := aes.NewCipher(h.totpKey())
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(secret), nil)), nil
+}
+
+// decryptTOTPSecret opens a secret sealed by encryptTOTPSecret
+func (h *AuthHandler) decryptTOTPSecret(sealed string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(h.totpKey())
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("sealed TOTP secret too short")
+	}
+	secret, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+// matchTOTPStep returns the time step a code was generated for, allowing one step of clock
+// skew either way, or -1 when it matches none of them
+func matchTOTPStep(secret, code string, now time.Time) (int64, error) {
+	current := now.Unix() / totpPeriod
+	for step := current - 1; step <= current+1; step++ {
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			return -1, err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+	return -1, nil
+}
+
+// checkTOTPCode checks a code against a user's sealed secret. Wrong codes count towards the
+// lockout and an accepted code's time step is recorded, so every code works only once.
+// It returns errTOTPLocked while the user is locked out.
+func (h *AuthHandler) checkTOTPCode(userID, sealed, code string) (bool, error) {
+	var locked bool
+	err := h.db.QueryRow(
+		"SELECT COALESCE(totp_locked_until > NOW(), false) FROM users WHERE id = $1",
+		userID,
+	).Scan(&locked)
+	if err != nil {
+		return false, err
+	}
+	if locked {
+		return false, errTOTPLocked
+	}
+
+	secret, err := h.decryptTOTPSecret(sealed)
+	if err != nil {
+		return false, err
+	}
+	step, err := matchTOTPStep(secret, code, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	if step < 0 {
+		_, err := h.db.Exec(`
+			UPDATE users SET
+				totp_failed_attempts = CASE WHEN totp_failed_attempts + 1 >= $2 THEN 0 ELSE totp_failed_attempts + 1 END,
+				totp_locked_until = CASE WHEN totp_failed_attempts + 1 >= $2 THEN $3 ELSE totp_locked_until END
+			WHERE id = $1
+		`, userID, maxTOTPFailures, time.Now().Add(totpLockout))
+		return false, err
+	}
+
+	// The step only moves forward, a code that was already used (or an older one) is refused
+	result, err := h.db.Exec(`
+		UPDATE users SET totp_last_step = $2, totp_failed_attempts = 0
+		WHERE id = $1 AND (totp_last_step IS NULL OR totp_last_step < $2)
+			AND (totp_locked_until IS NULL OR totp_locked_until <= NOW())
+	`, userID, step)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// respondTOTPCheckError answers a failed checkTOTPCode
+func (h *AuthHandler) respondTOTPCheckError(c *gin.Context, userID string, err error) {
+	if errors.Is(err, errTOTPLocked) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many invalid codes, try again later"})
+		return
+	}
+	h.logger.ErrorContext(c.Request.Context(), "Failed to check TOTP code", "user_id", userID, "error", err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+}
+
+// generatePartialToken creates the token that proves a correct password while the TOTP code
+// is still missing. AuthMiddleware and AgentAuth refuse it.
+func (h *AuthHandler) generatePartialToken(userID string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": userID,
+		"exp":     time.Now().Add(partialTokenTTL).Unix(),
+		"iat":     time.Now().Unix(),
+		"type":    middleware.PartialTokenType,
+	})
+	return token.SignedString([]byte(h.jwtSecret))
+}
+
+// respondRequires2FA answers a correct first factor for a user with 2FA enabled
+func (h *AuthHandler) respondRequires2FA(c *gin.Context, userID string) {
+	partialToken, err := h.generatePartialToken(userID)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to generate partial token", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tokens"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"requires_2fa": true, "partial_token": partialToken})
+}
+
+// SetupTOTP starts 2FA enrollment. The returned secret (and otpauth:// URI for a QR code)
+// only takes effect once a code from it is confirmed with VerifyTOTP.
+func (h *AuthHandler) SetupTOTP(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var email string
+	var enabled bool
+	err := h.db.QueryRow("SELECT email, totp_secret IS NOT NULL FROM users WHERE id = $1", userIDStr).Scan(&email, &enabled)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch user for 2FA setup", "user_id", userIDStr, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: email})
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to generate TOTP secret", "user_id", userIDStr, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set up two-factor authentication"})
+		return
+	}
+	sealed, err := h.encryptTOTPSecret(key.Secret())
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to encrypt TOTP secret", "user_id", userIDStr, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set up two-factor authentication"})
+		return
+	}
+
+	if _, err := h.db.Exec("UPDATE users SET totp_pending_secret = $1 WHERE id = $2", sealed, userIDStr); err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to store pending TOTP secret", "user_id", userIDStr, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"secret": key.Secret(), "otpauth_uri": key.URL()})
+}
+
+// VerifyTOTP enables 2FA once the user proves their authenticator has the pending secret
+func (h *AuthHandler) VerifyTOTP(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req models.TOTPCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var pending sql.NullString
+	err := h.db.QueryRow("SELECT totp_pending_secret FROM users WHERE id = $1", userIDStr).Scan(&pending)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch pending TOTP secret", "user_id", userIDStr, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !pending.Valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Start two-factor setup first"})
+		return
+	}
+
+	valid, err := h.checkTOTPCode(userIDStr.(string), pending.String, req.Code)
+	if err != nil {
+		h.respondTOTPCheckError(c, userIDStr.(string), err)
+		return
+	}
+	if !valid {
+		recordAuthEvent(h.db, c, userIDStr.(string), auditEventTOTPEnabled, false, gin.H{"reason": "invalid_code"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	_, err = h.db.Exec(
+		"UPDATE users SET totp_secret = totp_pending_secret, totp_pending_secret = NULL, updated_at = NOW() WHERE id = $1",
+		userIDStr,
+	)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to enable 2FA", "user_id", userIDStr, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	recordAuthEvent(h.db, c, userIDStr.(string), auditEventTOTPEnabled, true, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication enabled"})
+}
+
+// DisableTOTP turns 2FA off, a current code is required so a stolen session can't do it
+func (h *AuthHandler) DisableTOTP(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req models.TOTPCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var sealed sql.NullString
+	err := h.db.QueryRow("SELECT totp_secret FROM users WHERE id = $1", userIDStr).Scan(&sealed)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch TOTP secret", "user_id", userIDStr, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !sealed.Valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	valid, err := h.checkTOTPCode(userIDStr.(string), sealed.String, req.Code)
+	if err != nil {
+		h.respondTOTPCheckError(c, userIDStr.(string), err)
+		return
+	}
+	if !valid {
+		recordAuthEvent(h.db, c, userIDStr.(string), auditEventTOTPDisabled, false, gin.H{"reason": "invalid_code"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	_, err = h.db.Exec(
+		"UPDATE users SET totp_secret = NULL, totp_pending_secret = NULL, updated_at = NOW() WHERE id = $1",
+		userIDStr,
+	)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to disable 2FA", "user_id", userIDStr, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	recordAuthEvent(h.db, c, userIDStr.(string), auditEventTOTPDisabled, true, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// AuthenticateTOTP completes a login that returned requires_2fa, trading the partial token
+// and a current code for access and refresh tokens
+func (h *AuthHandler) AuthenticateTOTP(c *gin.Context) {
+	var req models.TOTPAuthenticateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, err := jwt.Parse(req.PartialToken, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return []byte(h.jwtSecret), nil
+	})
+	if err != nil || !token.Valid {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired partial token"})
+		return
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		return
+	}
+	if tokenType, _ := claims["type"].(string); tokenType != middleware.PartialTokenType {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Partial token required"})
+		return
+	}
+	userIDStr, ok := claims["user_id"].(string)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in token"})
+		return
+	}
+
+	var user models.User
+	var sealed sql.NullString
+	err = h.db.QueryRow(
+		"SELECT id, email, name, created_at, updated_at, totp_secret FROM users WHERE id = $1",
+		userIDStr,
+	).Scan(&user.ID, &user.Email, &user.Name, &user.CreatedAt, &user.UpdatedAt, &sealed)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch user for 2FA login", "user_id", userIDStr, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !sealed.Valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	valid, err := h.checkTOTPCode(userIDStr, sealed.String, req.Code)
+	if err != nil {
+		h.respondTOTPCheckError(c, userIDStr, err)
+		return
+	}
+	if !valid {
+		recordAuthEvent(h.db, c, userIDStr, auditEventLogin, false, gin.H{"reason": "invalid_totp_code"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	h.recordLoginSession(user, c)
+
+	accessToken, refreshToken, err := h.generateTokens(userIDStr)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to generate tokens", "user_id", userIDStr, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tokens"})
+		return
+	}
+
+	err = h.saveRefreshToken(user.ID, refreshToken)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to save refresh token", "user_id", userIDStr, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save refresh token"})
+		return
+	}
+
+	recordAuthEvent(h.db, c, userIDStr, auditEventLogin, true, gin.H{"two_factor": true})
+
+	c.JSON(http.StatusOK, models.AuthResponse{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		User:         user,
+	})
+}
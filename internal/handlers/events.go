@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// eventHistorySize is how many recent events are kept per user for Last-Event-ID resumption
+	eventHistorySize = 100
+	// eventSubscriberBuffer is how many events a slow SSE subscriber may fall behind before events are dropped
+	eventSubscriberBuffer = 64
+	// eventKeepAliveInterval sends an SSE comment so idle streams aren't closed by proxies
+	eventKeepAliveInterval = 30 * time.Second
+)
+
+// Event is a tunnel event delivered on GET /api/v1/events
+type Event struct {
+	ID        int64  `json:"id"`
+	Type      string `json:"type"`
+	TunnelID  string `json:"tunnel_id"`
+	Data      gin.H  `json:"data,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// eventBus fans tunnel events out to the SSE subscribers of the tunnel's owner. Event IDs
+// increase across all users, so a reconnecting client resumes after its Last-Event-ID.
+type eventBus struct {
+	mutex       sync.Mutex
+	nextID      int64
+	history     map[string][]Event
+	subscribers map[string]map[chan Event]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		history:     make(map[string][]Event),
+		subscribers: make(map[string]map[chan Event]struct{}),
+	}
+}
+
+func (b *eventBus) publish(userID, tunnelID, eventType string, data gin.H) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.nextID++
+	event := Event{
+		ID:        b.nextID,
+		Type:      eventType,
+		TunnelID:  tunnelID,
+		Data:      data,
+		Timestamp: time.Now().Unix(),
+	}
+
+	history := append(b.history[userID], event)
+	if len(history) > eventHistorySize {
+		history = history[len(history)-eventHistorySize:]
+	}
+	b.history[userID] = history
+
+	for subscriber := range b.subscribers[userID] {
+		select {
+		case subscriber <- event:
+		default:
+			// Never block the tunnel on a slow dashboard
+		}
+	}
+}
+
+// subscribe registers a subscriber for a user's events and returns the buffered events
+// newer than lastEventID
+func (b *eventBus) subscribe(userID string, lastEventID int64) (chan Event, []Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var missed []Event
+	if lastEventID > 0 {
+		for _, event := range b.history[userID] {
+			if event.ID > lastEventID {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	subscriber := make(chan Event, eventSubscriberBuffer)
+	if b.subscribers[userID] == nil {
+		b.subscribers[userID] = make(map[chan Event]struct{})
+	}
+	b.subscribers[userID][subscriber] = struct{}{}
+	return subscriber, missed
+}
+
+func (b *eventBus) unsubscribe(userID string, subscriber chan Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.subscribers[userID], subscriber)
+	if len(b.subscribers[userID]) == 0 {
+		delete(b.subscribers, userID)
+	}
+}
+
+// publishEvent reports an event for this tunnel, if the tunnel handler attached a publisher
+func (tp *TunnelProtocol) publishEvent(eventType string, data gin.H) {
+	if tp.events != nil {
+		tp.events(eventType, data)
+	}
+}
+
+// TunnelStatusEvent is a tunnel status change delivered on GET /api/v1/tunnels/events
+type TunnelStatusEvent struct {
+	TunnelID  string `json:"tunnel_id"`
+	Status    string `json:"status"`
+	Timestamp string `json:"timestamp"`
+}
+
+// tunnelStatuses maps the events that change a tunnel's status to the status. A heartbeat
+// timeout closes the connection, so it arrives as tunnel.disconnected.
+var tunnelStatuses = map[string]string{
+	"tunnel.connected":    "active",
+	"tunnel.disconnected": "inactive",
+}
+
+// StreamEvents is a Server-Sent Events feed of the user's tunnel events: tunnel.connected,
+// tunnel.disconnected, tunnel.request, tunnel.threshold_exceeded and tunnel.error.
+// Clients that reconnect with Last-Event-ID receive the events they missed.
+func (h *TunnelHandler) StreamEvents(c *gin.Context) {
+	h.streamEvents(c, writeEvent)
+}
+
+// StreamTunnelStatus is a Server-Sent Events feed of the user's tunnels becoming active or
+// inactive, so the dashboard doesn't have to poll GET /tunnels. It is fed by the in-process
+// event bus: in multi-instance deployments it only sees agents connected to this instance.
+func (h *TunnelHandler) StreamTunnelStatus(c *gin.Context) {
+	h.streamEvents(c, func(w http.ResponseWriter, event Event) {
+		status, changed := tunnelStatuses[event.Type]
+		if !changed {
+			return
+		}
+		data, err := json.Marshal(TunnelStatusEvent{
+			TunnelID:  event.TunnelID,
+			Status:    status,
+			Timestamp: time.Unix(event.Timestamp, 0).UTC().Format(time.RFC3339),
+		})
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "id: %d\ndata: %s\n\n", event.ID, data)
+	})
+}
+
+// streamEvents serves the user's events as Server-Sent Events, write formats each one.
+// Clients that reconnect with Last-Event-ID receive the events they missed.
+func (h *TunnelHandler) streamEvents(c *gin.Context, write func(w http.ResponseWriter, event Event)) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	userID := userIDStr.(string)
+
+	var lastEventID int64
+	if value := c.GetHeader("Last-Event-ID"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Last-Event-ID"})
+			return
+		}
+		lastEventID = parsed
+	}
+
+	subscriber, missed := h.events.subscribe(userID, lastEventID)
+	defer h.events.unsubscribe(userID, subscriber)
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	for _, event := range missed {
+		write(c.Writer, event)
+	}
+	c.Writer.Flush()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event := <-subscriber:
+			write(c.Writer, event)
+		case <-keepAlive.C:
+			fmt.Fprint(c.Writer, ": keep-alive\n\n")
+		}
+		c.Writer.Flush()
+	}
+}
+
+// writeEvent writes one event in SSE format with its ID for Last-Event-ID
+func writeEvent(w http.ResponseWriter, event Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// instanceCookieName remembers which instance served a visitor of a sticky session tunnel
+	instanceCookieName = "X-Skyport-Instance"
+	// instanceForwardedHeader marks requests forwarded by another instance so they are never forwarded again
+	instanceForwardedHeader = "X-Skyport-Forwarded-By"
+	// instanceSecretHeader carries SKYPORT_INSTANCE_SECRET on forwarded requests
+	instanceSecretHeader = "X-Skyport-Instance-Secret"
+	// instanceClientIPHeader carries the client IP the forwarding instance resolved
+	instanceClientIPHeader = "X-Skyport-Client-IP"
+)
+
+// peerForwardedClientIP returns the client IP of a request another instance forwarded after
+// running the tunnel's access checks. The forwarding headers are removed either way, so they
+// never reach the local service and visitors can't use them to skip the checks.
+func (h *ProxyHandler) peerForwardedClientIP(c *gin.Context) (string, bool) {
+	secret := c.GetHeader(instanceSecretHeader)
+	clientIP := c.GetHeader(instanceClientIPHeader)
+	c.Request.Header.Del(instanceSecretHeader)
+	c.Request.Header.Del(instanceClientIPHeader)
+
+	if h.config.InstanceSecret == "" || c.GetHeader(instanceForwardedHeader) == "" ||
+		subtle.ConstantTimeCompare([]byte(secret), []byte(h.config.InstanceSecret)) != 1 ||
+		net.ParseIP(clientIP) == nil {
+		return "", false
+	}
+	return clientIP, true
+}
+
+// forwardToInstance proxies a request for a tunnel whose agent is connected to another instance.
+// The instance recorded when the agent connected wins, the visitor's cookie is only used when
+// the tunnel has no recorded instance. Returns false when there is nowhere to forward to.
+func (h *ProxyHandler) forwardToInstance(c *gin.Context, subdomain, connectedInstance string) bool {
+	// A request another instance already forwarded stops here, even if the instances disagree
+	if c.GetHeader(instanceForwardedHeader) != "" {
+		return false
+	}
+
+	instanceID := connectedInstance
+	if instanceID == "" {
+		instanceID, _ = c.Cookie(instanceCookieName)
+	}
+	if instanceID == "" || instanceID == h.config.InstanceID {
+		return false
+	}
+
+	peerURL, known := h.config.InstancePeers[instanceID]
+	if !known {
+		h.logger.WarnContext(c.Request.Context(), "Tunnel is connected to an unknown instance", "subdomain", subdomain, "instance_id", instanceID)
+		return false
+	}
+	target, err := url.Parse(peerURL)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Invalid instance URL", "instance_id", instanceID, "error", err)
+		return false
+	}
+
+	clientIP := c.ClientIP()
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			// The peer routes by the tunnel's subdomain, not its own address
+			pr.Out.Host = pr.In.Host
+			pr.SetXForwarded()
+			pr.Out.Header.Set(instanceForwardedHeader, h.config.InstanceID)
+			// The access checks ran here, the peer trusts them and the client IP through the secret
+			pr.Out.Header.Set(instanceSecretHeader, h.config.InstanceSecret)
+			pr.Out.Header.Set(instanceClientIPHeader, clientIP)
+		},
+		// Flush immediately so event streams and chunked responses aren't held back
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			h.logger.ErrorContext(r.Context(), "Forwarding to instance failed", "subdomain", subdomain, "instance_id", instanceID, "error", err)
+			http.Error(w, "Failed to reach tunnel instance", http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(c.Writer, c.Request)
+	return true
+}
+
+// forwardControlToOwner hands an API request that acts on a tunnel's agent, like stopping or
+// reloading it, to the instance holding the agent's connection. That instance handles the
+// whole request and checks the user's token again. Returns false when this instance should
+// handle it: the agent is connected here or nowhere, or the request was already forwarded.
+func (h *TunnelHandler) forwardControlToOwner(c *gin.Context, tunnelID string) bool {
+	if c.GetHeader(instanceForwardedHeader) != "" {
+		return false
+	}
+	if _, exists := h.GetActiveTunnel(tunnelID); exists {
+		return false
+	}
+
+	record, registered, err := h.tunnelStore.Get(c.Request.Context(), tunnelID)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to look up tunnel in tunnel store", "tunnel_id", tunnelID, "error", err)
+		return false
+	}
+	if !registered || record.ServerID == h.config.InstanceID {
+		return false
+	}
+
+	peerURL, known := h.config.InstancePeers[record.ServerID]
+	if !known {
+		h.logger.WarnContext(c.Request.Context(), "Tunnel is connected to an unknown instance", "tunnel_id", tunnelID, "instance_id", record.ServerID)
+		return false
+	}
+	target, err := url.Parse(peerURL)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Invalid instance URL", "instance_id", record.ServerID, "error", err)
+		return false
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.Host = pr.In.Host
+			pr.SetXForwarded()
+			pr.Out.Header.Set(instanceForwardedHeader, h.config.InstanceID)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			h.logger.ErrorContext(r.Context(), "Forwarding to instance failed", "tunnel_id", tunnelID, "instance_id", record.ServerID, "error", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to reach tunnel instance"})
+		},
+	}
+	proxy.ServeHTTP(c.Writer, c.Request)
+	return true
+}
+
+// setInstanceCookie pins the visitor to this instance, unless the cookie already says so
+func (h *ProxyHandler) setInstanceCookie(c *gin.Context) {
+	if current, err := c.Cookie(instanceCookieName); err == nil && current == h.config.InstanceID {
+		return
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     instanceCookieName,
+		Value:    h.config.InstanceID,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
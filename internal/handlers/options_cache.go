@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxOptionsCacheEntries caps cached preflight responses per tunnel
+	maxOptionsCacheEntries = 256
+	// maxOptionsCacheAge caps Access-Control-Max-Age; browsers don't honour more than a day either
+	maxOptionsCacheAge = 24 * time.Hour
+)
+
+type optionsCacheEntry struct {
+	response  *TunnelMessage
+	expiresAt time.Time
+}
+
+// optionsCache holds preflight responses from the local service for as long as their
+// Access-Control-Max-Age allows
+type optionsCache struct {
+	mutex   sync.Mutex
+	entries map[string]optionsCacheEntry
+}
+
+// optionsCacheKey identifies a preflight by host (subdomain), origin and path. The requested
+// method and headers are included as well since the local service may answer them differently.
+func optionsCacheKey(r *http.Request) string {
+	return strings.Join([]string{
+		r.Host,
+		r.Header.Get("Origin"),
+		r.URL.Path,
+		r.Header.Get("Access-Control-Request-Method"),
+		r.Header.Get("Access-Control-Request-Headers"),
+	}, "\x00")
+}
+
+func (oc *optionsCache) get(key string) (*TunnelMessage, bool) {
+	oc.mutex.Lock()
+	defer oc.mutex.Unlock()
+
+	entry, exists := oc.entries[key]
+	if !exists {
+		return nil, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(oc.entries, key)
+		return nil, false
+	}
+	return entry.response, true
+}
+
+// store caches a response if it is a successful preflight carrying Access-Control-Max-Age
+func (oc *optionsCache) store(key string, response *TunnelMessage) {
+	if response == nil || response.Error != "" || response.Status < 200 || response.Status >= 300 {
+		return
+	}
+	maxAge, err := strconv.Atoi(headerValue(response.Headers, "Access-Control-Max-Age"))
+	if err != nil || maxAge <= 0 {
+		return
+	}
+	ttl := time.Duration(maxAge) * time.Second
+	if ttl > maxOptionsCacheAge {
+		ttl = maxOptionsCacheAge
+	}
+
+	oc.mutex.Lock()
+	defer oc.mutex.Unlock()
+
+	if oc.entries == nil {
+		oc.entries = make(map[string]optionsCacheEntry)
+	}
+
+	// Make room by dropping expired entries; if the cache is still full, skip caching
+	if len(oc.entries) >= maxOptionsCacheEntries {
+		now := time.Now()
+		for existingKey, entry := range oc.entries {
+			if now.After(entry.expiresAt) {
+				delete(oc.entries, existingKey)
+			}
+		}
+		if len(oc.entries) >= maxOptionsCacheEntries {
+			return
+		}
+	}
+
+	oc.entries[key] = optionsCacheEntry{response: response, expiresAt: time.Now().Add(ttl)}
+}
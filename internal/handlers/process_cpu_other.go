@@ -0,0 +1,10 @@
+//go:build !unix
+
+package handlers
+
+import "time"
+
+// processCPUTime is not available on this platform, capacity reports 0% CPU
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
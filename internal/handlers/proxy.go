@@ -2,29 +2,72 @@ package handlers
 
 import (
 	"database/sql"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"skyport-server/internal/certs"
 	"skyport-server/internal/config"
+	"skyport-server/internal/database"
+	"skyport-server/internal/geoip"
 	"skyport-server/internal/templates"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// tunnelHealthPath is reserved on every tunnel subdomain for checking the tunnel itself
+const tunnelHealthPath = "/_skyport/health"
+
 type ProxyHandler struct {
 	db            *sql.DB
 	tunnelHandler *TunnelHandler
 	config        *config.Config
+	geoLocator    *geoip.Locator
+	certCache     *certs.DBCache
+	dbHealth      *database.HealthChecker
+	logger        *slog.Logger
+
+	// basicAuth caches credentials already checked against tunnels' password hashes
+	basicAuth basicAuthCache
+	// basicAuthAttempts limits the password hashes compared for each tunnel
+	basicAuthAttempts basicAuthLimiter
 }
 
-func NewProxyHandler(db *sql.DB, tunnelHandler *TunnelHandler, cfg *config.Config) *ProxyHandler {
+func NewProxyHandler(db *sql.DB, tunnelHandler *TunnelHandler, cfg *config.Config, geoLocator *geoip.Locator, certCache *certs.DBCache, dbHealth *database.HealthChecker, logger *slog.Logger) *ProxyHandler {
 	return &ProxyHandler{
 		db:            db,
 		tunnelHandler: tunnelHandler,
 		config:        cfg,
+		geoLocator:    geoLocator,
+		certCache:     certCache,
+		dbHealth:      dbHealth,
+		logger:        logger,
 	}
 }
 
+// HandleACMEChallenge answers ACME HTTP-01 challenges for custom domains.
+// Unknown tokens fall through to subdomain routing so local services behind a tunnel
+// can still answer their own challenges.
+func (h *ProxyHandler) HandleACMEChallenge(c *gin.Context) {
+	token := c.Param("token")
+
+	keyAuth, found, err := h.certCache.LookupChallenge(c.Request.Context(), token)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to look up ACME challenge", "token", token, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if !found {
+		h.HandleSubdomain(c)
+		return
+	}
+
+	c.Data(http.StatusOK, "text/plain", []byte(keyAuth))
+}
+
 // HandleSubdomain handles requests to subdomains and proxies them to local tunnels
 func (h *ProxyHandler) HandleSubdomain(c *gin.Context) {
 	host := c.Request.Host
@@ -44,68 +87,224 @@ func (h *ProxyHandler) HandleSubdomain(c *gin.Context) {
 		return
 	}
 
+	// Fail fast while the database circuit is open instead of queueing up doomed queries
+	if !h.dbHealth.IsHealthy() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service temporarily unavailable"})
+		return
+	}
+
+	// Hosts outside the tunnel domain can only be verified custom domains of a tunnel
+	if !strings.HasSuffix(host, "."+h.config.Domain) {
+		tunnelSubdomain, found, err := lookupCustomDomain(h.db, host)
+		if err != nil {
+			h.logger.ErrorContext(c.Request.Context(), "Failed to look up custom domain", "host", host, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No tunnel found"})
+			return
+		}
+		subdomain = tunnelSubdomain
+	}
+
+	// Requests another instance forwarded already passed IP rules, basic auth and geofencing
+	// there, the peer's address would fail them here
+	clientIP, forwardedByPeer := h.peerForwardedClientIP(c)
+	if !forwardedByPeer {
+		clientIP = c.ClientIP()
+	}
+
+	// Load balancer health checks of the tunnel itself never reach the local service
+	if c.Request.URL.Path == tunnelHealthPath {
+		h.handleTunnelHealth(c, subdomain)
+		return
+	}
+
 	// Find active tunnel for this subdomain
 	var tunnelID, userID string
-	var localPort int
-	var isActive bool
+	var localPort, timeoutSeconds int
+	var maxBodyBytes int64
+	var isActive, isPaused, allowIndexing, stickySessionCookie, hasIPRules bool
+	var blockedCountries []string
+	var proxyTargetURL, connectedInstance, basicAuthUser, basicAuthPasswordHash sql.NullString
 
+	// Reverse proxy tunnels have no agent and are never marked active. The predicate matches
+	// the partial index idx_tunnels_active_subdomain, keep them in sync.
 	err := h.db.QueryRow(`
-		SELECT id, user_id, local_port, is_active 
+		SELECT id, user_id, local_port, is_active, is_paused, allow_indexing, blocked_countries, proxy_target_url,
+			sticky_session_cookie, connected_instance, timeout_seconds, max_body_bytes,
+			EXISTS(SELECT 1 FROM tunnel_ip_rules WHERE tunnel_id = tunnels.id), basic_auth_user, basic_auth_password_hash
 		FROM tunnels 
-		WHERE subdomain = $1 AND is_active = true
-	`, subdomain).Scan(&tunnelID, &userID, &localPort, &isActive)
+		WHERE subdomain = $1 AND (is_active = true OR is_paused = true OR proxy_target_url IS NOT NULL)
+	`, subdomain).Scan(&tunnelID, &userID, &localPort, &isActive, &isPaused, &allowIndexing, (*database.StringArray)(&blockedCountries),
+		&proxyTargetURL, &stickySessionCookie, &connectedInstance, &timeoutSeconds, &maxBodyBytes, &hasIPRules,
+		&basicAuthUser, &basicAuthPasswordHash)
+
+	// Keep tunnel URLs out of search results unless the owner opted in
+	if !allowIndexing {
+		c.Header("X-Robots-Tag", "noindex, nofollow")
+	}
 
 	if err == sql.ErrNoRows {
 		dashboardURL := h.config.WebAppURL + "/dashboard"
 		html, err := templates.RenderTunnelNotFound(subdomain, dashboardURL)
 		if err != nil {
-			log.Printf("Failed to render template: %v", err)
+			h.logger.ErrorContext(c.Request.Context(), "Failed to render template", "error", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Template error"})
 			return
 		}
-		c.Data(http.StatusNotFound, "text/html; charset=utf-8", []byte(html))
+		renderAndRespond(c, http.StatusNotFound, html)
 		return
 	}
 
 	if err != nil {
-		log.Printf("Failed to query tunnel for subdomain %s: %v", subdomain, err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to query tunnel", "subdomain", subdomain, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
+	if isPaused {
+		dashboardURL := h.config.WebAppURL + "/dashboard"
+		html, err := templates.RenderTunnelPaused(subdomain, dashboardURL)
+		if err != nil {
+			h.logger.ErrorContext(c.Request.Context(), "Failed to render template", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Template error"})
+			return
+		}
+		renderAndRespond(c, http.StatusServiceUnavailable, html)
+		return
+	}
+
+	// The tunnel owner may restrict which addresses can reach the tunnel
+	if hasIPRules && !forwardedByPeer {
+		allowed, err := h.clientAllowedByIPRules(c, tunnelID)
+		if err != nil {
+			h.logger.ErrorContext(c.Request.Context(), "Failed to check IP rules", "tunnel_id", tunnelID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if !allowed {
+			html, err := templates.RenderErrorPage(templates.ErrorPageData{
+				Title:     "Access Denied",
+				ErrorCode: "403",
+				Message:   "The owner of this tunnel has restricted access from your IP address.",
+			})
+			if err != nil {
+				h.logger.ErrorContext(c.Request.Context(), "Failed to render template", "error", err)
+				c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+				return
+			}
+			renderAndRespond(c, http.StatusForbidden, html)
+			return
+		}
+	}
+
+	if basicAuthUser.Valid && !forwardedByPeer && !h.checkBasicAuth(c, subdomain, basicAuthUser.String, basicAuthPasswordHash.String) {
+		return
+	}
+
+	// Tag the request with the client's location, dropping any spoofed values from the client.
+	// Forwarded requests keep the location the forwarding instance set.
+	var location geoip.Location
+	if !forwardedByPeer {
+		location = h.injectClientLocation(c)
+	}
+
+	// Geofencing: the tunnel owner may block visitors from some countries
+	if location.Country != "" && slices.Contains(blockedCountries, location.Country) {
+		html, err := templates.RenderErrorPage(templates.ErrorPageData{
+			Title:     "Unavailable For Legal Reasons",
+			ErrorCode: "451",
+			Message:   "The owner of this tunnel has restricted access from your country.",
+		})
+		if err != nil {
+			h.logger.ErrorContext(c.Request.Context(), "Failed to render template", "error", err)
+			c.JSON(http.StatusUnavailableForLegalReasons, gin.H{"error": "Unavailable in your country"})
+			return
+		}
+		renderAndRespond(c, http.StatusUnavailableForLegalReasons, html)
+		return
+	}
+
+	// Reverse proxy tunnels forward straight to their target, no agent involved
+	if proxyTargetURL.Valid {
+		stripBasicAuth(c, basicAuthUser.Valid)
+		target, err := url.Parse(proxyTargetURL.String)
+		if err != nil {
+			h.logger.ErrorContext(c.Request.Context(), "Invalid proxy target", "subdomain", subdomain, "error", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Invalid proxy target"})
+			return
+		}
+		h.serveReverseProxy(c, subdomain, target)
+		return
+	}
+
 	if !isActive {
 		dashboardURL := h.config.WebAppURL + "/dashboard"
 		html, err := templates.RenderTunnelOffline(subdomain, dashboardURL)
 		if err != nil {
-			log.Printf("Failed to render template: %v", err)
+			h.logger.ErrorContext(c.Request.Context(), "Failed to render template", "error", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Template error"})
 			return
 		}
-		c.Data(http.StatusServiceUnavailable, "text/html; charset=utf-8", []byte(html))
+		renderAndRespond(c, http.StatusServiceUnavailable, html)
 		return
 	}
 
 	// Check if we have an active tunnel connection
 	tunnel, exists := h.tunnelHandler.GetActiveTunnel(tunnelID)
+	if !exists && h.forwardToOwner(c, subdomain, tunnelID, stickySessionCookie, connectedInstance.String) {
+		return
+	}
 	if !exists {
 		dashboardURL := h.config.WebAppURL + "/dashboard"
 		html, err := templates.RenderTunnelConnectionLost(subdomain, dashboardURL)
 		if err != nil {
-			log.Printf("Failed to render template: %v", err)
+			h.logger.ErrorContext(c.Request.Context(), "Failed to render template", "error", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Template error"})
 			return
 		}
-		c.Data(http.StatusServiceUnavailable, "text/html; charset=utf-8", []byte(html))
+		renderAndRespond(c, http.StatusServiceUnavailable, html)
 		return
 	}
 
+	if stickySessionCookie {
+		h.setInstanceCookie(c)
+	}
+
+	// The credentials were for the tunnel, not the local service
+	stripBasicAuth(c, basicAuthUser.Valid)
+
+	// The protocol was configured when the agent connected, pick up timeout and body limit
+	// changes since then
+	tunnel.SetResponseTimeout(time.Duration(timeoutSeconds) * time.Second)
+	tunnel.SetMaxBodyBytes(maxBodyBytes)
+
 	// Check if this is a WebSocket upgrade request
 	if isWebSocketUpgrade(c.Request) {
-		tunnel.HandleWebSocketUpgrade(c.Writer, c.Request)
+		tunnel.HandleWebSocketUpgrade(c.Writer, withClientIP(c.Request, clientIP))
 	} else {
-		// Handle regular HTTP request through tunnel
-		tunnel.HandleIncomingHTTPRequest(c.Writer, c.Request)
+		// Handle regular HTTP request through tunnel, recording it for the request inspector.
+		// X-Skyport-Latency tells developers how much time the tunnel itself added.
+		tunnel.HandleInspectedHTTPRequest(newLatencyWriter(c.Writer), c.Request)
+	}
+}
+
+// injectClientLocation sets X-Client-Country and X-Client-Region on the forwarded request
+// and returns the location
+func (h *ProxyHandler) injectClientLocation(c *gin.Context) geoip.Location {
+	c.Request.Header.Del("X-Client-Country")
+	c.Request.Header.Del("X-Client-Region")
+
+	location := h.geoLocator.Lookup(c.ClientIP())
+	if location.Country != "" {
+		c.Request.Header.Set("X-Client-Country", location.Country)
 	}
+	if location.Region != "" {
+		c.Request.Header.Set("X-Client-Region", location.Region)
+	}
+	return location
 }
 
 // isWebSocketUpgrade checks if the request is a WebSocket upgrade request
@@ -113,3 +312,46 @@ func isWebSocketUpgrade(r *http.Request) bool {
 	return strings.ToLower(r.Header.Get("Connection")) == "upgrade" &&
 		strings.ToLower(r.Header.Get("Upgrade")) == "websocket"
 }
+
+// handleTunnelHealth answers GET and HEAD on tunnelHealthPath: 200 while the tunnel's agent
+// is connected (or the tunnel is a reverse proxy), 503 otherwise
+func (h *ProxyHandler) handleTunnelHealth(c *gin.Context, subdomain string) {
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		c.Header("Allow", "GET, HEAD")
+		c.Status(http.StatusMethodNotAllowed)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+
+	var tunnelID string
+	var isProxy bool
+	err := h.db.QueryRow(
+		"SELECT id, proxy_target_url IS NOT NULL FROM tunnels WHERE subdomain = $1", subdomain,
+	).Scan(&tunnelID, &isProxy)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"status": "not_found"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to query tunnel health", "subdomain", subdomain, "error", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unknown"})
+		return
+	}
+
+	if _, connected := h.tunnelHandler.GetActiveTunnel(tunnelID); connected || isProxy {
+		c.JSON(http.StatusOK, gin.H{"status": "connected"})
+		return
+	}
+	// The agent may be connected to another instance
+	_, registered, err := h.tunnelHandler.tunnelStore.Get(c.Request.Context(), tunnelID)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to look up tunnel in tunnel store", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unknown"})
+		return
+	}
+	if registered {
+		c.JSON(http.StatusOK, gin.H{"status": "connected"})
+		return
+	}
+	c.JSON(http.StatusServiceUnavailable, gin.H{"status": "disconnected"})
+}
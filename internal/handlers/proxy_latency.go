@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// latencyWriter adds X-Skyport-Latency to a proxied response: the time from receiving the
+// request to starting the response, minus the upstream's own X-Response-Time if it sent one
+type latencyWriter struct {
+	http.ResponseWriter
+	start       time.Time
+	wroteHeader bool
+}
+
+func newLatencyWriter(w http.ResponseWriter) *latencyWriter {
+	return &latencyWriter{ResponseWriter: w, start: time.Now()}
+}
+
+func (lw *latencyWriter) WriteHeader(status int) {
+	if !lw.wroteHeader {
+		lw.wroteHeader = true
+		overhead := time.Since(lw.start) - upstreamResponseTime(lw.Header().Get("X-Response-Time"))
+		if overhead < 0 {
+			overhead = 0
+		}
+		lw.Header().Set("X-Skyport-Latency", strconv.FormatInt(overhead.Milliseconds(), 10))
+	}
+	lw.ResponseWriter.WriteHeader(status)
+}
+
+func (lw *latencyWriter) Write(p []byte) (int, error) {
+	if !lw.wroteHeader {
+		lw.WriteHeader(http.StatusOK)
+	}
+	return lw.ResponseWriter.Write(p)
+}
+
+// Flush keeps streamed responses working through the wrapper
+func (lw *latencyWriter) Flush() {
+	if flusher, ok := lw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to abort a response
+func (lw *latencyWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+// upstreamResponseTime parses an X-Response-Time value such as "12ms", "0.012s" or a bare
+// number of milliseconds. Unparseable values count as zero.
+func upstreamResponseTime(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if ms, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return d
+	}
+	return 0
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"time"
+)
+
+// proxyProtocolV2Signature is the fixed 12-byte signature that starts every PROXY v2 header
+var proxyProtocolV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	proxyProtocolV2Proxy = 0x21 // version 2, PROXY command
+	proxyProtocolTCP4    = 0x11 // AF_INET, STREAM
+	proxyProtocolTCP6    = 0x21 // AF_INET6, STREAM
+)
+
+// clientIPKey is the request context key of the client IP resolved through trusted proxies
+type clientIPKey struct{}
+
+// withClientIP records the client IP gin resolved through the trusted proxies, so the PROXY
+// header names the visitor and not a load balancer in front of the server
+func withClientIP(r *http.Request, clientIP string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey{}, clientIP))
+}
+
+// buildProxyProtocolV2Header builds a PROXY protocol v2 header: the 16-byte fixed part
+// followed by the source and destination address block
+func buildProxyProtocolV2Header(src, dst *net.TCPAddr) []byte {
+	header := make([]byte, 16, 16+36)
+	copy(header, proxyProtocolV2Signature)
+	header[12] = proxyProtocolV2Proxy
+
+	srcIP4, dstIP4 := src.IP.To4(), dst.IP.To4()
+	if srcIP4 != nil && dstIP4 != nil {
+		header[13] = proxyProtocolTCP4
+		binary.BigEndian.PutUint16(header[14:16], 12)
+		header = append(header, srcIP4...)
+		header = append(header, dstIP4...)
+	} else {
+		header[13] = proxyProtocolTCP6
+		binary.BigEndian.PutUint16(header[14:16], 36)
+		header = append(header, src.IP.To16()...)
+		header = append(header, dst.IP.To16()...)
+	}
+
+	header = binary.BigEndian.AppendUint16(header, uint16(src.Port))
+	header = binary.BigEndian.AppendUint16(header, uint16(dst.Port))
+	return header
+}
+
+// sendProxyProtocolHeader tells the agent the real client and destination addresses of a
+// stream before its first data frame. Streams whose addresses can't be determined are skipped.
+func (tp *TunnelProtocol) sendProxyProtocolHeader(r *http.Request, requestID string) error {
+	src, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil || src.IP == nil {
+		return nil
+	}
+	// Behind a trusted proxy the peer is the proxy. Its port says nothing about the visitor's
+	// connection, so the source port is left 0.
+	if clientIP, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		if ip := net.ParseIP(clientIP); ip != nil && !ip.Equal(src.IP) {
+			src = &net.TCPAddr{IP: ip}
+		}
+	}
+	localAddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return nil
+	}
+	dst, err := net.ResolveTCPAddr("tcp", localAddr.String())
+	if err != nil || dst.IP == nil {
+		return nil
+	}
+
+	return tp.sendMessage(&TunnelMessage{
+		Type: "proxy_protocol_v2",
+		ID:   requestID,
+		Body: buildProxyProtocolV2Header(src, dst),
+		Headers: map[string]string{
+			"client_addr":      src.String(),
+			"destination_addr": dst.String(),
+		},
+		Timestamp: time.Now().Unix(),
+	})
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// reconnectBurst is how many agents may connect at once after a quiet period
+	reconnectBurst = 1000
+	// reconnectRefillPerSecond is the sustained rate of agent connections
+	reconnectRefillPerSecond = 100
+	// userReconnectBurst is how many connections one user's agents may make at once
+	userReconnectBurst = 50
+	// userReconnectRefillPerSecond is the sustained rate of one user's agent connections
+	userReconnectRefillPerSecond = 5
+)
+
+// tokenBucket holds tokens that refill at a fixed rate up to a burst size
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+	burst      float64
+	rate       float64
+}
+
+func newTokenBucket(burst, rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: burst, lastRefill: now, burst: burst, rate: rate}
+}
+
+// refill adds the tokens earned since the last call
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.lastRefill).Seconds()*b.rate)
+	b.lastRefill = now
+}
+
+// wait returns how long until the bucket has a whole token again
+func (b *tokenBucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// reconnectThrottle limits agent connections. After a server restart every agent reconnects
+// at the same moment; the global bucket spreads them out so the database isn't hit by all of
+// them together. Each user also has a bucket of their own, so one user's misbehaving agents
+// can't use up the global bucket and lock everyone else out.
+type reconnectThrottle struct {
+	mu     sync.Mutex
+	global *tokenBucket
+	users  map[string]*tokenBucket
+}
+
+func newReconnectThrottle() *reconnectThrottle {
+	return &reconnectThrottle{
+		global: newTokenBucket(reconnectBurst, reconnectRefillPerSecond, time.Now()),
+		users:  make(map[string]*tokenBucket),
+	}
+}
+
+// take consumes a token from the user's bucket and the global one. When either is empty
+// nothing is consumed and it returns false and how long until a connection is admitted.
+func (t *reconnectThrottle) take(userID string) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.global.refill(now)
+	user, ok := t.users[userID]
+	if ok {
+		user.refill(now)
+	} else {
+		t.pruneUsers(now)
+		user = newTokenBucket(userReconnectBurst, userReconnectRefillPerSecond, now)
+		t.users[userID] = user
+	}
+
+	if wait := max(user.wait(), t.global.wait()); wait > 0 {
+		return false, wait
+	}
+	user.tokens--
+	t.global.tokens--
+	return true, 0
+}
+
+// pruneUsers drops the buckets that have refilled completely, they are the same as a new
+// one. The caller holds mu.
+func (t *reconnectThrottle) pruneUsers(now time.Time) {
+	for userID, bucket := range t.users {
+		bucket.refill(now)
+		if bucket.tokens >= bucket.burst {
+			delete(t.users, userID)
+		}
+	}
+}
+
+// level returns the number of whole tokens left in the global bucket, for the capacity endpoint
+func (t *reconnectThrottle) level() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.global.refill(time.Now())
+	return int(t.global.tokens)
+}
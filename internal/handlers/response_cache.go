@@ -0,0 +1,257 @@
+package handlers
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxResponseCacheEntries caps the responses cached per tunnel, the least recently used
+	// is evicted first
+	maxResponseCacheEntries = 512
+	// maxResponseCacheAge caps how long a response is considered fresh, whatever its max-age
+	maxResponseCacheAge = time.Hour
+)
+
+// CachedResponse is what the response cache keeps of an agent response: the status, headers
+// and validators. Only conditional requests are answered from the cache, with a 304, so
+// the body isn't kept.
+type CachedResponse struct {
+	Status       int
+	Headers      map[string]string
+	ETag         string
+	LastModified time.Time
+}
+
+// newCachedResponse captures an agent response's headers and ETag/Last-Modified validators
+func newCachedResponse(response *TunnelMessage) *CachedResponse {
+	cached := &CachedResponse{
+		Status:  response.Status,
+		Headers: response.Headers,
+		ETag:    headerValue(response.Headers, "ETag"),
+	}
+	if lastModified := headerValue(response.Headers, "Last-Modified"); lastModified != "" {
+		if parsed, err := http.ParseTime(lastModified); err == nil {
+			cached.LastModified = parsed
+		}
+	}
+	return cached
+}
+
+type responseCacheEntry struct {
+	key       string
+	response  *CachedResponse
+	expiresAt time.Time
+}
+
+// responseCache is an LRU cache of fresh GET responses keyed by coalesceKey. While an entry
+// is fresh, a conditional request whose validators match it is answered with 304 without
+// asking the agent.
+type responseCache struct {
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	order   list.List // front is most recently used
+}
+
+// isRevalidationRequest reports whether a request is a bodiless conditional GET the cache can
+// answer. Clients asking for revalidation with no-cache or max-age=0 always reach the agent.
+func isRevalidationRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.ContentLength != 0 || len(r.TransferEncoding) != 0 {
+		return false
+	}
+	if r.Header.Get("If-None-Match") == "" && r.Header.Get("If-Modified-Since") == "" {
+		return false
+	}
+	directives := cacheControlDirectives(r.Header.Get("Cache-Control"))
+	if _, noCache := directives["no-cache"]; noCache {
+		return false
+	}
+	if maxAge, ok := directives["max-age"]; ok && maxAge == "0" {
+		return false
+	}
+	return !strings.Contains(strings.ToLower(r.Header.Get("Pragma")), "no-cache")
+}
+
+// responseFreshness returns how long a buffered GET response may be reused, from s-maxage or
+// max-age. Responses without validators, or that are private or vary on headers outside the
+// cache key, aren't cached.
+func responseFreshness(response *TunnelMessage) (time.Duration, bool) {
+	if response == nil || response.Error != "" || response.Status != http.StatusOK {
+		return 0, false
+	}
+	if headerValue(response.Headers, "ETag") == "" && headerValue(response.Headers, "Last-Modified") == "" {
+		return 0, false
+	}
+	if headerValue(response.Headers, "Set-Cookie") != "" || !varyCoveredByCoalesceKey(response.Headers) {
+		return 0, false
+	}
+
+	directives := cacheControlDirectives(headerValue(response.Headers, "Cache-Control"))
+	for _, name := range []string{"no-store", "no-cache", "private"} {
+		if _, found := directives[name]; found {
+			return 0, false
+		}
+	}
+	maxAge, found := directives["s-maxage"]
+	if !found {
+		maxAge = directives["max-age"]
+	}
+	seconds, err := strconv.Atoi(maxAge)
+	if err != nil || seconds <= 0 {
+		return 0, false
+	}
+	return min(time.Duration(seconds)*time.Second, maxResponseCacheAge), true
+}
+
+// cacheControlDirectives parses a Cache-Control header into lowercase directive names and
+// their unquoted values
+func cacheControlDirectives(header string) map[string]string {
+	directives := make(map[string]string)
+	for _, directive := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if name == "" {
+			continue
+		}
+		directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+	}
+	return directives
+}
+
+// get returns the fresh cached response for key
+func (rc *responseCache) get(key string) (*CachedResponse, bool) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	element, exists := rc.entries[key]
+	if !exists {
+		return nil, false
+	}
+
+	entry := element.Value.(*responseCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		rc.order.Remove(element)
+		delete(rc.entries, key)
+		return nil, false
+	}
+
+	rc.order.MoveToFront(element)
+	return entry.response, true
+}
+
+// store caches a response the agent sent for key. Any other response except a 304 drops
+// the cached one, the resource may have changed.
+func (rc *responseCache) store(key string, response *TunnelMessage) {
+	if response != nil && response.Status == http.StatusNotModified {
+		return
+	}
+	freshness, cacheable := responseFreshness(response)
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	element, exists := rc.entries[key]
+	if !cacheable {
+		if exists {
+			rc.order.Remove(element)
+			delete(rc.entries, key)
+		}
+		return
+	}
+
+	if exists {
+		entry := element.Value.(*responseCacheEntry)
+		entry.response = newCachedResponse(response)
+		entry.expiresAt = time.Now().Add(freshness)
+		rc.order.MoveToFront(element)
+		return
+	}
+
+	if rc.entries == nil {
+		rc.entries = make(map[string]*list.Element)
+	}
+	rc.entries[key] = rc.order.PushFront(&responseCacheEntry{
+		key:       key,
+		response:  newCachedResponse(response),
+		expiresAt: time.Now().Add(freshness),
+	})
+
+	if rc.order.Len() > maxResponseCacheEntries {
+		oldest := rc.order.Back()
+		rc.order.Remove(oldest)
+		delete(rc.entries, oldest.Value.(*responseCacheEntry).key)
+	}
+}
+
+// evaluateConditionalRequest reports whether the client's copy is still current, meaning
+// a 304 Not Modified can be sent instead of the body. If-None-Match takes precedence over
+// If-Modified-Since (RFC 9110 section 13.2.2).
+func evaluateConditionalRequest(r *http.Request, cached *CachedResponse) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if cached.Status != 0 && cached.Status != http.StatusOK {
+		return false
+	}
+
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if cached.ETag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || weakETagMatch(candidate, cached.ETag) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" && !cached.LastModified.IsZero() {
+		since, err := http.ParseTime(ifModifiedSince)
+		if err != nil {
+			return false
+		}
+		return !cached.LastModified.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
+
+// writeNotModified sends a 304 carrying the validators and caching headers of the cached
+// response. The tunnel's header changes apply as on full responses, so a revalidated
+// resource keeps the same headers.
+func (tp *TunnelProtocol) writeNotModified(w http.ResponseWriter, cached *CachedResponse) {
+	header := w.Header()
+	for _, name := range []string{"ETag", "Last-Modified", "Cache-Control", "Expires", "Vary", "Content-Location"} {
+		if value := headerValue(cached.Headers, name); value != "" {
+			header.Set(name, value)
+		}
+	}
+	tp.applyResponseTransforms(header)
+	tp.applyHeaderRules("response", header)
+	tp.applyCORSBypass(header)
+	header.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// weakETagMatch compares two entity tags ignoring the weak (W/) prefix
+func weakETagMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// headerValue looks up a header in a forwarded header map regardless of the key's case
+func headerValue(headers map[string]string, name string) string {
+	if value, exists := headers[name]; exists {
+		return value
+	}
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
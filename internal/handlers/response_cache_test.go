@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"skyport-server/internal/models"
+	"testing"
+)
+
+func TestWriteNotModifiedAppliesTunnelHeaders(t *testing.T) {
+	tp := &TunnelProtocol{
+		corsBypass: true,
+		transforms: []models.TransformRule{
+			{Type: "header_add", Direction: "response", Name: "X-Transformed", Value: "yes"},
+		},
+	}
+	tp.headerRules.Store(&[]models.HeaderRule{
+		{Direction: "response", Action: "set", HeaderName: "Strict-Transport-Security", HeaderValue: "max-age=31536000"},
+		{Direction: "response", Action: "remove", HeaderName: "Cache-Control"},
+		{Direction: "request", Action: "set", HeaderName: "X-Request-Only", HeaderValue: "no"},
+	})
+
+	response := &TunnelMessage{
+		Type:   "http_response",
+		ID:     "test",
+		Status: http.StatusNotModified,
+		Headers: map[string]string{
+			"ETag":          `"v1"`,
+			"Cache-Control": "max-age=60",
+			"Content-Type":  "text/html",
+		},
+	}
+
+	recorder := httptest.NewRecorder()
+	tp.writeHTTPResponse(recorder, response)
+
+	if recorder.Code != http.StatusNotModified {
+		t.Fatalf("status = %d, want 304", recorder.Code)
+	}
+	want := map[string]string{
+		"ETag":                        `"v1"`,
+		"X-Transformed":               "yes",
+		"Strict-Transport-Security":   "max-age=31536000",
+		"Access-Control-Allow-Origin": "*",
+		"X-Content-Type-Options":      "nosniff",
+		"Cache-Control":               "",
+		"Content-Type":                "",
+		"X-Request-Only":              "",
+	}
+	for name, value := range want {
+		if got := recorder.Header().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestCachedRevalidationAppliesTunnelHeaders(t *testing.T) {
+	tp := &TunnelProtocol{}
+	tp.headerRules.Store(&[]models.HeaderRule{
+		{Direction: "response", Action: "set", HeaderName: "X-Frame-Options", HeaderValue: "DENY"},
+	})
+
+	recorder := httptest.NewRecorder()
+	tp.writeNotModified(recorder, newCachedResponse(&TunnelMessage{
+		Status:  http.StatusOK,
+		Headers: map[string]string{"ETag": `"v2"`},
+	}))
+
+	if got := recorder.Header().Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("X-Frame-Options = %q, want DENY", got)
+	}
+	if got := recorder.Header().Get("ETag"); got != `"v2"` {
+		t.Errorf("ETag = %q, want %q", got, `"v2"`)
+	}
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// reverseProxyDialTimeout bounds connecting to a tunnel's proxy target
+	reverseProxyDialTimeout = 10 * time.Second
+	// reverseProxyResponseTimeout matches the 30 second wait for responses through agents
+	reverseProxyResponseTimeout = 30 * time.Second
+)
+
+// reverseProxyTransport is shared by all reverse proxy tunnels. Like agent callbacks it only
+// connects to public addresses, a proxy target can't be used to reach the server's network.
+var reverseProxyTransport = &http.Transport{
+	DialContext: (&net.Dialer{
+		Timeout: reverseProxyDialTimeout,
+		Control: rejectPrivateAddress,
+	}).DialContext,
+	ResponseHeaderTimeout: reverseProxyResponseTimeout,
+	IdleConnTimeout:       90 * time.Second,
+	MaxIdleConnsPerHost:   10,
+}
+
+// serveReverseProxy forwards a request to a tunnel's proxy_target_url instead of through an
+// agent. The target's path is used as a prefix for the request path.
+func (h *ProxyHandler) serveReverseProxy(c *gin.Context, subdomain string, target *url.URL) {
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+		},
+		Transport: reverseProxyTransport,
+		// Flush immediately so event streams and chunked responses aren't held back
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			h.logger.ErrorContext(r.Context(), "Reverse proxy failed", "subdomain", subdomain, "target", target.Host, "error", err)
+			http.Error(w, "Failed to reach proxy target", http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(c.Writer, c.Request)
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cpuSampler turns cumulative process CPU time into a usage percentage between calls
+type cpuSampler struct {
+	mu       sync.Mutex
+	lastWall time.Time
+	lastCPU  time.Duration
+}
+
+// percent returns the process CPU usage since the previous call, as a share of all cores.
+// The first call measures from startedAt.
+func (s *cpuSampler) percent(startedAt time.Time) float64 {
+	cpu, ok := processCPUTime()
+	if !ok {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastWall.IsZero() {
+		s.lastWall = startedAt
+	}
+	now := time.Now()
+	wall := now.Sub(s.lastWall)
+	used := cpu - s.lastCPU
+	s.lastWall, s.lastCPU = now, cpu
+	if wall <= 0 {
+		return 0
+	}
+
+	percent := float64(used) / float64(wall) / float64(runtime.NumCPU()) * 100
+	return float64(int(percent*10)) / 10
+}
+
+// GetServerCapacity reports load figures so operators can choose an instance for new agents.
+// When SKYPORT_CAPACITY_TOKEN is set the caller must send it as a bearer token.
+func (h *TunnelHandler) GetServerCapacity(c *gin.Context) {
+	if h.config.CapacityToken != "" {
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(h.config.CapacityToken)) != 1 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid capacity token"})
+			return
+		}
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	c.JSON(http.StatusOK, gin.H{
+		"active_tunnels": h.activeTunnelCount(),
+		"max_tunnels":    h.config.MaxActiveTunnels,
+		"cpu_percent":    h.cpu.percent(h.startedAt),
+		"memory_mb":      mem.Sys / (1 << 20),
+		"goroutines":     runtime.NumGoroutine(),
+		"uptime_seconds": int64(time.Since(h.startedAt).Seconds()),
+		// Agent connections the reconnect throttle still admits without waiting
+		"reconnect_tokens":    h.reconnects.level(),
+		"reconnect_token_max": reconnectBurst,
+	})
+}
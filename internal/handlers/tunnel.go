@@ -1,25 +1,64 @@
 package handlers
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
-	"log"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
+	"skyport-server/internal/certs"
 	"skyport-server/internal/config"
+	"skyport-server/internal/database"
 	"skyport-server/internal/models"
+	"skyport-server/internal/store"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
 )
 
 type TunnelHandler struct {
-	db            *sql.DB
+	db     *sql.DB
+	config *config.Config
+	ca     *certs.CA
+	logger *slog.Logger
+
+	// tunnelStore shares which instance holds each agent connection, activeTunnels has the
+	// connections of this instance
+	tunnelStore store.TunnelStore
+
 	upgrader      websocket.Upgrader
 	activeTunnels map[string]*TunnelProtocol
 	tunnelsMutex  sync.RWMutex
+
+	// events delivers tunnel events to the owners' SSE feeds
+	events *eventBus
+
+	// webhookQueue feeds connect and disconnect events to the webhook workers
+	webhookQueue chan webhookDelivery
+
+	// startedAt and cpu feed the capacity endpoint
+	startedAt time.Time
+	cpu       cpuSampler
+
+	// reconnects limits the rate of agent connections, e.g. after a restart
+	reconnects *reconnectThrottle
+
+	// connections counts running agent connections and shuttingDown refuses new ones,
+	// both guarded by tunnelsMutex for registration (see Shutdown)
+	connections  sync.WaitGroup
+	shuttingDown bool
 }
 
 type TunnelConnection struct {
@@ -28,10 +67,20 @@ type TunnelConnection struct {
 	Conn     *websocket.Conn
 }
 
-func NewTunnelHandler(db *sql.DB) *TunnelHandler {
-	return &TunnelHandler{
+// NewTunnelHandler creates a tunnel handler. ca may be nil, in which case tunnels are
+// created without client certificates.
+func NewTunnelHandler(db *sql.DB, cfg *config.Config, ca *certs.CA, tunnelStore store.TunnelStore, logger *slog.Logger) *TunnelHandler {
+	h := &TunnelHandler{
 		db:            db,
+		config:        cfg,
+		ca:            ca,
+		logger:        logger,
+		tunnelStore:   tunnelStore,
 		activeTunnels: make(map[string]*TunnelProtocol),
+		events:        newEventBus(),
+		webhookQueue:  make(chan webhookDelivery, webhookQueueSize),
+		startedAt:     time.Now(),
+		reconnects:    newReconnectThrottle(),
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true // Allow all origins for now
@@ -40,8 +89,14 @@ func NewTunnelHandler(db *sql.DB) *TunnelHandler {
 			EnableCompression: true,
 		},
 	}
+	for i := 0; i < webhookWorkers; i++ {
+		go h.runWebhookWorker()
+	}
+	return h
 }
 
+// GetTunnels streams the user's tunnels as {"tunnels":[...]}, writing each row as it is
+// scanned so users with hundreds of tunnels don't cost memory proportional to the list
 func (h *TunnelHandler) GetTunnels(c *gin.Context) {
 	userIDStr, exists := c.Get("user_id")
 	if !exists {
@@ -49,52 +104,152 @@ func (h *TunnelHandler) GetTunnels(c *gin.Context) {
 		return
 	}
 
-	rows, err := h.db.Query(`
-		SELECT id, user_id, name, subdomain, local_port, auth_token, is_active, last_seen, connected_ip, created_at, updated_at 
-		FROM tunnels 
-		WHERE user_id = $1 
-		ORDER BY created_at DESC
-	`, userIDStr)
+	filter := `WHERE user_id = $1 `
+	args := []interface{}{userIDStr}
+
+	// Optional tag filter. The GIN index on tags serves @>, not = ANY(...)
+	if tag := c.Query("tag"); tag != "" {
+		filter += `AND tags @> ARRAY[$2]::text[] `
+		args = append(args, tag)
+	}
+
+	// The total goes in a header and the summary makes the ETag, so it is read in parallel
+	// with the main query
+	type summaryResult struct {
+		summary tunnelListSummary
+		err     error
+	}
+	summaryDone := make(chan summaryResult, 1)
+	go func() {
+		var summary tunnelListSummary
+		err := h.db.QueryRow(`
+			SELECT COUNT(*), COALESCE(MAX(updated_at), 'epoch'), COALESCE(MAX(last_seen), 'epoch'),
+				COALESCE(array_agg(id::text ORDER BY id), '{}')
+			FROM tunnels `+filter, args...).Scan(&summary.total, &summary.updatedAt, &summary.lastSeen,
+			(*database.StringArray)(&summary.ids))
+		summaryDone <- summaryResult{summary, err}
+	}()
+
+	rows, err := h.db.Query(`SELECT `+database.TunnelColumns+`
+		FROM tunnels `+filter+`ORDER BY created_at DESC`, args...)
+	summary := <-summaryDone
 	if err != nil {
-		log.Printf("Failed to fetch tunnels for user %s: %v", userIDStr, err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch tunnels", "user_id", userIDStr, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tunnels"})
 		return
 	}
 	defer rows.Close()
+	if summary.err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to count tunnels", "user_id", userIDStr, "error", summary.err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tunnels"})
+		return
+	}
 
-	var tunnels []models.Tunnel
-	for rows.Next() {
-		var tunnel models.Tunnel
-		err := rows.Scan(
-			&tunnel.ID, &tunnel.UserID, &tunnel.Name, &tunnel.Subdomain,
-			&tunnel.LocalPort, &tunnel.AuthToken, &tunnel.IsActive,
-			&tunnel.LastSeen, &tunnel.ConnectedIP, &tunnel.CreatedAt, &tunnel.UpdatedAt,
-		)
-		if err != nil {
-			log.Printf("Failed to scan tunnel for user %s: %v", userIDStr, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan tunnel"})
-			return
+	// Stats are a summary, the list is still served if they can't be read
+	now := time.Now()
+	trafficStats, err := h.userTrafficStats(userIDStr, now)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch tunnel stats", "user_id", userIDStr, "error", err)
+	}
+
+	// Dashboards poll the list, an unchanged one is answered before any row is read
+	etag := h.tunnelListETag(summary.summary, trafficStats, now)
+	c.Header("ETag", etag)
+	if ifNoneMatch := c.GetHeader("If-None-Match"); ifNoneMatch != "" {
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			if candidate = strings.TrimSpace(candidate); candidate == "*" || weakETagMatch(candidate, etag) {
+				c.Status(http.StatusNotModified)
+				return
+			}
 		}
-		tunnels = append(tunnels, tunnel)
 	}
 
-	if tunnels == nil {
-		tunnels = []models.Tunnel{}
+	// No Content-Length is known up front, so net/http sends the body chunked
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	c.Header("X-Total-Count", strconv.Itoa(summary.summary.total))
+	c.Status(http.StatusOK)
+
+	encoder := json.NewEncoder(c.Writer)
+	c.Writer.WriteString(`{"tunnels":[`)
+	first := true
+	err = database.EachTunnel(rows, func(tunnel *models.Tunnel) error {
+		traffic := trafficStats[tunnel.ID.String()]
+
+		// Enhance with real-time data from memory for active tunnels
+		h.tunnelsMutex.RLock()
+		if protocol, exists := h.activeTunnels[tunnel.ID.String()]; exists {
+			// Get real-time status from memory
+			lastSeen := protocol.LastHeartbeat()
+			tunnel.LastSeen = &lastSeen
+			// Consider active while the heartbeat is within the tunnel's timeout
+			tunnel.IsActive = time.Since(lastSeen) < protocol.heartbeatTimeout()
+			traffic = traffic.add(protocol.traffic.peek(now))
+		}
+		h.tunnelsMutex.RUnlock()
+
+		if trafficStats != nil {
+			tunnel.Stats = summarizeTraffic(traffic, defaultStatsPeriod, statsPeriods[defaultStatsPeriod], tunnel.CreatedAt, now)
+		}
+
+		if !first {
+			c.Writer.WriteString(",")
+		}
+		first = false
+		if err := encoder.Encode(tunnel); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	})
+	if err != nil {
+		// The status is already sent. Ending the chunked body normally would look like a
+		// complete response to caches and clients, so the connection is aborted instead.
+		h.logger.ErrorContext(c.Request.Context(), "Failed to stream tunnels", "user_id", userIDStr, "error", err)
+		abortResponse(c.Writer)
+		return
 	}
+	c.Writer.WriteString("]}")
+}
+
+// tunnelListSummary describes a user's tunnel list without reading its rows
+type tunnelListSummary struct {
+	total     int
+	updatedAt time.Time
+	lastSeen  time.Time
+	ids       []string
+}
+
+// tunnelListETag is a validator for the tunnel list that is known before any row is streamed:
+// the list's size and latest change, the traffic stats and the live connection state. The
+// uptime and last_seen of connected tunnels advance continuously and aren't part of it.
+func (h *TunnelHandler) tunnelListETag(summary tunnelListSummary, trafficStats map[string]trafficSample, now time.Time) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%d|%d|%d\n", summary.total, summary.updatedAt.UnixNano(), summary.lastSeen.UnixNano())
 
-	// Enhance with real-time data from memory for active tunnels
 	h.tunnelsMutex.RLock()
-	for i := range tunnels {
-		if protocol, exists := h.activeTunnels[tunnels[i].ID.String()]; exists {
-			// Get real-time status from memory
-			tunnels[i].LastSeen = &protocol.lastHeartbeat
-			// Consider active if heartbeat is less than 45 seconds old
-			tunnels[i].IsActive = time.Since(protocol.lastHeartbeat) < 45*time.Second
+	defer h.tunnelsMutex.RUnlock()
+	for _, id := range summary.ids {
+		traffic := trafficStats[id]
+		fmt.Fprintf(hash, "%s|%d|%d|%d", id, traffic.requests, traffic.bytes, traffic.errors)
+		if protocol, exists := h.activeTunnels[id]; exists {
+			live := protocol.traffic.peek(now)
+			fmt.Fprintf(hash, "|%t|%d|%d|%d", time.Since(protocol.LastHeartbeat()) < protocol.heartbeatTimeout(),
+				live.requests, live.bytes, live.errors)
 		}
+		hash.Write([]byte("\n"))
 	}
-	h.tunnelsMutex.RUnlock()
 
-	c.JSON(http.StatusOK, gin.H{"tunnels": tunnels})
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+}
+
+// requireVerifiedEmail rejects tunnel creation until the user has verified their email
+// address. AuthMiddleware sets email_verified from the cached user.
+func requireVerifiedEmail(c *gin.Context) bool {
+	if verified, _ := c.Get("email_verified"); verified != true {
+		c.JSON(http.StatusForbidden, gin.H{"error": "email not verified"})
+		return false
+	}
+	return true
 }
 
 func (h *TunnelHandler) CreateTunnel(c *gin.Context) {
@@ -103,6 +258,9 @@ func (h *TunnelHandler) CreateTunnel(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
 		return
 	}
+	if !requireVerifiedEmail(c) {
+		return
+	}
 
 	var req models.CreateTunnelRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -110,46 +268,253 @@ func (h *TunnelHandler) CreateTunnel(c *gin.Context) {
 		return
 	}
 
+	userID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	tunnel, err := h.createTunnelTx(c.Request.Context(), userID, req)
+	if err != nil {
+		c.JSON(createErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, tunnel)
+}
+
+// dbQuerier is implemented by both *sql.DB and *sql.Tx
+type dbQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// tunnelCreateError is a tunnel creation failure with the HTTP status to report it with
+type tunnelCreateError struct {
+	status  int
+	message string
+}
+
+func (e *tunnelCreateError) Error() string {
+	return e.message
+}
+
+// createErrorStatus returns the HTTP status for an error returned by createTunnel
+func createErrorStatus(err error) int {
+	if createErr, ok := err.(*tunnelCreateError); ok {
+		return createErr.status
+	}
+	return http.StatusInternalServerError
+}
+
+// checkTunnelLimit enforces MaxTunnelsPerUser, admins are exempt. q is the transaction the
+// tunnel is inserted in: the user's advisory lock is held until it ends, so concurrent
+// creations can't all count the same number of tunnels and go over the limit.
+func (h *TunnelHandler) checkTunnelLimit(ctx context.Context, q *sql.Tx, userID uuid.UUID) error {
+	if h.config.MaxTunnelsPerUser <= 0 {
+		return nil
+	}
+
+	if _, err := q.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", userID.String()); err != nil {
+		h.logger.ErrorContext(ctx, "Failed to lock user's tunnels", "user_id", userID, "error", err)
+		return &tunnelCreateError{http.StatusInternalServerError, "Database error"}
+	}
+
+	var tunnelCount int
+	var isAdmin bool
+	err := q.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM tunnels WHERE user_id = $1),
+			COALESCE((SELECT is_admin FROM users WHERE id = $1), false)
+	`, userID).Scan(&tunnelCount, &isAdmin)
+	if err != nil {
+		h.logger.ErrorContext(ctx, "Failed to count tunnels", "user_id", userID, "error", err)
+		return &tunnelCreateError{http.StatusInternalServerError, "Database error"}
+	}
+
+	if !isAdmin && tunnelCount >= h.config.MaxTunnelsPerUser {
+		return &tunnelCreateError{http.StatusTooManyRequests, "tunnel limit reached"}
+	}
+	return nil
+}
+
+// createTunnel validates a create request and inserts the tunnel and its rules in q
+func (h *TunnelHandler) createTunnel(ctx context.Context, q *sql.Tx, userID uuid.UUID, req models.CreateTunnelRequest) (models.Tunnel, error) {
 	// Validate subdomain
 	isValid, validationError := config.ValidateSubdomain(req.Subdomain)
 	if !isValid {
-		c.JSON(http.StatusBadRequest, gin.H{"error": validationError})
-		return
+		return models.Tunnel{}, &tunnelCreateError{http.StatusBadRequest, validationError}
+	}
+
+	if req.Tags == nil {
+		req.Tags = []string{}
+	}
+	if isValid, validationError := config.ValidateTags(req.Tags); !isValid {
+		return models.Tunnel{}, &tunnelCreateError{http.StatusBadRequest, validationError}
+	}
+
+	if req.Transforms == nil {
+		req.Transforms = []models.TransformRule{}
+	}
+	if isValid, validationError := config.ValidateTransforms(req.Transforms); !isValid {
+		return models.Tunnel{}, &tunnelCreateError{http.StatusBadRequest, validationError}
+	}
+	transforms, err := json.Marshal(req.Transforms)
+	if err != nil {
+		return models.Tunnel{}, &tunnelCreateError{http.StatusBadRequest, "Invalid transforms"}
+	}
+
+	if req.RoutingRules == nil {
+		req.RoutingRules = []models.RoutingRule{}
+	}
+	if isValid, validationError := config.ValidateRoutingRules(req.RoutingRules); !isValid {
+		return models.Tunnel{}, &tunnelCreateError{http.StatusBadRequest, validationError}
+	}
+	routingRules, err := json.Marshal(req.RoutingRules)
+	if err != nil {
+		return models.Tunnel{}, &tunnelCreateError{http.StatusBadRequest, "Invalid routing rules"}
+	}
+
+	if req.WriteBufferKB == 0 {
+		req.WriteBufferKB = defaultSocketBufferBytes / 1024
+	}
+
+	if isValid, validationError := config.ValidateTimeoutSeconds(req.TimeoutSeconds); !isValid {
+		return models.Tunnel{}, &tunnelCreateError{http.StatusBadRequest, validationError}
+	}
+
+	if req.MaxBodyBytes == 0 {
+		req.MaxBodyBytes = defaultMaxBodyBytes
+	}
+
+	if req.BlockedCountries == nil {
+		req.BlockedCountries = []string{}
+	}
+	if isValid, validationError := config.ValidateCountryCodes(req.BlockedCountries); !isValid {
+		return models.Tunnel{}, &tunnelCreateError{http.StatusBadRequest, validationError}
+	}
+
+	var proxyTargetURL *string
+	if req.ProxyTargetURL != "" {
+		if isValid, validationError := config.ValidateProxyTargetURL(req.ProxyTargetURL); !isValid {
+			return models.Tunnel{}, &tunnelCreateError{http.StatusBadRequest, validationError}
+		}
+		proxyTargetURL = &req.ProxyTargetURL
+	}
+
+	var basicAuthUser, basicAuthPasswordHash *string
+	if req.BasicAuthUser != "" || req.BasicAuthPasswordHash != "" {
+		if isValid, validationError := config.ValidateBasicAuthHash(req.BasicAuthUser, req.BasicAuthPasswordHash); !isValid {
+			return models.Tunnel{}, &tunnelCreateError{http.StatusBadRequest, validationError}
+		}
+		basicAuthUser, basicAuthPasswordHash = &req.BasicAuthUser, &req.BasicAuthPasswordHash
+	}
+
+	if len(req.IPRules) > maxIPRulesPerTunnel {
+		return models.Tunnel{}, &tunnelCreateError{http.StatusBadRequest, "A tunnel can have at most 100 IP rules"}
+	}
+	ipRules := make([]models.CreateIPRuleRequest, 0, len(req.IPRules))
+	for _, rule := range req.IPRules {
+		network, err := parseIPRuleCIDR(rule.CIDR)
+		if err != nil {
+			return models.Tunnel{}, &tunnelCreateError{http.StatusBadRequest, "cidr must be an IP address or CIDR range"}
+		}
+		if rule.Action != "allow" && rule.Action != "deny" {
+			return models.Tunnel{}, &tunnelCreateError{http.StatusBadRequest, "IP rule action must be allow or deny"}
+		}
+		ipRules = append(ipRules, models.CreateIPRuleRequest{CIDR: network.String(), Action: rule.Action})
+	}
+
+	if len(req.HeaderRules) > config.MaxTunnelHeaderRules {
+		return models.Tunnel{}, &tunnelCreateError{http.StatusBadRequest, "A tunnel can have at most 50 header rules"}
+	}
+	headerRules := make([]models.CreateHeaderRuleRequest, 0, len(req.HeaderRules))
+	for _, rule := range req.HeaderRules {
+		if rule.Direction != "request" && rule.Direction != "response" {
+			return models.Tunnel{}, &tunnelCreateError{http.StatusBadRequest, "Header rule direction must be request or response"}
+		}
+		if rule.Action != "set" && rule.Action != "remove" {
+			return models.Tunnel{}, &tunnelCreateError{http.StatusBadRequest, "Header rule action must be set or remove"}
+		}
+		if rule.HeaderName == "" || len(rule.HeaderName) > 255 {
+			return models.Tunnel{}, &tunnelCreateError{http.StatusBadRequest, "Invalid header name"}
+		}
+		if len(rule.HeaderValue) > 4096 {
+			return models.Tunnel{}, &tunnelCreateError{http.StatusBadRequest, "Header value is too long"}
+		}
+		if isValid, validationError := config.ValidateHeaderRule(rule); !isValid {
+			return models.Tunnel{}, &tunnelCreateError{http.StatusBadRequest, validationError}
+		}
+		rule.HeaderName = http.CanonicalHeaderKey(rule.HeaderName)
+		if rule.Action == "remove" {
+			rule.HeaderValue = ""
+		}
+		headerRules = append(headerRules, rule)
+	}
+
+	if err := h.checkTunnelLimit(ctx, q, userID); err != nil {
+		return models.Tunnel{}, err
 	}
 
 	// Check if subdomain already exists
 	var subdomainExists bool
-	err := h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM tunnels WHERE subdomain = $1)", req.Subdomain).Scan(&subdomainExists)
+	err = q.QueryRow("SELECT EXISTS(SELECT 1 FROM tunnels WHERE subdomain = $1)", req.Subdomain).Scan(&subdomainExists)
 	if err != nil {
-		log.Printf("Failed to check subdomain existence for %s: %v", req.Subdomain, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
-		return
+		h.logger.ErrorContext(ctx, "Failed to check subdomain existence", "subdomain", req.Subdomain, "error", err)
+		return models.Tunnel{}, &tunnelCreateError{http.StatusInternalServerError, "Database error"}
 	}
 
 	if subdomainExists {
-		c.JSON(http.StatusConflict, gin.H{"error": "Subdomain already exists"})
-		return
+		return models.Tunnel{}, &tunnelCreateError{http.StatusConflict, "Subdomain already exists"}
 	}
 
 	// Generate auth token for tunnel
 	authToken := uuid.New().String()
 	tunnelID := uuid.New()
 
-	userID, err := uuid.Parse(userIDStr.(string))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
-		return
+	// Issue a client certificate for mTLS agent connections, the key is never stored
+	var clientCertDER, clientKeyPEM []byte
+	if h.ca != nil {
+		clientCertDER, clientKeyPEM, err = h.ca.IssueClientCert(tunnelID.String())
+		if err != nil {
+			h.logger.ErrorContext(ctx, "Failed to issue client certificate", "tunnel_id", tunnelID, "error", err)
+			return models.Tunnel{}, &tunnelCreateError{http.StatusInternalServerError, "Failed to issue client certificate"}
+		}
 	}
 
 	// Create tunnel
-	_, err = h.db.Exec(`
-		INSERT INTO tunnels (id, user_id, name, subdomain, local_port, auth_token) 
-		VALUES ($1, $2, $3, $4, $5, $6)
-	`, tunnelID, userID, req.Name, req.Subdomain, req.LocalPort, authToken)
+	_, err = q.Exec(`
+		INSERT INTO tunnels (id, user_id, name, subdomain, local_port, auth_token, coalesce_get_requests, tags, allow_indexing,
+			proxy_protocol_enabled, auto_restart, client_cert, transforms, write_buffer_kb,
+			blocked_countries, proxy_target_url, routing_rules, cors_bypass, sticky_session_cookie, timeout_seconds,
+			max_body_bytes, basic_auth_user, basic_auth_password_hash) 
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23)
+	`, tunnelID, userID, req.Name, req.Subdomain, req.LocalPort, authToken, req.CoalesceGetRequests, req.Tags, req.AllowIndexing,
+		req.ProxyProtocolEnabled, req.AutoRestart, clientCertDER, string(transforms), req.WriteBufferKB,
+		req.BlockedCountries, proxyTargetURL, string(routingRules), req.CORSBypass, req.StickySessionCookie, req.TimeoutSeconds,
+		req.MaxBodyBytes, basicAuthUser, basicAuthPasswordHash)
 	if err != nil {
-		log.Printf("Failed to create tunnel %s for user %s: %v", req.Name, userID, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create tunnel"})
-		return
+		h.logger.ErrorContext(ctx, "Failed to create tunnel", "name", req.Name, "user_id", userID, "error", err)
+		return models.Tunnel{}, &tunnelCreateError{http.StatusInternalServerError, "Failed to create tunnel"}
+	}
+
+	for _, rule := range ipRules {
+		_, err = q.Exec("INSERT INTO tunnel_ip_rules (tunnel_id, cidr, action) VALUES ($1, $2, $3)", tunnelID, rule.CIDR, rule.Action)
+		if err != nil {
+			h.logger.ErrorContext(ctx, "Failed to create IP rule", "tunnel_id", tunnelID, "error", err)
+			return models.Tunnel{}, &tunnelCreateError{http.StatusInternalServerError, "Failed to create tunnel"}
+		}
+	}
+
+	// Header rules apply in creation order, NOW() is the same for the whole transaction
+	for _, rule := range headerRules {
+		_, err = q.Exec(`
+			INSERT INTO tunnel_header_rules (tunnel_id, direction, action, header_name, header_value, created_at)
+			VALUES ($1, $2, $3, $4, $5, clock_timestamp())
+		`, tunnelID, rule.Direction, rule.Action, rule.HeaderName, rule.HeaderValue)
+		if err != nil {
+			h.logger.ErrorContext(ctx, "Failed to create header rule", "tunnel_id", tunnelID, "error", err)
+			return models.Tunnel{}, &tunnelCreateError{http.StatusInternalServerError, "Failed to create tunnel"}
+		}
 	}
 
 	// Return created tunnel
@@ -161,11 +526,317 @@ func (h *TunnelHandler) CreateTunnel(c *gin.Context) {
 		LocalPort: req.LocalPort,
 		AuthToken: authToken,
 		IsActive:  false,
+
+		CoalesceGetRequests: req.CoalesceGetRequests,
+		Tags:                req.Tags,
+		AllowIndexing:       req.AllowIndexing,
+
+		ProxyProtocolEnabled: req.ProxyProtocolEnabled,
+		AutoRestart:          req.AutoRestart,
+		Transforms:           req.Transforms,
+		WriteBufferKB:        req.WriteBufferKB,
+		BlockedCountries:     req.BlockedCountries,
+		ProxyTargetURL:       proxyTargetURL,
+		RoutingRules:         req.RoutingRules,
+		CORSBypass:           req.CORSBypass,
+		StickySessionCookie:  req.StickySessionCookie,
+		TimeoutSeconds:       req.TimeoutSeconds,
+		MaxBodyBytes:         req.MaxBodyBytes,
+
+		BasicAuthUser:         basicAuthUser,
+		BasicAuthPasswordHash: basicAuthPasswordHash,
+
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
+	if clientCertDER != nil {
+		tunnel.ClientCertificate = string(certs.EncodeCertificate(clientCertDER))
+		tunnel.ClientKey = string(clientKeyPEM)
+	}
+	return tunnel, nil
+}
 
-	c.JSON(http.StatusCreated, tunnel)
+// createTunnelTx runs createTunnel in a transaction of its own, so a tunnel is never left
+// without the rules it was created with
+func (h *TunnelHandler) createTunnelTx(ctx context.Context, userID uuid.UUID, req models.CreateTunnelRequest) (models.Tunnel, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		h.logger.ErrorContext(ctx, "Failed to begin tunnel creation", "user_id", userID, "error", err)
+		return models.Tunnel{}, &tunnelCreateError{http.StatusInternalServerError, "Database error"}
+	}
+	defer tx.Rollback()
+
+	tunnel, err := h.createTunnel(ctx, tx, userID, req)
+	if err != nil {
+		return models.Tunnel{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		h.logger.ErrorContext(ctx, "Failed to commit tunnel creation", "user_id", userID, "error", err)
+		return models.Tunnel{}, &tunnelCreateError{http.StatusInternalServerError, "Failed to create tunnel"}
+	}
+	return tunnel, nil
+}
+
+// ownedTunnel loads the tunnel named by the :id parameter and checks that it belongs to the
+// user. It writes the error response and returns false otherwise.
+func (h *TunnelHandler) ownedTunnel(c *gin.Context) (*models.Tunnel, bool) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return nil, false
+	}
+
+	tunnelID := c.Param("id")
+
+	tunnel, err := database.GetTunnel(h.db, tunnelID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
+		return nil, false
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch tunnel", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil, false
+	}
+
+	if tunnel.UserID.String() != userIDStr {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Tunnel does not belong to user"})
+		return nil, false
+	}
+	return tunnel, true
+}
+
+// GetTunnel returns a single tunnel owned by the user
+func (h *TunnelHandler) GetTunnel(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	tunnelID := c.Param("id")
+
+	tunnel, err := database.GetTunnel(h.db, tunnelID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch tunnel", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// Other users' tunnels are reported as missing so IDs can't be probed
+	if tunnel.UserID.String() != userIDStr {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
+		return
+	}
+
+	// Overlay real-time status like GetTunnels does
+	if protocol, exists := h.GetActiveTunnel(tunnelID); exists {
+		lastSeen := protocol.LastHeartbeat()
+		tunnel.LastSeen = &lastSeen
+		tunnel.IsActive = time.Since(lastSeen) < protocol.heartbeatTimeout()
+	}
+
+	c.JSON(http.StatusOK, tunnel)
+}
+
+// UpdateTunnel applies a partial update to a tunnel owned by the user
+func (h *TunnelHandler) UpdateTunnel(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	tunnelID := c.Param("id")
+
+	// A port change applies to the agent's connection, on the instance holding it
+	if h.forwardControlToOwner(c, tunnelID) {
+		return
+	}
+
+	var req models.UpdateTunnelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// An agent without port routing would keep forwarding to the port it connected with
+	if req.LocalPort != nil {
+		if protocol, exists := h.GetActiveTunnel(tunnelID); exists && !protocol.portRouting {
+			c.JSON(http.StatusConflict, gin.H{"error": "The connected agent can't change its local port, reconnect it to use the new port"})
+			return
+		}
+	}
+
+	var sets []string
+	var args []interface{}
+
+	if req.Name != nil {
+		args = append(args, *req.Name)
+		sets = append(sets, fmt.Sprintf("name = $%d", len(args)))
+	}
+
+	if req.LocalPort != nil {
+		args = append(args, *req.LocalPort)
+		sets = append(sets, fmt.Sprintf("local_port = $%d", len(args)))
+	}
+
+	if req.Tags != nil {
+		tags := *req.Tags
+		if tags == nil {
+			tags = []string{}
+		}
+		if isValid, validationError := config.ValidateTags(tags); !isValid {
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationError})
+			return
+		}
+		args = append(args, tags)
+		sets = append(sets, fmt.Sprintf("tags = $%d", len(args)))
+	}
+
+	if req.AllowIndexing != nil {
+		args = append(args, *req.AllowIndexing)
+		sets = append(sets, fmt.Sprintf("allow_indexing = $%d", len(args)))
+	}
+
+	if req.ProxyProtocolEnabled != nil {
+		args = append(args, *req.ProxyProtocolEnabled)
+		sets = append(sets, fmt.Sprintf("proxy_protocol_enabled = $%d", len(args)))
+	}
+
+	if req.AutoRestart != nil {
+		args = append(args, *req.AutoRestart)
+		sets = append(sets, fmt.Sprintf("auto_restart = $%d", len(args)))
+	}
+
+	if req.Transforms != nil {
+		rules := *req.Transforms
+		if rules == nil {
+			rules = []models.TransformRule{}
+		}
+		if isValid, validationError := config.ValidateTransforms(rules); !isValid {
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationError})
+			return
+		}
+		transforms, err := json.Marshal(rules)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transforms"})
+			return
+		}
+		args = append(args, string(transforms))
+		sets = append(sets, fmt.Sprintf("transforms = $%d", len(args)))
+	}
+
+	if req.WriteBufferKB != nil {
+		args = append(args, *req.WriteBufferKB)
+		sets = append(sets, fmt.Sprintf("write_buffer_kb = $%d", len(args)))
+	}
+
+	if req.BlockedCountries != nil {
+		countries := *req.BlockedCountries
+		if countries == nil {
+			countries = []string{}
+		}
+		if isValid, validationError := config.ValidateCountryCodes(countries); !isValid {
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationError})
+			return
+		}
+		args = append(args, countries)
+		sets = append(sets, fmt.Sprintf("blocked_countries = $%d", len(args)))
+	}
+
+	if req.ProxyTargetURL != nil {
+		var proxyTargetURL *string
+		if *req.ProxyTargetURL != "" {
+			if isValid, validationError := config.ValidateProxyTargetURL(*req.ProxyTargetURL); !isValid {
+				c.JSON(http.StatusBadRequest, gin.H{"error": validationError})
+				return
+			}
+			proxyTargetURL = req.ProxyTargetURL
+		}
+		args = append(args, proxyTargetURL)
+		sets = append(sets, fmt.Sprintf("proxy_target_url = $%d", len(args)))
+	}
+
+	if req.RoutingRules != nil {
+		rules := *req.RoutingRules
+		if rules == nil {
+			rules = []models.RoutingRule{}
+		}
+		if isValid, validationError := config.ValidateRoutingRules(rules); !isValid {
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationError})
+			return
+		}
+		routingRules, err := json.Marshal(rules)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid routing rules"})
+			return
+		}
+		args = append(args, string(routingRules))
+		sets = append(sets, fmt.Sprintf("routing_rules = $%d", len(args)))
+	}
+
+	if req.CORSBypass != nil {
+		args = append(args, *req.CORSBypass)
+		sets = append(sets, fmt.Sprintf("cors_bypass = $%d", len(args)))
+	}
+
+	if req.StickySessionCookie != nil {
+		args = append(args, *req.StickySessionCookie)
+		sets = append(sets, fmt.Sprintf("sticky_session_cookie = $%d", len(args)))
+	}
+
+	if req.TimeoutSeconds != nil {
+		if isValid, validationError := config.ValidateTimeoutSeconds(*req.TimeoutSeconds); !isValid {
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationError})
+			return
+		}
+		args = append(args, *req.TimeoutSeconds)
+		sets = append(sets, fmt.Sprintf("timeout_seconds = $%d", len(args)))
+	}
+
+	if req.MaxBodyBytes != nil {
+		args = append(args, *req.MaxBodyBytes)
+		sets = append(sets, fmt.Sprintf("max_body_bytes = $%d", len(args)))
+	}
+
+	if len(sets) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+
+	args = append(args, tunnelID, userIDStr)
+	query := fmt.Sprintf(`
+		UPDATE tunnels SET %s, updated_at = NOW()
+		WHERE id = $%d AND user_id = $%d
+		RETURNING %s
+	`, strings.Join(sets, ", "), len(args)-1, len(args), database.TunnelColumns)
+
+	var tunnel models.Tunnel
+	err := h.db.QueryRow(query, args...).Scan(database.TunnelScanArgs(&tunnel)...)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to update tunnel", "tunnel_id", tunnelID, "user_id", userIDStr, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update tunnel"})
+		return
+	}
+
+	// A connected agent forwards to the new port from the next request on
+	if req.LocalPort != nil {
+		if protocol, exists := h.GetActiveTunnel(tunnelID); exists {
+			protocol.SetLocalPort(tunnel.LocalPort)
+		}
+	}
+
+	c.JSON(http.StatusOK, tunnel)
 }
 
 func (h *TunnelHandler) DeleteTunnel(c *gin.Context) {
@@ -180,14 +851,14 @@ func (h *TunnelHandler) DeleteTunnel(c *gin.Context) {
 	// Delete tunnel (only if it belongs to the user)
 	result, err := h.db.Exec("DELETE FROM tunnels WHERE id = $1 AND user_id = $2", tunnelID, userIDStr)
 	if err != nil {
-		log.Printf("Failed to delete tunnel %s for user %s: %v", tunnelID, userIDStr, err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to delete tunnel", "tunnel_id", tunnelID, "user_id", userIDStr, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete tunnel"})
 		return
 	}
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		log.Printf("Failed to check deletion result for tunnel %s: %v", tunnelID, err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to check deletion result", "tunnel_id", tunnelID, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check deletion result"})
 		return
 	}
@@ -200,6 +871,98 @@ func (h *TunnelHandler) DeleteTunnel(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Tunnel deleted successfully"})
 }
 
+// DeleteTunnels deletes all of the user's tunnels, or only those listed in ?ids=uuid1,uuid2
+func (h *TunnelHandler) DeleteTunnels(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	failed := []gin.H{}
+
+	// Collect the requested IDs, rejecting malformed ones up front
+	var requestedIDs []string
+	if idsParam := c.Query("ids"); idsParam != "" {
+		for _, id := range strings.Split(idsParam, ",") {
+			id = strings.TrimSpace(id)
+			if _, err := uuid.Parse(id); err != nil {
+				failed = append(failed, gin.H{"id": id, "error": "Invalid tunnel ID"})
+				continue
+			}
+			requestedIDs = append(requestedIDs, id)
+		}
+		if len(requestedIDs) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"deleted": 0, "failed": failed})
+			return
+		}
+	}
+
+	// Find the matching tunnels owned by the user
+	var rows *sql.Rows
+	var err error
+	if requestedIDs != nil {
+		rows, err = h.db.Query("SELECT id FROM tunnels WHERE user_id = $1 AND id = ANY($2::uuid[])", userIDStr, requestedIDs)
+	} else {
+		rows, err = h.db.Query("SELECT id FROM tunnels WHERE user_id = $1", userIDStr)
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch tunnels to delete", "user_id", userIDStr, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tunnels"})
+		return
+	}
+	defer rows.Close()
+
+	owned := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			h.logger.ErrorContext(c.Request.Context(), "Failed to scan tunnel ID", "user_id", userIDStr, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan tunnel"})
+			return
+		}
+		owned[id] = true
+	}
+	// A partial list would delete some tunnels and report the rest as not found
+	if err := rows.Err(); err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch tunnels to delete", "user_id", userIDStr, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tunnels"})
+		return
+	}
+
+	for _, id := range requestedIDs {
+		if !owned[id] {
+			failed = append(failed, gin.H{"id": id, "error": "Tunnel not found"})
+		}
+	}
+
+	// Stop active tunnels first, skipping deletion of any that can't be stopped
+	toDelete := make([]string, 0, len(owned))
+	for id := range owned {
+		if protocol, active := h.GetActiveTunnel(id); active {
+			if err := protocol.SendTerminate(); err != nil {
+				h.logger.ErrorContext(c.Request.Context(), "Failed to send terminate message", "tunnel_id", id, "error", err)
+				failed = append(failed, gin.H{"id": id, "error": "Failed to stop tunnel"})
+				continue
+			}
+		}
+		toDelete = append(toDelete, id)
+	}
+
+	var deleted int64
+	if len(toDelete) > 0 {
+		result, err := h.db.Exec("DELETE FROM tunnels WHERE user_id = $1 AND id = ANY($2::uuid[])", userIDStr, toDelete)
+		if err != nil {
+			h.logger.ErrorContext(c.Request.Context(), "Failed to bulk delete tunnels", "user_id", userIDStr, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete tunnels"})
+			return
+		}
+		deleted, _ = result.RowsAffected()
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deleted": deleted, "failed": failed})
+}
+
 func (h *TunnelHandler) ConnectTunnel(c *gin.Context) {
 	userIDStr, exists := c.Get("user_id")
 	if !exists {
@@ -216,40 +979,94 @@ func (h *TunnelHandler) ConnectTunnel(c *gin.Context) {
 		return
 	}
 
-	// Validate tunnel ownership and auth token
-	var dbTunnelAuth string
-	var dbUserID string
-	err := h.db.QueryRow(
-		"SELECT auth_token, user_id FROM tunnels WHERE id = $1",
-		tunnelID,
-	).Scan(&dbTunnelAuth, &dbUserID)
+	// Agents retry against another instance or after the restart
+	if h.isShuttingDown() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is shutting down"})
+		return
+	}
+
+	// Spread out reconnect storms before they reach the database; agents retry after
+	// Retry-After with jittered backoff. The bucket is keyed by the authenticated user, so
+	// one user's agents can't drain another user's tokens.
+	if allowed, retryAfter := h.reconnects.take(fmt.Sprint(userIDStr)); !allowed {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many agents connecting, retry later"})
+		return
+	}
 
+	// Validate tunnel ownership and auth token
+	tunnel, err := database.GetTunnel(h.db, tunnelID)
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
 		return
 	}
 	if err != nil {
-		log.Printf("Failed to fetch tunnel %s from database: %v", tunnelID, err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch tunnel", "tunnel_id", tunnelID, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
 	// Verify user owns this tunnel
-	if dbUserID != userIDStr {
+	if tunnel.UserID.String() != userIDStr {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Tunnel does not belong to user"})
 		return
 	}
 
 	// Verify auth token
-	if dbTunnelAuth != tunnelAuth {
+	if tunnel.AuthToken != tunnelAuth {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid tunnel auth token"})
 		return
 	}
 
+	// Reverse proxy tunnels forward to their target URL, agents can't connect to them
+	if tunnel.ProxyTargetURL != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Tunnel is configured as a reverse proxy"})
+		return
+	}
+
+	if tunnel.IsPaused {
+		c.JSON(http.StatusConflict, gin.H{"error": "Tunnel is paused"})
+		return
+	}
+
+	// An agent that can't route by port would send every request to its own port
+	portRouting := c.GetHeader("X-Tunnel-Port-Routing") == "true"
+	if len(tunnel.RoutingRules) > 0 && !portRouting {
+		c.JSON(http.StatusConflict, gin.H{"error": "Tunnel has routing rules, which this agent version doesn't support"})
+		return
+	}
+
+	// With mTLS the agent must also present the certificate issued for this tunnel
+	if h.config.MTLSEnabled {
+		// client_cert is NULL for tunnels created before mTLS was enabled, it scans as nil
+		var clientCert []byte
+		if err := h.db.QueryRow("SELECT client_cert FROM tunnels WHERE id = $1", tunnelID).Scan(&clientCert); err != nil {
+			h.logger.ErrorContext(c.Request.Context(), "Failed to fetch client certificate", "tunnel_id", tunnelID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if clientCert == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Tunnel has no client certificate, it was created before mTLS was enabled"})
+			return
+		}
+		if !certs.PeerCertificateMatches(c.Request.TLS, clientCert) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or missing client certificate"})
+			return
+		}
+	}
+
+	// At the active tunnel limit a new connection displaces the least valuable one
+	if limit := h.config.MaxActiveTunnels; limit > 0 {
+		if _, reconnecting := h.GetActiveTunnel(tunnelID); !reconnecting && h.activeTunnelCount() >= limit && !h.evictLeastPriority() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is at its active tunnel limit"})
+			return
+		}
+	}
+
 	// Upgrade to WebSocket
 	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
-		log.Printf("Failed to upgrade to WebSocket: %v", err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to upgrade to WebSocket", "error", err)
 		return
 	}
 	defer conn.Close()
@@ -258,65 +1075,91 @@ func (h *TunnelHandler) ConnectTunnel(c *gin.Context) {
 	// This is critical for maintaining long-lived connections through NAT/firewalls
 	if tcpConn, ok := conn.UnderlyingConn().(*net.TCPConn); ok {
 		if err := tcpConn.SetKeepAlive(true); err != nil {
-			log.Printf("Failed to enable TCP keepalive for tunnel %s: %v", tunnelID, err)
+			h.logger.ErrorContext(c.Request.Context(), "Failed to enable TCP keepalive", "tunnel_id", tunnelID, "error", err)
 		} else {
 			// Send keepalive probes every 30 seconds
 			// This keeps NAT/firewall entries alive and detects dead connections
 			if err := tcpConn.SetKeepAlivePeriod(30 * time.Second); err != nil {
-				log.Printf("Failed to set TCP keepalive period for tunnel %s: %v", tunnelID, err)
+				h.logger.ErrorContext(c.Request.Context(), "Failed to set TCP keepalive period", "tunnel_id", tunnelID, "error", err)
 			} else {
-				log.Printf("TCP keepalive enabled for tunnel %s (30s interval)", tunnelID)
+				h.logger.InfoContext(c.Request.Context(), "TCP keepalive enabled", "interval", "30s", "tunnel_id", tunnelID)
 			}
 		}
-
-		// Optional: Set TCP buffer sizes for better performance
-		tcpConn.SetReadBuffer(64 * 1024)
-		tcpConn.SetWriteBuffer(64 * 1024)
 	}
 
-	// Update tunnel as active
+	// Update tunnel as active, remembering where the agent connected from for auto-restart
+	// and which instance holds the connection so other instances can forward to it
 	_, err = h.db.Exec(
-		"UPDATE tunnels SET is_active = true, last_seen = NOW(), connected_ip = $1 WHERE id = $2",
-		c.ClientIP(), tunnelID,
+		"UPDATE tunnels SET is_active = true, last_seen = NOW(), connected_ip = $1, last_agent_addr = $2, connected_instance = $3 WHERE id = $4",
+		c.ClientIP(), c.Request.RemoteAddr, h.config.InstanceID, tunnelID,
 	)
 	if err != nil {
-		log.Printf("ERROR: Failed to update tunnel status for %s: %v", tunnelID, err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to update tunnel status", "tunnel_id", tunnelID, "error", err)
 		// Send error message to agent before closing
 		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"terminate","id":"`+tunnelID+`","error":"Database error"}`))
 		return
 	}
 
-	log.Printf("Tunnel %s connected from user %s", tunnelID, userIDStr)
-
-	// Get tunnel info for local port
-	var localPort int
-	err = h.db.QueryRow("SELECT local_port FROM tunnels WHERE id = $1", tunnelID).Scan(&localPort)
-	if err != nil {
-		log.Printf("ERROR: Failed to get tunnel local port for %s: %v", tunnelID, err)
-		// Send error message to agent before closing
-		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"terminate","id":"`+tunnelID+`","error":"Database error"}`))
-		return
-	}
+	h.logger.InfoContext(c.Request.Context(), "Tunnel connected", "tunnel_id", tunnelID, "user_id", userIDStr)
 
 	// Create tunnel protocol handler
-	tunnelProtocol := NewTunnelProtocol(conn, tunnelID, localPort)
+	responseTimeout := time.Duration(tunnel.TimeoutSeconds) * time.Second
+	tunnelProtocol := NewTunnelProtocol(conn, tunnelID, tunnel.LocalPort, responseTimeout, h.config.MaxConcurrentRequests, h.config.MaxMessageBytes)
+	tunnelProtocol.logger = h.logger.With("tunnel_id", tunnelID)
+	tunnelProtocol.coalesceGetRequests = tunnel.CoalesceGetRequests
+	tunnelProtocol.proxyProtocolEnabled = tunnel.ProxyProtocolEnabled
+	tunnelProtocol.transforms = tunnel.Transforms
+	if headerRules, err := loadHeaderRules(h.db, tunnelID); err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to load header rules", "tunnel_id", tunnelID, "error", err)
+	} else {
+		tunnelProtocol.headerRules.Store(&headerRules)
+	}
+	tunnelProtocol.routingRules = tunnel.RoutingRules
+	tunnelProtocol.portRouting = portRouting
+	tunnelProtocol.corsBypass = tunnel.CORSBypass
+	tunnelProtocol.writeBufferBytes = tunnel.WriteBufferKB * 1024
+	tunnelProtocol.SetMaxBodyBytes(tunnel.MaxBodyBytes)
+	tunnelProtocol.applySocketBuffers()
+	tunnelProtocol.frameDebug = h.config.WSFrameDebug
+	tunnelProtocol.compression = negotiateCompression(c.GetHeader("X-Tunnel-Compression"))
+	if c.GetHeader("X-Tunnel-Batching") == "true" {
+		tunnelProtocol.batchWindow = h.config.BatchWindow
+	}
+	// Agents that predate request streaming only understand buffered http_request messages
+	tunnelProtocol.streamingEnabled = c.GetHeader("X-Tunnel-Streaming") == "true" &&
+		h.config.IsFeatureEnabled("streaming", tunnel.UserID)
+	tunnelProtocol.websocketControl = c.GetHeader("X-Tunnel-WebSocket-Control") == "true"
+	tunnelProtocol.events = func(eventType string, data gin.H) {
+		h.events.publish(userIDStr.(string), tunnelID, eventType, data)
+	}
 
-	// Store active tunnel
-	h.tunnelsMutex.Lock()
-	h.activeTunnels[tunnelID] = tunnelProtocol
-	h.tunnelsMutex.Unlock()
+	// Store active tunnel, unless shutdown started while the agent was connecting
+	if !h.registerTunnel(tunnelID, tunnelProtocol) {
+		tunnelProtocol.SendTerminateWithReason(shutdownReason)
+		if _, err := h.db.Exec("UPDATE tunnels SET is_active = false WHERE id = $1", tunnelID); err != nil {
+			h.logger.ErrorContext(c.Request.Context(), "Failed to update tunnel status", "tunnel_id", tunnelID, "error", err)
+		}
+		return
+	}
+	// Shutdown waits for this, so it runs after the tunnel is marked inactive below
+	defer h.connections.Done()
+	h.storeTunnel(tunnelID, tunnelProtocol)
+	tunnelProtocol.publishEvent("tunnel.connected", gin.H{"connected_ip": c.ClientIP()})
+	h.enqueueWebhook("tunnel.connected", tunnelID, c.ClientIP())
 
 	// Handle tunnel connection
-	h.handleTunnelConnection(&TunnelConnection{
+	crashed := h.handleTunnelConnection(&TunnelConnection{
 		TunnelID: tunnelID,
 		UserID:   userIDStr.(string),
 		Conn:     conn,
 	}, tunnelProtocol)
 
-	// Remove from active tunnels
-	h.tunnelsMutex.Lock()
-	delete(h.activeTunnels, tunnelID)
-	h.tunnelsMutex.Unlock()
+	// Remove from active tunnels, unless that already happened (token rotation) and a new
+	// agent may hold the entry now
+	if h.removeActiveTunnel(tunnelID, tunnelProtocol) {
+		h.unstoreTunnel(tunnelID)
+	}
+	h.flushTunnelStats(tunnelID, tunnelProtocol)
 
 	// Update tunnel as inactive when connection ends
 	_, err = h.db.Exec(
@@ -324,122 +1167,193 @@ func (h *TunnelHandler) ConnectTunnel(c *gin.Context) {
 		tunnelID,
 	)
 	if err != nil {
-		log.Printf("Failed to update tunnel status on disconnect: %v", err)
+		h.logger.ErrorContext(c.Request.Context(), "Failed to update tunnel status on disconnect", "error", err)
 	}
 
-	log.Printf("Tunnel %s disconnected", tunnelID)
+	h.logger.InfoContext(c.Request.Context(), "Tunnel disconnected", "tunnel_id", tunnelID)
+	tunnelProtocol.publishEvent("tunnel.disconnected", gin.H{"crashed": crashed})
+	h.enqueueWebhook("tunnel.disconnected", tunnelID, c.ClientIP())
+
+	if crashed {
+		go h.dispatchReconnect(tunnelID)
+	}
 }
 
-func (h *TunnelHandler) handleTunnelConnection(tunnelConn *TunnelConnection, protocol *TunnelProtocol) {
+// handleTunnelConnection runs the connection until it closes. It reports whether the agent
+// went away abnormally (crash, network loss) rather than closing cleanly or being stopped.
+func (h *TunnelHandler) handleTunnelConnection(tunnelConn *TunnelConnection, protocol *TunnelProtocol) (crashed bool) {
+	// Nothing answers pending requests once this returns, failing them lets waiting clients
+	// see the tunnel go away; event streams have no idle timeout and would wait forever
+	defer protocol.Close()
+
 	// Send connection confirmation
 	connectedMsg := &TunnelMessage{
 		Type:      "connected",
 		ID:        tunnelConn.TunnelID,
 		Timestamp: time.Now().Unix(),
 	}
+	if protocol.compression != "" || protocol.batchWindow > 0 {
+		connectedMsg.Headers = map[string]string{}
+	}
+	if protocol.compression != "" {
+		connectedMsg.Headers["compression"] = protocol.compression
+	}
+	if protocol.batchWindow > 0 {
+		connectedMsg.Headers["batching"] = "true"
+	}
 	if err := protocol.SendMessage(connectedMsg); err != nil {
-		log.Printf("Failed to send connection confirmation: %v", err)
+		protocol.logger.Error("Failed to send connection confirmation", "error", err)
 		return
 	}
 
-	// Track last heartbeat time
-	lastHeartbeat := time.Now()
-	heartbeatTimeout := 45 * time.Second // Mark inactive if no heartbeat for 45 seconds
+	// The confirmation goes out uncompressed, everything after it is compressed
+	if protocol.compression == compressionZstd {
+		if err := protocol.enableCompression(); err != nil {
+			protocol.logger.Error("Failed to enable compression", "error", err)
+			return
+		}
+	}
+	if protocol.batchWindow > 0 {
+		protocol.enableBatching(protocol.batchWindow)
+	}
 
 	// Set up ping handler to respond to agent's WebSocket control frame pings
 	tunnelConn.Conn.SetPingHandler(func(appData string) error {
 		// Extend read deadline when we receive a ping
-		tunnelConn.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		tunnelConn.Conn.SetReadDeadline(time.Now().Add(protocol.readTimeout()))
 		// Send pong response with write deadline
 		err := tunnelConn.Conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(10*time.Second))
 		if err != nil {
-			log.Printf("Failed to send pong to tunnel %s: %v", tunnelConn.TunnelID, err)
+			protocol.logger.Error("Failed to send pong", "error", err)
 		}
-		lastHeartbeat = time.Now()
-		protocol.lastHeartbeat = time.Now()
+		protocol.touchHeartbeat()
 		return err
 	})
 
+	// Ping interval changes are handed from the pong handler to the heartbeat loop
+	intervalChanges := make(chan time.Duration, 1)
+
 	// Set up pong handler to detect when agent responds to our pings
 	tunnelConn.Conn.SetPongHandler(func(appData string) error {
 		// Extend read deadline when we receive a pong
-		tunnelConn.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-		lastHeartbeat = time.Now()
-		protocol.lastHeartbeat = time.Now()
+		tunnelConn.Conn.SetReadDeadline(time.Now().Add(protocol.readTimeout()))
+		protocol.touchHeartbeat()
+
+		// Pings carry their send time so the round-trip latency can be measured
+		if sentAt, err := strconv.ParseInt(appData, 10, 64); err == nil {
+			previous := protocol.currentPingInterval()
+			if interval := protocol.adaptiveHeartbeat(time.Since(time.Unix(0, sentAt))); interval != previous {
+				select {
+				case intervalChanges <- interval:
+				default:
+				}
+			}
+		}
 		return nil
 	})
 
-	// Set initial read deadline (60 seconds allows time for first ping/pong exchange)
-	if err := tunnelConn.Conn.SetReadDeadline(time.Now().Add(60 * time.Second)); err != nil {
-		log.Printf("Failed to set initial read deadline for tunnel %s: %v", tunnelConn.TunnelID, err)
+	// Set initial read deadline (at least 60 seconds allows time for first ping/pong exchange)
+	if err := tunnelConn.Conn.SetReadDeadline(time.Now().Add(protocol.readTimeout())); err != nil {
+		protocol.logger.Error("Failed to set initial read deadline", "error", err)
 		return
 	}
 
-	// Channel to signal when read goroutine exits
+	// Channel to signal when read goroutine exits, readErr is safe to read once it's closed
 	readDone := make(chan struct{})
+	var readErr error
 
 	// Handle messages from agent in a goroutine
 	go func() {
 		defer close(readDone)
 		for {
-			_, message, err := tunnelConn.Conn.ReadMessage()
+			messageType, message, err := tunnelConn.Conn.ReadMessage()
 			if err != nil {
 				// Log all connection errors for debugging
-				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
-					log.Printf("Tunnel %s closed gracefully: %v", tunnelConn.TunnelID, err)
+				if errors.Is(err, websocket.ErrReadLimit) {
+					protocol.logger.Warn("Tunnel sent a message larger than the limit, closing connection", "limit_bytes", protocol.maxMessageBytes)
+				} else if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					protocol.logger.Info("Tunnel closed gracefully", "error", err)
 				} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					log.Printf("Tunnel %s unexpected close: %v", tunnelConn.TunnelID, err)
+					protocol.logger.Warn("Tunnel closed unexpectedly", "error", err)
 				} else {
-					log.Printf("Tunnel %s read error: %v", tunnelConn.TunnelID, err)
+					protocol.logger.Warn("Tunnel read error", "error", err)
 				}
+				readErr = err
 				return
 			}
 
 			// Extend read deadline on successful read (application-level messages)
-			tunnelConn.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+			tunnelConn.Conn.SetReadDeadline(time.Now().Add(protocol.readTimeout()))
+
+			message, err = protocol.decodeFrame(messageType, message)
+			if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+				protocol.logger.Warn("Tunnel sent a message larger than the limit, closing connection", "limit_bytes", protocol.maxMessageBytes)
+				readErr = err
+				return
+			}
+			if err != nil {
+				protocol.logger.Warn("Tunnel sent an invalid frame", "error", err)
+				continue
+			}
 
 			// Handle tunnel protocol messages
 			if err := protocol.HandleTunnelMessage(message); err != nil {
-				log.Printf("Failed to handle tunnel message: %v", err)
+				protocol.logger.Error("Failed to handle tunnel message", "error", err)
 			}
 
 			// Refresh heartbeat on any received message
-			lastHeartbeat = time.Now()
-			protocol.lastHeartbeat = time.Now()
+			protocol.touchHeartbeat()
 		}
 	}()
 
+	// The reader may be delivering a response, it has to stop before the channels are closed
+	defer func() {
+		tunnelConn.Conn.Close()
+		<-readDone
+	}()
+
 	// Heartbeat monitoring loop - send WebSocket control frame pings
-	heartbeatTicker := time.NewTicker(15 * time.Second) // Send ping every 15 seconds
+	heartbeatTicker := time.NewTicker(protocol.currentPingInterval())
 	defer heartbeatTicker.Stop()
+	storedAt := time.Now()
 
 	for {
 		select {
 		case <-readDone:
 			// Read goroutine exited, connection is closed
-			log.Printf("Tunnel %s read goroutine exited", tunnelConn.TunnelID)
-			return
+			protocol.logger.Info("Tunnel read goroutine exited")
+			return !websocket.IsCloseError(readErr, websocket.CloseNormalClosure, websocket.CloseGoingAway) &&
+				!protocol.IsDraining()
+		case interval := <-intervalChanges:
+			protocol.logger.Info("Tunnel ping interval changed", "interval", interval)
+			heartbeatTicker.Reset(interval)
 		case <-heartbeatTicker.C:
-			// Check if we've received a heartbeat recently
-			if time.Since(lastHeartbeat) > heartbeatTimeout {
-				log.Printf("Tunnel %s heartbeat timeout - marking as inactive", tunnelConn.TunnelID)
+			// Check if we've received a heartbeat recently, the timeout follows the ping interval
+			if time.Since(protocol.LastHeartbeat()) > protocol.heartbeatTimeout() {
+				protocol.logger.Warn("Tunnel heartbeat timeout - marking as inactive")
 				// Mark tunnel as inactive due to heartbeat timeout
 				_, err := h.db.Exec("UPDATE tunnels SET is_active = false WHERE id = $1", tunnelConn.TunnelID)
 				if err != nil {
-					log.Printf("Failed to mark tunnel as inactive: %v", err)
+					protocol.logger.Error("Failed to mark tunnel as inactive", "error", err)
 				}
-				return
+				return !protocol.IsDraining()
 			}
 
 			// Send WebSocket control frame ping to agent
 			err := tunnelConn.Conn.WriteControl(
 				websocket.PingMessage,
-				[]byte{},
+				[]byte(strconv.FormatInt(time.Now().UnixNano(), 10)),
 				time.Now().Add(10*time.Second),
 			)
 			if err != nil {
-				log.Printf("Failed to send ping to tunnel %s: %v", tunnelConn.TunnelID, err)
-				return
+				protocol.logger.Error("Failed to send ping", "error", err)
+				return !protocol.IsDraining()
+			}
+
+			// Keep the shared registration from expiring while the agent is connected
+			if time.Since(storedAt) > tunnelStoreRefreshInterval {
+				h.storeTunnel(tunnelConn.TunnelID, protocol)
+				storedAt = time.Now()
 			}
 		}
 	}
@@ -459,9 +1373,13 @@ func (h *TunnelHandler) StopTunnel(c *gin.Context) {
 		return
 	}
 
+	// The instance holding the agent's connection drains and terminates it
+	if h.forwardControlToOwner(c, tunnelID) {
+		return
+	}
+
 	// Verify user owns this tunnel
-	var dbUserID string
-	err := h.db.QueryRow("SELECT user_id FROM tunnels WHERE id = $1", tunnelID).Scan(&dbUserID)
+	tunnel, err := database.GetTunnel(h.db, tunnelID)
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
 		return
@@ -471,7 +1389,7 @@ func (h *TunnelHandler) StopTunnel(c *gin.Context) {
 		return
 	}
 
-	if dbUserID != userIDStr {
+	if tunnel.UserID.String() != userIDStr {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Tunnel does not belong to user"})
 		return
 	}
@@ -485,7 +1403,7 @@ func (h *TunnelHandler) StopTunnel(c *gin.Context) {
 		// No in-memory connection, but DB may still show active due to a stale state
 		// Force-mark the tunnel as inactive to reconcile state and return 200
 		if _, err := h.db.Exec("UPDATE tunnels SET is_active = false, last_seen = NOW() WHERE id = $1", tunnelID); err != nil {
-			log.Printf("Failed to reconcile inactive tunnel %s: %v", tunnelID, err)
+			h.logger.ErrorContext(c.Request.Context(), "Failed to reconcile inactive tunnel", "tunnel_id", tunnelID, "error", err)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Tunnel is not currently active"})
 			return
 		}
@@ -494,20 +1412,58 @@ func (h *TunnelHandler) StopTunnel(c *gin.Context) {
 		return
 	}
 
+	// Stop accepting new requests; a repeated stop while draining just reports progress
+	if !protocol.StartDraining() {
+		c.JSON(http.StatusAccepted, gin.H{"message": "draining", "pending_requests": protocol.PendingRequests()})
+		return
+	}
+
+	// Nothing in flight, terminate right away
+	if protocol.IsIdle() {
+		if err := h.terminateTunnel(tunnelID, protocol); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to stop tunnel"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Tunnel stop signal sent successfully"})
+		return
+	}
+
+	// Let in-flight requests finish (up to the drain timeout) before terminating
+	go func() {
+		if !protocol.WaitForDrain(h.config.DrainTimeout) {
+			h.logger.Warn("Drain timeout with requests still pending", "tunnel_id", tunnelID, "pending_requests", protocol.PendingRequests())
+		}
+		h.terminateTunnel(tunnelID, protocol)
+	}()
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "draining", "pending_requests": protocol.PendingRequests()})
+}
+
+// terminateTunnel sends the terminate message to the agent and marks the tunnel inactive
+func (h *TunnelHandler) terminateTunnel(tunnelID string, protocol *TunnelProtocol) error {
 	// Send terminate message to agent
 	if err := protocol.SendTerminate(); err != nil {
-		log.Printf("Failed to send terminate message to tunnel %s: %v", tunnelID, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to stop tunnel"})
-		return
+		h.logger.Error("Failed to send terminate message", "tunnel_id", tunnelID, "error", err)
+		return err
 	}
 
 	// Mark tunnel as inactive in database
-	_, err = h.db.Exec("UPDATE tunnels SET is_active = false WHERE id = $1", tunnelID)
-	if err != nil {
-		log.Printf("Failed to update tunnel status: %v", err)
+	if _, err := h.db.Exec("UPDATE tunnels SET is_active = false WHERE id = $1", tunnelID); err != nil {
+		h.logger.Error("Failed to update tunnel status", "error", err)
 	}
+	return nil
+}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Tunnel stop signal sent successfully"})
+// removeActiveTunnel removes a tunnel's connection from the active tunnels if it is still the
+// registered one, and reports whether it was
+func (h *TunnelHandler) removeActiveTunnel(tunnelID string, protocol *TunnelProtocol) bool {
+	h.tunnelsMutex.Lock()
+	defer h.tunnelsMutex.Unlock()
+	if h.activeTunnels[tunnelID] != protocol {
+		return false
+	}
+	delete(h.activeTunnels, tunnelID)
+	return true
 }
 
 // GetActiveTunnel returns the active tunnel protocol for a given tunnel ID
@@ -517,3 +1473,61 @@ func (h *TunnelHandler) GetActiveTunnel(tunnelID string) (*TunnelProtocol, bool)
 	tunnel, exists := h.activeTunnels[tunnelID]
 	return tunnel, exists
 }
+
+// GetCurlCommand returns a ready-to-run curl command for testing a tunnel
+func (h *TunnelHandler) GetCurlCommand(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	tunnelID := c.Param("id")
+
+	var subdomain string
+	err := h.db.QueryRow(
+		"SELECT subdomain FROM tunnels WHERE id = $1 AND user_id = $2",
+		tunnelID, userIDStr,
+	).Scan(&subdomain)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch tunnel for curl command", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	path := c.DefaultQuery("path", "/")
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	method := strings.ToUpper(c.DefaultQuery("method", http.MethodGet))
+	body := c.Query("body")
+
+	parts := []string{"curl", "-v"}
+	if method != http.MethodGet {
+		parts = append(parts, "-X", method)
+	}
+	parts = append(parts, shellQuote(h.tunnelPublicURL(subdomain)+path))
+	if body != "" {
+		parts = append(parts, "-H", shellQuote("Content-Type: application/json"), "-d", shellQuote(body))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"curl_command": strings.Join(parts, " ")})
+}
+
+// tunnelPublicURL returns the public URL a tunnel is reachable at
+func (h *TunnelHandler) tunnelPublicURL(subdomain string) string {
+	scheme := "https"
+	if strings.HasPrefix(h.config.Domain, "localhost") {
+		scheme = "http"
+	}
+	return scheme + "://" + subdomain + "." + h.config.Domain
+}
+
+// shellQuote wraps a value in single quotes so it can be pasted into a POSIX shell
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
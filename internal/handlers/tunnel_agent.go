@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serverRequestTimeout bounds how long the server waits for the agent to answer a server_request
+const serverRequestTimeout = 10 * time.Second
+
+// agentOperations maps management operations exposed by the API to requests on the agent process
+var agentOperations = map[string]struct {
+	method string
+	path   string
+}{
+	"ports":   {http.MethodGet, "/ports"},
+	"version": {http.MethodGet, "/version"},
+	"restart": {http.MethodPost, "/restart"},
+}
+
+// ServerRequest sends a request to the agent process itself (not to the local service)
+// and waits for its server_response
+func (tp *TunnelProtocol) ServerRequest(ctx context.Context, method, path string, body []byte) (*TunnelMessage, error) {
+	requestID := fmt.Sprintf("%s-srv-%d", tp.tunnelID, atomic.AddInt64(&tp.requestCount, 1))
+
+	responseChan, err := tp.addPendingRequest(requestID)
+	if err != nil {
+		return nil, err
+	}
+	defer tp.removePendingRequest(requestID)
+
+	message := &TunnelMessage{
+		Type:      "server_request",
+		ID:        requestID,
+		Method:    method,
+		URL:       path,
+		Body:      body,
+		Timestamp: time.Now().Unix(),
+	}
+	if err := tp.sendMessage(message); err != nil {
+		return nil, fmt.Errorf("failed to send server request: %w", err)
+	}
+
+	select {
+	case response, ok := <-responseChan:
+		if !ok {
+			return nil, errors.New("tunnel closed")
+		}
+		if response.Error != "" {
+			return response, errors.New(response.Error)
+		}
+		return response, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// AgentOperation runs a management operation (ports, version, restart) on a connected agent
+func (h *TunnelHandler) AgentOperation(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	tunnelID := c.Param("id")
+
+	operation, known := agentOperations[c.Param("operation")]
+	if !known || operation.method != c.Request.Method {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown agent operation"})
+		return
+	}
+
+	// Verify user owns this tunnel
+	var dbUserID string
+	err := h.db.QueryRow("SELECT user_id FROM tunnels WHERE id = $1", tunnelID).Scan(&dbUserID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch tunnel for agent operation", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if dbUserID != userIDStr {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Tunnel does not belong to user"})
+		return
+	}
+
+	protocol, exists := h.GetActiveTunnel(tunnelID)
+	if !exists {
+		c.JSON(http.StatusConflict, gin.H{"error": "Tunnel not connected"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), serverRequestTimeout)
+	defer cancel()
+
+	response, err := protocol.ServerRequest(ctx, operation.method, operation.path, nil)
+	if errors.Is(err, context.DeadlineExceeded) {
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "Agent did not respond"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Agent operation failed", "operation", operation.path, "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	status := response.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	// Agents answer with JSON, anything else is passed back as a string
+	if json.Valid(response.Body) {
+		c.Data(status, "application/json; charset=utf-8", response.Body)
+		return
+	}
+	c.JSON(status, gin.H{"result": string(response.Body)})
+}
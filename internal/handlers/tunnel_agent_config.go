@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"skyport-server/internal/database"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AgentConfig is everything the agent needs to connect a tunnel
+type AgentConfig struct {
+	ServerURL string `json:"server_url"`
+	TunnelID  string `json:"tunnel_id"`
+	AuthToken string `json:"auth_token"`
+	LocalPort int    `json:"local_port"`
+	Name      string `json:"name"`
+}
+
+// GetAgentConfig downloads the agent configuration for a tunnel, as JSON by default
+// or as a shell script exporting environment variables with ?format=sh
+func (h *TunnelHandler) GetAgentConfig(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	tunnelID := c.Param("id")
+
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "sh" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or sh"})
+		return
+	}
+
+	tunnel, err := database.GetTunnel(h.db, tunnelID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch tunnel for agent config", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if tunnel.UserID.String() != userIDStr {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Tunnel does not belong to user"})
+		return
+	}
+
+	agentConfig := AgentConfig{
+		ServerURL: h.websocketScheme() + "://" + h.config.Domain + "/api/v1/tunnel/connect",
+		TunnelID:  tunnel.ID.String(),
+		AuthToken: tunnel.AuthToken,
+		LocalPort: tunnel.LocalPort,
+		Name:      tunnel.Name,
+	}
+
+	// The file contains the tunnel's auth token
+	c.Header("Cache-Control", "no-store")
+
+	if format == "sh" {
+		c.Header("Content-Disposition", "attachment; filename=skyport-agent.sh")
+		c.Data(http.StatusOK, "text/x-shellscript", []byte(agentConfigScript(agentConfig)))
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=skyport-agent.json")
+	c.IndentedJSON(http.StatusOK, agentConfig)
+}
+
+// agentConfigScript renders the config as environment variables for the agent
+func agentConfigScript(agentConfig AgentConfig) string {
+	var script strings.Builder
+	script.WriteString("#!/bin/sh\n")
+	script.WriteString("# SkyPort agent configuration, source this file before starting the agent\n")
+	fmt.Fprintf(&script, "export SKYPORT_SERVER_URL=%s\n", shellQuote(agentConfig.ServerURL))
+	fmt.Fprintf(&script, "export SKYPORT_TUNNEL_ID=%s\n", shellQuote(agentConfig.TunnelID))
+	fmt.Fprintf(&script, "export SKYPORT_AUTH_TOKEN=%s\n", shellQuote(agentConfig.AuthToken))
+	fmt.Fprintf(&script, "export SKYPORT_LOCAL_PORT=%d\n", agentConfig.LocalPort)
+	fmt.Fprintf(&script, "export SKYPORT_TUNNEL_NAME=%s\n", shellQuote(agentConfig.Name))
+	return script.String()
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"skyport-server/internal/database"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AgentMetrics is the local service health the agent reports with "metrics" messages:
+//
+//	{"type":"metrics","id":"...","cpu_percent":12.5,"memory_mb":256,"active_connections":5,"local_service_healthy":true}
+type AgentMetrics struct {
+	CPUPercent          float64   `json:"cpu_percent"`
+	MemoryMB            float64   `json:"memory_mb"`
+	ActiveConnections   int       `json:"active_connections"`
+	LocalServiceHealthy bool      `json:"local_service_healthy"`
+	ReceivedAt          time.Time `json:"received_at"`
+}
+
+// agentMetricsState holds the latest report from the agent
+type agentMetricsState struct {
+	mutex  sync.RWMutex
+	latest *AgentMetrics
+}
+
+// handleAgentMetrics stores a metrics report. The values are top-level fields of the
+// message, so the raw frame is decoded again into AgentMetrics.
+func (tp *TunnelProtocol) handleAgentMetrics(messageBytes []byte) error {
+	var metrics AgentMetrics
+	if err := json.Unmarshal(messageBytes, &metrics); err != nil {
+		return fmt.Errorf("failed to unmarshal agent metrics: %w", err)
+	}
+	metrics.ReceivedAt = time.Now()
+
+	tp.agentMetrics.mutex.Lock()
+	tp.agentMetrics.latest = &metrics
+	tp.agentMetrics.mutex.Unlock()
+	return nil
+}
+
+// AgentMetrics returns the latest metrics reported by the agent, or nil if none arrived yet
+func (tp *TunnelProtocol) AgentMetrics() *AgentMetrics {
+	tp.agentMetrics.mutex.RLock()
+	defer tp.agentMetrics.mutex.RUnlock()
+	if tp.agentMetrics.latest == nil {
+		return nil
+	}
+	metrics := *tp.agentMetrics.latest
+	return &metrics
+}
+
+// GetAgentMetrics returns the local service health last reported by the tunnel's agent
+func (h *TunnelHandler) GetAgentMetrics(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	tunnelID := c.Param("id")
+
+	tunnel, err := database.GetTunnel(h.db, tunnelID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch tunnel for agent metrics", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if tunnel.UserID.String() != userIDStr {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Tunnel does not belong to user"})
+		return
+	}
+
+	protocol, exists := h.GetActiveTunnel(tunnelID)
+	if !exists {
+		c.JSON(http.StatusOK, gin.H{"tunnel_id": tunnelID, "active": false, "metrics": nil})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tunnel_id": tunnelID, "active": true, "metrics": protocol.AgentMetrics()})
+}
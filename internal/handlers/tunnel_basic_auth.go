@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"math"
+	"net/http"
+	"skyport-server/internal/models"
+	"skyport-server/internal/templates"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxBasicAuthCacheEntries bounds the verified credentials kept in memory, the cache is
+// cleared when it fills up
+const maxBasicAuthCacheEntries = 10000
+
+// basicAuthCache remembers credentials that passed bcrypt, which is far too slow to run on
+// every proxied request. Entries are keyed by the stored hash too, so changing the password
+// invalidates them.
+type basicAuthCache struct {
+	mutex    sync.Mutex
+	verified map[[sha256.Size]byte]struct{}
+}
+
+func basicAuthCacheKey(passwordHash, username, password string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(passwordHash + "\x00" + username + "\x00" + password))
+}
+
+func (bc *basicAuthCache) contains(key [sha256.Size]byte) bool {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	_, found := bc.verified[key]
+	return found
+}
+
+func (bc *basicAuthCache) add(key [sha256.Size]byte) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	if bc.verified == nil || len(bc.verified) >= maxBasicAuthCacheEntries {
+		bc.verified = make(map[[sha256.Size]byte]struct{})
+	}
+	bc.verified[key] = struct{}{}
+}
+
+const (
+	// basicAuthFailureBurst is how many uncached passwords one tunnel checks at once
+	basicAuthFailureBurst = 10
+	// basicAuthFailureRefillPerSecond is the sustained rate of password checks per tunnel
+	basicAuthFailureRefillPerSecond = 1
+)
+
+// basicAuthLimiter bounds the bcrypt compares run for each tunnel. Every wrong password costs
+// a full compare, so without a limit anyone can keep the CPU busy by guessing. Credentials
+// already in the cache don't use it up, visitors that signed in before keep getting through.
+type basicAuthLimiter struct {
+	mutex   sync.Mutex
+	tunnels map[string]*tokenBucket
+}
+
+// take consumes a token from the tunnel's bucket. When it's empty nothing is consumed and it
+// returns false and how long until the next check is allowed.
+func (bl *basicAuthLimiter) take(subdomain string) (bool, time.Duration) {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	now := time.Now()
+	bucket, ok := bl.tunnels[subdomain]
+	if ok {
+		bucket.refill(now)
+	} else {
+		bl.prune(now)
+		bucket = newTokenBucket(basicAuthFailureBurst, basicAuthFailureRefillPerSecond, now)
+		if bl.tunnels == nil {
+			bl.tunnels = make(map[string]*tokenBucket)
+		}
+		bl.tunnels[subdomain] = bucket
+	}
+
+	if wait := bucket.wait(); wait > 0 {
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// prune drops the buckets that have refilled completely. The caller holds mutex.
+func (bl *basicAuthLimiter) prune(now time.Time) {
+	for subdomain, bucket := range bl.tunnels {
+		bucket.refill(now)
+		if bucket.tokens >= bucket.burst {
+			delete(bl.tunnels, subdomain)
+		}
+	}
+}
+
+// checkBasicAuth verifies the visitor's credentials for a tunnel protected by basic auth,
+// otherwise a challenge is written and false returned. The Authorization header is kept so
+// an instance the request is forwarded to can check it again; it is removed just before
+// the request reaches the local service.
+func (h *ProxyHandler) checkBasicAuth(c *gin.Context, subdomain, username, passwordHash string) bool {
+	givenUser, givenPassword, ok := c.Request.BasicAuth()
+	if ok && subtle.ConstantTimeCompare([]byte(givenUser), []byte(username)) == 1 {
+		key := basicAuthCacheKey(passwordHash, givenUser, givenPassword)
+		if h.basicAuth.contains(key) {
+			return true
+		}
+		if allowed, retryAfter := h.basicAuthAttempts.take(subdomain); !allowed {
+			h.rejectBasicAuthAttempt(c, retryAfter)
+			return false
+		}
+		if bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(givenPassword)) == nil {
+			h.basicAuth.add(key)
+			return true
+		}
+	}
+
+	// The challenge makes browsers show their own login dialog, the page is shown if it's cancelled
+	c.Header("WWW-Authenticate", `Basic realm="`+subdomain+`", charset="UTF-8"`)
+	html, err := templates.RenderErrorPage(templates.ErrorPageData{
+		Title:     "Authentication Required",
+		ErrorCode: "401",
+		Message:   "This tunnel is protected. Reload the page and sign in with the username and password from its owner.",
+	})
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to render template", "error", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return false
+	}
+	renderAndRespond(c, http.StatusUnauthorized, html)
+	return false
+}
+
+// rejectBasicAuthAttempt answers 429 when the tunnel has checked too many passwords recently
+func (h *ProxyHandler) rejectBasicAuthAttempt(c *gin.Context, retryAfter time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	html, err := templates.RenderErrorPage(templates.ErrorPageData{
+		Title:     "Too Many Attempts",
+		ErrorCode: "429",
+		Message:   "Too many sign-in attempts for this tunnel. Wait a moment and try again.",
+	})
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to render template", "error", err)
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many sign-in attempts"})
+		return
+	}
+	renderAndRespond(c, http.StatusTooManyRequests, html)
+}
+
+// stripBasicAuth removes the visitor's tunnel credentials once the request is handled by this
+// instance, so they don't reach the local service
+func stripBasicAuth(c *gin.Context, protected bool) {
+	if protected {
+		c.Request.Header.Del("Authorization")
+	}
+}
+
+// SetBasicAuth protects a tunnel with a username and password that visitors must enter
+func (h *TunnelHandler) SetBasicAuth(c *gin.Context) {
+	var req models.SetBasicAuthRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// The header joins the two with a colon, so it can't be part of the username
+	if strings.Contains(req.Username, ":") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username must not contain a colon"})
+		return
+	}
+
+	tunnel, ok := h.ownedTunnel(c)
+	if !ok {
+		return
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to hash basic auth password", "tunnel_id", tunnel.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set basic auth"})
+		return
+	}
+
+	_, err = h.db.Exec(
+		"UPDATE tunnels SET basic_auth_user = $1, basic_auth_password_hash = $2, updated_at = NOW() WHERE id = $3",
+		req.Username, string(passwordHash), tunnel.ID,
+	)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to set basic auth", "tunnel_id", tunnel.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set basic auth"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Basic auth enabled", "basic_auth_user": req.Username})
+}
+
+// DeleteBasicAuth makes a tunnel reachable without credentials again
+func (h *TunnelHandler) DeleteBasicAuth(c *gin.Context) {
+	tunnel, ok := h.ownedTunnel(c)
+	if !ok {
+		return
+	}
+
+	_, err := h.db.Exec(
+		"UPDATE tunnels SET basic_auth_user = NULL, basic_auth_password_hash = NULL, updated_at = NOW() WHERE id = $1",
+		tunnel.ID,
+	)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to remove basic auth", "tunnel_id", tunnel.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove basic auth"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Basic auth disabled"})
+}
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxBatchMessages flushes a batch early once it holds this many messages
+	maxBatchMessages = 64
+	// maxBatchedBodyBytes is the largest request body that is batched, bigger requests
+	// gain nothing from sharing a frame and are sent on their own
+	maxBatchedBodyBytes = 4 * 1024
+)
+
+// messageBatcher accumulates small outgoing requests for up to window and sends them to the
+// agent as one "batch" message whose Messages the agent processes individually. Senders
+// wait for the flush so they still see write errors.
+type messageBatcher struct {
+	tp     *TunnelProtocol
+	window time.Duration
+
+	mutex    sync.Mutex
+	pending  []*TunnelMessage
+	waiters  []chan error
+	timer    *time.Timer
+	sequence int64
+}
+
+func (b *messageBatcher) send(message *TunnelMessage) error {
+	done := make(chan error, 1)
+
+	b.mutex.Lock()
+	b.pending = append(b.pending, message)
+	b.waiters = append(b.waiters, done)
+	if len(b.pending) >= maxBatchMessages {
+		messages, waiters := b.take()
+		b.mutex.Unlock()
+		b.write(messages, waiters)
+	} else {
+		if len(b.pending) == 1 {
+			b.timer = time.AfterFunc(b.window, b.flush)
+		}
+		b.mutex.Unlock()
+	}
+
+	return <-done
+}
+
+// flush sends whatever is pending when the batch window closes
+func (b *messageBatcher) flush() {
+	b.mutex.Lock()
+	messages, waiters := b.take()
+	b.mutex.Unlock()
+	b.write(messages, waiters)
+}
+
+// take empties the pending batch, the caller holds the mutex
+func (b *messageBatcher) take() ([]*TunnelMessage, []chan error) {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	messages, waiters := b.pending, b.waiters
+	b.pending, b.waiters = nil, nil
+	return messages, waiters
+}
+
+func (b *messageBatcher) write(messages []*TunnelMessage, waiters []chan error) {
+	if len(messages) == 0 {
+		return
+	}
+
+	var err error
+	if len(messages) == 1 {
+		err = b.tp.writeMessage(messages[0])
+	} else {
+		err = b.tp.writeMessage(&TunnelMessage{
+			Type:      "batch",
+			ID:        fmt.Sprintf("%s-batch-%d", b.tp.tunnelID, atomic.AddInt64(&b.sequence, 1)),
+			Messages:  messages,
+			Timestamp: time.Now().Unix(),
+		})
+	}
+
+	for _, waiter := range waiters {
+		waiter <- err
+	}
+}
+
+// isBatchable reports whether a message may wait for a batch. Only complete small requests
+// qualify; stream, WebSocket and control messages keep their ordering and latency.
+func isBatchable(message *TunnelMessage) bool {
+	return message.Type == "http_request" && len(message.Body) <= maxBatchedBodyBytes
+}
+
+// enableBatching starts batching small requests. It is called once the agent has been told
+// batching was accepted.
+func (tp *TunnelProtocol) enableBatching(window time.Duration) {
+	tp.batcher.Store(&messageBatcher{tp: tp, window: window})
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// BenchmarkSmallRequestFrames sends small requests from many goroutines at once and reports
+// how many frames reach the agent per request, with and without batching
+func BenchmarkSmallRequestFrames(b *testing.B) {
+	for _, bench := range []struct {
+		name   string
+		window time.Duration
+	}{
+		{"unbatched", 0},
+		{"batched", 5 * time.Millisecond},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			tp, client := agentConnection(b)
+			if bench.window > 0 {
+				tp.enableBatching(bench.window)
+			}
+
+			// The agent counts frames and the requests they carry until all have arrived
+			var frames int64
+			done := make(chan error, 1)
+			go func() {
+				for received := 0; received < b.N; {
+					var message TunnelMessage
+					if err := client.ReadJSON(&message); err != nil {
+						done <- err
+						return
+					}
+					frames++
+					if message.Type == "batch" {
+						received += len(message.Messages)
+					} else {
+						received++
+					}
+				}
+				done <- nil
+			}()
+
+			var sequence int64
+			b.SetParallelism(64)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					message := &TunnelMessage{
+						Type:   "http_request",
+						ID:     "req-" + strconv.FormatInt(atomic.AddInt64(&sequence, 1), 10),
+						Method: http.MethodGet,
+						URL:    "/api/health",
+					}
+					if err := tp.sendMessage(message); err != nil {
+						b.Errorf("send: %v", err)
+						return
+					}
+				}
+			})
+			if err := <-done; err != nil {
+				b.Fatalf("read: %v", err)
+			}
+			b.ReportMetric(float64(frames)/float64(b.N), "frames/req")
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"skyport-server/internal/database"
+	"skyport-server/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CloneTunnel creates a tunnel with the same settings as an existing one under a new
+// subdomain. The clone gets its own ID and auth token and starts disconnected.
+func (h *TunnelHandler) CloneTunnel(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	if !requireVerifiedEmail(c) {
+		return
+	}
+
+	var req models.CloneTunnelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tunnelID := c.Param("id")
+
+	source, err := database.GetTunnel(h.db, tunnelID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch tunnel for clone", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if source.UserID.String() != userIDStr {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Tunnel does not belong to user"})
+		return
+	}
+
+	name := req.Name
+	if name == "" {
+		name = source.Name
+	}
+
+	// Runtime state (connection, agent callback, certificates) belongs to the source tunnel
+	cloneReq := models.CreateTunnelRequest{
+		Name:                 name,
+		Subdomain:            req.Subdomain,
+		LocalPort:            source.LocalPort,
+		CoalesceGetRequests:  source.CoalesceGetRequests,
+		Tags:                 source.Tags,
+		AllowIndexing:        source.AllowIndexing,
+		ProxyProtocolEnabled: source.ProxyProtocolEnabled,
+		AutoRestart:          source.AutoRestart,
+		Transforms:           source.Transforms,
+		WriteBufferKB:        source.WriteBufferKB,
+		BlockedCountries:     source.BlockedCountries,
+		RoutingRules:         source.RoutingRules,
+		CORSBypass:           source.CORSBypass,
+		StickySessionCookie:  source.StickySessionCookie,
+		TimeoutSeconds:       source.TimeoutSeconds,
+		MaxBodyBytes:         source.MaxBodyBytes,
+	}
+	if source.ProxyTargetURL != nil {
+		cloneReq.ProxyTargetURL = *source.ProxyTargetURL
+	}
+	// The clone is protected by the same credentials, it must not come up public
+	if source.BasicAuthUser != nil && source.BasicAuthPasswordHash != nil {
+		cloneReq.BasicAuthUser = *source.BasicAuthUser
+		cloneReq.BasicAuthPasswordHash = *source.BasicAuthPasswordHash
+	}
+
+	ipRules, err := loadIPRules(h.db, tunnelID)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch IP rules for clone", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	for _, rule := range ipRules {
+		cloneReq.IPRules = append(cloneReq.IPRules, models.CreateIPRuleRequest{CIDR: rule.CIDR, Action: rule.Action})
+	}
+
+	headerRules, err := loadHeaderRules(h.db, tunnelID)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch header rules for clone", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	for _, rule := range headerRules {
+		cloneReq.HeaderRules = append(cloneReq.HeaderRules, models.CreateHeaderRuleRequest{
+			Direction:   rule.Direction,
+			Action:      rule.Action,
+			HeaderName:  rule.HeaderName,
+			HeaderValue: rule.HeaderValue,
+		})
+	}
+
+	// The clone and its rules are created in one transaction
+	tunnel, err := h.createTunnelTx(c.Request.Context(), source.UserID, cloneReq)
+	if err != nil {
+		c.JSON(createErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, tunnel)
+}
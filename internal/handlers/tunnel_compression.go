@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressionZstd is the only message compression the server supports
+const compressionZstd = "zstd"
+
+// The encoder and decoder are safe for concurrent EncodeAll/DecodeAll calls, so every
+// tunnel shares one pair instead of holding its own window buffers. The decoder's output
+// limit comes from the first tunnel to enable compression, every tunnel gets the same
+// MaxMessageBytes from the config.
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func sharedZstd(maxDecodedBytes int64) (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if zstdErr != nil {
+			return
+		}
+		// Without a limit a small frame could decompress into gigabytes, the read limit on
+		// the connection only applies to the compressed size
+		options := []zstd.DOption{zstd.WithDecoderConcurrency(0)}
+		if maxDecodedBytes > 0 {
+			options = append(options, zstd.WithDecoderMaxMemory(uint64(maxDecodedBytes)))
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, options...)
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+// negotiateCompression picks a compression from the agent's comma-separated offer
+// (X-Tunnel-Compression header), or "" to keep messages uncompressed
+func negotiateCompression(offer string) string {
+	for _, algorithm := range strings.Split(offer, ",") {
+		if strings.EqualFold(strings.TrimSpace(algorithm), compressionZstd) {
+			return compressionZstd
+		}
+	}
+	return ""
+}
+
+// enableCompression switches outgoing messages to zstd-compressed binary frames.
+// It is called once the agent has been told compression was accepted.
+func (tp *TunnelProtocol) enableCompression() error {
+	encoder, decoder, err := sharedZstd(tp.maxMessageBytes)
+	if err != nil {
+		return fmt.Errorf("failed to initialize zstd: %w", err)
+	}
+	tp.zstdEncoder = encoder
+	tp.zstdDecoder = decoder
+	tp.compressionEnabled.Store(true)
+	return nil
+}
+
+// encodeFrame returns the websocket frame type and payload for a marshalled message
+func (tp *TunnelProtocol) encodeFrame(data []byte) (int, []byte) {
+	if !tp.compressionEnabled.Load() {
+		return websocket.TextMessage, data
+	}
+	return websocket.BinaryMessage, tp.zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/2))
+}
+
+// decodeFrame returns the JSON message carried by a frame; binary frames are compressed.
+// Frames that decompress to more than maxMessageBytes, or declare a window larger than it,
+// fail with zstd.ErrDecoderSizeExceeded or zstd.ErrWindowSizeExceeded.
+func (tp *TunnelProtocol) decodeFrame(messageType int, data []byte) ([]byte, error) {
+	if messageType != websocket.BinaryMessage || !tp.compressionEnabled.Load() {
+		return data, nil
+	}
+	decoded, err := tp.zstdDecoder.DecodeAll(data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress tunnel message: %w", err)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// typicalTraffic returns marshalled messages shaped like what tunnels usually carry: a
+// request with browser headers, a JSON API response and an HTML page
+func typicalTraffic(b *testing.B) map[string][]byte {
+	b.Helper()
+
+	headers := map[string]string{
+		"Accept":          "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+		"Accept-Encoding": "gzip, deflate, br",
+		"Accept-Language": "en-US,en;q=0.9",
+		"Cookie":          "session=3f1c9a0e6b7d4c2a8e5f0b1d9c7a6e4f; theme=dark",
+		"User-Agent":      "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36",
+	}
+
+	var items []map[string]any
+	for i := 0; i < 50; i++ {
+		items = append(items, map[string]any{
+			"id":         fmt.Sprintf("item-%04d", i),
+			"name":       fmt.Sprintf("Product %d", i),
+			"price":      float64(i) * 9.99,
+			"in_stock":   i%3 != 0,
+			"tags":       []string{"sale", "featured"},
+			"created_at": "2026-01-15T10:30:00Z",
+		})
+	}
+	apiBody, err := json.Marshal(map[string]any{"items": items, "total": len(items)})
+	if err != nil {
+		b.Fatalf("marshal body: %v", err)
+	}
+
+	var page strings.Builder
+	page.WriteString("<!DOCTYPE html><html><head><title>Dashboard</title></head><body><ul>")
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&page, `<li class="row"><a href="/items/%d">Item %d</a><span class="price">%d.99</span></li>`, i, i, i)
+	}
+	page.WriteString("</ul></body></html>")
+
+	messages := map[string]*TunnelMessage{
+		"request": {Type: "http_request", ID: "req-1", Method: "GET", URL: "/api/items?page=1", Headers: headers},
+		"json": {Type: "http_response", ID: "req-1", Status: 200,
+			Headers: map[string]string{"Content-Type": "application/json"}, Body: apiBody},
+		"html": {Type: "http_response", ID: "req-2", Status: 200,
+			Headers: map[string]string{"Content-Type": "text/html; charset=utf-8"}, Body: []byte(page.String())},
+	}
+
+	frames := make(map[string][]byte, len(messages))
+	for name, message := range messages {
+		data, err := json.Marshal(message)
+		if err != nil {
+			b.Fatalf("marshal %s: %v", name, err)
+		}
+		frames[name] = data
+	}
+	return frames
+}
+
+func compressedProtocol(b *testing.B) *TunnelProtocol {
+	b.Helper()
+	tp := &TunnelProtocol{maxMessageBytes: 32 * 1024 * 1024}
+	if err := tp.enableCompression(); err != nil {
+		b.Fatalf("enable compression: %v", err)
+	}
+	return tp
+}
+
+// BenchmarkEncodeFrame measures the CPU cost of compressing typical messages and reports
+// the compression ratio (original size / compressed size)
+func BenchmarkEncodeFrame(b *testing.B) {
+	tp := compressedProtocol(b)
+	for name, data := range typicalTraffic(b) {
+		b.Run(name, func(b *testing.B) {
+			_, payload := tp.encodeFrame(data)
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tp.encodeFrame(data)
+			}
+			b.ReportMetric(float64(len(data))/float64(len(payload)), "ratio")
+		})
+	}
+}
+
+// BenchmarkDecodeFrame measures the CPU cost of decompressing the same messages
+func BenchmarkDecodeFrame(b *testing.B) {
+	tp := compressedProtocol(b)
+	for name, data := range typicalTraffic(b) {
+		b.Run(name, func(b *testing.B) {
+			_, payload := tp.encodeFrame(data)
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := tp.decodeFrame(websocket.BinaryMessage, payload); err != nil {
+					b.Fatalf("decode: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+package handlers
+
+import "net/http"
+
+// applyCORSBypass overwrites the CORS headers of a response from a tunnel with cors_bypass
+// enabled so browsers accept it from any origin. Meant for development tunnels only.
+func (tp *TunnelProtocol) applyCORSBypass(header http.Header) {
+	if !tp.corsBypass {
+		return
+	}
+	header.Set("Access-Control-Allow-Origin", "*")
+	header.Set("Access-Control-Allow-Methods", "*")
+	header.Set("Access-Control-Allow-Headers", "*")
+}
+
+// writeCORSBypassPreflight answers a preflight without asking the local service
+func (tp *TunnelProtocol) writeCORSBypassPreflight(w http.ResponseWriter) {
+	tp.applyCORSBypass(w.Header())
+	w.WriteHeader(http.StatusNoContent)
+}
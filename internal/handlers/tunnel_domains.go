@@ -0,0 +1,274 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"skyport-server/internal/models"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// maxCustomDomainsPerTunnel bounds the domains one tunnel can be reached on
+	maxCustomDomainsPerTunnel = 5
+	// customDomainRecordPrefix is the label of the TXT record that proves domain ownership
+	customDomainRecordPrefix = "_skyport-verification."
+	// customDomainRecordValue prefixes the verification token in the TXT record
+	customDomainRecordValue = "skyport-verification="
+	// customDomainLookupTimeout bounds the DNS lookup of a verification
+	customDomainLookupTimeout = 5 * time.Second
+)
+
+// domainLabelPattern matches one DNS label: letters, digits and inner hyphens
+var domainLabelPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// normalizeCustomDomain lowercases a domain and checks that it is a fully qualified host
+// name outside the tunnel domain, whose subdomains are handed out as tunnel names
+func normalizeCustomDomain(domain, tunnelDomain string) (string, error) {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 || len(domain) > 253 {
+		return "", errors.New("domain must be a fully qualified host name such as app.example.com")
+	}
+	for _, label := range labels {
+		if !domainLabelPattern.MatchString(label) {
+			return "", errors.New("domain must be a fully qualified host name such as app.example.com")
+		}
+	}
+	tunnelHost := strings.ToLower(tunnelDomain)
+	if host, _, err := net.SplitHostPort(tunnelHost); err == nil {
+		tunnelHost = host
+	}
+	if domain == tunnelHost || strings.HasSuffix(domain, "."+tunnelHost) {
+		return "", errors.New("domain can't be part of the tunnel domain")
+	}
+	return domain, nil
+}
+
+// customDomainResponse adds the DNS record to create for an unverified domain
+func customDomainResponse(domain models.CustomDomain) gin.H {
+	response := gin.H{"domain": domain}
+	if domain.VerifiedAt == nil {
+		response["verification_record"] = gin.H{
+			"type":  "TXT",
+			"name":  customDomainRecordPrefix + domain.Domain,
+			"value": customDomainRecordValue + domain.VerificationToken,
+		}
+	}
+	return response
+}
+
+// loadCustomDomain returns one of the tunnel's custom domains
+func loadCustomDomain(db *sql.DB, tunnelID uuid.UUID, domainID string) (models.CustomDomain, error) {
+	var domain models.CustomDomain
+	err := db.QueryRow(`
+		SELECT id, tunnel_id, domain, verification_token, verified_at, created_at
+		FROM custom_domains
+		WHERE id = $1 AND tunnel_id = $2
+	`, domainID, tunnelID).Scan(&domain.ID, &domain.TunnelID, &domain.Domain, &domain.VerificationToken,
+		&domain.VerifiedAt, &domain.CreatedAt)
+	return domain, err
+}
+
+// lookupCustomDomain returns the subdomain of the tunnel a verified custom domain routes to
+func lookupCustomDomain(db *sql.DB, host string) (string, bool, error) {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	var subdomain string
+	err := db.QueryRow(`
+		SELECT t.subdomain
+		FROM custom_domains d
+		JOIN tunnels t ON t.id = d.tunnel_id
+		WHERE d.domain = $1 AND d.verified_at IS NOT NULL
+	`, strings.TrimSuffix(strings.ToLower(host), ".")).Scan(&subdomain)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return subdomain, true, nil
+}
+
+// GetCustomDomains lists a tunnel's custom domains
+func (h *TunnelHandler) GetCustomDomains(c *gin.Context) {
+	tunnel, ok := h.ownedTunnel(c)
+	if !ok {
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT id, tunnel_id, domain, verification_token, verified_at, created_at
+		FROM custom_domains
+		WHERE tunnel_id = $1
+		ORDER BY created_at, id
+	`, tunnel.ID)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch custom domains", "tunnel_id", tunnel.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch custom domains"})
+		return
+	}
+	defer rows.Close()
+
+	domains := []gin.H{}
+	for rows.Next() {
+		var domain models.CustomDomain
+		if err := rows.Scan(&domain.ID, &domain.TunnelID, &domain.Domain, &domain.VerificationToken,
+			&domain.VerifiedAt, &domain.CreatedAt); err != nil {
+			h.logger.ErrorContext(c.Request.Context(), "Failed to scan custom domain", "tunnel_id", tunnel.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch custom domains"})
+			return
+		}
+		domains = append(domains, customDomainResponse(domain))
+	}
+	if err := rows.Err(); err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch custom domains", "tunnel_id", tunnel.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch custom domains"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"domains": domains})
+}
+
+// CreateCustomDomain adds a domain to the tunnel and returns the TXT record that verifies it
+func (h *TunnelHandler) CreateCustomDomain(c *gin.Context) {
+	var req models.CreateCustomDomainRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name, err := normalizeCustomDomain(req.Domain, h.config.Domain)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tunnel, ok := h.ownedTunnel(c)
+	if !ok {
+		return
+	}
+
+	var domainCount int
+	if err := h.db.QueryRow("SELECT COUNT(*) FROM custom_domains WHERE tunnel_id = $1", tunnel.ID).Scan(&domainCount); err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to count custom domains", "tunnel_id", tunnel.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if domainCount >= maxCustomDomainsPerTunnel {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A tunnel can have at most 5 custom domains"})
+		return
+	}
+
+	domain := models.CustomDomain{
+		TunnelID:          tunnel.ID,
+		Domain:            name,
+		VerificationToken: randomHex(16),
+	}
+	err = h.db.QueryRow(`
+		INSERT INTO custom_domains (tunnel_id, domain, verification_token)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (domain) DO NOTHING
+		RETURNING id, created_at
+	`, domain.TunnelID, domain.Domain, domain.VerificationToken).Scan(&domain.ID, &domain.CreatedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusConflict, gin.H{"error": "Domain is already in use"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to create custom domain", "tunnel_id", tunnel.ID, "domain", name, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create custom domain"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, customDomainResponse(domain))
+}
+
+// VerifyCustomDomain looks up the domain's TXT record and marks it verified when the token
+// matches. Verified domains are routed to the tunnel and get a certificate on first use.
+func (h *TunnelHandler) VerifyCustomDomain(c *gin.Context) {
+	tunnel, ok := h.ownedTunnel(c)
+	if !ok {
+		return
+	}
+
+	domainID := c.Param("domain_id")
+	if _, err := uuid.Parse(domainID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Custom domain not found"})
+		return
+	}
+
+	domain, err := loadCustomDomain(h.db, tunnel.ID, domainID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Custom domain not found"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch custom domain", "tunnel_id", tunnel.ID, "domain_id", domainID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if domain.VerifiedAt != nil {
+		c.JSON(http.StatusOK, customDomainResponse(domain))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), customDomainLookupTimeout)
+	defer cancel()
+	records, err := net.DefaultResolver.LookupTXT(ctx, customDomainRecordPrefix+domain.Domain)
+	if err != nil || !slices.Contains(records, customDomainRecordValue+domain.VerificationToken) {
+		response := customDomainResponse(domain)
+		response["error"] = "Verification record not found, DNS changes can take a while to propagate"
+		c.JSON(http.StatusUnprocessableEntity, response)
+		return
+	}
+
+	err = h.db.QueryRow(
+		"UPDATE custom_domains SET verified_at = NOW() WHERE id = $1 RETURNING verified_at",
+		domain.ID,
+	).Scan(&domain.VerifiedAt)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to verify custom domain", "tunnel_id", tunnel.ID, "domain_id", domainID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify custom domain"})
+		return
+	}
+
+	c.JSON(http.StatusOK, customDomainResponse(domain))
+}
+
+// DeleteCustomDomain removes one of a tunnel's custom domains
+func (h *TunnelHandler) DeleteCustomDomain(c *gin.Context) {
+	tunnel, ok := h.ownedTunnel(c)
+	if !ok {
+		return
+	}
+
+	domainID := c.Param("domain_id")
+	if _, err := uuid.Parse(domainID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Custom domain not found"})
+		return
+	}
+
+	result, err := h.db.Exec("DELETE FROM custom_domains WHERE id = $1 AND tunnel_id = $2", domainID, tunnel.ID)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to delete custom domain", "tunnel_id", tunnel.ID, "domain_id", domainID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Custom domain not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Custom domain deleted"})
+}
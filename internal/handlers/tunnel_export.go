@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"regexp"
+	"skyport-server/internal/database"
+	"skyport-server/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// TunnelExport is a tunnel's configuration in skyport.yaml form. Credentials (auth token,
+// client certificate) and runtime state (activity, addresses) are left out so the file can
+// be committed or shared. Basic auth is kept as the bcrypt hash, so an imported tunnel
+// isn't left unprotected.
+type TunnelExport struct {
+	Name      string   `yaml:"name"`
+	Subdomain string   `yaml:"subdomain"`
+	LocalPort int      `yaml:"local_port"`
+	Tags      []string `yaml:"tags,omitempty"`
+
+	CoalesceGetRequests  bool                  `yaml:"coalesce_get_requests"`
+	AllowIndexing        bool                  `yaml:"allow_indexing"`
+	ProxyProtocolEnabled bool                  `yaml:"proxy_protocol_enabled"`
+	AutoRestart          bool                  `yaml:"auto_restart"`
+	CORSBypass           bool                  `yaml:"cors_bypass"`
+	StickySessionCookie  bool                  `yaml:"sticky_session_cookie"`
+	TimeoutSeconds       int                   `yaml:"timeout_seconds,omitempty"`
+	MaxBodyBytes         int64                 `yaml:"max_body_bytes"`
+	WriteBufferKB        int                   `yaml:"write_buffer_kb"`
+	BlockedCountries     []string              `yaml:"blocked_countries,omitempty"`
+	ProxyTargetURL       string                `yaml:"proxy_target_url,omitempty"`
+	Transforms           []TransformRuleExport `yaml:"transforms,omitempty"`
+	RoutingRules         []RoutingRuleExport   `yaml:"routing_rules,omitempty"`
+
+	BasicAuthUser         string `yaml:"basic_auth_user,omitempty"`
+	BasicAuthPasswordHash string `yaml:"basic_auth_password_hash,omitempty"`
+
+	IPRules     []IPRuleExport     `yaml:"ip_rules,omitempty"`
+	HeaderRules []HeaderRuleExport `yaml:"header_rules,omitempty"`
+}
+
+// TransformRuleExport mirrors models.TransformRule with YAML tags
+type TransformRuleExport struct {
+	Type      string `yaml:"type"`
+	Direction string `yaml:"direction,omitempty"`
+	Name      string `yaml:"name,omitempty"`
+	Value     string `yaml:"value,omitempty"`
+	From      string `yaml:"from,omitempty"`
+	To        string `yaml:"to,omitempty"`
+}
+
+// RoutingRuleExport mirrors models.RoutingRule with YAML tags
+type RoutingRuleExport struct {
+	PathPrefix string `yaml:"path_prefix"`
+	TargetPort int    `yaml:"target_port"`
+}
+
+// IPRuleExport mirrors models.CreateIPRuleRequest with YAML tags
+type IPRuleExport struct {
+	CIDR   string `yaml:"cidr"`
+	Action string `yaml:"action"`
+}
+
+// HeaderRuleExport mirrors models.CreateHeaderRuleRequest with YAML tags
+type HeaderRuleExport struct {
+	Direction   string `yaml:"direction"`
+	Action      string `yaml:"action"`
+	HeaderName  string `yaml:"header_name"`
+	HeaderValue string `yaml:"header_value,omitempty"`
+}
+
+// unsafeFilenameChars are replaced in the exported file name
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func newTunnelExport(tunnel *models.Tunnel, ipRules []models.IPRule, headerRules []models.HeaderRule) TunnelExport {
+	export := TunnelExport{
+		Name:                 tunnel.Name,
+		Subdomain:            tunnel.Subdomain,
+		LocalPort:            tunnel.LocalPort,
+		Tags:                 tunnel.Tags,
+		CoalesceGetRequests:  tunnel.CoalesceGetRequests,
+		AllowIndexing:        tunnel.AllowIndexing,
+		ProxyProtocolEnabled: tunnel.ProxyProtocolEnabled,
+		AutoRestart:          tunnel.AutoRestart,
+		CORSBypass:           tunnel.CORSBypass,
+		StickySessionCookie:  tunnel.StickySessionCookie,
+		TimeoutSeconds:       tunnel.TimeoutSeconds,
+		MaxBodyBytes:         tunnel.MaxBodyBytes,
+		WriteBufferKB:        tunnel.WriteBufferKB,
+		BlockedCountries:     tunnel.BlockedCountries,
+	}
+	if tunnel.ProxyTargetURL != nil {
+		export.ProxyTargetURL = *tunnel.ProxyTargetURL
+	}
+	if tunnel.BasicAuthUser != nil && tunnel.BasicAuthPasswordHash != nil {
+		export.BasicAuthUser = *tunnel.BasicAuthUser
+		export.BasicAuthPasswordHash = *tunnel.BasicAuthPasswordHash
+	}
+	for _, rule := range tunnel.Transforms {
+		export.Transforms = append(export.Transforms, TransformRuleExport(rule))
+	}
+	for _, rule := range tunnel.RoutingRules {
+		export.RoutingRules = append(export.RoutingRules, RoutingRuleExport(rule))
+	}
+	for _, rule := range ipRules {
+		export.IPRules = append(export.IPRules, IPRuleExport{CIDR: rule.CIDR, Action: rule.Action})
+	}
+	for _, rule := range headerRules {
+		export.HeaderRules = append(export.HeaderRules, HeaderRuleExport{
+			Direction:   rule.Direction,
+			Action:      rule.Action,
+			HeaderName:  rule.HeaderName,
+			HeaderValue: rule.HeaderValue,
+		})
+	}
+	return export
+}
+
+// ExportTunnel downloads a tunnel's configuration as a YAML file
+func (h *TunnelHandler) ExportTunnel(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	tunnelID := c.Param("id")
+
+	tunnel, err := database.GetTunnel(h.db, tunnelID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch tunnel for export", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if tunnel.UserID.String() != userIDStr {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Tunnel does not belong to user"})
+		return
+	}
+
+	ipRules, err := loadIPRules(h.db, tunnelID)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch IP rules for export", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	headerRules, err := loadHeaderRules(h.db, tunnelID)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch header rules for export", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	data, err := yaml.Marshal(newTunnelExport(tunnel, ipRules, headerRules))
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to marshal tunnel export", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export tunnel"})
+		return
+	}
+
+	filename := unsafeFilenameChars.ReplaceAllString(tunnel.Name, "_")
+	if filename == "" || filename == "_" {
+		filename = tunnel.Subdomain
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`.yaml"`)
+	c.Data(http.StatusOK, "application/yaml", data)
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// frameLogSize is the number of recent frame events kept per tunnel
+const frameLogSize = 100
+
+// FrameEvent describes a single tunnel message sent to or received from the agent
+type FrameEvent struct {
+	Direction string    `json:"direction"` // "sent" or "received"
+	Type      string    `json:"type"`
+	ID        string    `json:"id"`
+	Size      int       `json:"size"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// frameLog is a fixed-size ring buffer of the most recent frame events
+type frameLog struct {
+	mutex  sync.Mutex
+	events [frameLogSize]FrameEvent
+	next   int // index the next event is written to
+	count  int
+}
+
+func (l *frameLog) add(event FrameEvent) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.events[l.next] = event
+	l.next = (l.next + 1) % frameLogSize
+	if l.count < frameLogSize {
+		l.count++
+	}
+}
+
+// snapshot returns the buffered events, oldest first
+func (l *frameLog) snapshot() []FrameEvent {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	events := make([]FrameEvent, 0, l.count)
+	start := (l.next - l.count + frameLogSize) % frameLogSize
+	for i := 0; i < l.count; i++ {
+		events = append(events, l.events[(start+i)%frameLogSize])
+	}
+	return events
+}
+
+// recordFrame logs a frame and adds it to the ring buffer when frame debugging is enabled
+func (tp *TunnelProtocol) recordFrame(direction string, message *TunnelMessage, size int) {
+	if !tp.frameDebug {
+		return
+	}
+
+	slog.Debug("tunnel frame",
+		"tunnel_id", tp.tunnelID,
+		"direction", direction,
+		"type", message.Type,
+		"id", message.ID,
+		"size", size,
+	)
+
+	tp.frames.add(FrameEvent{
+		Direction: direction,
+		Type:      message.Type,
+		ID:        message.ID,
+		Size:      size,
+		Timestamp: time.Now(),
+	})
+}
+
+// GetFrameLog returns the most recent frame events for an active tunnel (admin only)
+func (h *TunnelHandler) GetFrameLog(c *gin.Context) {
+	tunnelID := c.Param("id")
+
+	if !h.config.WSFrameDebug {
+		c.JSON(http.StatusConflict, gin.H{"error": "Frame debugging is disabled, set SKYPORT_WS_FRAME_DEBUG=true"})
+		return
+	}
+
+	protocol, exists := h.GetActiveTunnel(tunnelID)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not connected"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"tunnel_id": tunnelID,
+		"frames":    protocol.frames.snapshot(),
+	})
+}
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"skyport-server/internal/config"
+	"skyport-server/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// loadHeaderRules returns a tunnel's header rules in creation order
+func loadHeaderRules(db *sql.DB, tunnelID string) ([]models.HeaderRule, error) {
+	rows, err := db.Query(`
+		SELECT id, tunnel_id, direction, action, header_name, header_value, created_at
+		FROM tunnel_header_rules
+		WHERE tunnel_id = $1
+		ORDER BY created_at, id
+	`, tunnelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []models.HeaderRule{}
+	for rows.Next() {
+		var rule models.HeaderRule
+		if err := rows.Scan(&rule.ID, &rule.TunnelID, &rule.Direction, &rule.Action, &rule.HeaderName, &rule.HeaderValue, &rule.CreatedAt); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// applyHeaderRules sets or removes headers with the tunnel's rules for one direction
+func (tp *TunnelProtocol) applyHeaderRules(direction string, header http.Header) {
+	rules := tp.headerRules.Load()
+	if rules == nil {
+		return
+	}
+	for _, rule := range *rules {
+		if rule.Direction != direction {
+			continue
+		}
+		switch rule.Action {
+		case "set":
+			header.Set(rule.HeaderName, rule.HeaderValue)
+		case "remove":
+			header.Del(rule.HeaderName)
+		}
+	}
+}
+
+// refreshHeaderRules reloads the header rules of a tunnel connected to this instance, so
+// changes apply without the agent reconnecting
+func (h *TunnelHandler) refreshHeaderRules(c *gin.Context, tunnelID string) {
+	protocol, exists := h.GetActiveTunnel(tunnelID)
+	if !exists {
+		return
+	}
+	rules, err := loadHeaderRules(h.db, tunnelID)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to reload header rules", "tunnel_id", tunnelID, "error", err)
+		return
+	}
+	protocol.headerRules.Store(&rules)
+}
+
+// GetHeaderRules lists a tunnel's header rules
+func (h *TunnelHandler) GetHeaderRules(c *gin.Context) {
+	tunnel, ok := h.ownedTunnel(c)
+	if !ok {
+		return
+	}
+
+	rules, err := loadHeaderRules(h.db, tunnel.ID.String())
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch header rules", "tunnel_id", tunnel.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch header rules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"header_rules": rules})
+}
+
+// CreateHeaderRule adds a rule that sets or removes a request or response header
+func (h *TunnelHandler) CreateHeaderRule(c *gin.Context) {
+	// Rules are reloaded into the agent's connection on the instance holding it
+	if h.forwardControlToOwner(c, c.Param("id")) {
+		return
+	}
+
+	var req models.CreateHeaderRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if isValid, validationError := config.ValidateHeaderRule(req); !isValid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": validationError})
+		return
+	}
+
+	tunnel, ok := h.ownedTunnel(c)
+	if !ok {
+		return
+	}
+
+	var ruleCount int
+	if err := h.db.QueryRow("SELECT COUNT(*) FROM tunnel_header_rules WHERE tunnel_id = $1", tunnel.ID).Scan(&ruleCount); err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to count header rules", "tunnel_id", tunnel.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if ruleCount >= config.MaxTunnelHeaderRules {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A tunnel can have at most 50 header rules"})
+		return
+	}
+
+	rule := models.HeaderRule{
+		TunnelID:   tunnel.ID,
+		Direction:  req.Direction,
+		Action:     req.Action,
+		HeaderName: http.CanonicalHeaderKey(req.HeaderName),
+	}
+	if req.Action == "set" {
+		rule.HeaderValue = req.HeaderValue
+	}
+	err := h.db.QueryRow(`
+		INSERT INTO tunnel_header_rules (tunnel_id, direction, action, header_name, header_value)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`, rule.TunnelID, rule.Direction, rule.Action, rule.HeaderName, rule.HeaderValue).Scan(&rule.ID, &rule.CreatedAt)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to create header rule", "tunnel_id", tunnel.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create header rule"})
+		return
+	}
+
+	h.refreshHeaderRules(c, tunnel.ID.String())
+	c.JSON(http.StatusCreated, rule)
+}
+
+// UpdateHeaderRule replaces one of a tunnel's header rules, keeping its place in the order
+func (h *TunnelHandler) UpdateHeaderRule(c *gin.Context) {
+	// Rules are reloaded into the agent's connection on the instance holding it
+	if h.forwardControlToOwner(c, c.Param("id")) {
+		return
+	}
+
+	var req models.CreateHeaderRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if isValid, validationError := config.ValidateHeaderRule(req); !isValid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": validationError})
+		return
+	}
+
+	tunnel, ok := h.ownedTunnel(c)
+	if !ok {
+		return
+	}
+
+	ruleID := c.Param("rule_id")
+	if _, err := uuid.Parse(ruleID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Header rule not found"})
+		return
+	}
+
+	rule := models.HeaderRule{
+		TunnelID:   tunnel.ID,
+		Direction:  req.Direction,
+		Action:     req.Action,
+		HeaderName: http.CanonicalHeaderKey(req.HeaderName),
+	}
+	if req.Action == "set" {
+		rule.HeaderValue = req.HeaderValue
+	}
+	err := h.db.QueryRow(`
+		UPDATE tunnel_header_rules SET direction = $1, action = $2, header_name = $3, header_value = $4
+		WHERE id = $5 AND tunnel_id = $6
+		RETURNING id, created_at
+	`, rule.Direction, rule.Action, rule.HeaderName, rule.HeaderValue, ruleID, tunnel.ID).Scan(&rule.ID, &rule.CreatedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Header rule not found"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to update header rule", "tunnel_id", tunnel.ID, "rule_id", ruleID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update header rule"})
+		return
+	}
+
+	h.refreshHeaderRules(c, tunnel.ID.String())
+	c.JSON(http.StatusOK, rule)
+}
+
+// DeleteHeaderRule removes one of a tunnel's header rules
+func (h *TunnelHandler) DeleteHeaderRule(c *gin.Context) {
+	// Rules are reloaded into the agent's connection on the instance holding it
+	if h.forwardControlToOwner(c, c.Param("id")) {
+		return
+	}
+
+	tunnel, ok := h.ownedTunnel(c)
+	if !ok {
+		return
+	}
+
+	ruleID := c.Param("rule_id")
+	if _, err := uuid.Parse(ruleID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Header rule not found"})
+		return
+	}
+
+	result, err := h.db.Exec("DELETE FROM tunnel_header_rules WHERE id = $1 AND tunnel_id = $2", ruleID, tunnel.ID)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to delete header rule", "tunnel_id", tunnel.ID, "rule_id", ruleID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Header rule not found"})
+		return
+	}
+
+	h.refreshHeaderRules(c, tunnel.ID.String())
+	c.JSON(http.StatusOK, gin.H{"message": "Header rule deleted"})
+}
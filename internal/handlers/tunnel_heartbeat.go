@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultPingInterval is used until enough pong latencies have been measured
+	defaultPingInterval = 15 * time.Second
+	// fastPingInterval is used on slow or lossy connections to detect failures sooner
+	fastPingInterval = 5 * time.Second
+	// slowPingInterval is used on stable connections to reduce overhead
+	slowPingInterval = 30 * time.Second
+
+	// pongLatencyWindow is the number of pong latencies in the rolling average
+	pongLatencyWindow = 5
+	// highPongLatency switches to fastPingInterval when the average exceeds it
+	highPongLatency = 500 * time.Millisecond
+	// lowPongLatency switches to slowPingInterval after stablePingCount pings below it
+	lowPongLatency  = 50 * time.Millisecond
+	stablePingCount = 5
+
+	// minAgentReadTimeout is the shortest time the agent may stay silent before its
+	// connection is closed, so large messages have time to arrive at the fast ping interval
+	minAgentReadTimeout = 60 * time.Second
+)
+
+// heartbeatState tracks pong latencies for the adaptive ping interval
+type heartbeatState struct {
+	latencies     [pongLatencyWindow]time.Duration
+	next          int
+	count         int
+	stableStreak  int
+	averageMs     int64 // accessed atomically
+	intervalNanos int64 // accessed atomically, 0 means defaultPingInterval
+}
+
+// adaptiveHeartbeat records a pong round-trip latency and returns the ping interval to use.
+// It must only be called from one goroutine at a time (the connection's pong handler).
+func (tp *TunnelProtocol) adaptiveHeartbeat(latency time.Duration) time.Duration {
+	hb := &tp.heartbeat
+
+	hb.latencies[hb.next] = latency
+	hb.next = (hb.next + 1) % pongLatencyWindow
+	if hb.count < pongLatencyWindow {
+		hb.count++
+	}
+
+	var total time.Duration
+	for i := 0; i < hb.count; i++ {
+		total += hb.latencies[i]
+	}
+	average := total / time.Duration(hb.count)
+	atomic.StoreInt64(&hb.averageMs, average.Milliseconds())
+
+	if average < lowPongLatency {
+		hb.stableStreak++
+	} else {
+		hb.stableStreak = 0
+	}
+
+	interval := defaultPingInterval
+	switch {
+	case average > highPongLatency:
+		interval = fastPingInterval
+	case hb.stableStreak >= stablePingCount:
+		interval = slowPingInterval
+	}
+
+	atomic.StoreInt64(&hb.intervalNanos, int64(interval))
+	return interval
+}
+
+// currentPingInterval returns the ping interval currently used for this tunnel
+func (tp *TunnelProtocol) currentPingInterval() time.Duration {
+	if interval := atomic.LoadInt64(&tp.heartbeat.intervalNanos); interval > 0 {
+		return time.Duration(interval)
+	}
+	return defaultPingInterval
+}
+
+// heartbeatTimeout is how long the agent may stay silent before the tunnel counts as down,
+// two and a half ping intervals so a single late pong doesn't take it offline
+func (tp *TunnelProtocol) heartbeatTimeout() time.Duration {
+	return tp.currentPingInterval() * 5 / 2
+}
+
+// readTimeout is how long a read from the agent may take, never shorter than the heartbeat
+// timeout
+func (tp *TunnelProtocol) readTimeout() time.Duration {
+	return max(minAgentReadTimeout, tp.heartbeatTimeout())
+}
+
+// averagePongLatencyMs returns the rolling average pong latency in milliseconds
+func (tp *TunnelProtocol) averagePongLatencyMs() int64 {
+	return atomic.LoadInt64(&tp.heartbeat.averageMs)
+}
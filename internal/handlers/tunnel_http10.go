@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+)
+
+// isCloseDelimitedResponse reports whether the local service ended the body by closing the
+// connection, as HTTP/1.0 servers do without Content-Length. When the agent sends such a
+// response buffered it has read the body to the end, so the message holds all of it.
+//
+// The visitor's response keeps the protocol version of the visitor's request: net/http
+// doesn't allow choosing it, and a HTTP/1.1 client is better served by a sized response.
+func isCloseDelimitedResponse(response *TunnelMessage) bool {
+	if response.HTTPVersion != "HTTP/1.0" {
+		return false
+	}
+	for name := range response.Headers {
+		if strings.EqualFold(name, "Content-Length") || strings.EqualFold(name, "Transfer-Encoding") {
+			return false
+		}
+	}
+	return true
+}
+
+// isLocalConnectionHeader reports whether a header describes the agent's connection to the
+// local service rather than the response, so it must not close the visitor's connection
+func isLocalConnectionHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	return name == "Connection" || name == "Keep-Alive"
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// startHTTP10Server serves one close-delimited HTTP/1.0 response: no Content-Length, the
+// end of the body is signalled by closing the connection
+func startHTTP10Server(t *testing.T, body string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		io.WriteString(conn, "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\n"+body)
+	}()
+	return listener.Addr().String()
+}
+
+// fetchLikeAgent reads a response from the local service the way the agent does for
+// close-delimited bodies, until the connection closes, and builds the tunnel message
+func fetchLikeAgent(t *testing.T, addr string) *TunnelMessage {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, "GET / HTTP/1.0\r\nHost: localhost\r\n\r\n"); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.ContentLength != -1 {
+		t.Fatalf("mock server sent a Content-Length, ContentLength = %d", resp.ContentLength)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+
+	headers := make(map[string]string, len(resp.Header))
+	for name := range resp.Header {
+		headers[name] = resp.Header.Get(name)
+	}
+	return &TunnelMessage{
+		Type:        "http_response",
+		ID:          "test",
+		Status:      resp.StatusCode,
+		Headers:     headers,
+		Body:        body,
+		HTTPVersion: resp.Proto,
+	}
+}
+
+func TestWriteHTTPResponseCloseDelimited(t *testing.T) {
+	body := strings.Repeat("close-delimited body\n", 100)
+	response := fetchLikeAgent(t, startHTTP10Server(t, body))
+	if response.HTTPVersion != "HTTP/1.0" {
+		t.Fatalf("HTTPVersion = %q, want HTTP/1.0", response.HTTPVersion)
+	}
+
+	tp := &TunnelProtocol{}
+	recorder := httptest.NewRecorder()
+	tp.writeHTTPResponse(recorder, response)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200", recorder.Code)
+	}
+	if got, want := recorder.Header().Get("Content-Length"), strconv.Itoa(len(body)); got != want {
+		t.Errorf("Content-Length = %q, want %q", got, want)
+	}
+	if got := recorder.Header().Get("Connection"); got != "" {
+		t.Errorf("Connection = %q, the local service's connection header must not reach the visitor", got)
+	}
+	if recorder.Body.String() != body {
+		t.Errorf("body length = %d, want %d", recorder.Body.Len(), len(body))
+	}
+}
+
+func TestWriteResponseHeadersStreamedHTTP10(t *testing.T) {
+	// http_response_start carries no body, the chunks follow
+	start := &TunnelMessage{
+		Type:        "http_response_start",
+		ID:          "test",
+		Status:      http.StatusOK,
+		Headers:     map[string]string{"Content-Type": "text/plain", "Connection": "close"},
+		HTTPVersion: "HTTP/1.0",
+	}
+
+	tp := &TunnelProtocol{}
+	recorder := httptest.NewRecorder()
+	tp.writeResponseHeaders(recorder, start)
+
+	if got := recorder.Header().Get("Content-Length"); got != "" {
+		t.Errorf("Content-Length = %q, a streamed response must not announce a length", got)
+	}
+	if got := recorder.Header().Get("Connection"); got != "" {
+		t.Errorf("Connection = %q, want it dropped", got)
+	}
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"net/http"
+	"skyport-server/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// importFailure describes a tunnel config that could not be imported
+type importFailure struct {
+	Index     int    `json:"index"`
+	Subdomain string `json:"subdomain"`
+	Error     string `json:"error"`
+}
+
+// ImportTunnels creates tunnels in bulk from exported configs. With "atomic": true either
+// every tunnel is created or none is, otherwise each one succeeds or fails on its own.
+func (h *TunnelHandler) ImportTunnels(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	if !requireVerifiedEmail(c) {
+		return
+	}
+
+	var req models.ImportTunnelsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	created := []models.Tunnel{}
+	failed := []importFailure{}
+
+	if !req.Atomic {
+		for i, tunnelReq := range req.Tunnels {
+			tunnel, err := h.createTunnelTx(c.Request.Context(), userID, tunnelReq)
+			if err != nil {
+				failed = append(failed, importFailure{Index: i, Subdomain: tunnelReq.Subdomain, Error: err.Error()})
+				continue
+			}
+			created = append(created, tunnel)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"created": created, "failed": failed})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to begin tunnel import", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	for i, tunnelReq := range req.Tunnels {
+		tunnel, err := h.createTunnel(c.Request.Context(), tx, userID, tunnelReq)
+		if err != nil {
+			// Nothing is created when any tunnel fails
+			failed = append(failed, importFailure{Index: i, Subdomain: tunnelReq.Subdomain, Error: err.Error()})
+			c.JSON(createErrorStatus(err), gin.H{"created": []models.Tunnel{}, "failed": failed})
+			return
+		}
+		created = append(created, tunnel)
+	}
+
+	if err := tx.Commit(); err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to commit tunnel import", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import tunnels"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"created": created, "failed": failed})
+}
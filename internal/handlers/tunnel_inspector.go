@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"database/sql"
+	"io"
+	"net/http"
+	"skyport-server/internal/database"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// inspectorHistorySize is the number of recent request/response pairs kept per tunnel
+	inspectorHistorySize = 20
+	// inspectorBodyLimit truncates captured request and response bodies
+	inspectorBodyLimit = 4 * 1024
+	// inspectorSubscriberBuffer is how many events a slow SSE subscriber may fall behind before events are dropped
+	inspectorSubscriberBuffer = 16
+)
+
+// InspectedRequest is a request/response pair captured for the live request inspector
+type InspectedRequest struct {
+	ID                    string            `json:"id"`
+	Method                string            `json:"method"`
+	Path                  string            `json:"path"`
+	Status                int               `json:"status"`
+	LatencyMs             int64             `json:"latency_ms"`
+	RequestHeaders        map[string]string `json:"request_headers"`
+	RequestBody           string            `json:"request_body"`
+	RequestBodyTruncated  bool              `json:"request_body_truncated"`
+	ResponseHeaders       map[string]string `json:"response_headers"`
+	ResponseBody          string            `json:"response_body"`
+	ResponseBodyTruncated bool              `json:"response_body_truncated"`
+	Timestamp             time.Time         `json:"timestamp"`
+}
+
+// requestInspector keeps a ring buffer of recent requests and fans new ones out to subscribers
+type requestInspector struct {
+	mutex       sync.Mutex
+	history     [inspectorHistorySize]InspectedRequest
+	next        int
+	count       int
+	subscribers map[chan InspectedRequest]struct{}
+}
+
+func (ri *requestInspector) record(request InspectedRequest) {
+	ri.mutex.Lock()
+	defer ri.mutex.Unlock()
+
+	ri.history[ri.next] = request
+	ri.next = (ri.next + 1) % inspectorHistorySize
+	if ri.count < inspectorHistorySize {
+		ri.count++
+	}
+
+	for subscriber := range ri.subscribers {
+		select {
+		case subscriber <- request:
+		default:
+			// Never block the proxied request on a slow dashboard
+		}
+	}
+}
+
+// snapshot returns the buffered requests, oldest first
+func (ri *requestInspector) snapshot() []InspectedRequest {
+	ri.mutex.Lock()
+	defer ri.mutex.Unlock()
+
+	requests := make([]InspectedRequest, 0, ri.count)
+	start := (ri.next - ri.count + inspectorHistorySize) % inspectorHistorySize
+	for i := 0; i < ri.count; i++ {
+		requests = append(requests, ri.history[(start+i)%inspectorHistorySize])
+	}
+	return requests
+}
+
+func (ri *requestInspector) subscribe() chan InspectedRequest {
+	ri.mutex.Lock()
+	defer ri.mutex.Unlock()
+
+	if ri.subscribers == nil {
+		ri.subscribers = make(map[chan InspectedRequest]struct{})
+	}
+	subscriber := make(chan InspectedRequest, inspectorSubscriberBuffer)
+	ri.subscribers[subscriber] = struct{}{}
+	return subscriber
+}
+
+func (ri *requestInspector) unsubscribe(subscriber chan InspectedRequest) {
+	ri.mutex.Lock()
+	defer ri.mutex.Unlock()
+	delete(ri.subscribers, subscriber)
+}
+
+// limitedBuffer keeps the first inspectorBodyLimit bytes written to it
+type limitedBuffer struct {
+	data      []byte
+	truncated bool
+}
+
+func (b *limitedBuffer) capture(p []byte) {
+	remaining := inspectorBodyLimit - len(b.data)
+	if len(p) > remaining {
+		p = p[:remaining]
+		b.truncated = true
+	}
+	b.data = append(b.data, p...)
+}
+
+// captureBody records the start of a request body as the tunnel reads it
+type captureBody struct {
+	io.ReadCloser
+	buffer limitedBuffer
+	bytes  int64
+}
+
+func (cb *captureBody) Read(p []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(p)
+	if n > 0 {
+		cb.buffer.capture(p[:n])
+		cb.bytes += int64(n)
+	}
+	return n, err
+}
+
+// captureWriter records the status, headers and start of the body written to a client
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	buffer limitedBuffer
+	bytes  int64
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	cw.buffer.capture(p)
+	n, err := cw.ResponseWriter.Write(p)
+	cw.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps streamed responses working through the capture
+func (cw *captureWriter) Flush() {
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to abort a response
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// HandleInspectedHTTPRequest forwards a request like HandleIncomingHTTPRequest and records
+// it for the request inspector
+func (tp *TunnelProtocol) HandleInspectedHTTPRequest(w http.ResponseWriter, r *http.Request) {
+	requestHeaders := flattenHeaders(r.Header)
+	var body *captureBody
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &captureBody{ReadCloser: r.Body}
+		r.Body = body
+	}
+	writer := &captureWriter{ResponseWriter: w}
+
+	start := time.Now()
+	tp.HandleIncomingHTTPRequest(writer, r)
+	latency := time.Since(start)
+
+	inspected := InspectedRequest{
+		ID:              randomHex(8),
+		Method:          r.Method,
+		Path:            r.URL.RequestURI(),
+		Status:          writer.status,
+		LatencyMs:       latency.Milliseconds(),
+		RequestHeaders:  requestHeaders,
+		ResponseHeaders: flattenHeaders(w.Header()),
+		ResponseBody:    string(writer.buffer.data),
+		Timestamp:       start,
+
+		ResponseBodyTruncated: writer.buffer.truncated,
+	}
+	bytes := writer.bytes
+	if body != nil {
+		inspected.RequestBody = string(body.buffer.data)
+		inspected.RequestBodyTruncated = body.buffer.truncated
+		bytes += body.bytes
+	}
+	tp.inspector.record(inspected)
+	tp.traffic.record(writer.status, bytes, latency)
+
+	tp.publishEvent("tunnel.request", gin.H{
+		"method":     inspected.Method,
+		"path":       inspected.Path,
+		"status":     inspected.Status,
+		"latency_ms": inspected.LatencyMs,
+	})
+	if inspected.Status >= http.StatusInternalServerError {
+		tp.publishEvent("tunnel.error", gin.H{"method": inspected.Method, "path": inspected.Path, "status": inspected.Status})
+	}
+}
+
+// flattenHeaders joins multi-value headers the same way forwarded requests do
+func flattenHeaders(header http.Header) map[string]string {
+	flattened := make(map[string]string, len(header))
+	for name, values := range header {
+		flattened[name] = strings.Join(values, ", ")
+	}
+	return flattened
+}
+
+// GetInspectedRequests returns the recently captured requests for a tunnel
+func (h *TunnelHandler) GetInspectedRequests(c *gin.Context) {
+	protocol, ok := h.inspectableTunnel(c)
+	if !ok {
+		return
+	}
+
+	requests := []InspectedRequest{}
+	if protocol != nil {
+		requests = protocol.inspector.snapshot()
+	}
+	c.JSON(http.StatusOK, gin.H{"requests": requests})
+}
+
+// StreamInspectedRequests streams captured requests as Server-Sent Events as they complete
+func (h *TunnelHandler) StreamInspectedRequests(c *gin.Context) {
+	protocol, ok := h.inspectableTunnel(c)
+	if !ok {
+		return
+	}
+	if protocol == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Tunnel not connected"})
+		return
+	}
+
+	subscriber := protocol.inspector.subscribe()
+	defer protocol.inspector.unsubscribe(subscriber)
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case request := <-subscriber:
+			c.SSEvent("request", request)
+			return true
+		}
+	})
+}
+
+// inspectableTunnel checks that the user owns the tunnel and returns its active connection,
+// or nil if it isn't connected. It writes the error response and returns false otherwise.
+func (h *TunnelHandler) inspectableTunnel(c *gin.Context) (*TunnelProtocol, bool) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return nil, false
+	}
+
+	tunnelID := c.Param("id")
+
+	tunnel, err := database.GetTunnel(h.db, tunnelID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
+		return nil, false
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch tunnel for request inspector", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil, false
+	}
+
+	if tunnel.UserID.String() != userIDStr {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Tunnel does not belong to user"})
+		return nil, false
+	}
+
+	protocol, _ := h.GetActiveTunnel(tunnelID)
+	return protocol, true
+}
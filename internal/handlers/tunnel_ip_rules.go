@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"database/sql"
+	"net"
+	"net/http"
+	"skyport-server/internal/models"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// maxIPRulesPerTunnel keeps the per-request rule evaluation cheap
+const maxIPRulesPerTunnel = 100
+
+// parseIPRuleCIDR parses a rule's CIDR, a bare address is taken as a single host.
+// It returns the network in canonical form.
+func parseIPRuleCIDR(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		if ip := net.ParseIP(cidr); ip != nil {
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	return network, err
+}
+
+// ipRulesAllow evaluates a tunnel's rules for a client address. Deny rules are checked
+// first and win; if there are allow rules the address must then match one of them.
+func ipRulesAllow(rules []models.IPRule, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	hasAllowRules := false
+	for _, rule := range rules {
+		network, err := parseIPRuleCIDR(rule.CIDR)
+		if err != nil {
+			continue
+		}
+		if rule.Action == "deny" && network.Contains(ip) {
+			return false
+		}
+		hasAllowRules = hasAllowRules || rule.Action == "allow"
+	}
+	if !hasAllowRules {
+		return true
+	}
+
+	for _, rule := range rules {
+		network, err := parseIPRuleCIDR(rule.CIDR)
+		if err == nil && rule.Action == "allow" && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadIPRules returns a tunnel's IP rules in creation order
+func loadIPRules(db *sql.DB, tunnelID string) ([]models.IPRule, error) {
+	rows, err := db.Query(`
+		SELECT id, tunnel_id, cidr, action, created_at
+		FROM tunnel_ip_rules
+		WHERE tunnel_id = $1
+		ORDER BY created_at, id
+	`, tunnelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []models.IPRule{}
+	for rows.Next() {
+		var rule models.IPRule
+		if err := rows.Scan(&rule.ID, &rule.TunnelID, &rule.CIDR, &rule.Action, &rule.CreatedAt); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// clientAllowedByIPRules checks the visitor's address against the tunnel's IP rules
+func (h *ProxyHandler) clientAllowedByIPRules(c *gin.Context, tunnelID string) (bool, error) {
+	rules, err := loadIPRules(h.db, tunnelID)
+	if err != nil {
+		return false, err
+	}
+	return ipRulesAllow(rules, net.ParseIP(c.ClientIP())), nil
+}
+
+// GetIPRules lists a tunnel's IP rules
+func (h *TunnelHandler) GetIPRules(c *gin.Context) {
+	tunnel, ok := h.ownedTunnel(c)
+	if !ok {
+		return
+	}
+
+	rules, err := loadIPRules(h.db, tunnel.ID.String())
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch IP rules", "tunnel_id", tunnel.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch IP rules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"ip_rules": rules})
+}
+
+// CreateIPRule adds an allow or deny rule for a CIDR range to a tunnel
+func (h *TunnelHandler) CreateIPRule(c *gin.Context) {
+	var req models.CreateIPRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	network, err := parseIPRuleCIDR(req.CIDR)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cidr must be an IP address or CIDR range"})
+		return
+	}
+
+	tunnel, ok := h.ownedTunnel(c)
+	if !ok {
+		return
+	}
+
+	var ruleCount int
+	if err := h.db.QueryRow("SELECT COUNT(*) FROM tunnel_ip_rules WHERE tunnel_id = $1", tunnel.ID).Scan(&ruleCount); err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to count IP rules", "tunnel_id", tunnel.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if ruleCount >= maxIPRulesPerTunnel {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A tunnel can have at most 100 IP rules"})
+		return
+	}
+
+	rule := models.IPRule{
+		TunnelID: tunnel.ID,
+		CIDR:     network.String(),
+		Action:   req.Action,
+	}
+	err = h.db.QueryRow(`
+		INSERT INTO tunnel_ip_rules (tunnel_id, cidr, action)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`, rule.TunnelID, rule.CIDR, rule.Action).Scan(&rule.ID, &rule.CreatedAt)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to create IP rule", "tunnel_id", tunnel.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create IP rule"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, rule)
+}
+
+// DeleteIPRule removes one of a tunnel's IP rules
+func (h *TunnelHandler) DeleteIPRule(c *gin.Context) {
+	tunnel, ok := h.ownedTunnel(c)
+	if !ok {
+		return
+	}
+
+	ruleID := c.Param("rule_id")
+	if _, err := uuid.Parse(ruleID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "IP rule not found"})
+		return
+	}
+
+	result, err := h.db.Exec("DELETE FROM tunnel_ip_rules WHERE id = $1 AND tunnel_id = $2", ruleID, tunnel.ID)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to delete IP rule", "tunnel_id", tunnel.ID, "rule_id", ruleID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "IP rule not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "IP rule deleted"})
+}
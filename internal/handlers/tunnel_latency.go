@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// latencyBucketsMs are the upper bounds of the latency histogram buckets in milliseconds
+var latencyBucketsMs = [...]int64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+// latencyHistogram counts request latencies per bucket; the last slot counts requests
+// slower than the largest bucket. The zero value is ready to use.
+type latencyHistogram struct {
+	counts [len(latencyBucketsMs) + 1]int64
+}
+
+// observe records a single request latency
+func (h *latencyHistogram) observe(latency time.Duration) {
+	ms := latency.Milliseconds()
+	for i, bound := range latencyBucketsMs {
+		if ms <= bound {
+			atomic.AddInt64(&h.counts[i], 1)
+			return
+		}
+	}
+	atomic.AddInt64(&h.counts[len(latencyBucketsMs)], 1)
+}
+
+// quantile approximates the latency at quantile q (0-1) as the upper bound of the bucket
+// the q-th request falls in. Requests above the largest bucket report that bucket's bound.
+// Returns 0 when nothing has been recorded.
+func (h *latencyHistogram) quantile(q float64) int64 {
+	var counts [len(latencyBucketsMs) + 1]int64
+	var total int64
+	for i := range h.counts {
+		counts[i] = atomic.LoadInt64(&h.counts[i])
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := int64(q * float64(total))
+	if rank < 1 {
+		rank = 1
+	}
+
+	var seen int64
+	for i, count := range counts {
+		seen += count
+		if seen >= rank {
+			if i < len(latencyBucketsMs) {
+				return latencyBucketsMs[i]
+			}
+			break
+		}
+	}
+	return latencyBucketsMs[len(latencyBucketsMs)-1]
+}
+
+// p50LatencyMs returns the approximate median request latency in milliseconds
+func (tp *TunnelProtocol) p50LatencyMs() int64 {
+	return tp.latency.quantile(0.50)
+}
+
+// p95LatencyMs returns the approximate 95th percentile request latency in milliseconds
+func (tp *TunnelProtocol) p95LatencyMs() int64 {
+	return tp.latency.quantile(0.95)
+}
+
+// p99LatencyMs returns the approximate 99th percentile request latency in milliseconds
+func (tp *TunnelProtocol) p99LatencyMs() int64 {
+	return tp.latency.quantile(0.99)
+}
@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// metricsStreamInterval is how often a metrics snapshot is pushed to SSE subscribers
+	metricsStreamInterval = 2 * time.Second
+	// pingTimeout bounds how long a synthetic ping request may take
+	pingTimeout = 5 * time.Second
+)
+
+// StreamTunnelMetrics streams live tunnel metrics as Server-Sent Events
+func (h *TunnelHandler) StreamTunnelMetrics(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	tunnelID := c.Param("id")
+
+	// Verify user owns this tunnel
+	var dbUserID string
+	err := h.db.QueryRow("SELECT user_id FROM tunnels WHERE id = $1", tunnelID).Scan(&dbUserID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch tunnel for metrics stream", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if dbUserID != userIDStr {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Tunnel does not belong to user"})
+		return
+	}
+
+	ticker := time.NewTicker(metricsStreamInterval)
+	defer ticker.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	// Send the first snapshot immediately, then one per tick until the client disconnects
+	c.SSEvent("metrics", h.tunnelMetrics(tunnelID))
+	c.Writer.Flush()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-ticker.C:
+			c.SSEvent("metrics", h.tunnelMetrics(tunnelID))
+			return true
+		}
+	})
+}
+
+// tunnelMetrics builds a snapshot of the in-memory metrics for a tunnel
+func (h *TunnelHandler) tunnelMetrics(tunnelID string) gin.H {
+	protocol, exists := h.GetActiveTunnel(tunnelID)
+	if !exists {
+		return gin.H{
+			"tunnel_id": tunnelID,
+			"active":    false,
+			"timestamp": time.Now().Unix(),
+		}
+	}
+
+	return gin.H{
+		"tunnel_id":      tunnelID,
+		"active":         true,
+		"total_requests": protocol.RequestCount(),
+		"in_flight":      protocol.InFlightRequests(),
+		"queue_depth":    protocol.QueueDepth(),
+		"p50_latency_ms": protocol.p50LatencyMs(),
+		"p95_latency_ms": protocol.p95LatencyMs(),
+		"p99_latency_ms": protocol.p99LatencyMs(),
+		"last_heartbeat": protocol.LastHeartbeat().Unix(),
+		"timestamp":      time.Now().Unix(),
+
+		"current_ping_interval_seconds": int(protocol.currentPingInterval().Seconds()),
+		"avg_pong_latency_ms":           protocol.averagePongLatencyMs(),
+	}
+}
+
+// PingTunnel sends a synthetic GET / through the tunnel to check that the agent and
+// the local service respond
+func (h *TunnelHandler) PingTunnel(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	tunnelID := c.Param("id")
+
+	// Verify user owns this tunnel
+	var dbUserID string
+	err := h.db.QueryRow("SELECT user_id FROM tunnels WHERE id = $1", tunnelID).Scan(&dbUserID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch tunnel for ping", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if dbUserID != userIDStr {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Tunnel does not belong to user"})
+		return
+	}
+
+	protocol, exists := h.GetActiveTunnel(tunnelID)
+	if !exists {
+		c.JSON(http.StatusOK, gin.H{"alive": false, "error": "tunnel not connected"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), pingTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build ping request"})
+		return
+	}
+	req.Header.Set("User-Agent", "SkyPort-Ping/1.0")
+
+	writer := &pingWriter{header: make(http.Header)}
+	start := time.Now()
+	aborted := forwardPing(protocol, writer, req)
+	latency := time.Since(start)
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		c.JSON(http.StatusOK, gin.H{"alive": false, "error": "timeout"})
+		return
+	}
+	if aborted || writer.status == 0 {
+		c.JSON(http.StatusOK, gin.H{"alive": false, "error": "no complete response"})
+		return
+	}
+
+	// The proxy answers with these itself when the agent or the local service can't be
+	// reached, so they don't show a working tunnel
+	switch writer.status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		c.JSON(http.StatusOK, gin.H{"alive": false, "error": "unreachable", "status": writer.status})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"alive":      true,
+		"latency_ms": latency.Milliseconds(),
+		"status":     writer.status,
+	})
+}
+
+// pingWriter records the status of a ping response and discards the body
+type pingWriter struct {
+	header http.Header
+	status int
+}
+
+func (pw *pingWriter) Header() http.Header {
+	return pw.header
+}
+
+func (pw *pingWriter) WriteHeader(status int) {
+	if pw.status == 0 {
+		pw.status = status
+	}
+}
+
+func (pw *pingWriter) Write(p []byte) (int, error) {
+	if pw.status == 0 {
+		pw.status = http.StatusOK
+	}
+	return len(p), nil
+}
+
+// forwardPing sends the ping through the tunnel. A response that is cut short aborts with
+// http.ErrAbortHandler, which only concerns the ping and must not abort the API request.
+func forwardPing(protocol *TunnelProtocol, w *pingWriter, req *http.Request) (aborted bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			if err != http.ErrAbortHandler {
+				panic(err)
+			}
+			aborted = true
+		}
+	}()
+	protocol.HandleIncomingHTTPRequest(w, req)
+	return false
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"errors"
+	"mime"
+	"strings"
+)
+
+// maxBoundaryLength is the longest multipart boundary RFC 2046 allows
+const maxBoundaryLength = 70
+
+// validateMultipartBoundary checks the boundary of a multipart/form-data Content-Type so a
+// malformed upload is rejected here with a clear error instead of by the local service.
+// Other content types are not checked.
+func validateMultipartBoundary(contentType string) error {
+	if contentType == "" {
+		return nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(contentType)), "multipart/form-data") {
+			return errors.New("malformed multipart/form-data Content-Type header")
+		}
+		return nil
+	}
+	if mediaType != "multipart/form-data" {
+		return nil
+	}
+
+	boundary, ok := params["boundary"]
+	if !ok || boundary == "" {
+		return errors.New("multipart/form-data Content-Type is missing the boundary parameter")
+	}
+	if len(boundary) > maxBoundaryLength {
+		return errors.New("multipart boundary is longer than 70 characters")
+	}
+	if strings.HasSuffix(boundary, " ") {
+		return errors.New("multipart boundary must not end with a space")
+	}
+	for _, r := range boundary {
+		if !isBoundaryChar(r) {
+			return errors.New("multipart boundary contains an invalid character")
+		}
+	}
+	return nil
+}
+
+// isBoundaryChar reports whether r is allowed in a boundary (bchars in RFC 2046)
+func isBoundaryChar(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	}
+	return strings.ContainsRune("'()+_,-./:=? ", r)
+}
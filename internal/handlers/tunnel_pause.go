@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PauseTunnel stops a tunnel from accepting traffic without giving up its subdomain.
+// A connected agent is disconnected and can't reconnect until the tunnel is resumed.
+func (h *TunnelHandler) PauseTunnel(c *gin.Context) {
+	h.setPaused(c, true)
+}
+
+// ResumeTunnel lets a paused tunnel's agent connect again
+func (h *TunnelHandler) ResumeTunnel(c *gin.Context) {
+	h.setPaused(c, false)
+}
+
+func (h *TunnelHandler) setPaused(c *gin.Context, paused bool) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	tunnelID := c.Param("id")
+
+	// Pausing disconnects the agent, which only its own instance can do
+	if paused && h.forwardControlToOwner(c, tunnelID) {
+		return
+	}
+
+	result, err := h.db.Exec(
+		"UPDATE tunnels SET is_paused = $1, updated_at = NOW() WHERE id = $2 AND user_id = $3",
+		paused, tunnelID, userIDStr,
+	)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to set paused state", "paused", paused, "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
+		return
+	}
+
+	if !paused {
+		c.JSON(http.StatusOK, gin.H{"message": "Tunnel resumed", "is_paused": false})
+		return
+	}
+
+	if protocol, exists := h.GetActiveTunnel(tunnelID); exists {
+		if err := protocol.SendTerminateWithReason("tunnel_paused"); err != nil {
+			h.logger.ErrorContext(c.Request.Context(), "Failed to disconnect agent of paused tunnel", "tunnel_id", tunnelID, "error", err)
+		}
+		// Visitors stop reaching the agent right away, whether or not it follows the terminate
+		if h.removeActiveTunnel(tunnelID, protocol) {
+			h.unstoreTunnel(tunnelID)
+		}
+		protocol.conn.Close()
+	}
+	if _, err := h.db.Exec("UPDATE tunnels SET is_active = false WHERE id = $1", tunnelID); err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to mark paused tunnel inactive", "tunnel_id", tunnelID, "error", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Tunnel paused", "is_paused": true})
+}
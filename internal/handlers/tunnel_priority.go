@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// activityWindowMinutes is how far back request activity counts towards a tunnel's priority
+	activityWindowMinutes = 5
+	// newConnectionBonus is the score a just-connected tunnel gets, shrinking to zero over newConnectionPeriod
+	newConnectionBonus  = 10.0
+	newConnectionPeriod = time.Hour
+)
+
+// activityWindow counts requests per minute over the last activityWindowMinutes minutes
+type activityWindow struct {
+	mutex   sync.Mutex
+	buckets [activityWindowMinutes]int64
+	minutes [activityWindowMinutes]int64 // unix minute each bucket belongs to
+}
+
+func (aw *activityWindow) record(now time.Time) {
+	minute := now.Unix() / 60
+	i := minute % activityWindowMinutes
+
+	aw.mutex.Lock()
+	defer aw.mutex.Unlock()
+	if aw.minutes[i] != minute {
+		aw.minutes[i] = minute
+		aw.buckets[i] = 0
+	}
+	aw.buckets[i]++
+}
+
+func (aw *activityWindow) total(now time.Time) int64 {
+	minute := now.Unix() / 60
+
+	aw.mutex.Lock()
+	defer aw.mutex.Unlock()
+	var total int64
+	for i := range aw.buckets {
+		if minute-aw.minutes[i] < activityWindowMinutes {
+			total += aw.buckets[i]
+		}
+	}
+	return total
+}
+
+// priorityScore ranks a tunnel for eviction, the lowest score is evicted first. It is the
+// number of requests in the last five minutes plus a bonus for recently connected tunnels.
+// User plan tiers will add to the score once plans exist.
+func (tp *TunnelProtocol) priorityScore(now time.Time) float64 {
+	score := float64(tp.activity.total(now))
+
+	if age := now.Sub(tp.connectedAt); age < newConnectionPeriod {
+		score += newConnectionBonus * float64(newConnectionPeriod-age) / float64(newConnectionPeriod)
+	}
+	return score
+}
+
+// evictLeastPriority terminates the active tunnel with the lowest priority score to make room
+// for a new connection. Tunnels already draining are skipped since they are about to leave.
+// It returns false when there is nothing to evict.
+func (h *TunnelHandler) evictLeastPriority() bool {
+	now := time.Now()
+
+	h.tunnelsMutex.RLock()
+	var victimID string
+	var victim *TunnelProtocol
+	var lowest float64
+	for tunnelID, protocol := range h.activeTunnels {
+		if protocol.IsDraining() {
+			continue
+		}
+		if score := protocol.priorityScore(now); victim == nil || score < lowest {
+			victimID, victim, lowest = tunnelID, protocol, score
+		}
+	}
+	h.tunnelsMutex.RUnlock()
+
+	if victim == nil {
+		return false
+	}
+
+	h.logger.Info("Active tunnel limit reached, evicting tunnel", "tunnel_id", victimID, "priority_score", lowest)
+	victim.StartDraining()
+	if err := h.terminateTunnel(victimID, victim); err != nil {
+		return false
+	}
+	return true
+}
+
+// activeTunnelCount returns the number of connected tunnels
+func (h *TunnelHandler) activeTunnelCount() int {
+	h.tunnelsMutex.RLock()
+	defer h.tunnelsMutex.RUnlock()
+	return len(h.activeTunnels)
+}
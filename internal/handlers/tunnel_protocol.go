@@ -1,64 +1,355 @@
 package handlers
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"skyport-server/internal/models"
 	"skyport-server/internal/templates"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
 )
 
 // TunnelMessage represents a message in the tunnel protocol
 type TunnelMessage struct {
-	Type      string            `json:"type"`
-	ID        string            `json:"id"`
-	Method    string            `json:"method,omitempty"`
-	URL       string            `json:"url,omitempty"`
-	Headers   map[string]string `json:"headers,omitempty"`
-	Body      []byte            `json:"body,omitempty"`
-	Status    int               `json:"status,omitempty"`
-	Error     string            `json:"error,omitempty"`
-	Timestamp int64             `json:"timestamp"`
+	Type        string            `json:"type"`
+	ID          string            `json:"id"`
+	Method      string            `json:"method,omitempty"`
+	URL         string            `json:"url,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+	Status      int               `json:"status,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	Credit      int64             `json:"credit,omitempty"`       // Flow control credit in bytes (window_update)
+	Port        int               `json:"port,omitempty"`         // Local port chosen by routing rules, 0 for the tunnel's local port
+	Messages    []*TunnelMessage  `json:"messages,omitempty"`     // Requests carried by a batch message
+	HTTPVersion string            `json:"http_version,omitempty"` // Protocol of the local service's response, e.g. "HTTP/1.0"
+	Success     bool              `json:"success,omitempty"`      // Outcome reported by a reload_ack
+	Reason      string            `json:"reason,omitempty"`       // Why the server sent a terminate
+	Timestamp   int64             `json:"timestamp"`
 }
 
+const (
+	// streamingBodyThreshold is the request body size above which uploads are streamed in chunks
+	streamingBodyThreshold = 1024 * 1024
+	// streamChunkSize is the buffer size used when streaming request bodies through the tunnel
+	streamChunkSize = 32 * 1024
+	// initialResponseWindow is the credit granted to the agent when it starts streaming a response
+	initialResponseWindow = 256 * 1024
+	// defaultSocketBufferBytes is the TCP buffer size used unless the tunnel configures write_buffer_kb
+	defaultSocketBufferBytes = 64 * 1024
+	// defaultMaxBodyBytes is the request body limit of tunnels created without max_body_bytes
+	defaultMaxBodyBytes = 10 << 20
+	// responseChannelSize buffers streamed response messages; the flow control window keeps
+	// a well-behaved agent far below this limit
+	responseChannelSize = 64
+	// maxPendingRequests bounds requests waiting for an agent response, including WebSocket
+	// upgrades and server requests that don't take a request slot
+	maxPendingRequests = 1024
+	// defaultResponseTimeout is how long a request waits for the agent's response unless the
+	// tunnel sets timeout_seconds
+	defaultResponseTimeout = 30 * time.Second
+	// responseBackpressureTimeout is how long the read loop pauses on a full response channel
+	// before the request is failed
+	responseBackpressureTimeout = 5 * time.Second
+)
+
+// errTooManyPendingRequests is returned by addPendingRequest when every pending slot is taken
+var errTooManyPendingRequests = errors.New("too many pending requests")
+
 // TunnelProtocol handles the complete HTTP tunneling protocol
 type TunnelProtocol struct {
-	conn          *websocket.Conn
-	tunnelID      string
-	localPort     int
-	pendingReqs   map[string]chan *TunnelMessage
-	requestCount  int64
-	lastHeartbeat time.Time
+	conn         *websocket.Conn
+	writeMutex   sync.Mutex // gorilla/websocket supports only one concurrent writer
+	tunnelID     string
+	localPort    int
+	pendingReqs  map[string]chan *TunnelMessage
+	pendingMutex sync.Mutex
+	pendingSlots chan struct{}
+	requestCount int64
+
+	// lastHeartbeat is when the agent was last heard from in unix nanoseconds. The reader
+	// goroutine sets it while handlers and the heartbeat loop read it.
+	lastHeartbeat atomic.Int64
+
+	// logger tags every record with the tunnel ID, the tunnel handler swaps in its own logger
+	logger *slog.Logger
+
+	// traffic accumulates request statistics until they are flushed to tunnel_stats
+	traffic trafficCounters
+
+	// requestSlots bounds concurrent in-flight requests; blocked senders are woken in FIFO order
+	requestSlots chan struct{}
+	queuedCount  int64
+
+	// draining is set while the tunnel is being stopped; no new requests are forwarded
+	draining atomic.Bool
+
+	// streamingEnabled allows large request bodies to be streamed, for agents that send
+	// X-Tunnel-Streaming: true while the "streaming" feature flag is on
+	streamingEnabled bool
+
+	// websocketControl relays WebSocket pings and pongs between clients and the local
+	// service, for agents that send X-Tunnel-WebSocket-Control: true. Otherwise the proxy
+	// answers client pings itself.
+	websocketControl bool
+
+	// proxyProtocolEnabled sends a PROXY protocol v2 header ahead of each stream's data
+	proxyProtocolEnabled bool
+
+	// writeBufferBytes and readBufferBytes size the agent connection's TCP socket buffers
+	writeBufferBytes int
+	readBufferBytes  int
+
+	// maxMessageBytes is the read limit on the agent connection
+	maxMessageBytes int64
+
+	// maxBodyBytes rejects larger request bodies with 413 before they reach the agent, 0 for no
+	// limit. The proxy refreshes it from the tunnel record like responseTimeout.
+	maxBodyBytes atomic.Int64
+
+	// transforms rewrite requests before they are forwarded and responses before they are written
+	transforms []models.TransformRule
+
+	// headerRules set or remove headers, the tunnel handler swaps them when the owner edits them
+	headerRules atomic.Pointer[[]models.HeaderRule]
+
+	// routingRules pick the local port for each request by path prefix
+	routingRules []models.RoutingRule
+
+	// portRouting is set for agents that send X-Tunnel-Port-Routing: true. Older agents
+	// ignore TunnelMessage.Port and forward everything to the port they connected with.
+	portRouting bool
+
+	// localPortOverride is the tunnel's local port when it was changed after the agent
+	// connected with localPort, 0 while unchanged
+	localPortOverride atomic.Int64
+
+	// corsBypass answers preflights itself and allows every origin on responses
+	corsBypass bool
+
+	// responseTimeout overrides defaultResponseTimeout when positive, in nanoseconds. The proxy
+	// refreshes it from the tunnel record on every request so updates apply without reconnecting.
+	responseTimeout atomic.Int64
+
+	// events publishes to the owner's event feed, set by the tunnel handler
+	events func(eventType string, data gin.H)
+
+	// coalesceGetRequests shares one agent round-trip between identical concurrent GETs
+	coalesceGetRequests bool
+	coalescedReqs       map[string]*coalescedRequest
+	coalesceMutex       sync.Mutex
+
+	// connectedAt and activity feed the priority score used to evict tunnels at the active limit
+	connectedAt time.Time
+	activity    activityWindow
+
+	// latency is the distribution of HandleIncomingHTTPRequest durations
+	latency latencyHistogram
+
+	// frameDebug records every message sent and received in frames (SKYPORT_WS_FRAME_DEBUG)
+	frameDebug bool
+	frames     frameLog
+
+	// heartbeat adapts the ping interval to the measured pong latency
+	heartbeat heartbeatState
+
+	// preflights caches OPTIONS responses that carry Access-Control-Max-Age
+	preflights optionsCache
+
+	// responses keeps fresh GET responses to answer conditional requests with 304
+	responses responseCache
+
+	// websockets are the proxied client connections, keyed by request ID
+	websockets websocketClients
+
+	// agentMetrics is the local service health last reported by the agent
+	agentMetrics agentMetricsState
+
+	// inspector keeps recent request/response pairs for the live request inspector
+	inspector requestInspector
+
+	// compression is the algorithm negotiated with the agent ("" for none); once
+	// compressionEnabled is set, messages travel as zstd-compressed binary frames
+	compression        string
+	compressionEnabled atomic.Bool
+	zstdEncoder        *zstd.Encoder
+	zstdDecoder        *zstd.Decoder
+
+	// batchWindow is how long small requests wait to share a frame when the agent accepted
+	// batching (0 for none); batcher is set once batching is enabled
+	batchWindow time.Duration
+	batcher     atomic.Pointer[messageBatcher]
 }
 
-func NewTunnelProtocol(conn *websocket.Conn, tunnelID string, localPort int) *TunnelProtocol {
-	return &TunnelProtocol{
-		conn:          conn,
-		tunnelID:      tunnelID,
-		localPort:     localPort,
-		pendingReqs:   make(map[string]chan *TunnelMessage),
-		lastHeartbeat: time.Now(),
+// NewTunnelProtocol wraps an agent connection. timeout is how long requests wait for the
+// agent's response, 0 for defaultResponseTimeout.
+func NewTunnelProtocol(conn *websocket.Conn, tunnelID string, localPort int, timeout time.Duration, maxConcurrentRequests int, maxMessageBytes int64) *TunnelProtocol {
+	if maxConcurrentRequests < 1 {
+		maxConcurrentRequests = 1
+	}
+	// Without a limit an agent could make the server buffer an arbitrarily large message
+	if maxMessageBytes > 0 {
+		conn.SetReadLimit(maxMessageBytes)
+	}
+	tp := &TunnelProtocol{
+		conn:             conn,
+		tunnelID:         tunnelID,
+		localPort:        localPort,
+		pendingReqs:      make(map[string]chan *TunnelMessage),
+		pendingSlots:     make(chan struct{}, maxPendingRequests),
+		connectedAt:      time.Now(),
+		readBufferBytes:  defaultSocketBufferBytes,
+		writeBufferBytes: defaultSocketBufferBytes,
+		requestSlots:     make(chan struct{}, maxConcurrentRequests),
+		maxMessageBytes:  maxMessageBytes,
+		coalescedReqs:    make(map[string]*coalescedRequest),
+		logger:           slog.Default().With("tunnel_id", tunnelID),
+		traffic:          trafficCounters{flushedAt: time.Now()},
+	}
+	tp.SetResponseTimeout(timeout)
+	tp.touchHeartbeat()
+	return tp
+}
+
+// touchHeartbeat records that the agent was just heard from
+func (tp *TunnelProtocol) touchHeartbeat() {
+	tp.lastHeartbeat.Store(time.Now().UnixNano())
+}
+
+// LastHeartbeat returns when the agent was last heard from
+func (tp *TunnelProtocol) LastHeartbeat() time.Time {
+	return time.Unix(0, tp.lastHeartbeat.Load())
+}
+
+// applySocketBuffers sets the TCP buffer sizes of the agent connection. Tunnels serving large
+// files or video benefit from a bigger write buffer (write_buffer_kb).
+func (tp *TunnelProtocol) applySocketBuffers() {
+	tcpConn, ok := tp.conn.UnderlyingConn().(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tcpConn.SetReadBuffer(tp.readBufferBytes); err != nil {
+		tp.logger.Error("Failed to set read buffer", "error", err)
+	}
+	if err := tcpConn.SetWriteBuffer(tp.writeBufferBytes); err != nil {
+		tp.logger.Error("Failed to set write buffer", "error", err)
 	}
 }
 
 // HandleIncomingHTTPRequest processes an HTTP request and forwards it through the tunnel
 func (tp *TunnelProtocol) HandleIncomingHTTPRequest(w http.ResponseWriter, r *http.Request) {
-	tp.requestCount++
-	requestID := fmt.Sprintf("%s-%d", tp.tunnelID, tp.requestCount)
+	if tp.IsDraining() {
+		http.Error(w, "Tunnel is shutting down", http.StatusServiceUnavailable)
+		return
+	}
 
-	// Read request body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+	start := time.Now()
+	defer func() { tp.latency.observe(time.Since(start)) }()
+	tp.activity.record(start)
+
+	// Transforms run first so coalescing and caching see the request the agent will get
+	tp.applyRequestTransforms(r)
+	tp.applyHeaderRules("request", r.Header)
+
+	// A bad boundary would only surface as an opaque parse error in the local service
+	if err := validateMultipartBoundary(r.Header.Get("Content-Type")); err != nil {
+		http.Error(w, "Invalid multipart request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if tp.corsBypass && r.Method == http.MethodOptions {
+		tp.writeCORSBypassPreflight(w)
+		return
+	}
+
+	// CORS preflights are answered from cache when the local service allowed it
+	if r.Method == http.MethodOptions {
+		key := optionsCacheKey(r)
+		if cached, found := tp.preflights.get(key); found {
+			tp.writeHTTPResponse(w, cached)
+			return
+		}
+		tp.preflights.store(key, tp.forwardHTTPRequest(w, r))
 		return
 	}
-	r.Body.Close()
+
+	// A conditional GET whose validators match a fresh cached response needs no agent round trip
+	if isRevalidationRequest(r) {
+		if cached, found := tp.responses.get(coalesceKey(r)); found && evaluateConditionalRequest(r, cached) {
+			tp.writeNotModified(w, cached)
+			return
+		}
+	}
+
+	if !tp.coalesceGetRequests || !isCoalescable(r) {
+		tp.forwardHTTPRequest(w, r)
+		return
+	}
+
+	// Identical GETs already in flight wait for the first one's response instead of hitting the agent again
+	key := coalesceKey(r)
+	call, leader := tp.joinCoalescedRequest(key)
+	if leader {
+		call.response = tp.forwardHTTPRequest(w, r)
+		tp.finishCoalescedRequest(key, call)
+		return
+	}
+
+	select {
+	case <-call.done:
+		if call.response != nil && varyCoveredByCoalesceKey(call.response.Headers) {
+			tp.writeHTTPResponse(w, call.response)
+			return
+		}
+		// The first request failed, was streamed or varies on headers outside the key, so
+		// forward this one on its own
+		tp.forwardHTTPRequest(w, r)
+	case <-r.Context().Done():
+	}
+}
+
+// forwardHTTPRequest sends a request through the tunnel and writes the agent's response.
+// It returns the buffered response that was written, or nil if the request failed or the
+// response was streamed.
+func (tp *TunnelProtocol) forwardHTTPRequest(w http.ResponseWriter, r *http.Request) *TunnelMessage {
+	// Wait for a free request slot so a burst of requests can't overwhelm the agent
+	if !tp.acquireRequestSlot(r) {
+		tp.publishEvent("tunnel.threshold_exceeded", gin.H{"threshold": "concurrent_requests", "limit": cap(tp.requestSlots)})
+		http.Error(w, "Tunnel is busy, request was not processed", http.StatusServiceUnavailable)
+		return nil
+	}
+	defer tp.releaseRequestSlot()
+
+	// Draining may have started while the request was queued. The slot is held before the
+	// check, so WaitForDrain either waits for this request or it is refused here.
+	if tp.IsDraining() {
+		http.Error(w, "Tunnel is shutting down", http.StatusServiceUnavailable)
+		return nil
+	}
+
+	// Declared sizes are rejected before anything is read
+	maxBodyBytes := tp.maxBodyBytes.Load()
+	if maxBodyBytes > 0 && r.ContentLength > maxBodyBytes {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return nil
+	}
+
+	requestID := fmt.Sprintf("%s-%d", tp.tunnelID, atomic.AddInt64(&tp.requestCount, 1))
 
 	// Convert headers to map
 	headers := make(map[string]string)
@@ -66,43 +357,526 @@ func (tp *TunnelProtocol) HandleIncomingHTTPRequest(w http.ResponseWriter, r *ht
 		headers[name] = strings.Join(values, ", ")
 	}
 
-	// Create tunnel message
-	message := &TunnelMessage{
-		Type:      "http_request",
+	// Propagate (or start) a W3C trace so the local service can join the distributed trace
+	injectTraceContext(headers)
+
+	// Create response channel
+	responseChan, err := tp.addPendingRequest(requestID)
+	if err != nil {
+		tp.publishEvent("tunnel.threshold_exceeded", gin.H{"threshold": "pending_requests", "limit": maxPendingRequests})
+		http.Error(w, "Tunnel is busy, request was not processed", http.StatusServiceUnavailable)
+		return nil
+	}
+	defer tp.removePendingRequest(requestID)
+
+	if tp.streamingEnabled && shouldStreamRequestBody(r) {
+		// Large or chunked uploads are streamed instead of buffered in memory
+		if maxBodyBytes > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+		}
+		if err := tp.streamHTTPRequest(requestID, r, headers); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return nil
+			}
+			tp.logger.ErrorContext(r.Context(), "Failed to stream request through tunnel", "message_id", requestID, "error", err)
+			http.Error(w, "Failed to send request through tunnel", http.StatusBadGateway)
+			return nil
+		}
+	} else {
+		// Read request body, one byte past the tunnel's limit tells a body that was cut off
+		reader := io.Reader(r.Body)
+		if maxBodyBytes > 0 {
+			reader = io.LimitReader(r.Body, maxBodyBytes+1)
+		}
+		body, err := io.ReadAll(reader)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) || (maxBodyBytes > 0 && int64(len(body)) > maxBodyBytes) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return nil
+		}
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+			return nil
+		}
+		r.Body.Close()
+
+		// Create tunnel message
+		message := &TunnelMessage{
+			Type:      "http_request",
+			ID:        requestID,
+			Method:    r.Method,
+			URL:       r.URL.String(),
+			Headers:   headers,
+			Port:      tp.targetPort(r.URL.Path),
+			Body:      body,
+			Timestamp: time.Now().Unix(),
+		}
+
+		// Send request through tunnel
+		if err := tp.sendMessage(message); err != nil {
+			http.Error(w, "Failed to send request through tunnel", http.StatusBadGateway)
+			return nil
+		}
+	}
+
+	// Wait for response (with timeout)
+	select {
+	case response, ok := <-responseChan:
+		if !ok {
+			http.Error(w, "Tunnel closed", http.StatusBadGateway)
+			return nil
+		}
+		if response.Type == "http_response_start" {
+			tp.streamHTTPResponse(w, r, response, responseChan)
+			return nil
+		}
+		tp.writeHTTPResponse(w, response)
+		if r.Method == http.MethodGet {
+			tp.responses.store(coalesceKey(r), response)
+		}
+		return response
+	case <-time.After(tp.ResponseTimeout()):
+		http.Error(w, "Tunnel request timeout", http.StatusGatewayTimeout)
+		return nil
+	case <-r.Context().Done():
+		// Client went away (or the caller's deadline passed), nobody is waiting for the response
+		return nil
+	}
+}
+
+// coalescedRequest is a GET in flight that identical requests can wait on
+type coalescedRequest struct {
+	done     chan struct{}
+	response *TunnelMessage
+}
+
+// uncoalescableHeaders make the response depend on what the client already has, so a
+// shared 206 or 304 would be wrong for the other waiting requests
+var uncoalescableHeaders = []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"}
+
+// coalesceKeyHeaders are the request headers that must match for two requests to share a response
+var coalesceKeyHeaders = []string{"Authorization", "Cookie", "Accept", "Accept-Encoding"}
+
+// isCoalescable reports whether a request is a bodiless, unconditional GET that can share a
+// response. Event streams never end, so a waiting duplicate would never be served.
+func isCoalescable(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.ContentLength != 0 || len(r.TransferEncoding) != 0 || isEventStreamRequest(r) {
+		return false
+	}
+	for _, name := range uncoalescableHeaders {
+		if r.Header.Get(name) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// isEventStreamRequest reports whether the client asked for Server-Sent Events
+func isEventStreamRequest(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// isEventStreamResponse reports whether the local service answered with Server-Sent Events
+func isEventStreamResponse(headers map[string]string) bool {
+	return strings.HasPrefix(strings.ToLower(headerValue(headers, "Content-Type")), "text/event-stream")
+}
+
+// coalesceKey identifies identical requests. Credentials are part of the key so
+// responses are never shared between different users of the local service, and the
+// negotiation headers so nobody gets a body in an encoding they didn't ask for.
+func coalesceKey(r *http.Request) string {
+	var key strings.Builder
+	key.WriteString(r.Method + " " + r.URL.String())
+	for _, name := range coalesceKeyHeaders {
+		key.WriteString("\x00" + strings.Join(r.Header.Values(name), ","))
+	}
+	return key.String()
+}
+
+// varyCoveredByCoalesceKey reports whether every header a response varies on is part of the
+// coalesce key, so waiting requests can be given the same response
+func varyCoveredByCoalesceKey(headers map[string]string) bool {
+	for _, name := range strings.Split(headerValue(headers, "Vary"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "*" || !slices.Contains(coalesceKeyHeaders, http.CanonicalHeaderKey(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// joinCoalescedRequest returns the in-flight request for key, or registers a new one.
+// The second return value is true when the caller is the first request and must forward it.
+func (tp *TunnelProtocol) joinCoalescedRequest(key string) (*coalescedRequest, bool) {
+	tp.coalesceMutex.Lock()
+	defer tp.coalesceMutex.Unlock()
+
+	if call, exists := tp.coalescedReqs[key]; exists {
+		return call, false
+	}
+	call := &coalescedRequest{done: make(chan struct{})}
+	tp.coalescedReqs[key] = call
+	return call, true
+}
+
+// finishCoalescedRequest wakes up the waiting requests once the response is known
+func (tp *TunnelProtocol) finishCoalescedRequest(key string, call *coalescedRequest) {
+	tp.coalesceMutex.Lock()
+	delete(tp.coalescedReqs, key)
+	tp.coalesceMutex.Unlock()
+	close(call.done)
+}
+
+// streamHTTPResponse writes a response the agent sends as http_response_start followed by
+// http_response_chunk messages and a final http_response_end. The agent may only send as many
+// bytes as it has credit for; credit is granted with window_update messages after each chunk
+// has been flushed to the client, so a slow client throttles the agent instead of filling memory.
+//
+// Server-Sent Events streams may stay quiet for long stretches, so they have no idle timeout
+// and last until the client disconnects or the tunnel closes.
+func (tp *TunnelProtocol) streamHTTPResponse(w http.ResponseWriter, r *http.Request, start *TunnelMessage, responseChan chan *TunnelMessage) {
+	if start.Error != "" {
+		tp.writeHTTPResponse(w, start)
+		return
+	}
+
+	var idleTimeout <-chan time.Time
+	eventStream := isEventStreamRequest(r) || isEventStreamResponse(start.Headers)
+	if eventStream {
+		// Keep reverse proxies in front of the server from buffering the stream
+		w.Header().Set("X-Accel-Buffering", "no")
+	}
+	tp.writeResponseHeaders(w, start)
+
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	if err := tp.sendWindowUpdate(start.ID, initialResponseWindow); err != nil {
+		tp.logger.ErrorContext(r.Context(), "Failed to grant response window", "message_id", start.ID, "error", err)
+		return
+	}
+
+	// Other streams fail when the agent sends nothing for the tunnel's response timeout
+	responseTimeout := tp.ResponseTimeout()
+	for {
+		if !eventStream {
+			idleTimeout = time.After(responseTimeout)
+		}
+
+		select {
+		case message, ok := <-responseChan:
+			if !ok {
+				// The tunnel closed or the request was failed, the client must not take the
+				// body it got so far for the whole response
+				abortResponse(w)
+				return
+			}
+			if message.Type == "http_response_end" {
+				return
+			}
+			if message.Type == "http_response_trailers" {
+				// net/http sends them after the last chunk when the handler returns
+				writeResponseTrailers(w, message.Headers)
+				continue
+			}
+			if message.Type != "http_response_chunk" {
+				continue
+			}
+
+			if _, err := w.Write(message.Body); err != nil {
+				tp.logger.InfoContext(r.Context(), "Client went away while streaming", "message_id", start.ID, "error", err)
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+
+			// Replenish the credit that was just flushed to the client
+			if err := tp.sendWindowUpdate(start.ID, int64(len(message.Body))); err != nil {
+				tp.logger.ErrorContext(r.Context(), "Failed to send window update", "message_id", start.ID, "error", err)
+				return
+			}
+		case <-idleTimeout:
+			tp.logger.WarnContext(r.Context(), "Timed out waiting for response chunk", "message_id", start.ID)
+			return
+		case <-r.Context().Done():
+			// Let the agent close the upstream connection instead of streaming into the void
+			tp.sendMessage(&TunnelMessage{
+				Type:      "http_response_cancel",
+				ID:        start.ID,
+				Timestamp: time.Now().Unix(),
+			})
+			return
+		}
+	}
+}
+
+// sendWindowUpdate grants the agent credit to send more response bytes for a request
+func (tp *TunnelProtocol) sendWindowUpdate(requestID string, credit int64) error {
+	return tp.sendMessage(&TunnelMessage{
+		Type:      "window_update",
+		ID:        requestID,
+		Credit:    credit,
+		Timestamp: time.Now().Unix(),
+	})
+}
+
+// injectTraceContext continues an incoming W3C traceparent header or starts a new trace when
+// none (or an invalid one) is present. Skyport's own span, recorded in X-Skyport-Span-ID,
+// becomes the parent of the local service's span. Header names are canonicalised because
+// they are copied from http.Header.
+func injectTraceContext(headers map[string]string) {
+	spanID := randomHex(8)
+	headers["X-Skyport-Span-Id"] = spanID
+
+	if traceparent := headers["Traceparent"]; isValidTraceparent(traceparent) {
+		// Keep the version, trace ID and flags, only the parent changes
+		parts := strings.Split(traceparent, "-")
+		headers["Traceparent"] = strings.Join([]string{parts[0], parts[1], spanID, parts[3]}, "-")
+		return
+	}
+
+	// A tracestate without a valid traceparent must be discarded
+	delete(headers, "Tracestate")
+	headers["Traceparent"] = fmt.Sprintf("00-%s-%s-01", randomHex(16), spanID)
+}
+
+// isValidTraceparent checks the version-traceid-parentid-flags layout of a traceparent header
+func isValidTraceparent(value string) bool {
+	parts := strings.Split(value, "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return false
+	}
+	for _, part := range parts {
+		if _, err := hex.DecodeString(part); err != nil {
+			return false
+		}
+	}
+	// All-zero trace and parent IDs are invalid per the spec
+	return parts[1] != strings.Repeat("0", 32) && parts[2] != strings.Repeat("0", 16)
+}
+
+// randomHex returns n random bytes encoded as lowercase hex
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// acquireRequestSlot blocks until the request may be forwarded.
+// It gives up if the client goes away or the request waits longer than the request timeout.
+func (tp *TunnelProtocol) acquireRequestSlot(r *http.Request) bool {
+	select {
+	case tp.requestSlots <- struct{}{}:
+		return true
+	default:
+	}
+
+	atomic.AddInt64(&tp.queuedCount, 1)
+	defer atomic.AddInt64(&tp.queuedCount, -1)
+
+	select {
+	case tp.requestSlots <- struct{}{}:
+		return true
+	case <-r.Context().Done():
+		return false
+	case <-time.After(tp.ResponseTimeout()):
+		return false
+	}
+}
+
+func (tp *TunnelProtocol) releaseRequestSlot() {
+	<-tp.requestSlots
+}
+
+// SetResponseTimeout sets how long requests wait for the agent's response, 0 for the default
+func (tp *TunnelProtocol) SetResponseTimeout(timeout time.Duration) {
+	tp.responseTimeout.Store(int64(timeout))
+}
+
+// SetMaxBodyBytes sets the largest request body forwarded to the agent, 0 for no limit
+func (tp *TunnelProtocol) SetMaxBodyBytes(limit int64) {
+	tp.maxBodyBytes.Store(limit)
+}
+
+// ResponseTimeout returns how long requests wait for the agent's response
+func (tp *TunnelProtocol) ResponseTimeout() time.Duration {
+	if timeout := time.Duration(tp.responseTimeout.Load()); timeout > 0 {
+		return timeout
+	}
+	return defaultResponseTimeout
+}
+
+// StartDraining stops new requests from being forwarded.
+// It returns false if the tunnel was already draining.
+func (tp *TunnelProtocol) StartDraining() bool {
+	return tp.draining.CompareAndSwap(false, true)
+}
+
+// IsDraining reports whether the tunnel is being stopped
+func (tp *TunnelProtocol) IsDraining() bool {
+	return tp.draining.Load()
+}
+
+// PendingRequests returns the number of requests still waiting for a response from the agent
+func (tp *TunnelProtocol) PendingRequests() int {
+	tp.pendingMutex.Lock()
+	defer tp.pendingMutex.Unlock()
+	return len(tp.pendingReqs)
+}
+
+// IsIdle reports whether no requests are pending or hold a request slot, streamed responses
+// keep their slot until the last chunk is written
+func (tp *TunnelProtocol) IsIdle() bool {
+	return tp.PendingRequests() == 0 && tp.InFlightRequests() == 0
+}
+
+// WaitForDrain blocks until the tunnel is idle or the timeout expires. It returns true if
+// all requests completed.
+func (tp *TunnelProtocol) WaitForDrain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !tp.IsIdle() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// QueueDepth returns the number of requests waiting for a free slot
+func (tp *TunnelProtocol) QueueDepth() int {
+	return int(atomic.LoadInt64(&tp.queuedCount))
+}
+
+// InFlightRequests returns the number of requests currently being forwarded
+func (tp *TunnelProtocol) InFlightRequests() int {
+	return len(tp.requestSlots)
+}
+
+// RequestCount returns the total number of requests forwarded through the tunnel
+func (tp *TunnelProtocol) RequestCount() int64 {
+	return atomic.LoadInt64(&tp.requestCount)
+}
+
+// shouldStreamRequestBody reports whether a request body is too large or of unknown length to buffer
+func shouldStreamRequestBody(r *http.Request) bool {
+	for _, encoding := range r.TransferEncoding {
+		if encoding == "chunked" {
+			return true
+		}
+	}
+	return r.ContentLength < 0 || r.ContentLength > streamingBodyThreshold
+}
+
+// streamHTTPRequest sends the request headers as http_request_start, the body as a sequence of
+// http_request_chunk messages and finally http_request_end once the body has been fully read
+func (tp *TunnelProtocol) streamHTTPRequest(requestID string, r *http.Request, headers map[string]string) error {
+	defer r.Body.Close()
+
+	// Let the agent know whether to expect a known length or read until http_request_end
+	if r.ContentLength < 0 {
+		headers["Transfer-Encoding"] = "chunked"
+	}
+
+	startMessage := &TunnelMessage{
+		Type:      "http_request_start",
 		ID:        requestID,
 		Method:    r.Method,
 		URL:       r.URL.String(),
 		Headers:   headers,
-		Body:      body,
+		Port:      tp.targetPort(r.URL.Path),
 		Timestamp: time.Now().Unix(),
 	}
+	if err := tp.sendMessage(startMessage); err != nil {
+		return err
+	}
 
-	// Create response channel
-	responseChan := make(chan *TunnelMessage, 1)
-	tp.pendingReqs[requestID] = responseChan
+	writer := &requestChunkWriter{tp: tp, requestID: requestID}
+	if _, err := io.CopyBuffer(writer, r.Body, make([]byte, streamChunkSize)); err != nil {
+		// Tell the agent to discard the partial body
+		tp.sendMessage(&TunnelMessage{
+			Type:      "http_request_end",
+			ID:        requestID,
+			Error:     "Client aborted request body",
+			Timestamp: time.Now().Unix(),
+		})
+		return fmt.Errorf("failed to stream request body: %w", err)
+	}
 
-	// Send request through tunnel
-	if err := tp.sendMessage(message); err != nil {
-		delete(tp.pendingReqs, requestID)
-		http.Error(w, "Failed to send request through tunnel", http.StatusBadGateway)
-		return
+	return tp.sendMessage(&TunnelMessage{
+		Type:      "http_request_end",
+		ID:        requestID,
+		Timestamp: time.Now().Unix(),
+	})
+}
+
+// requestChunkWriter forwards every write as an http_request_chunk message
+type requestChunkWriter struct {
+	tp        *TunnelProtocol
+	requestID string
+}
+
+func (cw *requestChunkWriter) Write(p []byte) (int, error) {
+	chunk := &TunnelMessage{
+		Type:      "http_request_chunk",
+		ID:        cw.requestID,
+		Body:      p,
+		Timestamp: time.Now().Unix(),
+	}
+	if err := cw.tp.sendMessage(chunk); err != nil {
+		return 0, err
 	}
+	return len(p), nil
+}
 
-	// Wait for response (with timeout)
+// addPendingRequest registers a response channel for a request sent through the tunnel.
+// It takes a pending slot first and fails with errTooManyPendingRequests when none is free.
+func (tp *TunnelProtocol) addPendingRequest(requestID string) (chan *TunnelMessage, error) {
 	select {
-	case response := <-responseChan:
-		tp.writeHTTPResponse(w, response)
-		delete(tp.pendingReqs, requestID)
-	case <-time.After(30 * time.Second):
+	case tp.pendingSlots <- struct{}{}:
+	default:
+		return nil, errTooManyPendingRequests
+	}
+
+	responseChan := make(chan *TunnelMessage, responseChannelSize)
+	tp.pendingMutex.Lock()
+	tp.pendingReqs[requestID] = responseChan
+	tp.pendingMutex.Unlock()
+	return responseChan, nil
+}
+
+func (tp *TunnelProtocol) removePendingRequest(requestID string) {
+	tp.pendingMutex.Lock()
+	if _, exists := tp.pendingReqs[requestID]; exists {
 		delete(tp.pendingReqs, requestID)
-		http.Error(w, "Tunnel request timeout", http.StatusGatewayTimeout)
+		<-tp.pendingSlots
 	}
+	tp.pendingMutex.Unlock()
+}
+
+func (tp *TunnelProtocol) getPendingRequest(requestID string) (chan *TunnelMessage, bool) {
+	tp.pendingMutex.Lock()
+	defer tp.pendingMutex.Unlock()
+	responseChan, exists := tp.pendingReqs[requestID]
+	return responseChan, exists
 }
 
 // HandleWebSocketUpgrade handles WebSocket upgrade requests through the tunnel
 func (tp *TunnelProtocol) HandleWebSocketUpgrade(w http.ResponseWriter, r *http.Request) {
-	tp.requestCount++
-	requestID := fmt.Sprintf("%s-ws-%d", tp.tunnelID, tp.requestCount)
+	if tp.IsDraining() {
+		http.Error(w, "Tunnel is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	requestID := fmt.Sprintf("%s-ws-%d", tp.tunnelID, atomic.AddInt64(&tp.requestCount, 1))
 
 	// Convert headers to map
 	headers := make(map[string]string)
@@ -117,31 +891,35 @@ func (tp *TunnelProtocol) HandleWebSocketUpgrade(w http.ResponseWriter, r *http.
 		Method:    r.Method,
 		URL:       r.URL.String(),
 		Headers:   headers,
+		Port:      tp.targetPort(r.URL.Path),
 		Timestamp: time.Now().Unix(),
 	}
 
 	// Create response channel
-	responseChan := make(chan *TunnelMessage, 1)
-	tp.pendingReqs[requestID] = responseChan
+	responseChan, err := tp.addPendingRequest(requestID)
+	if err != nil {
+		http.Error(w, "Tunnel is busy, WebSocket upgrade was not processed", http.StatusServiceUnavailable)
+		return
+	}
+	defer tp.removePendingRequest(requestID)
 
 	// Send upgrade request through tunnel
 	if err := tp.sendMessage(message); err != nil {
-		delete(tp.pendingReqs, requestID)
 		http.Error(w, "Failed to send WebSocket upgrade through tunnel", http.StatusBadGateway)
 		return
 	}
 
 	// Wait for upgrade response
 	select {
-	case response := <-responseChan:
-		if response.Status == http.StatusSwitchingProtocols {
+	case response, ok := <-responseChan:
+		if !ok {
+			http.Error(w, "Tunnel closed", http.StatusBadGateway)
+		} else if response.Status == http.StatusSwitchingProtocols {
 			tp.handleWebSocketTunnel(w, r, requestID)
 		} else {
 			tp.writeHTTPResponse(w, response)
 		}
-		delete(tp.pendingReqs, requestID)
 	case <-time.After(10 * time.Second):
-		delete(tp.pendingReqs, requestID)
 		http.Error(w, "WebSocket upgrade timeout", http.StatusGatewayTimeout)
 	}
 }
@@ -152,44 +930,99 @@ func (tp *TunnelProtocol) HandleTunnelMessage(messageBytes []byte) error {
 	if err := json.Unmarshal(messageBytes, &message); err != nil {
 		return fmt.Errorf("failed to unmarshal tunnel message: %w", err)
 	}
+	tp.recordFrame("received", &message, len(messageBytes))
 
 	switch message.Type {
-	case "http_response":
+	case "http_response", "http_response_start", "http_response_chunk", "http_response_end", "http_response_trailers",
+		"server_response", "reload_ack":
 		return tp.handleHTTPResponse(&message)
 	case "websocket_upgrade_response":
 		return tp.handleWebSocketUpgradeResponse(&message)
 	case "websocket_data":
 		return tp.handleWebSocketData(&message)
+	case "websocket_control":
+		return tp.handleWebSocketControl(&message)
+	case "metrics":
+		return tp.handleAgentMetrics(messageBytes)
 	case "ping":
 		return tp.handlePing(&message)
 	case "pong":
 		return tp.handlePong(&message)
 	default:
-		log.Printf("Unknown tunnel message type: %s", message.Type)
+		tp.logger.Warn("Unknown tunnel message type", "type", message.Type)
 	}
 
 	return nil
 }
 
 func (tp *TunnelProtocol) handleHTTPResponse(message *TunnelMessage) error {
-	if responseChan, exists := tp.pendingReqs[message.ID]; exists {
+	if responseChan, exists := tp.getPendingRequest(message.ID); exists {
 		select {
 		case responseChan <- message:
 		default:
-			log.Printf("Response channel full for request %s", message.ID)
+			// Back-pressure: stop reading from the agent until the client catches up
+			tp.waitForResponseChannel(responseChan, message)
 		}
 	} else {
-		log.Printf("No pending request found for ID: %s", message.ID)
+		tp.logger.Warn("No pending request found", "message_id", message.ID)
 	}
 	return nil
 }
 
+// waitForResponseChannel blocks the read loop until responseChan accepts message, so an agent
+// streaming faster than the client reads is slowed down instead of having messages dropped.
+// A channel that stays full for responseBackpressureTimeout fails the request: dropping the
+// message would silently corrupt the body.
+func (tp *TunnelProtocol) waitForResponseChannel(responseChan chan *TunnelMessage, message *TunnelMessage) {
+	timer := time.NewTimer(responseBackpressureTimeout)
+	defer timer.Stop()
+
+	select {
+	case responseChan <- message:
+	case <-timer.C:
+		tp.logger.Warn("Response channel full, failing request", "message_id", message.ID, "timeout", responseBackpressureTimeout)
+		tp.failPendingRequest(message.ID, responseChan)
+	}
+}
+
+// failPendingRequest cancels a request whose client stopped reading. Closing the channel
+// makes the waiting handler abort the client connection, and the agent stops sending.
+// Only the read loop sends on response channels, so closing here can't race a send.
+func (tp *TunnelProtocol) failPendingRequest(requestID string, responseChan chan *TunnelMessage) {
+	tp.pendingMutex.Lock()
+	if tp.pendingReqs[requestID] != responseChan {
+		tp.pendingMutex.Unlock()
+		return
+	}
+	delete(tp.pendingReqs, requestID)
+	<-tp.pendingSlots
+	close(responseChan)
+	tp.pendingMutex.Unlock()
+
+	tp.sendMessage(&TunnelMessage{
+		Type:      "http_response_cancel",
+		ID:        requestID,
+		Timestamp: time.Now().Unix(),
+	})
+}
+
+// abortResponse closes the client connection in the middle of a response, so the client sees
+// an error instead of a complete-looking truncated body. HTTP/2 connections can't be
+// hijacked, the panic makes net/http reset the stream instead.
+func abortResponse(w http.ResponseWriter) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	conn.Close()
+}
+
 func (tp *TunnelProtocol) handleWebSocketUpgradeResponse(message *TunnelMessage) error {
-	if responseChan, exists := tp.pendingReqs[message.ID]; exists {
+	if responseChan, exists := tp.getPendingRequest(message.ID); exists {
 		select {
 		case responseChan <- message:
 		default:
-			log.Printf("WebSocket upgrade response channel full for request %s", message.ID)
+			tp.logger.Warn("WebSocket upgrade response channel full", "message_id", message.ID)
 		}
 	}
 	return nil
@@ -198,7 +1031,7 @@ func (tp *TunnelProtocol) handleWebSocketUpgradeResponse(message *TunnelMessage)
 func (tp *TunnelProtocol) handleWebSocketData(message *TunnelMessage) error {
 	// Handle WebSocket data forwarding
 	// This would be implemented based on the WebSocket connection mapping
-	log.Printf("Received WebSocket data for ID: %s", message.ID)
+	tp.logger.Debug("Received WebSocket data", "message_id", message.ID)
 	return nil
 }
 
@@ -218,35 +1051,86 @@ func (tp *TunnelProtocol) handlePong(message *TunnelMessage) error {
 }
 
 func (tp *TunnelProtocol) writeHTTPResponse(w http.ResponseWriter, response *TunnelMessage) {
+	// Never let browsers sniff a different content type than the one declared,
+	// the tunnel owner may not control how the local service serves uploads
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
 	// Check if this is an error response that needs a nice error page
 	if response.Error != "" {
 		tp.writeErrorPage(w, response)
 		return
 	}
 
-	// Set status code
+	// Only the validators, caching headers and the tunnel's own headers belong on a 304
+	if response.Status == http.StatusNotModified {
+		tp.writeNotModified(w, newCachedResponse(response))
+		return
+	}
+
+	tp.setResponseHeaders(w.Header(), response)
+	// A buffered close-delimited body is complete, so the visitor gets its exact length.
+	// Streamed responses don't come through here, their length isn't known up front.
+	if isCloseDelimitedResponse(response) && statusAllowsBody(response.Status) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(response.Body)))
+	}
 	if response.Status > 0 {
 		w.WriteHeader(response.Status)
 	}
 
-	// Set headers
-	for name, value := range response.Headers {
-		w.Header().Set(name, value)
+	// Write body, unless the status forbids one (101 upgrades, 204, 304)
+	if len(response.Body) > 0 && statusAllowsBody(response.Status) {
+		w.Write(response.Body)
 	}
+}
 
-	// Write body
-	if len(response.Body) > 0 {
-		w.Write(response.Body)
+// statusAllowsBody reports whether a response with this status may carry a body (RFC 9110 section 6.4.1)
+func statusAllowsBody(status int) bool {
+	switch {
+	case status >= 100 && status < 200:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// writeResponseHeaders copies the response headers and writes the status code
+func (tp *TunnelProtocol) writeResponseHeaders(w http.ResponseWriter, response *TunnelMessage) {
+	tp.setResponseHeaders(w.Header(), response)
+
+	// Set status code
+	if response.Status > 0 {
+		w.WriteHeader(response.Status)
+	}
+}
+
+// setResponseHeaders copies the response headers and applies the tunnel's header changes.
+// It must run before the status code is written, otherwise the headers are discarded.
+func (tp *TunnelProtocol) setResponseHeaders(header http.Header, response *TunnelMessage) {
+	closeDelimited := isCloseDelimitedResponse(response)
+	for name, value := range response.Headers {
+		// Bodiless responses (101, 204, 304) must not announce a body length
+		if !statusAllowsBody(response.Status) && strings.EqualFold(name, "Content-Length") {
+			continue
+		}
+		if closeDelimited && isLocalConnectionHeader(name) {
+			continue
+		}
+		header.Set(name, value)
 	}
+	tp.applyResponseTransforms(header)
+	tp.applyHeaderRules("response", header)
+	tp.applyCORSBypass(header)
+	header.Set("X-Content-Type-Options", "nosniff")
 }
 
 // writeErrorPage renders a beautiful error page
 func (tp *TunnelProtocol) writeErrorPage(w http.ResponseWriter, response *TunnelMessage) {
 	// Use the template system to render error page
-	html, err := templates.RenderLocalServiceError(tp.localPort, response.Error)
+	html, err := templates.RenderLocalServiceError(tp.currentLocalPort(), response.Error)
 	if err != nil {
 		// Fallback to simple error if template fails
-		log.Printf("Failed to render error template: %v", err)
+		tp.logger.Error("Failed to render error template", "error", err)
 		http.Error(w, fmt.Sprintf("Error: %s", response.Error), http.StatusBadGateway)
 		return
 	}
@@ -256,6 +1140,7 @@ func (tp *TunnelProtocol) writeErrorPage(w http.ResponseWriter, response *Tunnel
 	if response.Status > 0 {
 		statusCode = response.Status
 	}
+	setSecurityHeaders(w.Header())
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(statusCode)
 	w.Write([]byte(html))
@@ -269,16 +1154,32 @@ func (tp *TunnelProtocol) handleWebSocketTunnel(w http.ResponseWriter, r *http.R
 
 	wsConn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("Failed to upgrade WebSocket connection: %v", err)
+		tp.logger.ErrorContext(r.Context(), "Failed to upgrade WebSocket connection", "error", err)
 		return
 	}
 	defer wsConn.Close()
 
+	// The PROXY protocol header has to reach the agent before any data frame
+	if tp.proxyProtocolEnabled {
+		if err := tp.sendProxyProtocolHeader(r, requestID); err != nil {
+			tp.logger.ErrorContext(r.Context(), "Failed to send PROXY protocol header", "message_id", requestID, "error", err)
+			return
+		}
+	}
+
+	// Pings and pongs travel end to end between the client and the local service when the
+	// agent can relay them, older agents would drop them and clients would time out
+	if tp.websocketControl {
+		tp.websockets.add(requestID, wsConn)
+		defer tp.websockets.remove(requestID)
+		tp.forwardClientControlFrames(wsConn, requestID)
+	}
+
 	// Handle WebSocket messages
 	for {
 		messageType, data, err := wsConn.ReadMessage()
 		if err != nil {
-			log.Printf("WebSocket read error: %v", err)
+			tp.logger.ErrorContext(r.Context(), "WebSocket read error", "error", err)
 			break
 		}
 
@@ -292,24 +1193,37 @@ func (tp *TunnelProtocol) handleWebSocketTunnel(w http.ResponseWriter, r *http.R
 		}
 
 		if err := tp.sendMessage(tunnelMsg); err != nil {
-			log.Printf("Failed to forward WebSocket message: %v", err)
+			tp.logger.ErrorContext(r.Context(), "Failed to forward WebSocket message", "error", err)
 			break
 		}
 	}
 }
 
 func (tp *TunnelProtocol) sendMessage(message *TunnelMessage) error {
+	if batcher := tp.batcher.Load(); batcher != nil && isBatchable(message) {
+		return batcher.send(message)
+	}
+	return tp.writeMessage(message)
+}
+
+// writeMessage sends a single message frame to the agent
+func (tp *TunnelProtocol) writeMessage(message *TunnelMessage) error {
 	data, err := json.Marshal(message)
 	if err != nil {
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
+	tp.recordFrame("sent", message, len(data))
+	frameType, payload := tp.encodeFrame(data)
+
+	tp.writeMutex.Lock()
+	defer tp.writeMutex.Unlock()
 
 	// Set write deadline to prevent hanging on dead connections
 	if err := tp.conn.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
 		return fmt.Errorf("failed to set write deadline: %w", err)
 	}
 
-	return tp.conn.WriteMessage(websocket.TextMessage, data)
+	return tp.conn.WriteMessage(frameType, payload)
 }
 
 // SendMessage is a public method to send messages
@@ -331,9 +1245,15 @@ func (tp *TunnelProtocol) SendPing() error {
 
 // SendTerminate sends a terminate message to the agent
 func (tp *TunnelProtocol) SendTerminate() error {
+	return tp.SendTerminateWithReason("")
+}
+
+// SendTerminateWithReason tells the agent to disconnect, reason explains why (e.g. "token_rotated")
+func (tp *TunnelProtocol) SendTerminateWithReason(reason string) error {
 	terminateMessage := &TunnelMessage{
 		Type:      "terminate",
 		ID:        fmt.Sprintf("%s-terminate-%d", tp.tunnelID, time.Now().Unix()),
+		Reason:    reason,
 		Timestamp: time.Now().Unix(),
 	}
 	return tp.sendMessage(terminateMessage)
@@ -345,13 +1265,16 @@ func (tp *TunnelProtocol) IsHealthy() bool {
 	return tp.conn != nil
 }
 
-// Close closes the tunnel protocol connection
+// Close fails every pending request and closes the agent connection
 func (tp *TunnelProtocol) Close() error {
 	// Close all pending request channels
+	tp.pendingMutex.Lock()
 	for id, ch := range tp.pendingReqs {
 		close(ch)
 		delete(tp.pendingReqs, id)
+		<-tp.pendingSlots
 	}
+	tp.pendingMutex.Unlock()
 
 	if tp.conn != nil {
 		return tp.conn.Close()
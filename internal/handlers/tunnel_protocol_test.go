@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// agentConnection connects a websocket client standing in for the agent over TCP loopback
+// and returns the server side wrapped in a TunnelProtocol together with the client
+func agentConnection(tb testing.TB) (*TunnelProtocol, *websocket.Conn) {
+	tb.Helper()
+
+	serverConns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		serverConns <- conn
+	}))
+	tb.Cleanup(server.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		tb.Fatalf("dial: %v", err)
+	}
+	tb.Cleanup(func() { client.Close() })
+
+	var conn *websocket.Conn
+	select {
+	case conn = <-serverConns:
+	case <-time.After(5 * time.Second):
+		tb.Fatal("server never accepted the websocket")
+	}
+	tb.Cleanup(func() { conn.Close() })
+
+	return NewTunnelProtocol(conn, "bench", 3000, 0, 1, 0), client
+}
+
+// BenchmarkWriteLargeMessage measures how fast 1 MB responses reach the agent for different
+// write_buffer_kb settings. Loopback uses 64 KB segments, buffers smaller than that stall
+// on delayed ACKs there (about 1 MB/s) so the benchmark starts at 64 KB.
+func BenchmarkWriteLargeMessage(b *testing.B) {
+	body := make([]byte, 1024*1024)
+	for i := range body {
+		body[i] = byte(i)
+	}
+
+	for _, bufferKB := range []int{64, 256, 1024, 4096} {
+		b.Run(fmt.Sprintf("buffer=%dKB", bufferKB), func(b *testing.B) {
+			tp, client := agentConnection(b)
+			tp.writeBufferBytes = bufferKB * 1024
+			tp.readBufferBytes = bufferKB * 1024
+			tp.applySocketBuffers()
+
+			// The agent drains frames as fast as it can
+			readErr := make(chan error, 1)
+			go func() {
+				for i := 0; i < b.N; i++ {
+					if _, _, err := client.ReadMessage(); err != nil {
+						readErr <- err
+						return
+					}
+				}
+				readErr <- nil
+			}()
+
+			message := &TunnelMessage{Type: "http_response", ID: "bench", Status: http.StatusOK, Body: body}
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := tp.writeMessage(message); err != nil {
+					b.Fatalf("write: %v", err)
+				}
+			}
+			if err := <-readErr; err != nil {
+				b.Fatalf("read: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"context"
+	"skyport-server/internal/store"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tunnelStoreRefreshInterval is how often a connected tunnel's record is re-registered so it
+// outlives store.RedisTunnelTTL only while this instance is alive
+const tunnelStoreRefreshInterval = 30 * time.Second
+
+// storeTunnel registers a tunnel connected to this instance in the shared tunnel store
+func (h *TunnelHandler) storeTunnel(tunnelID string, protocol *TunnelProtocol) {
+	record := store.TunnelRecord{
+		ServerID:    h.config.InstanceID,
+		LocalPort:   protocol.currentLocalPort(),
+		ConnectedAt: protocol.connectedAt,
+	}
+	if err := h.tunnelStore.Register(context.Background(), tunnelID, record); err != nil {
+		protocol.logger.Error("Failed to register tunnel in tunnel store", "error", err)
+	}
+}
+
+// unstoreTunnel removes this instance's registration of a disconnected tunnel
+func (h *TunnelHandler) unstoreTunnel(tunnelID string) {
+	if err := h.tunnelStore.Deregister(context.Background(), tunnelID, h.config.InstanceID); err != nil {
+		h.logger.Error("Failed to deregister tunnel from tunnel store", "tunnel_id", tunnelID, "error", err)
+	}
+}
+
+// forwardToOwner sends a request for a tunnel that isn't connected here to the instance holding
+// its agent. The tunnel store is authoritative; sticky session tunnels fall back to the instance
+// recorded in the database or the visitor's cookie. Returns false when nothing was forwarded.
+func (h *ProxyHandler) forwardToOwner(c *gin.Context, subdomain, tunnelID string, stickySessionCookie bool, connectedInstance string) bool {
+	record, registered, err := h.tunnelHandler.tunnelStore.Get(c.Request.Context(), tunnelID)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to look up tunnel in tunnel store", "tunnel_id", tunnelID, "error", err)
+	}
+	if registered {
+		return h.forwardToInstance(c, subdomain, record.ServerID)
+	}
+	return stickySessionCookie && h.forwardToInstance(c, subdomain, connectedInstance)
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// agentReloadTimeout bounds how long the server waits for the agent's reload_ack
+const agentReloadTimeout = 30 * time.Second
+
+// Reload asks the agent to restart (or signal) the local service and waits for its reload_ack.
+// The returned message reports the outcome in Success and Error.
+func (tp *TunnelProtocol) Reload(ctx context.Context) (*TunnelMessage, error) {
+	requestID := fmt.Sprintf("%s-reload-%d", tp.tunnelID, atomic.AddInt64(&tp.requestCount, 1))
+
+	responseChan, err := tp.addPendingRequest(requestID)
+	if err != nil {
+		return nil, err
+	}
+	defer tp.removePendingRequest(requestID)
+
+	message := &TunnelMessage{
+		Type:      "reload",
+		ID:        requestID,
+		Timestamp: time.Now().Unix(),
+	}
+	if err := tp.sendMessage(message); err != nil {
+		return nil, fmt.Errorf("failed to send reload: %w", err)
+	}
+
+	select {
+	case ack, ok := <-responseChan:
+		if !ok {
+			return nil, errors.New("tunnel closed")
+		}
+		return ack, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ReloadTunnel triggers a hot-reload of the local service behind a connected agent
+func (h *TunnelHandler) ReloadTunnel(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	tunnelID := c.Param("id")
+
+	// Only the instance the agent is connected to can reach it
+	if h.forwardControlToOwner(c, tunnelID) {
+		return
+	}
+
+	// Verify user owns this tunnel
+	var dbUserID string
+	err := h.db.QueryRow("SELECT user_id FROM tunnels WHERE id = $1", tunnelID).Scan(&dbUserID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch tunnel for reload", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if dbUserID != userIDStr {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Tunnel does not belong to user"})
+		return
+	}
+
+	protocol, exists := h.GetActiveTunnel(tunnelID)
+	if !exists {
+		c.JSON(http.StatusConflict, gin.H{"error": "Tunnel not connected"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), agentReloadTimeout)
+	defer cancel()
+
+	ack, err := protocol.Reload(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "Agent did not acknowledge the reload"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Reload failed", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !ack.Success {
+		c.JSON(http.StatusBadGateway, gin.H{"success": false, "error": ack.Error})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
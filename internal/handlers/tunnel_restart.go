@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"skyport-server/internal/database"
+	"skyport-server/internal/models"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// agentCallbackTimeout bounds a reconnect notification to an agent callback URL
+const agentCallbackTimeout = 10 * time.Second
+
+// errPrivateAddress is returned when a user-supplied URL resolves to an internal address
+var errPrivateAddress = errors.New("address is not publicly routable")
+
+// rejectPrivateAddress is a net.Dialer Control function that refuses loopback, private and
+// link-local addresses, so user-supplied URLs can't reach services inside the server's network.
+// It runs after DNS resolution, which also covers hostnames pointing at internal addresses.
+func rejectPrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+// agentCallbackClient only connects to public addresses
+var agentCallbackClient = &http.Client{
+	Timeout: agentCallbackTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: agentCallbackTimeout,
+			Control: rejectPrivateAddress,
+		}).DialContext,
+	},
+}
+
+// SetAgentCallback registers the URL the server notifies when an auto-restart tunnel's agent crashes
+func (h *TunnelHandler) SetAgentCallback(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	tunnelID := c.Param("id")
+
+	var req models.AgentCallbackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	callbackURL, err := url.Parse(req.CallbackURL)
+	if err != nil || callbackURL.Host == "" || (callbackURL.Scheme != "http" && callbackURL.Scheme != "https") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "callback_url must be an absolute http(s) URL"})
+		return
+	}
+
+	result, err := h.db.Exec(
+		"UPDATE tunnels SET agent_callback_url = $1, updated_at = NOW() WHERE id = $2 AND user_id = $3",
+		callbackURL.String(), tunnelID, userIDStr,
+	)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to set agent callback", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set agent callback"})
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to check agent callback update", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set agent callback"})
+		return
+	}
+
+	if rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Agent callback registered", "callback_url": callbackURL.String()})
+}
+
+// dispatchReconnect asks a crashed agent to reconnect through its registered callback URL,
+// if the tunnel has auto-restart enabled
+func (h *TunnelHandler) dispatchReconnect(tunnelID string) {
+	tunnel, err := database.GetTunnel(h.db, tunnelID)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		h.logger.Error("Failed to load tunnel for auto-restart", "tunnel_id", tunnelID, "error", err)
+		return
+	}
+
+	if !tunnel.AutoRestart || tunnel.IsPaused || tunnel.AgentCallbackURL == nil || *tunnel.AgentCallbackURL == "" {
+		return
+	}
+
+	payload, err := json.Marshal(gin.H{
+		"event":           "reconnect",
+		"tunnel_id":       tunnelID,
+		"last_agent_addr": tunnel.LastAgentAddr,
+		"timestamp":       time.Now().Unix(),
+	})
+	if err != nil {
+		h.logger.Error("Failed to build reconnect notification", "tunnel_id", tunnelID, "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), agentCallbackTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, *tunnel.AgentCallbackURL, bytes.NewReader(payload))
+	if err != nil {
+		h.logger.Warn("Invalid agent callback URL", "tunnel_id", tunnelID, "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "SkyPort-Reconnect/1.0")
+
+	resp, err := agentCallbackClient.Do(req)
+	if err != nil {
+		h.logger.Error("Failed to notify agent to reconnect", "tunnel_id", tunnelID, "error", err)
+		return
+	}
+	resp.Body.Close()
+
+	h.logger.Info("Sent reconnect notification", "tunnel_id", tunnelID, "status", resp.StatusCode)
+}
@@ -0,0 +1,31 @@
+package handlers
+
+import "strings"
+
+// targetPort returns the local port a request path is routed to: the port of the first
+// routing rule whose prefix matches, the tunnel's new local port if it was changed while
+// connected, or 0 to let the agent use the port it connected with
+func (tp *TunnelProtocol) targetPort(path string) int {
+	for _, rule := range tp.routingRules {
+		if strings.HasPrefix(path, rule.PathPrefix) {
+			return rule.TargetPort
+		}
+	}
+	return int(tp.localPortOverride.Load())
+}
+
+// SetLocalPort points requests without a matching routing rule at a new local port
+func (tp *TunnelProtocol) SetLocalPort(port int) {
+	if port == tp.localPort {
+		port = 0
+	}
+	tp.localPortOverride.Store(int64(port))
+}
+
+// currentLocalPort is the local port requests without a matching routing rule go to
+func (tp *TunnelProtocol) currentLocalPort() int {
+	if port := int(tp.localPortOverride.Load()); port != 0 {
+		return port
+	}
+	return tp.localPort
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"skyport-server/internal/database"
+	"skyport-server/internal/templates"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// setupStatusInterval is how often the setup page's status socket checks for the agent
+	setupStatusInterval = 2 * time.Second
+	// setupStatusTicketTTL is how long the setup page can keep (re)opening its status socket
+	setupStatusTicketTTL = 30 * time.Minute
+	// setupStatusTicketType marks tickets that only open a tunnel's setup status socket
+	setupStatusTicketType = "setup_status"
+)
+
+// GetSetupPage returns an HTML page with the commands to install the agent and connect
+// the tunnel, plus a live indicator that flips once the agent connects
+func (h *TunnelHandler) GetSetupPage(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	tunnelID := c.Param("id")
+
+	tunnel, err := database.GetTunnel(h.db, tunnelID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch tunnel for setup page", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if tunnel.UserID.String() != userIDStr {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Tunnel does not belong to user"})
+		return
+	}
+
+	ticket, err := h.generateSetupStatusTicket(tunnel.ID.String())
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to generate setup status ticket", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render setup page"})
+		return
+	}
+
+	html, err := templates.RenderAgentInstallPage(tunnel.AuthToken, h.tunnelPublicURL(tunnel.Subdomain),
+		tunnel.ID.String(), h.config.AgentInstallCommand, h.setupStatusURL(tunnel.ID.String(), ticket))
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to render setup page", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render setup page"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
+}
+
+// setupStatusURL is the WebSocket the setup page watches. Browsers can't send an
+// Authorization header on WebSockets, so the URL carries a ticket. URLs end up in access
+// logs and browser history, so it is never the tunnel's auth token.
+func (h *TunnelHandler) setupStatusURL(tunnelID, ticket string) string {
+	return h.websocketScheme() + "://" + h.config.Domain + "/api/v1/tunnels/" + tunnelID + "/setup/status?ticket=" + url.QueryEscape(ticket)
+}
+
+// generateSetupStatusTicket creates a short-lived token that only opens the status socket of
+// one tunnel. It has no user_id, so AuthMiddleware and the other token checks refuse it.
+func (h *TunnelHandler) generateSetupStatusTicket(tunnelID string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"tunnel_id": tunnelID,
+		"exp":       time.Now().Add(setupStatusTicketTTL).Unix(),
+		"iat":       time.Now().Unix(),
+		"type":      setupStatusTicketType,
+	})
+	return token.SignedString([]byte(h.config.JWTSecret))
+}
+
+// validSetupStatusTicket reports whether ticket is an unexpired setup status ticket for the tunnel
+func (h *TunnelHandler) validSetupStatusTicket(ticket, tunnelID string) bool {
+	token, err := jwt.Parse(ticket, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return []byte(h.config.JWTSecret), nil
+	})
+	if err != nil || !token.Valid {
+		return false
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return false
+	}
+	tokenType, _ := claims["type"].(string)
+	ticketTunnelID, _ := claims["tunnel_id"].(string)
+	return tokenType == setupStatusTicketType && ticketTunnelID == tunnelID
+}
+
+// websocketScheme is ws for local development and wss everywhere else
+func (h *TunnelHandler) websocketScheme() string {
+	if strings.HasPrefix(h.config.Domain, "localhost") {
+		return "ws"
+	}
+	return "wss"
+}
+
+// SetupStatus streams {"connected": bool} over a WebSocket until the tunnel's agent connects.
+// It authenticates with the ticket from the setup page rather than a session.
+func (h *TunnelHandler) SetupStatus(c *gin.Context) {
+	tunnelID := c.Param("id")
+
+	if !h.validSetupStatusTicket(c.Query("ticket"), tunnelID) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired setup status ticket"})
+		return
+	}
+
+	// The tunnel may have been deleted since the page was rendered
+	var exists bool
+	if err := h.db.QueryRow("SELECT EXISTS (SELECT 1 FROM tunnels WHERE id = $1)", tunnelID).Scan(&exists); err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch tunnel for setup status", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to upgrade setup status connection", "tunnel_id", tunnelID, "error", err)
+		return
+	}
+	defer conn.Close()
+
+	// Reading is only needed to notice the page going away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(setupStatusInterval)
+	defer ticker.Stop()
+
+	for {
+		_, connected := h.GetActiveTunnel(tunnelID)
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := conn.WriteJSON(gin.H{"connected": connected}); err != nil || connected {
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		}
+
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// shutdownReason is sent to agents in the terminate message when the server stops
+const shutdownReason = "server_shutdown"
+
+// registerTunnel stores a connected tunnel and counts its connection for Shutdown. It returns
+// false once shutdown has started, the caller must then disconnect the agent itself.
+func (h *TunnelHandler) registerTunnel(tunnelID string, protocol *TunnelProtocol) bool {
+	h.tunnelsMutex.Lock()
+	defer h.tunnelsMutex.Unlock()
+	if h.shuttingDown {
+		return false
+	}
+	h.activeTunnels[tunnelID] = protocol
+	h.connections.Add(1)
+	return true
+}
+
+// isShuttingDown reports whether Shutdown has been called
+func (h *TunnelHandler) isShuttingDown() bool {
+	h.tunnelsMutex.RLock()
+	defer h.tunnelsMutex.RUnlock()
+	return h.shuttingDown
+}
+
+// Shutdown stops accepting agents and disconnects the connected ones. Each tunnel stops taking
+// new requests, gets up to the drain timeout for in-flight requests and is then sent a
+// terminate message with reason "server_shutdown". Shutdown returns once every connection
+// handler has finished; if ctx expires first the remaining agent connections are closed.
+func (h *TunnelHandler) Shutdown(ctx context.Context) error {
+	h.tunnelsMutex.Lock()
+	h.shuttingDown = true
+	protocols := make([]*TunnelProtocol, 0, len(h.activeTunnels))
+	for _, protocol := range h.activeTunnels {
+		protocols = append(protocols, protocol)
+	}
+	h.tunnelsMutex.Unlock()
+
+	h.logger.Info("Disconnecting tunnels for shutdown", "tunnels", len(protocols))
+
+	// Draining must leave time for the agents to disconnect before ctx expires
+	drainTimeout := h.config.DrainTimeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < drainTimeout {
+		drainTimeout = time.Until(deadline)
+	}
+
+	var terminating sync.WaitGroup
+	for _, protocol := range protocols {
+		terminating.Add(1)
+		go func(protocol *TunnelProtocol) {
+			defer terminating.Done()
+			protocol.StartDraining()
+			if !protocol.WaitForDrain(drainTimeout) {
+				protocol.logger.Warn("Drain timeout with requests still pending", "pending_requests", protocol.PendingRequests())
+			}
+			if err := protocol.SendTerminateWithReason(shutdownReason); err != nil {
+				protocol.logger.Error("Failed to send terminate message", "error", err)
+			}
+		}(protocol)
+	}
+	terminating.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		h.connections.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		// Agents that didn't disconnect in time are cut off, their read loops end on the closed connection
+		for _, protocol := range protocols {
+			protocol.conn.Close()
+		}
+		return ctx.Err()
+	}
+}
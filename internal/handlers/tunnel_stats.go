@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"skyport-server/internal/database"
+	"skyport-server/internal/models"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// statsFlushInterval is how often the traffic counters of connected tunnels are written
+	// to tunnel_stats
+	statsFlushInterval = time.Minute
+	// statsRetention is how long hourly tunnel_stats rows are kept, a day more than the longest period
+	statsRetention = 31 * 24 * time.Hour
+	// defaultStatsPeriod is used when ?period is missing, it is also the period of the list summary
+	defaultStatsPeriod = "24h"
+)
+
+// statsPeriods are the values accepted by ?period
+var statsPeriods = map[string]time.Duration{
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+}
+
+// trafficSample is traffic accumulated over some time, as stored in a tunnel_stats row
+type trafficSample struct {
+	requests         int64
+	bytes            int64
+	latencyMs        int64
+	errors           int64
+	connectedSeconds int64
+}
+
+func (s trafficSample) add(other trafficSample) trafficSample {
+	return trafficSample{
+		requests:         s.requests + other.requests,
+		bytes:            s.bytes + other.bytes,
+		latencyMs:        s.latencyMs + other.latencyMs,
+		errors:           s.errors + other.errors,
+		connectedSeconds: s.connectedSeconds + other.connectedSeconds,
+	}
+}
+
+// trafficCounters accumulate a connected tunnel's traffic until it is flushed to tunnel_stats
+type trafficCounters struct {
+	requests  atomic.Int64
+	bytes     atomic.Int64
+	latencyMs atomic.Int64
+	errors    atomic.Int64
+
+	// flushedAt is the end of the connected time already flushed
+	flushMutex sync.Mutex
+	flushedAt  time.Time
+}
+
+// record counts a finished request, bytes covers the request and response bodies
+func (tc *trafficCounters) record(status int, bytes int64, latency time.Duration) {
+	tc.requests.Add(1)
+	tc.bytes.Add(bytes)
+	tc.latencyMs.Add(latency.Milliseconds())
+	if status >= http.StatusInternalServerError {
+		tc.errors.Add(1)
+	}
+}
+
+// take returns the traffic since the last take and resets the counters
+func (tc *trafficCounters) take(now time.Time) trafficSample {
+	tc.flushMutex.Lock()
+	defer tc.flushMutex.Unlock()
+
+	connected := now.Sub(tc.flushedAt) / time.Second
+	tc.flushedAt = tc.flushedAt.Add(connected * time.Second)
+	return trafficSample{
+		requests:         tc.requests.Swap(0),
+		bytes:            tc.bytes.Swap(0),
+		latencyMs:        tc.latencyMs.Swap(0),
+		errors:           tc.errors.Swap(0),
+		connectedSeconds: int64(connected),
+	}
+}
+
+// peek returns the traffic not flushed yet without resetting anything
+func (tc *trafficCounters) peek(now time.Time) trafficSample {
+	tc.flushMutex.Lock()
+	defer tc.flushMutex.Unlock()
+
+	return trafficSample{
+		requests:         tc.requests.Load(),
+		bytes:            tc.bytes.Load(),
+		latencyMs:        tc.latencyMs.Load(),
+		errors:           tc.errors.Load(),
+		connectedSeconds: int64(now.Sub(tc.flushedAt) / time.Second),
+	}
+}
+
+// flushTunnelStats adds a tunnel's unflushed traffic to the current hour of tunnel_stats.
+// Traffic is dropped if the write fails, the statistics are best effort.
+func (h *TunnelHandler) flushTunnelStats(tunnelID string, protocol *TunnelProtocol) {
+	sample := protocol.traffic.take(time.Now())
+	if sample == (trafficSample{}) {
+		return
+	}
+
+	// A tunnel deleted while connected has nowhere to keep its stats
+	_, err := h.db.Exec(`
+		INSERT INTO tunnel_stats (tunnel_id, hour, requests, bytes, latency_ms_total, errors, connected_seconds)
+		SELECT id, date_trunc('hour', NOW()), $2, $3, $4, $5, $6 FROM tunnels WHERE id = $1
+		ON CONFLICT (tunnel_id, hour) DO UPDATE SET
+			requests = tunnel_stats.requests + EXCLUDED.requests,
+			bytes = tunnel_stats.bytes + EXCLUDED.bytes,
+			latency_ms_total = tunnel_stats.latency_ms_total + EXCLUDED.latency_ms_total,
+			errors = tunnel_stats.errors + EXCLUDED.errors,
+			connected_seconds = tunnel_stats.connected_seconds + EXCLUDED.connected_seconds
+	`, tunnelID, sample.requests, sample.bytes, sample.latencyMs, sample.errors, sample.connectedSeconds)
+	if err != nil {
+		protocol.logger.Error("Failed to write tunnel stats", "error", err)
+	}
+}
+
+// RunStatsFlusher writes the traffic of connected tunnels to tunnel_stats every
+// statsFlushInterval and prunes rows older than statsRetention, until ctx is done
+func (h *TunnelHandler) RunStatsFlusher(ctx context.Context) {
+	ticker := time.NewTicker(statsFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		h.tunnelsMutex.RLock()
+		protocols := make(map[string]*TunnelProtocol, len(h.activeTunnels))
+		for tunnelID, protocol := range h.activeTunnels {
+			protocols[tunnelID] = protocol
+		}
+		h.tunnelsMutex.RUnlock()
+
+		for tunnelID, protocol := range protocols {
+			h.flushTunnelStats(tunnelID, protocol)
+		}
+
+		if _, err := h.db.Exec("DELETE FROM tunnel_stats WHERE hour < $1", time.Now().Add(-statsRetention)); err != nil {
+			h.logger.Error("Failed to prune tunnel stats", "error", err)
+		}
+	}
+}
+
+// GetTunnelStats returns a tunnel's traffic statistics for ?period=24h|7d|30d (default 24h)
+func (h *TunnelHandler) GetTunnelStats(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	period := c.DefaultQuery("period", defaultStatsPeriod)
+	periodLength, valid := statsPeriods[period]
+	if !valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "period must be one of 24h, 7d or 30d"})
+		return
+	}
+
+	tunnelID := c.Param("id")
+
+	tunnel, err := database.GetTunnel(h.db, tunnelID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch tunnel for stats", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if tunnel.UserID.String() != userIDStr {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Tunnel does not belong to user"})
+		return
+	}
+
+	now := time.Now()
+	var sample trafficSample
+	err = h.db.QueryRow(`
+		SELECT COALESCE(SUM(requests), 0), COALESCE(SUM(bytes), 0), COALESCE(SUM(latency_ms_total), 0),
+			COALESCE(SUM(errors), 0), COALESCE(SUM(connected_seconds), 0)
+		FROM tunnel_stats
+		WHERE tunnel_id = $1 AND hour >= $2
+	`, tunnelID, statsWindowStart(now, periodLength)).Scan(
+		&sample.requests, &sample.bytes, &sample.latencyMs, &sample.errors, &sample.connectedSeconds)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to read tunnel stats", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// Include what hasn't been flushed yet so the numbers are current
+	if protocol, active := h.GetActiveTunnel(tunnelID); active {
+		sample = sample.add(protocol.traffic.peek(now))
+	}
+
+	c.JSON(http.StatusOK, summarizeTraffic(sample, period, periodLength, tunnel.CreatedAt, now))
+}
+
+// userTrafficStats returns the traffic of each of the user's tunnels over defaultStatsPeriod,
+// keyed by tunnel ID. Tunnels without traffic are missing from the map.
+func (h *TunnelHandler) userTrafficStats(userID interface{}, now time.Time) (map[string]trafficSample, error) {
+	rows, err := h.db.Query(`
+		SELECT s.tunnel_id, SUM(s.requests), SUM(s.bytes), SUM(s.latency_ms_total), SUM(s.errors), SUM(s.connected_seconds)
+		FROM tunnel_stats s
+		JOIN tunnels t ON t.id = s.tunnel_id
+		WHERE t.user_id = $1 AND s.hour >= $2
+		GROUP BY s.tunnel_id
+	`, userID, statsWindowStart(now, statsPeriods[defaultStatsPeriod]))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := make(map[string]trafficSample)
+	for rows.Next() {
+		var tunnelID string
+		var sample trafficSample
+		if err := rows.Scan(&tunnelID, &sample.requests, &sample.bytes, &sample.latencyMs, &sample.errors, &sample.connectedSeconds); err != nil {
+			return nil, err
+		}
+		samples[tunnelID] = sample
+	}
+	return samples, rows.Err()
+}
+
+// statsWindowStart is the first hourly bucket of a period ending now; the oldest bucket is
+// counted whole, so a period can include up to an hour more than its length
+func statsWindowStart(now time.Time, periodLength time.Duration) time.Time {
+	return now.Add(-periodLength).Truncate(time.Hour)
+}
+
+// summarizeTraffic turns accumulated traffic into the API representation. Uptime is measured
+// against the period, or against the tunnel's lifetime for tunnels younger than the period.
+func summarizeTraffic(sample trafficSample, period string, periodLength time.Duration, createdAt, now time.Time) *models.TunnelStats {
+	stats := &models.TunnelStats{
+		Period:        period,
+		TotalRequests: sample.requests,
+		TotalBytes:    sample.bytes,
+	}
+	if sample.requests > 0 {
+		stats.AvgLatencyMs = float64(sample.latencyMs) / float64(sample.requests)
+		stats.ErrorRate = float64(sample.errors) / float64(sample.requests)
+	}
+
+	window := periodLength
+	if lifetime := now.Sub(createdAt); lifetime < window {
+		window = lifetime
+	}
+	if window > 0 {
+		stats.UptimePercent = min(100, float64(sample.connectedSeconds)/window.Seconds()*100)
+	}
+	return stats
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// RotateToken replaces a tunnel's auth token, e.g. after the agent's machine was compromised.
+// A connected agent is told to disconnect and its connection is closed, a compromised agent
+// can't be trusted to follow the terminate message.
+func (h *TunnelHandler) RotateToken(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	tunnelID := c.Param("id")
+
+	// The agent is disconnected by the instance it's connected to
+	if h.forwardControlToOwner(c, tunnelID) {
+		return
+	}
+
+	authToken := uuid.New().String()
+	result, err := h.db.Exec(
+		"UPDATE tunnels SET auth_token = $1, updated_at = NOW() WHERE id = $2 AND user_id = $3",
+		authToken, tunnelID, userIDStr,
+	)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to rotate auth token", "tunnel_id", tunnelID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
+		return
+	}
+
+	if protocol, exists := h.GetActiveTunnel(tunnelID); exists {
+		if err := protocol.SendTerminateWithReason("token_rotated"); err != nil {
+			h.logger.ErrorContext(c.Request.Context(), "Failed to send terminate after token rotation", "tunnel_id", tunnelID, "error", err)
+		}
+		// Stop routing visitors to the old session right away, closing the connection ends
+		// its read loop and ConnectTunnel marks the tunnel inactive
+		if h.removeActiveTunnel(tunnelID, protocol) {
+			h.unstoreTunnel(tunnelID)
+		}
+		protocol.conn.Close()
+	}
+
+	h.logger.InfoContext(c.Request.Context(), "Auth token rotated", "tunnel_id", tunnelID, "user_id", userIDStr)
+
+	c.JSON(http.StatusOK, gin.H{"auth_token": authToken})
+}
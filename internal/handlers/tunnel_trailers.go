@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+)
+
+// writeResponseTrailers sets the trailers of a streamed response, as sent by the agent in an
+// http_response_trailers message after the last chunk. Trailers announced in the response's
+// Trailer header are set directly; others use http.TrailerPrefix so net/http still sends
+// them. gRPC-Web and some streaming APIs report their status this way.
+func writeResponseTrailers(w http.ResponseWriter, trailers map[string]string) {
+	declared := make(map[string]bool)
+	for _, value := range w.Header().Values("Trailer") {
+		for _, name := range strings.Split(value, ",") {
+			declared[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+
+	for name, value := range trailers {
+		name = http.CanonicalHeaderKey(name)
+		if declared[name] {
+			w.Header().Set(name, value)
+		} else {
+			w.Header().Set(http.TrailerPrefix+name, value)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+)
+
+// applyRequestTransforms rewrites an incoming request with the tunnel's request rules
+func (tp *TunnelProtocol) applyRequestTransforms(r *http.Request) {
+	for _, rule := range tp.transforms {
+		if rule.Direction == "response" {
+			continue
+		}
+		switch rule.Type {
+		case "header_add":
+			r.Header.Set(rule.Name, rule.Value)
+		case "header_remove":
+			r.Header.Del(rule.Name)
+		case "path_rewrite":
+			if strings.HasPrefix(r.URL.Path, rule.From) {
+				r.URL.Path = rule.To + strings.TrimPrefix(r.URL.Path, rule.From)
+				r.URL.RawPath = ""
+			}
+		}
+	}
+}
+
+// applyResponseTransforms rewrites response headers with the tunnel's response rules
+func (tp *TunnelProtocol) applyResponseTransforms(header http.Header) {
+	for _, rule := range tp.transforms {
+		if rule.Direction != "response" {
+			continue
+		}
+		switch rule.Type {
+		case "header_add":
+			header.Set(rule.Name, rule.Value)
+		case "header_remove":
+			header.Del(rule.Name)
+		}
+	}
+}
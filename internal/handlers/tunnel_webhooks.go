@@ -0,0 +1,357 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"skyport-server/internal/database"
+	"skyport-server/internal/models"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// webhookWorkers deliver webhooks concurrently, a slow endpoint only holds up one of them
+	webhookWorkers = 4
+	// webhookQueueSize is how many deliveries may wait for a worker before new ones are dropped
+	webhookQueueSize = 256
+	// webhookAttempts is how many times a delivery is tried, with webhookRetryDelay doubling in between
+	webhookAttempts   = 3
+	webhookRetryDelay = time.Second
+	// webhookTimeout bounds a single delivery attempt
+	webhookTimeout = 10 * time.Second
+	// maxWebhooksPerTunnel bounds the requests sent for each tunnel event
+	maxWebhooksPerTunnel = 10
+	// maxWebhookResponseBytes is how much of a webhook's response body a test delivery returns
+	maxWebhookResponseBytes = 64 << 10
+)
+
+// webhookEvents are the events a webhook can subscribe to
+var webhookEvents = []string{"tunnel.connected", "tunnel.disconnected"}
+
+// webhookClient only connects to public addresses, like agentCallbackClient
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: webhookTimeout,
+			Control: rejectPrivateAddress,
+		}).DialContext,
+	},
+}
+
+// webhookDelivery is a tunnel event waiting to be sent to the tunnel's webhooks
+type webhookDelivery struct {
+	Event       string `json:"event"`
+	TunnelID    string `json:"tunnel_id"`
+	Timestamp   string `json:"timestamp"`
+	ConnectedIP string `json:"connected_ip"`
+	// Test marks deliveries sent by TestWebhook rather than a real event
+	Test bool `json:"test,omitempty"`
+}
+
+// webhookTestResult is the outcome of a test delivery to one webhook
+type webhookTestResult struct {
+	WebhookID  uuid.UUID `json:"webhook_id"`
+	URL        string    `json:"url"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Body       string    `json:"body,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// enqueueWebhook queues an event for the tunnel's webhooks without blocking the connection
+func (h *TunnelHandler) enqueueWebhook(event, tunnelID, connectedIP string) {
+	delivery := webhookDelivery{
+		Event:       event,
+		TunnelID:    tunnelID,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		ConnectedIP: connectedIP,
+	}
+	select {
+	case h.webhookQueue <- delivery:
+	default:
+		h.logger.Warn("Webhook queue full, dropping event", "tunnel_id", tunnelID, "event", event)
+	}
+}
+
+// runWebhookWorker sends queued events to every webhook of the tunnel subscribed to them
+func (h *TunnelHandler) runWebhookWorker() {
+	for delivery := range h.webhookQueue {
+		webhooks, err := loadWebhooks(h.db, delivery.TunnelID)
+		if err != nil {
+			h.logger.Error("Failed to load webhooks", "tunnel_id", delivery.TunnelID, "error", err)
+			continue
+		}
+
+		payload, err := json.Marshal(delivery)
+		if err != nil {
+			continue
+		}
+		for _, webhook := range webhooks {
+			if slices.Contains(webhook.Events, delivery.Event) {
+				h.deliverWebhook(webhook, delivery, payload)
+			}
+		}
+	}
+}
+
+// deliverWebhook posts a payload to a webhook, retrying failed attempts with exponential backoff
+func (h *TunnelHandler) deliverWebhook(webhook models.Webhook, delivery webhookDelivery, payload []byte) {
+	signature := webhookSignature(webhook.Secret, payload)
+
+	delay := webhookRetryDelay
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		statusCode, _, err := postWebhook(webhook.URL, signature, delivery.Event, payload)
+		if err == nil && (statusCode < 200 || statusCode >= 300) {
+			err = fmt.Errorf("webhook returned %d", statusCode)
+		}
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			h.logger.Warn("Webhook delivery failed", "tunnel_id", delivery.TunnelID, "webhook_id", webhook.ID,
+				"event", delivery.Event, "attempts", attempt, "error", err)
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// webhookSignature signs a payload with the webhook's secret for X-Skyport-Signature
+func webhookSignature(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook sends one delivery attempt and returns the response status and the start of
+// its body. Non-2xx responses are not an error, the caller decides what counts as delivered.
+func postWebhook(webhookURL, signature, event string, payload []byte) (int, []byte, error) {
+	req, err := http.NewRequest(http.MethodPost, webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Skyport-Signature", signature)
+	req.Header.Set("X-Skyport-Event", event)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxWebhookResponseBytes))
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+	return resp.StatusCode, body, nil
+}
+
+// loadWebhooks returns a tunnel's webhooks including their secrets
+func loadWebhooks(db *sql.DB, tunnelID string) ([]models.Webhook, error) {
+	rows, err := db.Query(`
+		SELECT id, tunnel_id, url, secret, events, created_at
+		FROM tunnel_webhooks
+		WHERE tunnel_id = $1
+		ORDER BY created_at, id
+	`, tunnelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []models.Webhook{}
+	for rows.Next() {
+		var webhook models.Webhook
+		if err := rows.Scan(&webhook.ID, &webhook.TunnelID, &webhook.URL, &webhook.Secret,
+			(*database.StringArray)(&webhook.Events), &webhook.CreatedAt); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// GetWebhooks lists a tunnel's webhooks, secrets are only shown when a webhook is created
+func (h *TunnelHandler) GetWebhooks(c *gin.Context) {
+	tunnel, ok := h.ownedTunnel(c)
+	if !ok {
+		return
+	}
+
+	webhooks, err := loadWebhooks(h.db, tunnel.ID.String())
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch webhooks", "tunnel_id", tunnel.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhooks"})
+		return
+	}
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+
+	c.JSON(http.StatusOK, gin.H{"webhooks": webhooks})
+}
+
+// CreateWebhook registers a URL that receives the tunnel's connect and disconnect events.
+// Without a secret one is generated; either way it is returned only in this response.
+func (h *TunnelHandler) CreateWebhook(c *gin.Context) {
+	var req models.CreateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	webhookURL, err := url.Parse(req.URL)
+	if err != nil || webhookURL.Host == "" || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url must be an absolute http(s) URL"})
+		return
+	}
+
+	if len(req.Events) == 0 {
+		req.Events = webhookEvents
+	}
+	for _, event := range req.Events {
+		if !slices.Contains(webhookEvents, event) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown event %q, expected tunnel.connected or tunnel.disconnected", event)})
+			return
+		}
+	}
+
+	if req.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			h.logger.ErrorContext(c.Request.Context(), "Failed to generate webhook secret", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook"})
+			return
+		}
+		req.Secret = hex.EncodeToString(secret)
+	}
+
+	tunnel, ok := h.ownedTunnel(c)
+	if !ok {
+		return
+	}
+
+	var webhookCount int
+	if err := h.db.QueryRow("SELECT COUNT(*) FROM tunnel_webhooks WHERE tunnel_id = $1", tunnel.ID).Scan(&webhookCount); err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to count webhooks", "tunnel_id", tunnel.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if webhookCount >= maxWebhooksPerTunnel {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A tunnel can have at most 10 webhooks"})
+		return
+	}
+
+	webhook := models.Webhook{
+		TunnelID: tunnel.ID,
+		URL:      webhookURL.String(),
+		Secret:   req.Secret,
+		Events:   slices.Compact(slices.Sorted(slices.Values(req.Events))),
+	}
+	err = h.db.QueryRow(`
+		INSERT INTO tunnel_webhooks (tunnel_id, url, secret, events)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`, webhook.TunnelID, webhook.URL, webhook.Secret, webhook.Events).Scan(&webhook.ID, &webhook.CreatedAt)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to create webhook", "tunnel_id", tunnel.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, webhook)
+}
+
+// DeleteWebhook removes one of a tunnel's webhooks
+func (h *TunnelHandler) DeleteWebhook(c *gin.Context) {
+	tunnel, ok := h.ownedTunnel(c)
+	if !ok {
+		return
+	}
+
+	webhookID := c.Param("webhook_id")
+	if _, err := uuid.Parse(webhookID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+
+	result, err := h.db.Exec("DELETE FROM tunnel_webhooks WHERE id = $1 AND tunnel_id = $2", webhookID, tunnel.ID)
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to delete webhook", "tunnel_id", tunnel.ID, "webhook_id", webhookID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted"})
+}
+
+// TestWebhook sends a synthetic tunnel.connected event to the tunnel's webhooks, or only to
+// the one in ?webhook_id=, and returns what each endpoint answered. The payload is signed
+// like a real event and is sent once, without retries, so the result shows the first attempt.
+func (h *TunnelHandler) TestWebhook(c *gin.Context) {
+	tunnel, ok := h.ownedTunnel(c)
+	if !ok {
+		return
+	}
+
+	webhooks, err := loadWebhooks(h.db, tunnel.ID.String())
+	if err != nil {
+		h.logger.ErrorContext(c.Request.Context(), "Failed to fetch webhooks", "tunnel_id", tunnel.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhooks"})
+		return
+	}
+	if webhookID := c.Query("webhook_id"); webhookID != "" {
+		webhooks = slices.DeleteFunc(webhooks, func(webhook models.Webhook) bool {
+			return webhook.ID.String() != webhookID
+		})
+	}
+	if len(webhooks) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel has no webhooks"})
+		return
+	}
+
+	delivery := webhookDelivery{
+		Event:     "tunnel.connected",
+		TunnelID:  tunnel.ID.String(),
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Test:      true,
+	}
+	payload, err := json.Marshal(delivery)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build test event"})
+		return
+	}
+
+	results := make([]webhookTestResult, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		result := webhookTestResult{WebhookID: webhook.ID, URL: webhook.URL}
+		statusCode, body, err := postWebhook(webhook.URL, webhookSignature(webhook.Secret, payload), delivery.Event, payload)
+		result.StatusCode = statusCode
+		result.Body = string(body)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
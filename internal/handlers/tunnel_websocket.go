@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// websocketControlTimeout bounds how long forwarding a ping or pong to a client may block
+const websocketControlTimeout = 5 * time.Second
+
+// websocketClients maps proxied WebSocket request IDs to the end client's connection so
+// control frames from the local service can be delivered to the right client
+type websocketClients struct {
+	mutex sync.Mutex
+	conns map[string]*websocket.Conn
+}
+
+func (wc *websocketClients) add(requestID string, conn *websocket.Conn) {
+	wc.mutex.Lock()
+	defer wc.mutex.Unlock()
+	if wc.conns == nil {
+		wc.conns = make(map[string]*websocket.Conn)
+	}
+	wc.conns[requestID] = conn
+}
+
+func (wc *websocketClients) remove(requestID string) {
+	wc.mutex.Lock()
+	defer wc.mutex.Unlock()
+	delete(wc.conns, requestID)
+}
+
+func (wc *websocketClients) get(requestID string) (*websocket.Conn, bool) {
+	wc.mutex.Lock()
+	defer wc.mutex.Unlock()
+	conn, exists := wc.conns[requestID]
+	return conn, exists
+}
+
+// forwardClientControlFrames relays pings and pongs from the end client to the local service.
+// The proxy doesn't answer these pings itself, the local service's pong comes back through
+// handleWebSocketControl so both ends see a real round-trip. Only agents that advertise
+// websocket_control support get them.
+func (tp *TunnelProtocol) forwardClientControlFrames(wsConn *websocket.Conn, requestID string) {
+	forward := func(control string) func(string) error {
+		return func(appData string) error {
+			err := tp.sendMessage(&TunnelMessage{
+				Type:      "websocket_control",
+				ID:        requestID,
+				Body:      []byte(appData),
+				Headers:   map[string]string{"control": control},
+				Timestamp: time.Now().Unix(),
+			})
+			if err != nil {
+				tp.logger.Error("Failed to forward WebSocket control frame", "control", control, "message_id", requestID, "error", err)
+			}
+			return nil
+		}
+	}
+	wsConn.SetPingHandler(forward("ping"))
+	wsConn.SetPongHandler(forward("pong"))
+}
+
+// handleWebSocketControl delivers a ping or pong from the local service to the end client.
+// WriteControl may be called concurrently with the connection's other methods.
+func (tp *TunnelProtocol) handleWebSocketControl(message *TunnelMessage) error {
+	wsConn, exists := tp.websockets.get(message.ID)
+	if !exists {
+		tp.logger.Warn("No WebSocket client found for control frame", "message_id", message.ID)
+		return nil
+	}
+
+	var frameType int
+	switch message.Headers["control"] {
+	case "ping":
+		frameType = websocket.PingMessage
+	case "pong":
+		frameType = websocket.PongMessage
+	default:
+		tp.logger.Warn("Unknown WebSocket control frame", "control", message.Headers["control"], "message_id", message.ID)
+		return nil
+	}
+
+	if err := wsConn.WriteControl(frameType, message.Body, time.Now().Add(websocketControlTimeout)); err != nil {
+		tp.logger.Error("Failed to write WebSocket control frame to client", "control", message.Headers["control"], "message_id", message.ID, "error", err)
+	}
+	return nil
+}
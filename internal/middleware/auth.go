@@ -1,14 +1,46 @@
 package middleware
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
+// PartialTokenType marks tokens issued after the password of a user with two-factor
+// authentication, they only grant access to the TOTP step of the login
+const PartialTokenType = "2fa_pending"
+
+// ErrTokenRevoked means a token was issued before its user's last password change
+var ErrTokenRevoked = errors.New("token issued before the last password change")
+
+// LoadTokenUser returns the cached state of a token's user after checking the token is still
+// valid for them. It returns sql.ErrNoRows when the user no longer exists and ErrTokenRevoked
+// when the password changed after the token was issued.
+func LoadTokenUser(db *sql.DB, userID string, claims jwt.MapClaims) (CachedUser, error) {
+	// Per-user state is cached briefly so most requests skip the database
+	user, err := loadCachedUser(db, userID)
+	if err != nil {
+		return CachedUser{}, err
+	}
+
+	// Tokens issued before the last password change are no longer valid
+	if !user.PasswordChangedAt.IsZero() {
+		issuedAt, err := claims.GetIssuedAt()
+		if err != nil || issuedAt == nil || issuedAt.Time.Before(user.PasswordChangedAt.Truncate(time.Second)) {
+			return CachedUser{}, ErrTokenRevoked
+		}
+	}
+	return user, nil
+}
+
+func AuthMiddleware(db *sql.DB, jwtSecret string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -48,19 +80,46 @@ func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
 			return
 		}
 
+		if tokenType, _ := claims["type"].(string); tokenType == PartialTokenType {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Two-factor authentication required"})
+			c.Abort()
+			return
+		}
+
 		// Set user ID in context
-		if userID, exists := claims["user_id"]; exists {
-			c.Set("user_id", userID)
-		} else {
+		userID, exists := claims["user_id"]
+		if !exists {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in token"})
 			c.Abort()
 			return
 		}
+		c.Set("user_id", userID)
+
+		user, err := LoadTokenUser(db, fmt.Sprint(userID), claims)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User no longer exists"})
+			c.Abort()
+			return
+		}
+		if errors.Is(err, ErrTokenRevoked) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session expired, please log in again"})
+			c.Abort()
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to load user", "user_id", userID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			c.Abort()
+			return
+		}
+		c.Set("email_verified", user.EmailVerified)
+
+		// Keep a separate trail of everything done while impersonating a user
+		if adminID, impersonated := claims["impersonated_by"]; impersonated {
+			c.Set("impersonated_by", adminID)
+			slog.InfoContext(c.Request.Context(), "IMPERSONATION: admin acting as user", "admin_id", adminID, "user_id", userID, "method", c.Request.Method, "path", c.Request.URL.Path)
+		}
 
 		c.Next()
 	}
 }
-
-
-
-
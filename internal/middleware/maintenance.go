@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"database/sql"
+	"log/slog"
+	"math"
+	"net/http"
+	"skyport-server/internal/config"
+	"skyport-server/internal/templates"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maintenanceCacheTTL limits how often the maintenance flag is read from the database
+const maintenanceCacheTTL = 5 * time.Second
+
+// maintenanceExemptPaths stay reachable during maintenance so admins can sign in and turn it off
+var maintenanceExemptPaths = []string{
+	"/health",
+	"/maintenance",
+	"/.well-known/acme-challenge/",
+	"/api/v1/admin/",
+	"/api/v1/auth/login",
+	"/api/v1/auth/refresh",
+}
+
+// MaintenanceMiddleware serves the maintenance page while server_settings.maintenance_mode_until
+// is in the future. Traffic to tunnel subdomains and custom domains is not affected.
+func MaintenanceMiddleware(db *sql.DB, domain string) gin.HandlerFunc {
+	var (
+		mutex     sync.Mutex
+		until     sql.NullTime
+		checkedAt time.Time
+	)
+
+	maintenanceUntil := func() sql.NullTime {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if time.Since(checkedAt) < maintenanceCacheTTL {
+			return until
+		}
+
+		var value sql.NullTime
+		if err := db.QueryRow("SELECT maintenance_mode_until FROM server_settings").Scan(&value); err != nil && err != sql.ErrNoRows {
+			// Keep serving with the last known state rather than locking everyone out
+			slog.Error("Failed to read maintenance mode", "error", err)
+			return until
+		}
+		until = value
+		checkedAt = time.Now()
+		return until
+	}
+
+	return func(c *gin.Context) {
+		if config.IsProxiedHost(c.Request.Host, domain) || isMaintenanceExempt(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+
+		end := maintenanceUntil()
+		if !end.Valid || !time.Now().Before(end.Time) {
+			c.Next()
+			return
+		}
+
+		remaining := time.Until(end.Time)
+		html, err := templates.RenderMaintenancePage(int(math.Ceil(remaining.Minutes())))
+		if err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to render template", "error", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service under maintenance"})
+			c.Abort()
+			return
+		}
+
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(remaining.Seconds()))))
+		c.Data(http.StatusServiceUnavailable, "text/html; charset=utf-8", []byte(html))
+		c.Abort()
+	}
+}
+
+func isMaintenanceExempt(path string) bool {
+	for _, exempt := range maintenanceExemptPaths {
+		if path == exempt || (strings.HasSuffix(exempt, "/") && strings.HasPrefix(path, exempt)) {
+			return true
+		}
+	}
+	return false
+}
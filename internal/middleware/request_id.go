@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"skyport-server/internal/logging"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader carries the correlation ID of a request, in both directions
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds IDs supplied by clients, longer ones are replaced
+const maxRequestIDLength = 128
+
+// RequestIDMiddleware gives every request an ID, reusing a sane X-Request-ID from the client.
+// The ID is stored in the context under "request_id", attached to the request context so log
+// records carry it, echoed in the response and written back to the request headers so it is
+// forwarded to tunnel agents along with the rest of the request.
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(RequestIDHeader)
+		if !isValidRequestID(requestID) {
+			requestID = uuid.New().String()
+		}
+
+		c.Set("request_id", requestID)
+		c.Request.Header.Set(RequestIDHeader, requestID)
+		c.Request = c.Request.WithContext(logging.WithRequestID(c.Request.Context(), requestID))
+		c.Header(RequestIDHeader, requestID)
+
+		c.Next()
+	}
+}
+
+// isValidRequestID accepts short IDs of printable ASCII so clients can't inject into logs
+func isValidRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(requestID); i++ {
+		if requestID[i] < 0x21 || requestID[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"net/http"
+	"skyport-server/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestSizeLimiter caps request bodies at maxBytes so oversized JSON is rejected before it
+// is read into memory. Tunnel traffic forwards uploads to the local service and gets
+// proxyMaxBytes instead. Requests announcing a larger Content-Length fail immediately with
+// 413; chunked bodies fail with a *http.MaxBytesError once the limit is read.
+func RequestSizeLimiter(maxBytes, proxyMaxBytes int64, domain string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := maxBytes
+		if config.IsProxiedHost(c.Request.Host, domain) {
+			limit = proxyMaxBytes
+		}
+
+		if c.Request.ContentLength > limit {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+			return
+		}
+
+		if c.Request.Body != nil {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TunnelAccessMiddleware accepts tunnel access tokens from POST /auth/token/exchange. The
+// token must be scoped to the tunnel in the :id route parameter; its ID and owner are set
+// as "tunnel_id" and "tunnel_owner_id".
+func TunnelAccessMiddleware(jwtSecret string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authHeader := c.GetHeader("Authorization")
+		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+		if authHeader == "" || tokenString == authHeader {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Tunnel access token required"})
+			c.Abort()
+			return
+		}
+
+		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, jwt.ErrSignatureInvalid
+			}
+			return []byte(jwtSecret), nil
+		})
+		if err != nil || !token.Valid {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+			c.Abort()
+			return
+		}
+
+		claims, ok := token.Claims.(jwt.MapClaims)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+			c.Abort()
+			return
+		}
+
+		if tokenType, _ := claims["type"].(string); tokenType != "tunnel_access" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Tunnel access token required"})
+			c.Abort()
+			return
+		}
+
+		// Tunnel access tokens always expire, one without an exp claim wasn't issued by us
+		if expiresAt, err := claims.GetExpirationTime(); err != nil || expiresAt == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+			c.Abort()
+			return
+		}
+
+		tunnelID, _ := claims["tunnel_id"].(string)
+		if tunnelID == "" || tunnelID != c.Param("id") {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Token is not valid for this tunnel"})
+			c.Abort()
+			return
+		}
+
+		ownerID, _ := claims["sub"].(string)
+		c.Set("tunnel_id", tunnelID)
+		c.Set("tunnel_owner_id", ownerID)
+
+		c.Next()
+	}
+}
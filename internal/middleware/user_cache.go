@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"container/list"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+const (
+	// userCacheTTL is how long a cached user stays valid before it's reloaded from the database
+	userCacheTTL = 30 * time.Second
+	// userCacheSize caps the number of cached users, the least recently used is evicted first
+	userCacheSize = 10000
+)
+
+// CachedUser holds the per-user state AuthMiddleware checks on every request
+type CachedUser struct {
+	EmailVerified     bool
+	PasswordChangedAt time.Time
+}
+
+type userCacheEntry struct {
+	userID    string
+	user      CachedUser
+	expiresAt time.Time
+}
+
+// userCache is an LRU cache of CachedUser keyed by user ID with a fixed TTL
+type userCache struct {
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // front is most recently used
+}
+
+var authUserCache = newUserCache()
+
+func newUserCache() *userCache {
+	return &userCache{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (uc *userCache) get(userID string) (CachedUser, bool) {
+	uc.mutex.Lock()
+	defer uc.mutex.Unlock()
+
+	element, exists := uc.entries[userID]
+	if !exists {
+		return CachedUser{}, false
+	}
+
+	entry := element.Value.(*userCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		uc.order.Remove(element)
+		delete(uc.entries, userID)
+		return CachedUser{}, false
+	}
+
+	uc.order.MoveToFront(element)
+	return entry.user, true
+}
+
+func (uc *userCache) set(userID string, user CachedUser) {
+	uc.mutex.Lock()
+	defer uc.mutex.Unlock()
+
+	if element, exists := uc.entries[userID]; exists {
+		entry := element.Value.(*userCacheEntry)
+		entry.user = user
+		entry.expiresAt = time.Now().Add(userCacheTTL)
+		uc.order.MoveToFront(element)
+		return
+	}
+
+	uc.entries[userID] = uc.order.PushFront(&userCacheEntry{
+		userID:    userID,
+		user:      user,
+		expiresAt: time.Now().Add(userCacheTTL),
+	})
+
+	if uc.order.Len() > userCacheSize {
+		oldest := uc.order.Back()
+		uc.order.Remove(oldest)
+		delete(uc.entries, oldest.Value.(*userCacheEntry).userID)
+	}
+}
+
+func (uc *userCache) delete(userID string) {
+	uc.mutex.Lock()
+	defer uc.mutex.Unlock()
+
+	if element, exists := uc.entries[userID]; exists {
+		uc.order.Remove(element)
+		delete(uc.entries, userID)
+	}
+}
+
+// InvalidateUserCache drops a cached user so the next request reloads it from the database.
+// Call it after changing anything CachedUser holds (password, email verification).
+func InvalidateUserCache(userID string) {
+	authUserCache.delete(userID)
+}
+
+// loadCachedUser returns the cached user, querying the database on a miss
+func loadCachedUser(db *sql.DB, userID string) (CachedUser, error) {
+	if user, found := authUserCache.get(userID); found {
+		return user, nil
+	}
+
+	var user CachedUser
+	var passwordChangedAt sql.NullTime
+	err := db.QueryRow(
+		"SELECT is_email_verified, password_changed_at FROM users WHERE id = $1",
+		userID,
+	).Scan(&user.EmailVerified, &passwordChangedAt)
+	if err != nil {
+		return CachedUser{}, err
+	}
+	if passwordChangedAt.Valid {
+		user.PasswordChangedAt = passwordChangedAt.Time
+	}
+
+	authUserCache.set(userID, user)
+	return user, nil
+}
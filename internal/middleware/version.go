@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	APIVersionV1 = "v1"
+	APIVersionV2 = "v2"
+
+	// DefaultAPIVersion is used when neither the path nor the Accept header names a version
+	DefaultAPIVersion = APIVersionV1
+)
+
+// APIVersionFromAccept extracts the version from an "application/vnd.skyport.vN+json" Accept header
+func APIVersionFromAccept(accept string) (string, bool) {
+	for _, version := range []string{APIVersionV2, APIVersionV1} {
+		if strings.Contains(accept, "application/vnd.skyport."+version+"+json") {
+			return version, true
+		}
+	}
+	return "", false
+}
+
+// VersionMiddleware stores the requested API version in the context under "api_version".
+// The vendor Accept header wins, otherwise the version is taken from the /api/vN path prefix.
+// Clients that negotiated a vendor media type get it echoed back as the response Content-Type.
+func VersionMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		version, negotiated := APIVersionFromAccept(c.GetHeader("Accept"))
+		if !negotiated {
+			version = DefaultAPIVersion
+			if strings.HasPrefix(c.Request.URL.Path, "/api/"+APIVersionV2+"/") {
+				version = APIVersionV2
+			}
+		}
+
+		c.Set("api_version", version)
+		if negotiated {
+			c.Header("Content-Type", "application/vnd.skyport."+version+"+json")
+		}
+
+		c.Next()
+	}
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
@@ -15,6 +16,13 @@ type User struct {
 	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
 }
 
+// ProfileResponse is the user with their account limits, MaxTunnels is 0 when unlimited
+type ProfileResponse struct {
+	User
+	MaxTunnels    int  `json:"max_tunnels"`
+	EmailVerified bool `json:"email_verified"`
+}
+
 type Tunnel struct {
 	ID          uuid.UUID  `json:"id" db:"id"`
 	UserID      uuid.UUID  `json:"user_id" db:"user_id"`
@@ -25,8 +33,58 @@ type Tunnel struct {
 	IsActive    bool       `json:"is_active" db:"is_active"`
 	LastSeen    *time.Time `json:"last_seen" db:"last_seen"`
 	ConnectedIP *string    `json:"connected_ip" db:"connected_ip"`
-	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
-	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
+
+	CoalesceGetRequests bool     `json:"coalesce_get_requests" db:"coalesce_get_requests"`
+	Tags                []string `json:"tags" db:"tags"`
+	AllowIndexing       bool     `json:"allow_indexing" db:"allow_indexing"`
+
+	ProxyProtocolEnabled bool `json:"proxy_protocol_enabled" db:"proxy_protocol_enabled"`
+
+	AutoRestart      bool    `json:"auto_restart" db:"auto_restart"`
+	AgentCallbackURL *string `json:"agent_callback_url" db:"agent_callback_url"`
+	LastAgentAddr    *string `json:"last_agent_addr" db:"last_agent_addr"`
+
+	Transforms []TransformRule `json:"transforms" db:"transforms"`
+
+	WriteBufferKB int `json:"write_buffer_kb" db:"write_buffer_kb"`
+
+	BlockedCountries []string `json:"blocked_countries" db:"blocked_countries"`
+
+	// ProxyTargetURL turns the tunnel into a plain reverse proxy to a remote URL, no agent connects
+	ProxyTargetURL *string `json:"proxy_target_url" db:"proxy_target_url"`
+
+	// RoutingRules send requests to different local ports by path prefix, first match wins
+	RoutingRules []RoutingRule `json:"routing_rules" db:"routing_rules"`
+
+	// CORSBypass allows every origin, method and header, for development tunnels
+	CORSBypass bool `json:"cors_bypass" db:"cors_bypass"`
+
+	// StickySessionCookie pins visitors to the server instance holding the agent connection
+	StickySessionCookie bool `json:"sticky_session_cookie" db:"sticky_session_cookie"`
+
+	// TimeoutSeconds is how long requests wait for the agent's response, 0 for the 30 second default
+	TimeoutSeconds int `json:"timeout_seconds" db:"timeout_seconds"`
+
+	// MaxBodyBytes is the largest request body forwarded to the agent, larger ones get 413
+	MaxBodyBytes int64 `json:"max_body_bytes" db:"max_body_bytes"`
+
+	// BasicAuthUser is set when visitors must sign in with HTTP Basic Auth, the password is
+	// only stored as a bcrypt hash
+	BasicAuthUser         *string `json:"basic_auth_user" db:"basic_auth_user"`
+	BasicAuthPasswordHash *string `json:"-" db:"basic_auth_password_hash"`
+
+	// IsPaused rejects agent connections and visitors while keeping the subdomain reserved
+	IsPaused bool `json:"is_paused" db:"is_paused"`
+
+	// Stats summarizes the last 24 hours of traffic, only the tunnel list fills it in
+	Stats *TunnelStats `json:"stats,omitempty" db:"-"`
+
+	// ClientCertificate and ClientKey are only returned once, when the tunnel is created with mTLS available
+	ClientCertificate string `json:"client_certificate,omitempty" db:"-"`
+	ClientKey         string `json:"client_key,omitempty" db:"-"`
+
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
 }
 
 type AuthResponse struct {
@@ -40,22 +98,290 @@ type LoginRequest struct {
 	Password string `json:"password" binding:"required,min=6"`
 }
 
+type MagicLinkRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,min=6,max=72"`
+}
+
 type SignUpRequest struct {
 	Name     string `json:"name" binding:"required,min=2"`
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required,min=6"`
+
+	// InviteCode is required when the server runs in invite-only mode
+	InviteCode string `json:"invite_code"`
 }
 
 type CreateTunnelRequest struct {
 	Name      string `json:"name" binding:"required,min=1"`
 	Subdomain string `json:"subdomain" binding:"required,min=3,max=20"`
 	LocalPort int    `json:"local_port" binding:"required,min=1,max=65535"`
+
+	CoalesceGetRequests bool     `json:"coalesce_get_requests"`
+	Tags                []string `json:"tags"`
+	AllowIndexing       bool     `json:"allow_indexing"`
+
+	ProxyProtocolEnabled bool `json:"proxy_protocol_enabled"`
+	AutoRestart          bool `json:"auto_restart"`
+
+	Transforms []TransformRule `json:"transforms"`
+
+	// WriteBufferKB sizes the agent connection's socket buffers, larger values help big downloads
+	WriteBufferKB int `json:"write_buffer_kb" binding:"omitempty,min=16,max=4096"`
+
+	// BlockedCountries are ISO 3166-1 alpha-2 codes whose visitors get 451 Unavailable For Legal Reasons
+	BlockedCountries []string `json:"blocked_countries"`
+
+	// ProxyTargetURL forwards traffic to a remote URL instead of through an agent
+	ProxyTargetURL string `json:"proxy_target_url"`
+
+	RoutingRules []RoutingRule `json:"routing_rules"`
+
+	CORSBypass bool `json:"cors_bypass"`
+
+	StickySessionCookie bool `json:"sticky_session_cookie"`
+
+	// TimeoutSeconds is 5 to 300 seconds, 0 for the 30 second default
+	TimeoutSeconds int `json:"timeout_seconds"`
+
+	// MaxBodyBytes defaults to 10 MB, at most 100 MB
+	MaxBodyBytes int64 `json:"max_body_bytes" binding:"omitempty,min=1,max=104857600"`
+
+	// BasicAuthUser and BasicAuthPasswordHash keep the basic auth of an exported or cloned
+	// tunnel, new passwords are set with SetBasicAuthRequest
+	BasicAuthUser         string `json:"basic_auth_user"`
+	BasicAuthPasswordHash string `json:"basic_auth_password_hash"`
+
+	IPRules     []CreateIPRuleRequest     `json:"ip_rules"`
+	HeaderRules []CreateHeaderRuleRequest `json:"header_rules"`
+}
+
+// TransformRule modifies requests before they reach the local service, or responses before
+// they reach the client. Type is header_add (Name, Value), header_remove (Name) or
+// path_rewrite (From, To, requests only). Direction is "request" (the default) or "response".
+type TransformRule struct {
+	Type      string `json:"type"`
+	Direction string `json:"direction,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Value     string `json:"value,omitempty"`
+	From      string `json:"from,omitempty"`
+	To        string `json:"to,omitempty"`
+}
+
+// RoutingRule sends requests whose path starts with PathPrefix to TargetPort on the agent's
+// machine instead of the tunnel's local port
+type RoutingRule struct {
+	PathPrefix string `json:"path_prefix"`
+	TargetPort int    `json:"target_port"`
+}
+
+// TunnelStats summarizes a tunnel's traffic over Period (24h, 7d or 30d). ErrorRate is the
+// fraction of requests answered with a 5xx status.
+type TunnelStats struct {
+	Period        string  `json:"period"`
+	TotalRequests int64   `json:"total_requests"`
+	TotalBytes    int64   `json:"total_bytes"`
+	AvgLatencyMs  float64 `json:"avg_latency_ms"`
+	ErrorRate     float64 `json:"error_rate"`
+	UptimePercent float64 `json:"uptime_percent"`
+}
+
+// IPRule allows or denies visitors from a CIDR range. Action is "allow" or "deny".
+type IPRule struct {
+	ID        uuid.UUID `json:"id" db:"id"`
+	TunnelID  uuid.UUID `json:"tunnel_id" db:"tunnel_id"`
+	CIDR      string    `json:"cidr" db:"cidr"`
+	Action    string    `json:"action" db:"action"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+type CreateIPRuleRequest struct {
+	CIDR   string `json:"cidr" binding:"required"`
+	Action string `json:"action" binding:"required,oneof=allow deny"`
+}
+
+type SetBasicAuthRequest struct {
+	Username string `json:"username" binding:"required,max=255"`
+	Password string `json:"password" binding:"required,min=6,max=72"`
+}
+
+// HeaderRule sets or removes a header on requests before they reach the local service, or on
+// responses before they reach the client. Direction is "request" or "response", Action is
+// "set" (HeaderName to HeaderValue) or "remove".
+type HeaderRule struct {
+	ID          uuid.UUID `json:"id" db:"id"`
+	TunnelID    uuid.UUID `json:"tunnel_id" db:"tunnel_id"`
+	Direction   string    `json:"direction" db:"direction"`
+	Action      string    `json:"action" db:"action"`
+	HeaderName  string    `json:"header_name" db:"header_name"`
+	HeaderValue string    `json:"header_value" db:"header_value"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+}
+
+type CreateHeaderRuleRequest struct {
+	Direction   string `json:"direction" binding:"required,oneof=request response"`
+	Action      string `json:"action" binding:"required,oneof=set remove"`
+	HeaderName  string `json:"header_name" binding:"required,max=255"`
+	HeaderValue string `json:"header_value" binding:"max=4096"`
+}
+
+// Webhook receives a signed POST for each of Events (tunnel.connected, tunnel.disconnected).
+// Secret signs the payloads and is only returned when the webhook is created.
+type Webhook struct {
+	ID        uuid.UUID `json:"id" db:"id"`
+	TunnelID  uuid.UUID `json:"tunnel_id" db:"tunnel_id"`
+	URL       string    `json:"url" db:"url"`
+	Secret    string    `json:"secret,omitempty" db:"secret"`
+	Events    []string  `json:"events" db:"events"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+type CreateWebhookRequest struct {
+	URL    string   `json:"url" binding:"required,max=2048"`
+	Secret string   `json:"secret" binding:"omitempty,min=16,max=255"`
+	Events []string `json:"events"`
+}
+
+// CustomDomain routes a domain the user owns to a tunnel. It only serves traffic (and gets a
+// certificate) once VerifiedAt is set, after the TXT record with VerificationToken was found.
+type CustomDomain struct {
+	ID                uuid.UUID  `json:"id" db:"id"`
+	TunnelID          uuid.UUID  `json:"tunnel_id" db:"tunnel_id"`
+	Domain            string     `json:"domain" db:"domain"`
+	VerificationToken string     `json:"verification_token" db:"verification_token"`
+	VerifiedAt        *time.Time `json:"verified_at" db:"verified_at"`
+	CreatedAt         time.Time  `json:"created_at" db:"created_at"`
+}
+
+type CreateCustomDomainRequest struct {
+	Domain string `json:"domain" binding:"required,max=253"`
+}
+
+// ImportTunnelsRequest bulk-creates tunnels, Atomic rolls back every tunnel if any one fails
+type ImportTunnelsRequest struct {
+	Tunnels []CreateTunnelRequest `json:"tunnels" binding:"required,min=1,max=100,dive"`
+	Atomic  bool                  `json:"atomic"`
+}
+
+// CloneTunnelRequest copies a tunnel's settings to a new subdomain, Name defaults to the source's
+type CloneTunnelRequest struct {
+	Subdomain string `json:"subdomain" binding:"required,min=3,max=20"`
+	Name      string `json:"name"`
+}
+
+// UpdateTunnelRequest is a partial update, nil fields are left unchanged
+type UpdateTunnelRequest struct {
+	Name      *string `json:"name" binding:"omitempty,min=1"`
+	LocalPort *int    `json:"local_port" binding:"omitempty,min=1,max=65535"`
+
+	Tags          *[]string `json:"tags"`
+	AllowIndexing *bool     `json:"allow_indexing"`
+
+	ProxyProtocolEnabled *bool `json:"proxy_protocol_enabled"`
+	AutoRestart          *bool `json:"auto_restart"`
+
+	Transforms *[]TransformRule `json:"transforms"`
+
+	WriteBufferKB *int `json:"write_buffer_kb" binding:"omitempty,min=16,max=4096"`
+
+	BlockedCountries *[]string `json:"blocked_countries"`
+
+	// ProxyTargetURL set to "" switches the tunnel back to agent mode
+	ProxyTargetURL *string `json:"proxy_target_url"`
+
+	RoutingRules *[]RoutingRule `json:"routing_rules"`
+
+	CORSBypass *bool `json:"cors_bypass"`
+
+	StickySessionCookie *bool `json:"sticky_session_cookie"`
+
+	TimeoutSeconds *int `json:"timeout_seconds"`
+
+	MaxBodyBytes *int64 `json:"max_body_bytes" binding:"omitempty,min=1,max=104857600"`
+}
+
+type AgentCallbackRequest struct {
+	CallbackURL string `json:"callback_url" binding:"required,url"`
 }
 
 type AgentAuthRequest struct {
 	Token string `json:"token" binding:"required"`
 }
 
+type TOTPCodeRequest struct {
+	Code string `json:"code" binding:"required,len=6,numeric"`
+}
+
+type TOTPAuthenticateRequest struct {
+	PartialToken string `json:"partial_token" binding:"required"`
+	Code         string `json:"code" binding:"required,len=6,numeric"`
+}
+
+// TokenExchangeRequest trades an agent token for a short-lived token scoped to one tunnel
+type TokenExchangeRequest struct {
+	AgentToken string `json:"agent_token" binding:"required"`
+	TunnelID   string `json:"tunnel_id" binding:"required,uuid"`
+}
+
+type AuthAuditEntry struct {
+	ID        int64           `json:"id" db:"id"`
+	UserID    *uuid.UUID      `json:"user_id" db:"user_id"`
+	EventType string          `json:"event_type" db:"event_type"`
+	IPAddress *string         `json:"ip_address" db:"ip_address"`
+	UserAgent *string         `json:"user_agent" db:"user_agent"`
+	Success   bool            `json:"success" db:"success"`
+	Details   json.RawMessage `json:"details" db:"details"`
+	CreatedAt time.Time       `json:"created_at" db:"created_at"`
+}
 
+type LoginSession struct {
+	ID          uuid.UUID `json:"id" db:"id"`
+	UserID      uuid.UUID `json:"user_id" db:"user_id"`
+	Fingerprint string    `json:"fingerprint" db:"fingerprint"`
+	IP          string    `json:"ip" db:"ip"`
+	FirstSeen   time.Time `json:"first_seen" db:"first_seen"`
+	LastSeen    time.Time `json:"last_seen" db:"last_seen"`
+	Count       int       `json:"count" db:"count"`
+	IsNewDevice bool      `json:"is_new_device" db:"is_new_device"`
+	IsTrusted   bool      `json:"is_trusted" db:"is_trusted"`
+}
 
+type TrustedDevice struct {
+	Fingerprint string    `json:"fingerprint"`
+	LastIP      string    `json:"last_ip"`
+	LastSeen    time.Time `json:"last_seen"`
+}
 
+type TrustDeviceRequest struct {
+	Fingerprint string `json:"fingerprint" binding:"required,len=64"`
+}
+
+type SetMaintenanceRequest struct {
+	Enabled bool `json:"enabled"`
+	Minutes int  `json:"minutes" binding:"min=0,max=1440"`
+}
+
+type ImpersonateRequest struct {
+	UserID string `json:"user_id" binding:"required,uuid"`
+}
+
+type CreateInviteRequest struct {
+	Email          string `json:"email" binding:"required,email"`
+	ExpiresInHours int    `json:"expires_in_hours" binding:"min=0,max=720"`
+}
+
+type Invitation struct {
+	Code      string     `json:"code" db:"code"`
+	Email     string     `json:"email" db:"email"`
+	InvitedBy uuid.UUID  `json:"invited_by" db:"invited_by"`
+	UsedAt    *time.Time `json:"used_at" db:"used_at"`
+	ExpiresAt time.Time  `json:"expires_at" db:"expires_at"`
+}
@@ -0,0 +1,100 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisTunnelKeyPrefix namespaces tunnel records, the tunnel ID follows it
+	redisTunnelKeyPrefix = "skyport:tunnel:"
+	// RedisTunnelTTL expires records of instances that died without deregistering; the
+	// holding instance re-registers its tunnels well within it
+	RedisTunnelTTL = 2 * time.Minute
+)
+
+// deregisterScript deletes a record only while it still names the given server
+var deregisterScript = redis.NewScript(`
+local value = redis.call("GET", KEYS[1])
+if value and cjson.decode(value).server_id == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// RedisTunnelStore shares tunnel records between instances through Redis
+type RedisTunnelStore struct {
+	client *redis.Client
+}
+
+// NewRedisTunnelStore connects to the Redis server at redisURL (redis://[:password@]host:port/db)
+func NewRedisTunnelStore(ctx context.Context, redisURL string) (*RedisTunnelStore, error) {
+	options, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+	return &RedisTunnelStore{client: client}, nil
+}
+
+func (s *RedisTunnelStore) Register(ctx context.Context, tunnelID string, record TunnelRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, redisTunnelKeyPrefix+tunnelID, value, RedisTunnelTTL).Err()
+}
+
+func (s *RedisTunnelStore) Deregister(ctx context.Context, tunnelID, serverID string) error {
+	return deregisterScript.Run(ctx, s.client, []string{redisTunnelKeyPrefix + tunnelID}, serverID).Err()
+}
+
+func (s *RedisTunnelStore) Get(ctx context.Context, tunnelID string) (TunnelRecord, bool, error) {
+	var record TunnelRecord
+	value, err := s.client.Get(ctx, redisTunnelKeyPrefix+tunnelID).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return record, false, nil
+	}
+	if err != nil {
+		return record, false, err
+	}
+	if err := json.Unmarshal(value, &record); err != nil {
+		return record, false, err
+	}
+	return record, true, nil
+}
+
+func (s *RedisTunnelStore) List(ctx context.Context) (map[string]TunnelRecord, error) {
+	tunnels := make(map[string]TunnelRecord)
+	iter := s.client.Scan(ctx, 0, redisTunnelKeyPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		value, err := s.client.Get(ctx, key).Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue // expired or deregistered since the scan
+		}
+		if err != nil {
+			return nil, err
+		}
+		var record TunnelRecord
+		if err := json.Unmarshal(value, &record); err != nil {
+			return nil, err
+		}
+		tunnels[key[len(redisTunnelKeyPrefix):]] = record
+	}
+	return tunnels, iter.Err()
+}
+
+// Close releases the Redis connections
+func (s *RedisTunnelStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TunnelRecord tells which server instance holds a tunnel's agent connection
+type TunnelRecord struct {
+	ServerID    string    `json:"server_id"`
+	LocalPort   int       `json:"local_port"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+// TunnelStore tracks connected tunnels across server instances. The agent connection itself
+// stays on the instance it was made to, other instances use the record to reach it.
+type TunnelStore interface {
+	// Register records (or refreshes) a tunnel connected to record.ServerID
+	Register(ctx context.Context, tunnelID string, record TunnelRecord) error
+	// Deregister removes the tunnel if it is still registered to serverID, so an instance
+	// cleaning up an old connection doesn't remove the agent's newer one on another instance
+	Deregister(ctx context.Context, tunnelID, serverID string) error
+	// Get returns the tunnel's record and whether it is registered
+	Get(ctx context.Context, tunnelID string) (TunnelRecord, bool, error)
+	// List returns every registered tunnel keyed by tunnel ID
+	List(ctx context.Context) (map[string]TunnelRecord, error)
+}
+
+// MemoryTunnelStore keeps records in process, for single-instance deployments
+type MemoryTunnelStore struct {
+	mutex   sync.RWMutex
+	tunnels map[string]TunnelRecord
+}
+
+func NewMemoryTunnelStore() *MemoryTunnelStore {
+	return &MemoryTunnelStore{
+		tunnels: make(map[string]TunnelRecord),
+	}
+}
+
+func (s *MemoryTunnelStore) Register(ctx context.Context, tunnelID string, record TunnelRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tunnels[tunnelID] = record
+	return nil
+}
+
+func (s *MemoryTunnelStore) Deregister(ctx context.Context, tunnelID, serverID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if record, exists := s.tunnels[tunnelID]; exists && record.ServerID == serverID {
+		delete(s.tunnels, tunnelID)
+	}
+	return nil
+}
+
+func (s *MemoryTunnelStore) Get(ctx context.Context, tunnelID string) (TunnelRecord, bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	record, exists := s.tunnels[tunnelID]
+	return record, exists, nil
+}
+
+func (s *MemoryTunnelStore) List(ctx context.Context) (map[string]TunnelRecord, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	tunnels := make(map[string]TunnelRecord, len(s.tunnels))
+	for tunnelID, record := range s.tunnels {
+		tunnels[tunnelID] = record
+	}
+	return tunnels, nil
+}
@@ -95,6 +95,23 @@ func RenderTunnelOffline(subdomain, dashboardURL string) (string, error) {
 	return buf.String(), nil
 }
 
+// RenderTunnelPaused renders the tunnel_paused.html template
+func RenderTunnelPaused(subdomain, dashboardURL string) (string, error) {
+	if err := Initialize(); err != nil {
+		return "", fmt.Errorf("failed to initialize templates: %w", err)
+	}
+
+	var buf bytes.Buffer
+	data := TunnelErrorData{
+		Subdomain:    subdomain,
+		DashboardURL: dashboardURL,
+	}
+	if err := templates.ExecuteTemplate(&buf, "tunnel_paused.html", data); err != nil {
+		return "", fmt.Errorf("failed to render tunnel paused page: %w", err)
+	}
+	return buf.String(), nil
+}
+
 // RenderTunnelConnectionLost renders the tunnel_connection_lost.html template
 func RenderTunnelConnectionLost(subdomain, dashboardURL string) (string, error) {
 	if err := Initialize(); err != nil {
@@ -112,6 +129,56 @@ func RenderTunnelConnectionLost(subdomain, dashboardURL string) (string, error)
 	return buf.String(), nil
 }
 
+// MaintenanceData contains data for the maintenance page
+type MaintenanceData struct {
+	EstimatedMinutes int
+}
+
+// RenderMaintenancePage renders the maintenance.html template
+func RenderMaintenancePage(estimatedMinutes int) (string, error) {
+	if err := Initialize(); err != nil {
+		return "", fmt.Errorf("failed to initialize templates: %w", err)
+	}
+
+	var buf bytes.Buffer
+	data := MaintenanceData{
+		EstimatedMinutes: estimatedMinutes,
+	}
+	if err := templates.ExecuteTemplate(&buf, "maintenance.html", data); err != nil {
+		return "", fmt.Errorf("failed to render maintenance page: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// AgentSetupData contains data for the agent setup page
+type AgentSetupData struct {
+	AgentToken     string
+	TunnelID       string
+	TunnelURL      string
+	InstallCommand string
+	StatusURL      string // WebSocket that reports when the agent connects
+}
+
+// RenderAgentInstallPage renders the agent_setup.html template
+func RenderAgentInstallPage(agentToken, tunnelURL, tunnelID, installCommand, statusURL string) (string, error) {
+	if err := Initialize(); err != nil {
+		return "", fmt.Errorf("failed to initialize templates: %w", err)
+	}
+
+	var buf bytes.Buffer
+	data := AgentSetupData{
+		AgentToken:     agentToken,
+		TunnelID:       tunnelID,
+		TunnelURL:      tunnelURL,
+		InstallCommand: installCommand,
+		StatusURL:      statusURL,
+	}
+	if err := templates.ExecuteTemplate(&buf, "agent_setup.html", data); err != nil {
+		return "", fmt.Errorf("failed to render agent setup page: %w", err)
+	}
+	return buf.String(), nil
+}
+
 // RenderLocalServiceError renders a beautiful error page for local service connection issues
 func RenderLocalServiceError(localPort int, errorMessage string) (string, error) {
 	if err := Initialize(); err != nil {
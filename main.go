@@ -1,40 +1,101 @@
 package main
 
 import (
-	"log"
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"skyport-server/internal/certs"
 	"skyport-server/internal/config"
 	"skyport-server/internal/database"
+	"skyport-server/internal/email"
+	"skyport-server/internal/geoip"
 	"skyport-server/internal/handlers"
+	"skyport-server/internal/logging"
 	"skyport-server/internal/middleware"
+	"skyport-server/internal/store"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 )
 
+// maxAPIRequestBytes caps request bodies for the API, tunnel traffic uses SKYPORT_PROXY_MAX_REQUEST_BYTES
+const maxAPIRequestBytes = 1 << 20
+
+// shutdownTimeout bounds graceful shutdown, including draining tunnels
+const shutdownTimeout = 30 * time.Second
+
 func main() {
+	// Structured JSON logs, records emitted while serving a request carry its request ID
+	logLevel := new(slog.LevelVar)
+	logger := logging.New(os.Stderr, logLevel)
+	slog.SetDefault(logger)
+
 	// Load .env file if it exists (optional)
 	if err := godotenv.Load(".env"); err != nil {
-		log.Println("No .env file found, using environment variables or defaults")
+		slog.Info("No .env file found, using environment variables or defaults")
 	}
 
 	// Load configuration
 	cfg := config.Load()
+	if err := config.Validate(cfg); err != nil {
+		fatal("Invalid configuration", err)
+	}
+
+	// Frame debugging logs at debug level, which slog hides by default
+	if cfg.WSFrameDebug {
+		logLevel.Set(slog.LevelDebug)
+	}
+
+	// Tracing is a no-op unless OTEL_EXPORTER_OTLP_ENDPOINT is set
+	shutdownTracing, err := database.InitTracing("skyport-server")
+	if err != nil {
+		slog.Error("Failed to initialize tracing", "error", err)
+	} else {
+		defer shutdownTracing(context.Background())
+	}
 
-	// Initialize database
-	db, err := database.Initialize(cfg.DatabaseURL)
+	// Initialize database, failing over to the next URL when the current one is unreachable
+	db, err := database.ConnectWithFailover(append([]string{cfg.DatabaseURL}, cfg.DBFailoverURLs...))
 	if err != nil {
-		log.Fatal("Failed to initialize database:", err)
+		fatal("Failed to initialize database", err)
 	}
 	defer db.Close()
 
 	// Run migrations
 	if err := database.RunMigrations(db); err != nil {
-		log.Fatal("Failed to run migrations:", err)
+		fatal("Failed to run migrations", err)
 	}
 
-	// Initialize router
-	r := gin.Default()
+	// Background database health checks, the proxy fails fast while the database is down
+	dbHealth := database.NewHealthChecker(db)
+	go dbHealth.Run(context.Background())
+
+	// Initialize router. Recovery lets http.ErrAbortHandler through so handlers can still
+	// abort a response that was cut short.
+	r := gin.New()
+	r.Use(gin.Logger(), gin.CustomRecovery(func(c *gin.Context, err any) {
+		if err == http.ErrAbortHandler {
+			panic(err)
+		}
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}))
+
+	// ClientIP only reads X-Forwarded-For from configured proxies, otherwise any visitor
+	// could pick their own address and get past tunnel IP rules
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		fatal("Invalid SKYPORT_TRUSTED_PROXIES", err)
+	}
+
+	// Correlation IDs come first so every later middleware and handler can log them
+	r.Use(middleware.RequestIDMiddleware())
 
 	// CORS middleware
 	// Support both with and without www subdomain
@@ -50,20 +111,57 @@ func main() {
 
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     allowedOrigins,
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", middleware.RequestIDHeader},
+		ExposeHeaders:    []string{"Content-Length", middleware.RequestIDHeader},
 		AllowCredentials: true,
+		MaxAge:           cfg.CORSMaxAge,
 	}))
 
+	// Reject oversized bodies before handlers read them, tunnels get their own limit
+	r.Use(middleware.RequestSizeLimiter(maxAPIRequestBytes, cfg.ProxyMaxRequestBytes, cfg.Domain))
+
+	// Maintenance mode (tunnel traffic keeps flowing)
+	r.Use(middleware.MaintenanceMiddleware(db, cfg.Domain))
+
 	// Initialize handlers
-	authHandler := handlers.NewAuthHandler(db, cfg.JWTSecret)
-	tunnelHandler := handlers.NewTunnelHandler(db)
-	proxyHandler := handlers.NewProxyHandler(db, tunnelHandler, cfg)
+	mailer := email.NewSender(cfg)
+	authHandler := handlers.NewAuthHandler(db, cfg.JWTSecret, mailer, cfg.InviteOnly, cfg.AllowedEmailDomains, cfg.WebAppURL, cfg.MaxTunnelsPerUser, logger)
+	var ca *certs.CA
+	if cfg.CAKeyFile != "" {
+		ca, err = certs.LoadCA(cfg.CAKeyFile)
+		if err != nil {
+			fatal("Failed to load CA key", err)
+		}
+	}
+	// Multi-instance deployments share tunnel locations through Redis
+	var tunnelStore store.TunnelStore = store.NewMemoryTunnelStore()
+	if cfg.RedisURL != "" {
+		redisStore, err := store.NewRedisTunnelStore(context.Background(), cfg.RedisURL)
+		if err != nil {
+			fatal("Failed to initialize tunnel store", err)
+		}
+		defer redisStore.Close()
+		tunnelStore = redisStore
+	}
+	tunnelHandler := handlers.NewTunnelHandler(db, cfg, ca, tunnelStore, logger)
+	go tunnelHandler.RunStatsFlusher(context.Background())
+	geoLocator := geoip.Open(cfg.GeoIPDatabasePath)
+	defer geoLocator.Close()
+	adminHandler := handlers.NewAdminHandler(db, logger)
+	certCache := certs.NewDBCache(db)
+	proxyHandler := handlers.NewProxyHandler(db, tunnelHandler, cfg, geoLocator, certCache, dbHealth, logger)
 
 	// Routes
 	api := r.Group("/api/v1")
+	api.Use(middleware.VersionMiddleware())
 	{
+		// Load figures for routing agents across instances
+		api.GET("/server/capacity", tunnelHandler.GetServerCapacity)
+
+		// The setup page's live status authenticates with a ticket from the page, not a session
+		api.GET("/tunnels/:id/setup/status", tunnelHandler.SetupStatus)
+
 		// Auth routes
 		auth := api.Group("/auth")
 		{
@@ -71,31 +169,256 @@ func main() {
 			auth.POST("/login", authHandler.Login)
 			auth.POST("/refresh", authHandler.RefreshToken)
 			auth.POST("/agent-auth", authHandler.AgentAuth)
+			auth.POST("/token/exchange", authHandler.ExchangeToken)
+			auth.POST("/magic-link", authHandler.RequestMagicLink)
+			auth.GET("/magic-link/verify", authHandler.VerifyMagicLink)
+			auth.POST("/forgot-password", authHandler.ForgotPassword)
+			auth.POST("/reset-password", authHandler.ResetPassword)
+			auth.GET("/verify-email", authHandler.VerifyEmail)
+			auth.GET("/token/inspect", authHandler.InspectToken)
+			auth.POST("/2fa/authenticate", authHandler.AuthenticateTOTP)
+
+			// Device management routes
+			authProtected := auth.Group("/")
+			authProtected.Use(middleware.AuthMiddleware(db, cfg.JWTSecret))
+			{
+				authProtected.GET("/sessions", authHandler.GetSessions)
+				authProtected.GET("/audit-log", authHandler.GetAuditLog)
+				authProtected.GET("/trusted-devices", authHandler.GetTrustedDevices)
+				authProtected.POST("/trusted-devices", authHandler.TrustDevice)
+				authProtected.DELETE("/trusted-devices/:fingerprint", authHandler.UntrustDevice)
+				authProtected.POST("/2fa/setup", authHandler.SetupTOTP)
+				authProtected.POST("/2fa/verify", authHandler.VerifyTOTP)
+				authProtected.DELETE("/2fa", authHandler.DisableTOTP)
+				authProtected.POST("/resend-verification", authHandler.ResendVerification)
+			}
 		}
 
 		// Protected routes
 		protected := api.Group("/")
-		protected.Use(middleware.AuthMiddleware(cfg.JWTSecret))
+		protected.Use(middleware.AuthMiddleware(db, cfg.JWTSecret))
 		{
 			protected.GET("/profile", authHandler.GetProfile)
+			protected.GET("/events", tunnelHandler.StreamEvents)
 			protected.GET("/tunnels", tunnelHandler.GetTunnels)
 			protected.POST("/tunnels", tunnelHandler.CreateTunnel)
+			protected.POST("/tunnels/import", tunnelHandler.ImportTunnels)
+			protected.GET("/tunnels/events", tunnelHandler.StreamTunnelStatus)
+			protected.DELETE("/tunnels", tunnelHandler.DeleteTunnels)
+			protected.GET("/tunnels/:id", tunnelHandler.GetTunnel)
+			protected.PATCH("/tunnels/:id", tunnelHandler.UpdateTunnel)
+			protected.PUT("/tunnels/:id", tunnelHandler.UpdateTunnel)
 			protected.DELETE("/tunnels/:id", tunnelHandler.DeleteTunnel)
+			protected.POST("/tunnels/:id/clone", tunnelHandler.CloneTunnel)
 			protected.POST("/tunnels/:id/stop", tunnelHandler.StopTunnel)
+			protected.POST("/tunnels/:id/rotate-token", tunnelHandler.RotateToken)
+			protected.POST("/tunnels/:id/pause", tunnelHandler.PauseTunnel)
+			protected.POST("/tunnels/:id/resume", tunnelHandler.ResumeTunnel)
+			protected.POST("/tunnels/:id/reload", tunnelHandler.ReloadTunnel)
+			protected.POST("/tunnels/:id/agent-callback", tunnelHandler.SetAgentCallback)
+			protected.GET("/tunnels/:id/metrics/stream", tunnelHandler.StreamTunnelMetrics)
+			protected.GET("/tunnels/:id/curl", tunnelHandler.GetCurlCommand)
+			protected.GET("/tunnels/:id/ping", tunnelHandler.PingTunnel)
+			protected.GET("/tunnels/:id/agent-metrics", tunnelHandler.GetAgentMetrics)
+			protected.GET("/tunnels/:id/stats", tunnelHandler.GetTunnelStats)
+			protected.GET("/tunnels/:id/ip-rules", tunnelHandler.GetIPRules)
+			protected.POST("/tunnels/:id/ip-rules", tunnelHandler.CreateIPRule)
+			protected.DELETE("/tunnels/:id/ip-rules/:rule_id", tunnelHandler.DeleteIPRule)
+			protected.PUT("/tunnels/:id/basic-auth", tunnelHandler.SetBasicAuth)
+			protected.DELETE("/tunnels/:id/basic-auth", tunnelHandler.DeleteBasicAuth)
+			protected.GET("/tunnels/:id/header-rules", tunnelHandler.GetHeaderRules)
+			protected.POST("/tunnels/:id/header-rules", tunnelHandler.CreateHeaderRule)
+			protected.PUT("/tunnels/:id/header-rules/:rule_id", tunnelHandler.UpdateHeaderRule)
+			protected.DELETE("/tunnels/:id/header-rules/:rule_id", tunnelHandler.DeleteHeaderRule)
+			protected.GET("/tunnels/:id/webhooks", tunnelHandler.GetWebhooks)
+			protected.POST("/tunnels/:id/webhooks", tunnelHandler.CreateWebhook)
+			protected.DELETE("/tunnels/:id/webhooks/:webhook_id", tunnelHandler.DeleteWebhook)
+			protected.POST("/tunnels/:id/test-webhook", tunnelHandler.TestWebhook)
+			protected.GET("/tunnels/:id/domains", tunnelHandler.GetCustomDomains)
+			protected.POST("/tunnels/:id/domains", tunnelHandler.CreateCustomDomain)
+			protected.POST("/tunnels/:id/domains/:domain_id/verify", tunnelHandler.VerifyCustomDomain)
+			protected.DELETE("/tunnels/:id/domains/:domain_id", tunnelHandler.DeleteCustomDomain)
+			protected.GET("/tunnels/:id/export", tunnelHandler.ExportTunnel)
+			protected.GET("/tunnels/:id/agent-config", tunnelHandler.GetAgentConfig)
+			protected.GET("/tunnels/:id/setup", tunnelHandler.GetSetupPage)
+			protected.GET("/tunnels/:id/requests", tunnelHandler.GetInspectedRequests)
+			protected.GET("/tunnels/:id/requests/stream", tunnelHandler.StreamInspectedRequests)
+			protected.GET("/tunnels/:id/agent/:operation", tunnelHandler.AgentOperation)
+			protected.POST("/tunnels/:id/agent/:operation", tunnelHandler.AgentOperation)
 
 			// Tunnel connection WebSocket
 			protected.GET("/tunnel/connect", tunnelHandler.ConnectTunnel)
 		}
+
+		// Admin routes
+		admin := api.Group("/admin")
+		admin.Use(middleware.AuthMiddleware(db, cfg.JWTSecret), middleware.AdminMiddleware(db))
+		{
+			admin.POST("/maintenance", adminHandler.SetMaintenance)
+			admin.POST("/invites", adminHandler.CreateInvite)
+			admin.GET("/audit-log", adminHandler.GetAuditLog)
+			// Full database health including the last ping error, /health leaves it out
+			admin.GET("/health", func(c *gin.Context) {
+				c.JSON(http.StatusOK, dbHealth.Status())
+			})
+		}
+
+		// Admin-only tunnel debugging
+		tunnelDebug := api.Group("/tunnels")
+		tunnelDebug.Use(middleware.AuthMiddleware(db, cfg.JWTSecret), middleware.AdminMiddleware(db))
+		{
+			tunnelDebug.GET("/:id/frame-log", tunnelHandler.GetFrameLog)
+		}
+
+		// Admin impersonation lives under /auth but requires an admin session
+		impersonate := api.Group("/auth")
+		impersonate.Use(middleware.AuthMiddleware(db, cfg.JWTSecret), middleware.AdminMiddleware(db))
+		{
+			impersonate.POST("/impersonate", authHandler.Impersonate)
+		}
 	}
 
-	// Health check
+	// API v2 - mirrors the v1 layout, endpoints are added here as they change
+	apiV2 := r.Group("/api/v2")
+	apiV2.Use(middleware.VersionMiddleware())
+
+	// Health check, public so the driver error (host names, users) stays out of it. Load
+	// balancers take the instance out of rotation on the 503.
 	r.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{"status": "ok"})
+		dbStatus := dbHealth.Status()
+		dbStatus.LastError = ""
+		if !dbStatus.Healthy {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "degraded", "database": dbStatus})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "database": dbStatus})
 	})
 
+	// Maintenance status
+	r.GET("/maintenance", adminHandler.GetMaintenanceStatus)
+
+	// ACME HTTP-01 challenges for custom domain certificates
+	r.GET("/.well-known/acme-challenge/:token", proxyHandler.HandleACMEChallenge)
+
 	// Subdomain proxy - catch all other routes for subdomain handling
 	r.NoRoute(proxyHandler.HandleSubdomain)
 
-	log.Printf("Server starting on port %s", cfg.Port)
-	log.Fatal(r.Run(":" + cfg.Port))
+	// versionRouter runs first so longLivedRouter sees the versioned path
+	handler := versionRouter(longLivedRouter(r, cfg.Domain), cfg.Domain)
+
+	server := newHTTPServer(":"+cfg.Port, handler, cfg)
+	servers := []*http.Server{server}
+	go func() {
+		slog.Info("Server starting", "port", cfg.Port)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			fatal("Server failed", err)
+		}
+	}()
+
+	// HTTPS for custom domains, certificates are provisioned and renewed on demand
+	if cfg.ACMEEnabled {
+		certManager := certs.NewManager(db, certCache, cfg.ACMEEmail)
+		tlsConfig := certManager.TLSConfig()
+		// Agents present their tunnel certificate, browsers connect without one
+		if cfg.MTLSEnabled && ca != nil {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			tlsConfig.ClientCAs = ca.CertPool()
+		}
+		tlsServer := newHTTPServer(":"+cfg.TLSPort, handler, cfg)
+		tlsServer.TLSConfig = tlsConfig
+		servers = append(servers, tlsServer)
+		go func() {
+			slog.Info("TLS server starting", "port", cfg.TLSPort)
+			if err := tlsServer.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+				fatal("TLS server failed", err)
+			}
+		}()
+	}
+
+	// Wait for SIGTERM (deploys, docker stop) or SIGINT (Ctrl+C)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-stop
+	slog.Info("Shutting down", "signal", sig.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Agent connections are hijacked and invisible to http.Server.Shutdown, so tunnels go first
+	if err := tunnelHandler.Shutdown(ctx); err != nil {
+		slog.Warn("Tunnels did not disconnect before the shutdown deadline", "error", err)
+	}
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Warn("Server did not shut down cleanly", "addr", srv.Addr, "error", err)
+		}
+	}
+	slog.Info("Server stopped")
+}
+
+// fatal logs err and exits, slog has no fatal level
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// newHTTPServer creates a server with the configured timeouts
+func newHTTPServer(addr string, handler http.Handler, cfg *config.Config) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       cfg.HTTPReadTimeout,
+		WriteTimeout:      cfg.HTTPWriteTimeout,
+		IdleTimeout:       cfg.HTTPIdleTimeout,
+		ReadHeaderTimeout: cfg.HTTPReadHeaderTimeout,
+	}
+}
+
+// eventStreamPaths are the Server-Sent Events routes, they stay open for as long as the client listens
+var eventStreamPaths = []string{
+	"/api/" + middleware.APIVersionV1 + "/events",
+	"/api/" + middleware.APIVersionV1 + "/tunnels/events",
+}
+
+// longLivedRouter lifts the server's read and write deadlines for requests that are meant to
+// take longer: the Server-Sent Events routes and all traffic to tunnel hosts, including custom
+// domains, which is bounded by the tunnel's own timeout_seconds and stream idle timeouts
+// instead. WebSocket upgrades need no exemption, gorilla/websocket clears the deadlines of
+// the hijacked connection.
+func longLivedRouter(next http.Handler, domain string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isLongLivedRequest(r, domain) {
+			controller := http.NewResponseController(w)
+			controller.SetReadDeadline(time.Time{})
+			controller.SetWriteDeadline(time.Time{})
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isLongLivedRequest(r *http.Request, domain string) bool {
+	if config.IsProxiedHost(r.Host, domain) {
+		return true
+	}
+	return r.Method == http.MethodGet && slices.Contains(eventStreamPaths, r.URL.Path)
+}
+
+// versionRouter maps unversioned API paths (/api/tunnels) onto a versioned group
+// (/api/v1/tunnels) based on the Accept header. Requests to tunnel subdomains and custom
+// domains are left untouched so the local service still receives its own /api paths.
+func versionRouter(next http.Handler, domain string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if strings.HasPrefix(path, "/api/") && !config.IsProxiedHost(r.Host, domain) &&
+			!strings.HasPrefix(path, "/api/"+middleware.APIVersionV1+"/") &&
+			!strings.HasPrefix(path, "/api/"+middleware.APIVersionV2+"/") {
+			version, ok := middleware.APIVersionFromAccept(r.Header.Get("Accept"))
+			if !ok {
+				version = middleware.DefaultAPIVersion
+			}
+			r.URL.Path = "/api/" + version + strings.TrimPrefix(path, "/api")
+			r.URL.RawPath = ""
+		}
+		next.ServeHTTP(w, r)
+	})
 }